@@ -0,0 +1,37 @@
+//
+// This package pools the bytes.Buffers that paxos and shardkv
+// encode into, so that each write doesn't grow a buffer anew.
+//
+// only buffers are pooled, never gob encoders: an encoder
+// sends each type once per stream, and every file or reply
+// encoded must carry its own type information.
+//
+
+package bufpool
+
+import (
+	"bytes"
+	"sync"
+)
+
+// buffers grown past MaxPooled are left to the garbage
+// collector rather than kept around by the pool.
+const MaxPooled = 1 << 20
+
+var pool = sync.Pool{New: func() interface{} { return new(bytes.Buffer) }}
+
+// Get returns an empty buffer, from the pool if it has one.
+func Get() *bytes.Buffer {
+	buf := pool.Get().(*bytes.Buffer)
+	buf.Reset()
+	return buf
+}
+
+// Put returns buf to the pool. The caller must not use buf,
+// or any slice of its bytes, afterwards.
+func Put(buf *bytes.Buffer) {
+	if buf.Cap() <= MaxPooled {
+		buf.Reset()
+		pool.Put(buf)
+	}
+}
@@ -0,0 +1,218 @@
+package paxos
+
+//
+// a fast path for a steady proposer (Multi-Paxos style).
+//
+// a peer whose proposal is decided tries to become leader:
+// it asks every peer, with PrepareRange, to promise proposal
+// number n for all instances from the first it hasn't heard
+// of. an acceptor that promises reports the instances from
+// there on that it accepted a value in, or promised n or
+// more for; those are "busy". with promises from a majority,
+// the leader may propose in any other instance at or past
+// the range by sending Accepts with n straight away: a
+// majority has prepared n for it and accepted nothing.
+//
+// the leader proposes with n at most once per instance, as a
+// second value under the same number could be accepted by
+// another majority. any Accept turned down, as when another
+// proposer prepared a higher number, ends the leadership, and
+// the instance goes through both phases as usual.
+//
+// the application may also move the leadership on purpose,
+// say before taking the leader down: Lead() has a peer
+// establish itself at once, and Resign() keeps the old
+// leader from taking the leadership back.
+//
+
+// a promise covering all instances from From on
+type rangePromise struct {
+	From     int
+	Proposal int // 0 if none
+}
+
+// this peer's leadership, as far as it knows
+type leadership struct {
+	ok       bool
+	from     int
+	proposal int
+	busy     map[int]bool // instances not to take the fast path in
+	epoch    int          // first instance of the peers that promised
+}
+
+//
+// the proposal number an acceptor promised for seq through
+// a PrepareRange. px.mu must be held.
+//
+func (px *Paxos) promisedFor(seq int) int {
+	if px.promised.Proposal > 0 && seq >= px.promised.From {
+		return px.promised.Proposal
+	}
+	return 0
+}
+
+func (px *Paxos) PrepareRange(args *PrepareRangeArgs, reply *PrepareRangeReply) error {
+	DPrintf("RPC PrepareRange : from %d : prop %d : serv %s\n",
+		args.From, args.Proposal, px.self())
+	n, busy, ok := px.prepareRangeHandler(args.From, args.Proposal)
+	if ok {
+		reply.Err = OK
+		reply.Busy = busy
+	} else {
+		reply.Err = ErrRejected
+	}
+	reply.Proposal = n
+	return nil
+}
+
+func (px *Paxos) prepareRangeHandler(from int, n int) (int, []int, bool) {
+	px.mu.Lock()
+	defer px.mu.Unlock()
+
+	if n <= px.promised.Proposal {
+		return px.promised.Proposal, nil, false
+	}
+	promise := rangePromise{from, n}
+	if px.promised.Proposal > 0 && px.promised.From < from {
+		// still covering what the last promise did
+		promise.From = px.promised.From
+	}
+	if px.persistPromise(promise) != nil {
+		return px.promised.Proposal, nil, false
+	}
+	px.promised = promise
+
+	busy := []int{}
+	for seq, state := range px.accpState {
+		if seq >= from && (state.accpProposal > 0 || state.prepProposal >= n) {
+			busy = append(busy, seq)
+		}
+	}
+	return n, busy, true
+}
+
+func (px *Paxos) prepareRange(peer string, from int, n int) (int, []int, bool) {
+	if px.isSelf(peer) {
+		return px.prepareRangeHandler(from, n)
+	}
+	args := &PrepareRangeArgs{from, n}
+	var reply PrepareRangeReply
+	if !send(peer, "Paxos.PrepareRange", args, &reply) {
+		return 0, nil, false
+	}
+	return reply.Proposal, reply.Busy, reply.Err == OK
+}
+
+//
+// try to become leader for the instances past those this
+// peer knows of.
+//
+func (px *Paxos) establish() {
+	px.mu.Lock()
+	from := px.maxSeqSeen + 1
+	n := px.promised.Proposal
+	if px.rangeSeen > n {
+		n = px.rangeSeen
+	}
+	n++
+	px.mu.Unlock()
+
+	cntok := 0
+	busy := map[int]bool{}
+	peers := px.Peers(from)
+	for _, peer := range peers {
+		na, b, ok := px.prepareRange(peer, from, n)
+		if ok {
+			cntok++
+			for _, seq := range b {
+				busy[seq] = true
+			}
+		} else {
+			px.mu.Lock()
+			if na > px.rangeSeen {
+				px.rangeSeen = na
+			}
+			px.mu.Unlock()
+		}
+	}
+
+	px.mu.Lock()
+	defer px.mu.Unlock()
+	if cntok > len(peers) / 2 && n > px.lead.proposal {
+		px.lead = leadership{true, from, n, busy, px.epochs[px.epochAt(from)].from}
+	}
+}
+
+//
+// as leader, propose v for seq with Accepts alone. false if
+// this peer isn't leader for seq, or the Accepts didn't get
+// v decided; the caller then runs both phases.
+//
+func (px *Paxos) proposeFast(seq int, v interface{}) bool {
+	px.mu.Lock()
+	lead := px.lead
+	// the promises are only good among the peers that made them
+	ok := lead.ok && seq >= lead.from && !lead.busy[seq] &&
+		px.epochs[px.epochAt(seq)].from == lead.epoch
+	if ok {
+		// once only with this number
+		px.lead.busy[seq] = true
+	}
+	px.mu.Unlock()
+	if !ok {
+		return false
+	}
+
+	okch := make(chan bool, 2)
+	go px.sendAcceptToAll(seq, lead.proposal, v, okch)
+	if <-okch {
+		px.sendDecidedToAll(seq, lead.proposal, v)
+		return true
+	}
+
+	// another proposer may have prepared a higher number
+	px.mu.Lock()
+	if px.lead.proposal == lead.proposal {
+		px.lead.ok = false
+	}
+	px.mu.Unlock()
+	return false
+}
+
+// whether this peer holds the leadership, as far as it knows.
+func (px *Paxos) IsLeader() bool {
+	px.mu.Lock()
+	defer px.mu.Unlock()
+	return px.lead.ok
+}
+
+//
+// take the leadership now, rather than after this peer's
+// next decided proposal, as a peer asked to take over from
+// another does. true if this peer is leader.
+//
+func (px *Paxos) Lead() bool {
+	px.mu.Lock()
+	px.resigned = false
+	px.mu.Unlock()
+	px.establish()
+	return px.IsLeader()
+}
+
+//
+// give up the leadership, and stop taking it after decided
+// proposals until Lead() is called: another peer is taking
+// over, and this one would only take the leadership back.
+//
+func (px *Paxos) Resign() {
+	px.mu.Lock()
+	defer px.mu.Unlock()
+	px.lead.ok = false
+	px.resigned = true
+}
+
+func (px *Paxos) resigning() bool {
+	px.mu.Lock()
+	defer px.mu.Unlock()
+	return px.resigned
+}
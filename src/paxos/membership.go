@@ -0,0 +1,161 @@
+package paxos
+
+//
+// membership changes, for peers that SetReconfigDelay().
+//
+// the application changes its group's peers by getting a
+// Membership decided in some instance i, like any value.
+// the new peers then run the instances from i + delay on;
+// those before keep the peers they had. a Membership lists
+// as many peers as the one it replaces, peer j of the new
+// list taking over from peer j of the old, as when a dead
+// server is replaced; one of another size is ignored.
+//
+// for the peers of a group to agree on who runs an instance,
+// a peer proposes in instance s only once it knows the value
+// of every instance up to s - delay, and so every Membership
+// that could take effect by s. with no delay set (the
+// default), Memberships are values like any other, and the
+// peers are fixed at Make().
+//
+// a peer taking over calls JoinAt() with the first instance
+// of its membership. it runs only the instances from there
+// on; the others are done with those before for it, so a
+// replaced peer doesn't hold back Min() forever.
+//
+
+import "encoding/gob"
+import "time"
+
+// a value that changes the peers, once decided
+type Membership struct {
+	Peers []string
+}
+
+// the peers of the instances from from on
+type epoch struct {
+	from  int
+	peers []string
+}
+
+func init() {
+	gob.Register(Membership{})
+}
+
+//
+// have a Membership decided in instance i take effect at
+// instance i + delay. 0 fixes the peers. every peer of a
+// group must use the same delay.
+//
+func (px *Paxos) SetReconfigDelay(delay int) {
+	px.mu.Lock()
+	defer px.mu.Unlock()
+	px.delay = delay
+}
+
+//
+// the application starts this peer to take over in instance
+// from, with the peers it was made with.
+//
+func (px *Paxos) JoinAt(from int) {
+	px.mu.Lock()
+	defer px.mu.Unlock()
+	px.epochs = []epoch{{from, px.epochs[0].peers}}
+	px.learned = from
+	if from > px.peerMin {
+		px.peerMin = from
+	}
+	if px.doneSeqs[px.me] < from-1 {
+		px.doneSeqs[px.me] = from - 1
+	}
+}
+
+//
+// the peers of instance seq, as far as this peer knows.
+//
+func (px *Paxos) Peers(seq int) []string {
+	px.mu.Lock()
+	defer px.mu.Unlock()
+	return px.peersFor(seq)
+}
+
+// px.mu must be held
+func (px *Paxos) peersFor(seq int) []string {
+	return px.epochs[px.epochAt(seq)].peers
+}
+
+// index into px.epochs of seq's epoch. px.mu must be held
+func (px *Paxos) epochAt(seq int) int {
+	e := 0
+	for i := range px.epochs {
+		if px.epochs[i].from <= seq {
+			e = i
+		}
+	}
+	return e
+}
+
+//
+// seq was decided with v: if v is a Membership, note when
+// it takes effect. px.mu must be held.
+//
+func (px *Paxos) learnMembership(seq int, v interface{}) {
+	m, ok := v.(Membership)
+	if !ok || px.delay <= 0 {
+		return
+	}
+	from := seq + px.delay
+	old := px.peersFor(from)
+	if len(m.Peers) != len(old) {
+		DPrintf("Membership : inst %d : %d peers for %d : serv %s\n",
+			seq, len(m.Peers), len(old), px.self())
+		return
+	}
+	for _, e := range px.epochs {
+		if e.from == from {
+			return
+		}
+	}
+
+	e := px.epochAt(from)
+	px.epochs = append(px.epochs, epoch{})
+	copy(px.epochs[e+2:], px.epochs[e+1:])
+	px.epochs[e+1] = epoch{from, m.Peers}
+
+	// a new peer needs nothing before it joins
+	for j := range m.Peers {
+		if m.Peers[j] != old[j] && px.doneSeqs[j] < from-1 {
+			px.doneSeqs[j] = from - 1
+		}
+	}
+}
+
+//
+// whether this peer knows every Membership that could take
+// effect by instance seq. px.mu must be held.
+//
+func (px *Paxos) knowsPeers(seq int) bool {
+	if px.delay <= 0 {
+		return true
+	}
+	for px.learned <= seq-px.delay {
+		if _, ok := px.values[px.learned]; !ok && px.learned >= px.min() {
+			return false
+		}
+		px.learned++
+	}
+	return true
+}
+
+// wait until this peer knows who runs instance seq.
+func (px *Paxos) awaitPeers(seq int) {
+	for !px.isdead() {
+		px.mu.Lock()
+		ok := px.knowsPeers(seq)
+		px.mu.Unlock()
+		if ok {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
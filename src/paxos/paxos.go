@@ -6,18 +6,29 @@ package paxos
 // a Paxos peer.
 //
 // Manages a sequence of agreed-on values.
-// The set of peers is fixed.
+// The set of peers is fixed, unless changed through the log
+// (see membership.go).
 // Copes with network failures (partition, msg loss, &c).
-// Does not store anything persistently, so cannot handle crash+restart.
+// Made with Make(), stores nothing persistently, so cannot handle
+// crash+restart; made with MakePersistent(), keeps its acceptor
+// state on disk (see persist.go).
 //
 // The application interface:
 //
 // px = paxos.Make(peers []string, me string)
-// px.Start(seq int, v interface{}) -- start agreement on new instance
+// px = paxos.MakePersistent(peers []string, me string, dir string)
+// px.Start(seq int, v interface{}) bool -- start agreement on new instance
+// px.StartPriority(seq int, v interface{}, prio int) bool -- same, with a priority hint
+// px.SetWindow(n int) -- how far past Min() Start() may go
+// px.SetReconfigDelay(n int) -- let decided Memberships change the peers
+// px.JoinAt(from int) -- take over as a new peer from an instance
+// px.Peers(seq int) []string -- the peers of an instance
 // px.Status(seq int) (Fate, v interface{}) -- get info about an instance
 // px.Done(seq int) -- ok to forget all instances <= seq
 // px.Max() int -- highest instance seq known, or -1
 // px.Min() int -- instances before this seq have been forgotten
+// px.Decision(seq int) (Decision, bool) -- how an instance was decided
+// px.Subscribe(seq int) <-chan struct{} -- closed once an instance is decided
 //
 
 import "net"
@@ -30,6 +41,7 @@ import "sync"
 import "sync/atomic"
 import "fmt"
 import "math/rand"
+import "time"
 
 // for debugging
 const Debug = 0
@@ -51,14 +63,36 @@ const (
 	Forgotten      // decided but forgotten.
 )
 
+// StartPriority() priorities. while a proposal is in flight,
+// this peer holds back its proposals of lower priority, so
+// that e.g. filling a gap in the log finishes ahead of
+// speculative proposals for future instances.
+const (
+	PriorityNormal = 0
+	PriorityHigh   = 1
+)
+
+// longest a proposal holds back for higher priorities before
+// running a round anyway, so that a stuck high-priority
+// proposal (e.g. for an instance no majority can decide)
+// does not starve the rest.
+const MaxYield = 100 * time.Millisecond
+
+// how far past Min() a peer starts instances, unless
+// SetWindow() says otherwise. every instance from Min() to
+// the highest started is kept in memory until Done().
+const DefaultWindow = 100000
+
 type Paxos struct {
 	mu         sync.Mutex
 	l          net.Listener
 	dead       int32 // for testing
 	unreliable int32 // for testing
 	rpcCount   int32 // for testing
+	prepares   int32 // Prepare RPCs handled, for testing
 	peers      []string
 	me         int // index into peers[]
+	addr       string // peers[me] as made
 
 	// Your data here.
 	doneSeqs   []int                 // doneSeqs[i] is highest seq passed to Done() 
@@ -69,6 +103,41 @@ type Paxos struct {
 	values     map[int]interface{}   // decided value of each instance	
 
 	accpState  map[int]State         // acceptor state of each instance
+
+	inflight   map[int]int           // priority -> number of running proposals
+	maxYield   time.Duration         // see yieldTo(); MaxYield but in tests
+
+	decisions  map[int]Decision      // how each decided instance was decided
+
+	peerMin    int                   // highest Min() a peer reported refusing a prepare
+
+	dir        string                // where accpState is saved, or "" (see persist.go)
+
+	subscribed map[int]chan struct{} // Subscribe() channels of undecided instances
+
+	window     int                   // Start() refuses seqs >= Min() + window, if > 0
+
+	// see membership.go
+	delay      int                   // instances before a Membership takes effect; 0 for never
+	epochs     []epoch               // the peers of each range of instances, by from
+	learned    int                   // every instance before it is known decided or forgotten
+
+	// see leader.go
+	promised   rangePromise          // acceptor's promise for a range of instances
+	rangeSeen  int                   // highest range promise a peer refused us for
+	lead       leadership
+	resigned   bool                  // see Resign()
+}
+
+//
+// the proposal that decided an instance, as first learned by
+// a peer. several peers may get the same value decided with
+// different proposal numbers; a peer reports the first one
+// it hears of.
+//
+type Decision struct {
+	Proposal int // proposal number
+	Proposer int // index into the instance's peers of the peer that proposed it
 }
 
 // acceptor state
@@ -94,18 +163,53 @@ func (px *Paxos) unlock() {
 // instance seq, with proposed value v.
 // Start() returns right away; the application will
 // call Status() to find out if/when agreement
-// is reached.
+// is reached. Start() returns false, and starts
+// nothing, if seq is Min() + the window or more
+// (see SetWindow()), as instances that far ahead
+// would have this peer keep all those between.
 //
-func (px *Paxos) Start(seq int, v interface{}) {
-	if seq < px.Min() {
-		return
+func (px *Paxos) Start(seq int, v interface{}) bool {
+	return px.StartPriority(seq, v, PriorityNormal)
+}
+
+//
+// like Start(), but with a priority hint. proposals of
+// this peer with lower priority wait for the higher ones
+// to be decided before running another round.
+//
+func (px *Paxos) StartPriority(seq int, v interface{}, prio int) bool {
+	min := px.Min()
+	if seq < min {
+		return true
 	}
 	
 	px.mu.Lock()
+	if m, ok := v.(Membership); ok && px.delay > 0 && len(m.Peers) != len(px.peers) {
+		px.mu.Unlock()
+		return false
+	}
+	if px.window > 0 && seq - min >= px.window {
+		px.mu.Unlock()
+		DPrintf("Start : seq %d : past window %d from min %d : serv %s\n",
+			seq, px.window, min, px.self())
+		return false
+	}
 	px.updateMaxSeqSeen(seq)
+	px.inflight[prio]++
 	px.mu.Unlock()
 
-	go px.propose(seq, v)
+	go px.propose(seq, v, prio)
+	return true
+}
+
+//
+// have Start() refuse seqs n or more past Min(). 0 lets it
+// start any seq.
+//
+func (px *Paxos) SetWindow(n int) {
+	px.mu.Lock()
+	defer px.mu.Unlock()
+	px.window = n
 }
 
 func (px *Paxos) updateMaxSeqSeen(seq int) {
@@ -114,14 +218,48 @@ func (px *Paxos) updateMaxSeqSeen(seq int) {
 	}
 }
 
-func (px *Paxos) isDecided(seq int) bool {
-	decided, _ := px.Status(seq)
-	return decided == Decided
+func (px *Paxos) isPending(seq int) bool {
+	fate, _ := px.Status(seq)
+	return fate == Pending
+}
+
+// wait until no proposal of higher priority is in flight,
+// or MaxYield has passed.
+func (px *Paxos) yieldTo(prio int) {
+	deadline := time.Now().Add(px.maxYield)
+	for !px.isdead() && time.Now().Before(deadline) {
+		busy := false
+		px.mu.Lock()
+		for p, n := range px.inflight {
+			if p > prio && n > 0 {
+				busy = true
+			}
+		}
+		px.mu.Unlock()
+		if !busy {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
 }
  
-func (px *Paxos) propose(seq int, v interface{}) {	
-	for !px.isDecided(seq) {
-		
+func (px *Paxos) propose(seq int, v interface{}, prio int) {	
+	defer func() {
+		px.mu.Lock()
+		px.inflight[prio]--
+		px.mu.Unlock()
+	}()
+
+	px.awaitPeers(seq)
+	px.yieldTo(prio)
+	if px.isPending(seq) && px.proposeFast(seq, v) {
+		return
+	}
+
+	won := false
+	for px.isPending(seq) && !px.isdead() {
+		px.yieldTo(prio)
+
 		// choose n, unique and higher than any proposal number seen
 		n := px.chooseProposalNumber(seq)
 		
@@ -145,15 +283,22 @@ func (px *Paxos) propose(seq int, v interface{}) {
 
 		ok = <- chan3
 		if ok { // we reach agreement on value v1
-			go px.sendDecidedToAll(seq, v1)
+			px.sendDecidedToAll(seq, n, v1)
+			won = true
 			break;
 		}
 	}
+	if won && !px.IsLeader() && !px.resigning() && !px.isdead() {
+		px.establish()
+	}
 }
 
 func (px *Paxos) chooseProposalNumber(seq int) int {	
 	px.mu.Lock()     
 	n := px.accpState[seq].prepProposal
+	if p := px.promisedFor(seq); p > n {
+		n = p
+	}
 	px.mu.Unlock()
 	return n + 1
 }
@@ -162,7 +307,8 @@ func (px *Paxos) sendPrepareToAll(seq int,
 	n int, v interface{}, chan1 chan<- bool, chan2 chan<- interface{}) {
 	cntok, maxna := 0, 0
 	var v1 interface{}
-	for _, peer := range px.peers {
+	peers := px.Peers(seq)
+	for _, peer := range peers {
 		na, va, ok := px.prepare(peer, seq, n)
 		if ok {
 			if na > maxna {
@@ -178,7 +324,7 @@ func (px *Paxos) sendPrepareToAll(seq int,
 			}
 		}
 	}
-	if cntok > len(px.peers) / 2 {
+	if cntok > len(peers) / 2 {
 		if maxna == 0 {
 			v1 = v
 		}
@@ -196,6 +342,9 @@ func (px *Paxos) updateProposalNumber(seq int, n int) bool {
 	state := px.accpState[seq]
 	if (n > state.prepProposal) {
 		state.prepProposal = n
+		if px.persist(seq, state) != nil {
+			return false
+		}
 		px.accpState[seq] = state
 		return true
 	}
@@ -204,7 +353,7 @@ func (px *Paxos) updateProposalNumber(seq int, n int) bool {
 
 
 func (px *Paxos) self() string {
-	return px.peers[px.me]
+	return px.addr
 }
 
 func (px *Paxos) isSelf(peer string) bool {
@@ -215,11 +364,21 @@ func (px *Paxos) prepare(peer string, seq int, n int) (int, interface{}, bool) {
 	if px.isSelf(peer) {
 		return px.prepareHandler(seq, n)
 	} else {
-		args := &PrepareArgs{seq, n}
+		args := &PrepareArgs{seq, n, px.me, px.doneIns()}
 		var reply PrepareReply
-		ok := call(peer, "Paxos.Prepare", args, &reply)
+		ok := send(peer, "Paxos.Prepare", args, &reply)
 		if !ok {
 			return 0, nil, false
+		}
+		px.heardDone(reply.Sender, reply.DoneIns)
+		if reply.Err == ErrForgotten {
+			px.mu.Lock()
+			if reply.Min > px.peerMin {
+				px.peerMin = reply.Min
+				px.notifyBelow(px.peerMin)
+			}
+			px.mu.Unlock()
+			return 0, nil, false
 		} else if reply.Err != OK { 
 			return reply.Proposal, nil, false
 		}
@@ -230,6 +389,15 @@ func (px *Paxos) prepare(peer string, seq int, n int) (int, interface{}, bool) {
 func (px *Paxos) Prepare(args *PrepareArgs, reply *PrepareReply) error {
 	DPrintf("RPC Prepare : inst %d : prop %d : serv %s\n", 
 		args.Instance, args.Proposal, px.self())
+	atomic.AddInt32(&px.prepares, 1)
+	px.heardDone(args.Sender, args.DoneIns)
+	reply.Sender, reply.DoneIns = px.me, px.doneIns()
+	if min := px.Min(); args.Instance < min {
+		// every peer called Done() on it, so it was decided
+		// long ago: the proposer must have lost its state
+		reply.Err, reply.Min = ErrForgotten, min
+		return nil
+	}
 	n, v, ok := px.prepareHandler(args.Instance, args.Proposal)
 	if ok {
 		reply.Err = OK
@@ -246,25 +414,34 @@ func (px *Paxos) prepareHandler(seq int, n int) (int, interface{}, bool) {
 	px.mu.Lock()
 	defer px.mu.Unlock()
 	state := px.accpState[seq]
-	if n > state.prepProposal {
+	promised := state.prepProposal
+	if p := px.promisedFor(seq); p > promised {
+		promised = p
+	}
+	if n > promised {
 		state.prepProposal = n
+		if px.persist(seq, state) != nil {
+			// a promise not on disk could be broken by a restart
+			return promised, nil, false
+		}
 		n, v := state.accpProposal, state.accpValue
 		px.accpState[seq] = state
 		return n, v, true
 	} else {
-		return state.prepProposal, nil, false
+		return promised, nil, false
 	}
 }
 
 func (px *Paxos) sendAcceptToAll(seq int, n int, v interface{}, okch chan<- bool) {
 	cntok := 0
-	for _, peer := range px.peers {
+	peers := px.Peers(seq)
+	for _, peer := range peers {
 		ok := px.accept(peer, seq, n, v)
 		if ok {
 			cntok++
 		}
 	}
-	if cntok > len(px.peers) / 2 {
+	if cntok > len(peers) / 2 {
 		okch <- true
 	}
 	okch <- false
@@ -274,13 +451,14 @@ func (px *Paxos) accept(peer string, seq int, n int, v interface{}) bool {
 	if px.isSelf(peer) {
 		return px.acceptHandler(seq, n, v)
 	} else {
-		args := AcceptArgs{seq, n, v}
+		args := AcceptArgs{seq, n, v, px.me, px.doneIns()}
 		var reply AcceptReply
-		ok := call(peer, "Paxos.Accept", args, &reply)
-		if !ok || reply.Err != OK {
+		ok := send(peer, "Paxos.Accept", args, &reply)
+		if !ok {
 			return false
 		}
-		return true
+		px.heardDone(reply.Sender, reply.DoneIns)
+		return reply.Err == OK
 	}
 }
 
@@ -288,6 +466,8 @@ func (px *Paxos) Accept(args *AcceptArgs, reply *AcceptReply) error {
 	DPrintf("RPC Accept : inst %d : prop %d : value %v : serv %s\n", 
 		args.Instance, args.Proposal, args.Value, px.self())
 	
+	px.heardDone(args.Sender, args.DoneIns)
+	reply.Sender, reply.DoneIns = px.me, px.doneIns()
 	ok := px.acceptHandler(args.Instance, args.Proposal, args.Value)
 	if ok {
 		reply.Err = OK
@@ -302,32 +482,61 @@ func (px *Paxos) acceptHandler(seq int, n int, v interface{}) bool {
 	defer px.mu.Unlock()
 	px.updateMaxSeqSeen(seq)
 	state := px.accpState[seq]
-	if n >= state.prepProposal {
+	if n >= state.prepProposal && n >= px.promisedFor(seq) {
 		state.prepProposal = n
 		state.accpProposal = n
 		state.accpValue = v
+		if px.persist(seq, state) != nil {
+			return false
+		}
 		px.accpState[seq] = state
 		return true
 	} 
 	return false
 }
 
-func (px *Paxos) sendDecidedToAll(seq int, v interface{}) {
+//
+// record seq's decision at this peer, and tell the others in
+// the background. only the local record is done by the time
+// this returns, so that lower-priority proposals yielding to
+// the caller find seq decided once it is no longer in flight.
+//
+func (px *Paxos) sendDecidedToAll(seq int, n int, v interface{}) {
 	//px.status[seq] = Decided
-	for _, peer := range px.peers {
-		px.decided(peer, seq, v)
+	var sent sync.WaitGroup
+	// this peer learns it even if no longer one of seq's peers
+	px.decided(px.self(), seq, n, v, &sent)
+	for _, peer := range px.Peers(seq) {
+		if !px.isSelf(peer) {
+			px.decided(peer, seq, n, v, &sent)
+		}
 	}
-}
-
-func (px *Paxos) decided(peer string, seq int, v interface{}) {
+	// wake this peer's subscribers once the others have been
+	// told, so that an application acting on the decision
+	// can expect its peers to know of it too
+	go func() {
+		sent.Wait()
+		px.mu.Lock()
+		px.notify(seq)
+		px.mu.Unlock()
+	}()
+}
+
+func (px *Paxos) decided(peer string, seq int, n int, v interface{}, sent *sync.WaitGroup) {
 	px.mu.Lock()
 	defer px.mu.Unlock()
 	if px.isSelf(peer) {
 		px.values[seq] = v
+		px.learnMembership(seq, v)
+		px.noteDecision(seq, Decision{n, px.me})
 	} else {
-		args := &DecidedArgs{px.me, px.doneSeqs[px.me], seq, v}
+		args := &DecidedArgs{px.me, px.doneSeqs[px.me], seq, n, v}
 		var reply DecidedReply
-		go call(peer, "Paxos.Decided", args, &reply)
+		sent.Add(1)
+		go func() {
+			send(peer, "Paxos.Decided", args, &reply)
+			sent.Done()
+		}()
 	}
 }
 
@@ -336,13 +545,110 @@ func (px *Paxos) Decided(args *DecidedArgs, reply *DecidedReply) error {
 		args.Instance, args.Value, px.self())
 	px.mu.Lock()
 	px.values[args.Instance] = args.Value
-	if px.doneSeqs[args.Sender] < args.DoneIns {
-		px.doneSeqs[args.Sender] = args.DoneIns
-	}
+	px.learnMembership(args.Instance, args.Value)
+	px.noteDecision(args.Instance, Decision{args.Proposal, args.Sender})
+	px.notify(args.Instance)
+	px.noteDone(args.Sender, args.DoneIns)
 	px.mu.Unlock()
 	return nil
 }
 
+// this peer's Done() seq, to piggyback on a message
+func (px *Paxos) doneIns() int {
+	px.mu.Lock()
+	defer px.mu.Unlock()
+	return px.doneSeqs[px.me]
+}
+
+// a peer piggybacked its Done() seq on a message
+func (px *Paxos) heardDone(peer int, done int) {
+	px.mu.Lock()
+	defer px.mu.Unlock()
+	if px.noteDone(peer, done) {
+		px.doMemShrink()
+	}
+}
+
+//
+// note that peer's application is done with instances up to
+// done, returning whether that is news. px.mu must be held.
+//
+func (px *Paxos) noteDone(peer int, done int) bool {
+	if peer < 0 || peer >= len(px.doneSeqs) || px.doneSeqs[peer] >= done {
+		return false
+	}
+	px.doneSeqs[peer] = done
+	return true
+}
+
+//
+// the application wants to wait for an instance to be
+// decided without polling Status(). the channel returned is
+// closed once this peer knows seq to be decided, or has
+// forgotten it; Status() then tells which. a peer whose
+// proposal decided seq closes it once it has sent the
+// decision to the others. like Status(), it only reflects
+// what this peer has heard: a peer that missed the decision
+// may wait until it proposes seq itself.
+//
+func (px *Paxos) Subscribe(seq int) <-chan struct{} {
+	px.mu.Lock()
+	defer px.mu.Unlock()
+
+	if ch, ok := px.subscribed[seq]; ok {
+		return ch
+	}
+	ch := make(chan struct{})
+	if _, ok := px.values[seq]; ok || seq <= px.doMemShrink() || seq < px.peerMin {
+		close(ch)
+		return ch
+	}
+	px.subscribed[seq] = ch
+	return ch
+}
+
+// wake seq's subscribers. px.mu must be held
+func (px *Paxos) notify(seq int) {
+	if ch, ok := px.subscribed[seq]; ok {
+		close(ch)
+		delete(px.subscribed, seq)
+	}
+}
+
+// wake the subscribers of instances before min, forgotten.
+// px.mu must be held
+func (px *Paxos) notifyBelow(min int) {
+	for seq := range px.subscribed {
+		if seq < min {
+			px.notify(seq)
+		}
+	}
+}
+
+// px.mu must be held
+func (px *Paxos) noteDecision(seq int, d Decision) {
+	if _, ok := px.decisions[seq]; !ok {
+		px.decisions[seq] = d
+	}
+}
+
+//
+// the application wants to know how an instance was
+// decided. false if this peer doesn't know it to be
+// decided, or has forgotten it.
+//
+func (px *Paxos) Decision(seq int) (Decision, bool) {
+	if seq < px.Min() {
+		return Decision{}, false
+	}
+
+	px.mu.Lock()
+	defer px.mu.Unlock()
+
+	d, ok := px.decisions[seq]
+	return d, ok
+}
+
 //
 // the application on this machine is done with
 // all instances <= seq.
@@ -372,6 +678,22 @@ func (px *Paxos) doMemShrink() int {
 		if seq <= mm {
 			delete(px.values, seq)
 			delete(px.accpState, seq)
+			delete(px.decisions, seq)
+			px.unpersist(seq)
+		}
+	}
+	// instances this peer accepted but never learned were
+	// still decided, as every peer is done with them
+	for seq := range px.accpState {
+		if seq <= mm {
+			delete(px.accpState, seq)
+			px.unpersist(seq)
+		}
+	}
+	px.notifyBelow(mm + 1)
+	for seq := range px.lead.busy {
+		if seq <= mm {
+			delete(px.lead.busy, seq)
 		}
 	}
 	return mm
@@ -417,11 +739,26 @@ func (px *Paxos) Max() int {
 // missed -- the other peers therefor cannot forget these
 // instances.
 //
+// a peer restarted without its state can't catch up that
+// way: the others may have forgotten instances it never
+// learned. they refuse to prepare instances below their
+// Min(), and the restarted peer's Min() then rises to theirs,
+// so its application can tell that it must get the state
+// of those instances elsewhere.
+//
 func (px *Paxos) Min() int {
 	px.mu.Lock()
 	defer px.mu.Unlock()
-	
-	return px.doMemShrink() + 1
+	return px.min()
+}
+
+// Min(), with px.mu held
+func (px *Paxos) min() int {
+	min := px.doMemShrink() + 1
+	if px.peerMin > min {
+		min = px.peerMin
+	}
+	return min
 }
 
 //
@@ -432,13 +769,15 @@ func (px *Paxos) Min() int {
 // it should not contact other Paxos peers.
 //
 func (px *Paxos) Status(seq int) (Fate, interface{}) {
-	if seq < px.Min() {
-		return Forgotten, nil
-	} 
-
 	px.mu.Lock()
 	defer px.mu.Unlock()
 
+	// under the one lock, so an instance forgotten
+	// meanwhile isn't taken for a Pending one
+	if seq < px.min() {
+		return Forgotten, nil
+	}
+
 	v, ok := px.values[seq]
 	if ok {
 		return Decided, v
@@ -486,9 +825,20 @@ func (px *Paxos) isunreliable() bool {
 // are in peers[]. this servers port is peers[me].
 //
 func Make(peers []string, me int, rpcs *rpc.Server) *Paxos {
+	return MakePersistent(peers, me, rpcs, "")
+}
+
+//
+// like Make(), but the peer keeps its acceptor state in dir,
+// and a peer made again with the same dir after a crash
+// resumes from it. "" keeps it in memory, as Make() does.
+//
+func MakePersistent(peers []string, me int, rpcs *rpc.Server, dir string) *Paxos {
 	px := &Paxos{}
 	px.peers = peers
 	px.me = me
+	px.addr = peers[me]
+	px.dir = dir
 
 	// Your initialization code here.
 	npeers := len(px.peers)
@@ -500,10 +850,25 @@ func Make(peers []string, me int, rpcs *rpc.Server) *Paxos {
 	
 	px.values = make(map[int]interface{})
 	px.accpState = make(map[int]State)
+	px.inflight = make(map[int]int)
+	px.maxYield = MaxYield
+	px.decisions = make(map[int]Decision)
+	px.subscribed = make(map[int]chan struct{})
+	px.window = DefaultWindow
+	px.epochs = []epoch{{0, peers}}
+	px.lead.busy = make(map[int]bool)
+
+	if px.dir != "" {
+		if err := px.recover(); err != nil {
+			log.Fatal("paxos state: ", err)
+		}
+	}
 
 	if rpcs != nil {
-		// caller will create socket &c
-		rpcs.Register(px)
+		// caller will create socket &c. peers sharing the
+		// caller's rpc.Server tell themselves apart by tag.
+		_, service := rpcTarget(peers[me], "Paxos")
+		rpcs.RegisterName(service, px)
 	} else {
 		rpcs = rpc.NewServer()
 		rpcs.Register(px)
@@ -0,0 +1,158 @@
+package paxos
+
+//
+// acceptor state on disk, for peers made with MakePersistent().
+//
+// a peer's promises and acceptances are what make a value,
+// once chosen, stay chosen: an acceptor that forgot them in a
+// crash could help a later proposer choose another. so each
+// instance's State is written to dir/<seq>, through a temp
+// file fsync'd and renamed into place, before the Prepare or
+// Accept that changed it is answered. a restarted peer reads
+// them all back. files go when Done() lets the instances go.
+// a PrepareRange promise (see leader.go) goes to dir/promise.
+//
+
+import "bytes"
+import "encoding/gob"
+import "fmt"
+import "io/ioutil"
+import "os"
+import "path/filepath"
+import "strconv"
+import "strings"
+import "bufpool"
+
+// State, with fields gob can see
+type savedState struct {
+	PrepProposal int
+	AccpProposal int
+	AccpValue    interface{}
+}
+
+func (px *Paxos) stateFile(seq int) string {
+	return filepath.Join(px.dir, strconv.Itoa(seq))
+}
+
+const promiseFile = "promise"
+
+//
+// durably record seq's acceptor state. a peer without a dir
+// keeps it in memory only. px.mu must be held, so that two
+// handlers don't write one instance's file out of order.
+//
+func (px *Paxos) persist(seq int, state State) error {
+	if px.dir == "" {
+		return nil
+	}
+	saved := savedState{state.prepProposal, state.accpProposal, state.accpValue}
+	return writeDurably(px.stateFile(seq), &saved)
+}
+
+// likewise for a PrepareRange promise. px.mu must be held.
+func (px *Paxos) persistPromise(promise rangePromise) error {
+	if px.dir == "" {
+		return nil
+	}
+	return writeDurably(filepath.Join(px.dir, promiseFile), &promise)
+}
+
+// gob-encode v into file name, replacing it once v is on disk
+func writeDurably(name string, v interface{}) error {
+	buf := bufpool.Get()
+	defer bufpool.Put(buf)
+	if err := gob.NewEncoder(buf).Encode(v); err != nil {
+		return err
+	}
+
+	tmp := name + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(buf.Bytes())
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, name)
+	}
+	if err == nil {
+		// make the rename itself durable
+		err = syncDir(filepath.Dir(name))
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if cerr := d.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// drop seq's saved state, once it is forgotten. px.mu must be held.
+func (px *Paxos) unpersist(seq int) {
+	if px.dir != "" {
+		os.Remove(px.stateFile(seq))
+	}
+}
+
+//
+// load the acceptor state a previous incarnation of this
+// peer saved in px.dir, creating the directory if need be.
+//
+func (px *Paxos) recover() error {
+	if err := os.MkdirAll(px.dir, 0777); err != nil {
+		return err
+	}
+	files, err := ioutil.ReadDir(px.dir)
+	if err != nil {
+		return err
+	}
+	for _, fi := range files {
+		if strings.HasSuffix(fi.Name(), ".tmp") {
+			// a write cut short; its Prepare or Accept was not answered
+			os.Remove(filepath.Join(px.dir, fi.Name()))
+			continue
+		}
+		if fi.Name() == promiseFile {
+			data, err := ioutil.ReadFile(filepath.Join(px.dir, fi.Name()))
+			if err != nil {
+				return err
+			}
+			if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&px.promised); err != nil {
+				return fmt.Errorf("promise: %v", err)
+			}
+			continue
+		}
+		seq, err := strconv.Atoi(fi.Name())
+		if err != nil {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(px.dir, fi.Name()))
+		if err != nil {
+			return err
+		}
+		var saved savedState
+		if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&saved); err != nil {
+			return fmt.Errorf("instance %d: %v", seq, err)
+		}
+		px.accpState[seq] = State{saved.PrepProposal, saved.AccpProposal, saved.AccpValue}
+		if seq > px.maxSeqSeen {
+			px.maxSeqSeen = seq
+		}
+	}
+	return nil
+}
@@ -4,6 +4,7 @@ import "fmt"
 import "net"
 import "net/rpc"
 import "syscall"
+import "strings"
 
 //
 // call() sends an RPC to the rpcname handler on server srv
@@ -42,16 +43,50 @@ func call(srv string, name string, args interface{}, reply interface{}) bool {
 }
 
 
+//
+// a peer address may be socket@tag, for a peer that shares
+// the rpc.Server behind socket with others: its services are
+// then registered as name@tag. returns the socket to dial
+// and the RPC name to call for rpcname at peer.
+//
+func rpcTarget(peer string, rpcname string) (string, string) {
+	i := strings.LastIndex(peer, "@")
+	if i < 0 {
+		return peer, rpcname
+	}
+	service, method := rpcname, ""
+	if j := strings.Index(rpcname, "."); j >= 0 {
+		service, method = rpcname[:j], rpcname[j:]
+	}
+	return peer[:i], service + peer[i:] + method
+}
+
+// call() for a peer address that may carry a tag
+func send(peer string, rpcname string, args interface{}, reply interface{}) bool {
+	srv, name := rpcTarget(peer, rpcname)
+	return call(srv, name, args, reply)
+}
+
 const (
 	OK          = "OK"
 	ErrRejected = "ErrRejected"
+	ErrForgotten = "ErrForgotten"
 )
 
 type Err string
 
+//
+// Prepare and Accept carry the highest seq the sender's
+// application passed to Done(), and their replies the
+// replier's, as Decided does: peers thus learn each other's
+// progress, and Min() advances, with every round rather than
+// only with decisions each peer proposed.
+//
 type PrepareArgs struct {
 	Instance int
 	Proposal int
+	Sender   int
+	DoneIns  int
 }
 
 type PrepareReply struct {
@@ -59,16 +94,38 @@ type PrepareReply struct {
 	Instance int
 	Proposal int
 	Value    interface{}
+	Min      int // the peer's Min(), for ErrForgotten
+	Sender   int
+	DoneIns  int
+}
+
+//
+// ask for a promise of Proposal for every instance from
+// From on; see leader.go.
+//
+type PrepareRangeArgs struct {
+	From     int
+	Proposal int
+}
+
+type PrepareRangeReply struct {
+	Err      Err
+	Proposal int   // if ErrRejected, the one promised instead
+	Busy     []int // instances from From on not to take the fast path in
 }
 
 type AcceptArgs struct {
 	Instance int
 	Proposal int
 	Value    interface{}
+	Sender   int
+	DoneIns  int
 }
 
 type AcceptReply struct {
 	Err      Err
+	Sender   int
+	DoneIns  int
 }
 
 type DecidedArgs struct {
@@ -76,6 +133,7 @@ type DecidedArgs struct {
 	DoneIns  int
 
 	Instance int
+	Proposal int
 	Value    interface{}
 }
 
@@ -10,6 +10,9 @@ import "math/rand"
 import crand "crypto/rand"
 import "encoding/base64"
 import "sync/atomic"
+import "bytes"
+import "encoding/gob"
+import "io/ioutil"
 
 func randstring(n int) string {
 	b := make([]byte, 2*n)
@@ -500,6 +503,68 @@ func TestDoneMax(t *testing.T) {
 	fmt.Printf("  ... Passed\n")
 }
 
+//
+// does a peer restarted without its state find out which
+// instances the others have forgotten, rather than get an
+// old one decided again?
+//
+func TestRestartForgotten(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	fmt.Printf("Test: Restarted peer learns the forgotten instances ...\n")
+
+	const npaxos = 3
+	var pxa []*Paxos = make([]*Paxos, npaxos)
+	var pxh []string = make([]string, npaxos)
+	defer cleanup(pxa)
+
+	for i := 0; i < npaxos; i++ {
+		pxh[i] = port("restart", i)
+	}
+	for i := 0; i < npaxos; i++ {
+		pxa[i] = Make(pxh, i, nil)
+	}
+
+	for i := 0; i < 5; i++ {
+		pxa[0].Start(i, "x")
+		waitn(t, pxa, i, npaxos)
+	}
+	for i := 0; i < npaxos; i++ {
+		pxa[i].Done(4)
+	}
+	// propagate the Done()s
+	for i := 0; i < npaxos; i++ {
+		pxa[i].Start(5+i, "y")
+		waitn(t, pxa, 5+i, npaxos)
+	}
+	for i := 0; i < npaxos; i++ {
+		for iters := 0; iters < 30 && pxa[i].Min() != 5; iters++ {
+			time.Sleep(100 * time.Millisecond)
+		}
+		if m := pxa[i].Min(); m != 5 {
+			t.Fatalf("Min() %v, wanted 5", m)
+		}
+	}
+
+	pxa[2].Kill()
+	pxa[2] = Make(pxh, 2, nil)
+	if m := pxa[2].Min(); m != 0 {
+		t.Fatalf("restarted peer has Min() %v", m)
+	}
+	pxa[2].Start(2, "stale")
+	for iters := 0; iters < 30 && pxa[2].Min() != 5; iters++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if m := pxa[2].Min(); m != 5 {
+		t.Fatalf("restarted peer has Min() %v, wanted 5", m)
+	}
+	if fate, _ := pxa[2].Status(2); fate != Forgotten {
+		t.Fatalf("restarted peer has instance 2 %v", fate)
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
 func TestRPCCount(t *testing.T) {
 	runtime.GOMAXPROCS(4)
 
@@ -659,6 +724,96 @@ func TestOld(t *testing.T) {
 	fmt.Printf("  ... Passed\n")
 }
 
+//
+// a high-priority proposal for a gap in the log should
+// be decided before the same peer's normal proposals.
+//
+func TestPriority(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	fmt.Printf("Test: Prioritized gap-fill decided first ...\n")
+
+	const npaxos = 3
+	var pxa []*Paxos = make([]*Paxos, npaxos)
+	var pxh []string = make([]string, npaxos)
+	defer cleanup(pxa)
+
+	for i := 0; i < npaxos; i++ {
+		pxh[i] = port("prio", i)
+	}
+	for i := 0; i < npaxos; i++ {
+		pxa[i] = Make(pxh, i, nil)
+	}
+
+	// normal proposals wait for the gap-fill however long it
+	// takes, so none can be decided first
+	pxa[0].maxYield = time.Hour
+
+	const nlow = 10
+	pxa[0].StartPriority(0, "gap", PriorityHigh)
+	for seq := 1; seq <= nlow; seq++ {
+		pxa[0].Start(seq, seq*10)
+	}
+
+	for iters := 0; ; iters++ {
+		if decided, _ := pxa[0].Status(0); decided == Decided {
+			break
+		}
+		for seq := 1; seq <= nlow; seq++ {
+			if decided, _ := pxa[0].Status(seq); decided == Decided {
+				t.Fatalf("instance %v decided before the gap-fill", seq)
+			}
+		}
+		if iters > 1000 {
+			t.Fatalf("gap-fill never decided")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	for seq := 0; seq <= nlow; seq++ {
+		waitn(t, pxa, seq, npaxos)
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+//
+// a high-priority proposal that never finishes should only
+// hold back normal ones for MaxYield.
+//
+func TestPriorityStarvation(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	fmt.Printf("Test: Stuck high-priority proposal doesn't starve others ...\n")
+
+	const npaxos = 3
+	var pxa []*Paxos = make([]*Paxos, npaxos)
+	var pxh []string = make([]string, npaxos)
+	defer cleanup(pxa)
+
+	for i := 0; i < npaxos; i++ {
+		pxh[i] = port("starve", i)
+	}
+	for i := 0; i < npaxos; i++ {
+		pxa[i] = Make(pxh, i, nil)
+	}
+
+	// a high-priority proposal that stays in flight for good
+	pxa[0].mu.Lock()
+	pxa[0].inflight[PriorityHigh]++
+	pxa[0].mu.Unlock()
+
+	pxa[0].Start(0, "normal")
+	for iters := 0; ndecided(t, pxa, 0) < npaxos; iters++ {
+		if iters > 200 {
+			t.Fatalf("normal proposal starved")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
 //
 // many agreements, with unreliable RPC
 //
@@ -955,3 +1110,517 @@ func TestLots(t *testing.T) {
 
 	fmt.Printf("  ... Passed\n")
 }
+
+func TestPersistentAcceptor(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	fmt.Printf("Test: Restarted acceptor keeps its promises ...\n")
+
+	const npaxos = 3
+	var pxa []*Paxos = make([]*Paxos, npaxos)
+	var pxh []string = make([]string, npaxos)
+	var dirs []string = make([]string, npaxos)
+	defer cleanup(pxa)
+
+	for i := 0; i < npaxos; i++ {
+		pxh[i] = port("persist", i)
+		dirs[i] = pxh[i] + ".state"
+		os.RemoveAll(dirs[i])
+		defer os.RemoveAll(dirs[i])
+	}
+
+	// peer 0 alone accepts "a" for instance 0, then crashes
+	pxa[0] = MakePersistent(pxh, 0, nil, dirs[0])
+	if !pxa[0].acceptHandler(0, 5, "a") {
+		t.Fatalf("fresh acceptor refused an accept")
+	}
+	pxa[0].Kill()
+	pxa[0] = MakePersistent(pxh, 0, nil, dirs[0])
+
+	if n, _, ok := pxa[0].prepareHandler(0, 3); ok || n != 5 {
+		t.Fatalf("restarted acceptor answered an old prepare: %v %v", ok, n)
+	}
+	if pxa[0].acceptHandler(0, 4, "b") {
+		t.Fatalf("restarted acceptor accepted a conflicting value")
+	}
+	if n, v, ok := pxa[0].prepareHandler(0, 7); !ok || n != 5 || v != "a" {
+		t.Fatalf("restarted acceptor's prepare got %v %v %v, wanted 5 a", ok, n, v)
+	}
+	if pxa[0].Max() != 0 {
+		t.Fatalf("restarted acceptor has Max() %v", pxa[0].Max())
+	}
+
+	// a majority decides "x"; after every peer restarts, a
+	// proposer of "y" must find "x"
+	for i := 1; i < npaxos; i++ {
+		pxa[i] = MakePersistent(pxh, i, nil, dirs[i])
+	}
+	pxa[1].Start(1, "x")
+	waitn(t, pxa, 1, npaxos)
+	for i := 0; i < npaxos; i++ {
+		pxa[i].Kill()
+		pxa[i] = MakePersistent(pxh, i, nil, dirs[i])
+	}
+	pxa[2].Start(1, "y")
+	waitn(t, pxa, 1, 1)
+	if _, v := pxa[2].Status(1); v != "x" {
+		t.Fatalf("decided %v after the restart, wanted x", v)
+	}
+
+	// Done() instances leave no files behind
+	pxa[0].Start(0, "z")
+	waitn(t, pxa, 0, npaxos)
+	for i := 0; i < npaxos; i++ {
+		pxa[i].Done(1)
+	}
+	for i := 0; i < npaxos; i++ {
+		pxa[i].Start(2+i, "w")
+		waitn(t, pxa, 2+i, npaxos)
+	}
+	for i := 0; i < npaxos; i++ {
+		for iters := 0; iters < 30 && pxa[i].Min() != 2; iters++ {
+			time.Sleep(100 * time.Millisecond)
+		}
+		for seq := 0; seq < 2; seq++ {
+			if _, err := os.Stat(pxa[i].stateFile(seq)); !os.IsNotExist(err) {
+				t.Fatalf("peer %d kept instance %d's state after Done(): %v", i, seq, err)
+			}
+		}
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestSubscribe(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	fmt.Printf("Test: Subscribers hear of decisions at once ...\n")
+
+	const npaxos = 3
+	var pxa []*Paxos = make([]*Paxos, npaxos)
+	var pxh []string = make([]string, npaxos)
+	defer cleanup(pxa)
+
+	for i := 0; i < npaxos; i++ {
+		pxh[i] = port("subscribe", i)
+	}
+	for i := 0; i < npaxos; i++ {
+		pxa[i] = Make(pxh, i, nil)
+	}
+
+	for seq := 0; seq < 5; seq++ {
+		chs := make([]<-chan struct{}, npaxos)
+		for i := 0; i < npaxos; i++ {
+			chs[i] = pxa[i].Subscribe(seq)
+		}
+		start := time.Now()
+		pxa[seq%npaxos].Start(seq, seq*10)
+		for i := 0; i < npaxos; i++ {
+			select {
+			case <-chs[i]:
+			case <-time.After(time.Second):
+				t.Fatalf("peer %d not told of instance %d's decision", i, seq)
+			}
+			if fate, v := pxa[i].Status(seq); fate != Decided || v != seq*10 {
+				t.Fatalf("peer %d woken with instance %d %v %v", i, seq, fate, v)
+			}
+		}
+		if d := time.Since(start); d > 200*time.Millisecond {
+			t.Fatalf("instance %d took %v to be seen decided", seq, d)
+		}
+	}
+
+	// decided and forgotten instances are closed at once
+	select {
+	case <-pxa[0].Subscribe(0):
+	default:
+		t.Fatalf("Subscribe() to a decided instance not closed")
+	}
+	for i := 0; i < npaxos; i++ {
+		pxa[i].Done(4)
+	}
+	for i := 0; i < npaxos; i++ {
+		pxa[i].Start(5+i, "y")
+		waitn(t, pxa, 5+i, npaxos)
+	}
+	for iters := 0; iters < 30 && pxa[0].Min() != 5; iters++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	select {
+	case <-pxa[0].Subscribe(2):
+	default:
+		t.Fatalf("Subscribe() to a forgotten instance not closed")
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestLeaderFastPath(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	fmt.Printf("Test: A steady leader skips Prepare ...\n")
+
+	const npaxos = 3
+	var pxa []*Paxos = make([]*Paxos, npaxos)
+	var pxh []string = make([]string, npaxos)
+	defer cleanup(pxa)
+
+	for i := 0; i < npaxos; i++ {
+		pxh[i] = port("leader", i)
+	}
+	for i := 0; i < npaxos; i++ {
+		pxa[i] = Make(pxh, i, nil)
+	}
+	prepares := func() int {
+		n := 0
+		for i := 0; i < npaxos; i++ {
+			n += int(atomic.LoadInt32(&pxa[i].prepares))
+		}
+		return n
+	}
+
+	// a decided proposal makes peer 0 leader
+	pxa[0].Start(0, "x")
+	waitn(t, pxa, 0, npaxos)
+	for iters := 0; iters < 30 && !pxa[0].IsLeader(); iters++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !pxa[0].IsLeader() {
+		t.Fatalf("peer 0 not leader after its proposal was decided")
+	}
+
+	const ninst = 50
+	before := prepares()
+	for seq := 1; seq <= ninst; seq++ {
+		pxa[0].Start(seq, seq)
+		waitn(t, pxa, seq, npaxos)
+	}
+	// classic Paxos sends each other peer a Prepare per instance
+	if n := prepares() - before; n > ninst/5 {
+		t.Fatalf("%d Prepares for %d instances under a leader", n, ninst)
+	}
+
+	// a competing proposer: every instance still gets one value
+	for seq := ninst + 1; seq <= ninst+20; seq++ {
+		pxa[0].Start(seq, "leader")
+		pxa[1].Start(seq, "rival")
+		if seq%2 == 0 {
+			pxa[2].Start(seq, "other")
+		}
+	}
+	for seq := ninst + 1; seq <= ninst+20; seq++ {
+		waitn(t, pxa, seq, npaxos)
+	}
+
+	// a leader turned down falls back, and can lead again
+	for seq := ninst + 21; seq <= ninst+30; seq++ {
+		pxa[0].Start(seq, seq)
+		waitn(t, pxa, seq, npaxos)
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestLeadResign(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	fmt.Printf("Test: Leadership handed to another peer ...\n")
+
+	const npaxos = 3
+	var pxa []*Paxos = make([]*Paxos, npaxos)
+	var pxh []string = make([]string, npaxos)
+	defer cleanup(pxa)
+
+	for i := 0; i < npaxos; i++ {
+		pxh[i] = port("leadresign", i)
+	}
+	for i := 0; i < npaxos; i++ {
+		pxa[i] = Make(pxh, i, nil)
+	}
+
+	pxa[0].Start(0, "x")
+	waitn(t, pxa, 0, npaxos)
+	for iters := 0; iters < 30 && !pxa[0].IsLeader(); iters++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !pxa[0].IsLeader() {
+		t.Fatalf("peer 0 not leader after its proposal was decided")
+	}
+
+	pxa[0].Resign()
+	if !pxa[2].Lead() {
+		t.Fatalf("peer 2 did not take the leadership")
+	}
+
+	// peer 0's proposals, through both phases now, don't
+	// make it leader again
+	for seq := 1; seq <= 10; seq++ {
+		pxa[0].Start(seq, seq)
+		waitn(t, pxa, seq, npaxos)
+	}
+	if pxa[0].IsLeader() {
+		t.Fatalf("peer 0 took the leadership back")
+	}
+
+	// nor do peer 2's proposals lose it
+	for seq := 11; seq <= 20; seq++ {
+		pxa[2].Start(seq, seq)
+		waitn(t, pxa, seq, npaxos)
+	}
+	if !pxa[2].IsLeader() || pxa[0].IsLeader() {
+		t.Fatalf("leaders %v %v, wanted peer 2 alone", pxa[0].IsLeader(), pxa[2].IsLeader())
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestStartWindow(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	fmt.Printf("Test: Start() refuses instances far past Min() ...\n")
+
+	const npaxos = 3
+	var pxa []*Paxos = make([]*Paxos, npaxos)
+	var pxh []string = make([]string, npaxos)
+	defer cleanup(pxa)
+
+	for i := 0; i < npaxos; i++ {
+		pxh[i] = port("window", i)
+	}
+	for i := 0; i < npaxos; i++ {
+		pxa[i] = Make(pxh, i, nil)
+	}
+
+	if pxa[0].Start(1<<40, "far") {
+		t.Fatalf("Start() of an absurd seq accepted")
+	}
+	if pxa[0].Max() != -1 {
+		t.Fatalf("refused Start() moved Max() to %v", pxa[0].Max())
+	}
+	for i := 0; i < npaxos; i++ {
+		pxa[i].mu.Lock()
+		n := len(pxa[i].accpState) + len(pxa[i].inflight)
+		pxa[i].mu.Unlock()
+		if n != 0 {
+			t.Fatalf("peer %d keeps state for a refused instance", i)
+		}
+	}
+
+	for i := 0; i < npaxos; i++ {
+		pxa[i].SetWindow(20)
+	}
+	if pxa[0].Start(20, "x") {
+		t.Fatalf("Start() past a window of 20 accepted")
+	}
+	if !pxa[0].Start(19, "y") {
+		t.Fatalf("Start() inside the window refused")
+	}
+	waitn(t, pxa, 19, npaxos)
+
+	// the window moves up with Min()
+	for seq := 0; seq < 10; seq++ {
+		pxa[0].Start(seq, seq)
+		waitn(t, pxa, seq, npaxos)
+	}
+	for i := 0; i < npaxos; i++ {
+		pxa[i].Done(9)
+	}
+	for i := 0; i < npaxos; i++ {
+		// the Decideds tell the others of this peer's Done()
+		pxa[i].Start(10+i, i)
+		waitn(t, pxa, 10+i, npaxos)
+	}
+	if pxa[0].Min() != 10 {
+		t.Fatalf("Min() %v after Done(9)", pxa[0].Min())
+	}
+	if !pxa[0].Start(29, "w") {
+		t.Fatalf("Start() refused once Min() moved up")
+	}
+	waitn(t, pxa, 29, npaxos)
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestMembership(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	fmt.Printf("Test: A decided Membership replaces a peer ...\n")
+
+	const npaxos = 3
+	const delay = 5
+	var pxa []*Paxos = make([]*Paxos, npaxos)
+	var pxh []string = make([]string, npaxos)
+	defer cleanup(pxa)
+
+	for i := 0; i < npaxos; i++ {
+		pxh[i] = port("member", i)
+	}
+	for i := 0; i < npaxos; i++ {
+		pxa[i] = Make(pxh, i, nil)
+		pxa[i].SetReconfigDelay(delay)
+	}
+	for seq := 0; seq < delay; seq++ {
+		pxa[0].Start(seq, seq)
+		waitn(t, pxa, seq, npaxos)
+	}
+
+	// replace dead peer 2 with a peer at another address
+	pxa[2].Kill()
+	newh := []string{pxh[0], pxh[1], port("member", npaxos)}
+	if pxa[0].Start(delay, Membership{newh[:2]}) {
+		t.Fatalf("Start() of a Membership of another size accepted")
+	}
+	pxa[0].Start(delay, Membership{newh})
+	for iters := 0; iters < 30; iters++ {
+		if fate, _ := pxa[1].Status(delay); fate == Decided {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	from := delay + delay
+	for i := 0; i < 2; i++ {
+		if fate, _ := pxa[i].Status(delay); fate != Decided {
+			t.Fatalf("Membership not decided on peer %d", i)
+		}
+		if p := pxa[i].Peers(from - 1); p[2] != pxh[2] {
+			t.Fatalf("peer %d has %v for the last instance before the change", i, p)
+		}
+		if p := pxa[i].Peers(from); p[2] != newh[2] {
+			t.Fatalf("peer %d has %v for the first instance after the change", i, p)
+		}
+	}
+	pxa[2] = Make(newh, 2, nil)
+	pxa[2].SetReconfigDelay(delay)
+	pxa[2].JoinAt(from)
+
+	for seq := delay + 1; seq < from; seq++ {
+		pxa[0].Start(seq, seq)
+		waitn(t, pxa, seq, 2)
+	}
+	if ndecided(t, pxa[2:], from-1) != 0 {
+		t.Fatalf("new peer took part before its membership")
+	}
+	for seq := from; seq < from+5; seq++ {
+		pxa[0].Start(seq, seq)
+		waitn(t, pxa, seq, npaxos)
+	}
+
+	// the new peer makes a majority with peer 0
+	pxa[1].Kill()
+	for seq := from + 5; seq < from+10; seq++ {
+		pxa[0].Start(seq, seq)
+		waitn(t, pxa, seq, 2)
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestDonePiggyback(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	tag := "piggyback"
+	const npaxos = 3
+	var pxa []*Paxos = make([]*Paxos, npaxos)
+	defer cleanup(pxa)
+	defer cleanpp(tag, npaxos)
+
+	for i := 0; i < npaxos; i++ {
+		var pxh []string = make([]string, npaxos)
+		for j := 0; j < npaxos; j++ {
+			if j == i {
+				pxh[j] = port(tag, i)
+			} else {
+				pxh[j] = pp(tag, i, j)
+			}
+		}
+		pxa[i] = Make(pxh, i, nil)
+	}
+	defer part(t, tag, npaxos, []int{}, []int{}, []int{})
+
+	fmt.Printf("Test: Done() piggybacked on Prepare and Accept ...\n")
+
+	// peer 0 proposes everything, with a hiccup cutting off
+	// peer 2 halfway; peer 2 catches up after by proposing.
+	part(t, tag, npaxos, []int{0, 1, 2}, []int{}, []int{})
+	for seq := 0; seq < 10; seq++ {
+		pxa[0].Start(seq, randstring(10000))
+		waitn(t, pxa, seq, npaxos)
+	}
+	part(t, tag, npaxos, []int{0, 1}, []int{2}, []int{})
+	for seq := 10; seq < 20; seq++ {
+		pxa[0].Start(seq, randstring(10000))
+		waitmajority(t, pxa, seq)
+	}
+	part(t, tag, npaxos, []int{0, 1, 2}, []int{}, []int{})
+	for seq := 10; seq < 20; seq++ {
+		pxa[2].Start(seq, "catch up")
+		waitn(t, pxa, seq, npaxos)
+	}
+
+	// peer 1 never proposes: peer 0 can only hear of its
+	// Done() in replies
+	for i := 0; i < npaxos; i++ {
+		pxa[i].Done(19)
+	}
+	pxa[0].Start(20, "x")
+	waitn(t, pxa, 20, npaxos)
+
+	for iters := 0; ; iters++ {
+		pxa[0].mu.Lock()
+		nvalues := len(pxa[0].values)
+		pxa[0].mu.Unlock()
+		min := pxa[0].Min()
+		if min == 20 && nvalues == 1 {
+			break
+		}
+		if iters == 10 {
+			t.Fatalf("peer 0 at Min() %d holding %d values; wanted 20 and 1", min, nvalues)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if fate, _ := pxa[0].Status(15); fate != Forgotten {
+		t.Fatalf("instance 15 not forgotten")
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestPersistBuffers(t *testing.T) {
+	dir := "/var/tmp/824-" + strconv.Itoa(os.Getuid()) + "/px-buffers-" + strconv.Itoa(os.Getpid())
+	os.RemoveAll(dir)
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fmt.Printf("Test: Reused encoding buffers start empty ...\n")
+
+	// a short state saved after a long one must hold
+	// nothing of the long one
+	long := savedState{PrepProposal: 1, AccpProposal: 1, AccpValue: randstring(4096)}
+	short := savedState{PrepProposal: 2, AccpProposal: 2, AccpValue: "x"}
+	for i := 0; i < 10; i++ {
+		if err := writeDurably(dir + "/long", &long); err != nil {
+			t.Fatal(err)
+		}
+		if err := writeDurably(dir + "/short", &short); err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadFile(dir + "/short")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(data) > 1024 {
+			t.Fatalf("short state saved as %d bytes", len(data))
+		}
+		var saved savedState
+		if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&saved); err != nil {
+			t.Fatal(err)
+		}
+		if saved != short {
+			t.Fatalf("saved %v, wanted %v", saved, short)
+		}
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
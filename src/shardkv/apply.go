@@ -0,0 +1,926 @@
+package shardkv
+
+import "shardmaster"
+import "strconv"
+import "sort"
+import "crypto/sha256"
+import "encoding/hex"
+
+//
+// the deterministic state machine replicated by the servers
+// of a group. it depends on nothing but the ops applied to
+// it, so every replica (and every version of this code)
+// applying the same log ends up in the same state.
+//
+type applier struct {
+	gid     int64 // my replica group ID
+	me      int   // for debugging only
+
+	config  shardmaster.Config
+	xstate  XState
+
+	// applied[shard] is the seq of the last op applied to shard
+	applied [shardmaster.NShards]int
+
+	funcs   map[string]TransformFunc // for Apply ops
+
+	// shards being handed over to another group by the next
+	// config, which no longer take client ops
+	frozen  map[int]bool
+
+	// the latest Op.Time applied: the log's clock, in ms
+	clock   int64
+
+	maxClients int // Options.MaxClients
+	maxValue   int // Options.MaxValueBytes
+
+	lease       leaseState // see lease.go
+	leaseMillis int64      // Options.LeaseDuration, in ms
+
+	sizes [shardmaster.NShards]shardSize // see shardstats.go
+
+	// what the last RepairSharding op found; see
+	// ShardKV.RepairSharding()
+	orphans map[string]int64
+
+	log Logger // Options.Logger; see logger.go
+}
+
+func (ap *applier) init(gid int64, me int) {
+	ap.gid = gid
+	ap.me = me
+	ap.xstate.Init()
+	ap.frozen = map[int]bool{}
+	ap.log = nopLogger{}
+}
+
+//
+// apply a recorded log to an empty state the way a server
+// of group gid does, and return the resulting state. lets
+// two versions of the apply logic be compared on one log.
+// funcs are the servers' Options.Funcs, for Apply ops.
+//
+func ApplyLog(gid int64, ops []Op, funcs map[string]TransformFunc) *XState {
+	var ap applier
+	ap.init(gid, -1)
+	ap.funcs = funcs
+	for seq := range ops {
+		batch := ops[seq].unbatch()
+		for i := range batch {
+			ap.apply(seq, &batch[i])
+		}
+	}
+	return &ap.xstate
+}
+
+//
+// apply the op decided at seq, returning the reply for
+// client ops (nil for Reconf).
+//
+func (ap *applier) apply(seq int, op *Op) (rep *Rep) {
+	if op.Time > ap.clock {
+		ap.clock = op.Time
+	}
+
+	if op.CID != "" && op.Op != Get && op.Seq <= ap.xstate.MRRSMap[op.CID] {
+		// a client op decided again, as when a retry was
+		// proposed by another server before the first was
+		// applied: answer it as the duplicate it is. one the
+		// client sent before its most recent, and decided
+		// after it, is applied now.
+		if r, dup := ap.filterDuplicate(op); dup {
+			return r
+		}
+	}
+	if ap.fenced(op) {
+		ap.logEvent(LevelDebug, "op fenced", Field{"seq", seq}, Field{"op", op.Op},
+			Field{"client", op.CID}, Field{"holder", ap.lease.Holder})
+		return &Rep{Err:ErrNotLeader}
+	}
+
+	switch op.Op {
+	case Get, Put, PutIfAbsent, CAS, Append, AppendBounded, Delete, Incr, Apply:
+		ap.expire(seq, op.Key)
+	}
+
+	switch op.Op {
+	case Reconf:
+		extra := op.Extra.(ReconfExtra)
+		if extra.Config.Num <= ap.config.Num {
+			// logged again, by a replica that had not applied
+			// the first one yet: its state was taken in then,
+			// and merging it again would undo later writes
+			ap.logEvent(LevelWarn, "reconf skipped", Field{"seq", seq},
+				Field{"config", extra.Config.Num}, Field{"at", ap.config.Num})
+			break
+		}
+		gained, lost := []int{}, []int{}
+		for shard, gid := range extra.Config.Shards {
+			if gid == ap.gid && ap.config.Shards[shard] != ap.gid {
+				ap.applied[shard] = seq
+				gained = append(gained, shard)
+			} else if gid != ap.gid && ap.config.Shards[shard] == ap.gid {
+				lost = append(lost, shard)
+			}
+		}
+		for shard, gid := range extra.Config.Shards {
+			if gid == ap.gid && ap.config.Shards[shard] != ap.gid {
+				// what is left of the shard from when this
+				// group last served it is stale: keys since
+				// deleted must not come back
+				ap.dropShard(shard)
+			}
+		}
+		ap.config = extra.Config
+		ap.frozen = map[int]bool{}
+		ap.xstate.Update(&extra.XState)
+		ap.rebaseTTLs(seq, &extra.XState)
+		ap.adoptClients(seq, &extra.XState)
+		for _, shard := range gained {
+			ap.recount(shard)
+		}
+		ap.logEvent(LevelInfo, "reconfigured", Field{"seq", seq}, Field{"config", ap.config.Num},
+			Field{"gained", gained}, Field{"lost", lost})
+	case Put, PutIfAbsent, CAS, Append, AppendBounded:
+		if op.Deadline > 0 && seq > op.Deadline {
+			// decided too late: the log seq is the clock, so
+			// every replica skips it alike
+			rep = &Rep{Err:ErrExpired}
+			ap.recordOperation(op.CID, op.Seq, -1, rep)
+			ap.noteShards(op.CID, op.Seq, key2shard(op.Key))
+			break
+		}
+		rep = ap.doPutAppend(op)
+		if rep.Err == OK && (op.TTL > 0 || op.TTLMillis > 0) {
+			ap.clearTTL(op.Key)
+			if op.TTL > 0 {
+				ap.xstate.Expires[op.Key] = seq + op.TTL
+			}
+			if op.TTLMillis > 0 {
+				ap.xstate.Deadlines[op.Key] = ap.clock + int64(op.TTLMillis)
+			}
+		} else if rep.Err == OK && op.Op != Append && op.Op != AppendBounded {
+			ap.clearTTL(op.Key)
+		}
+		ap.recordOperation(op.CID, op.Seq, key2shard(op.Key), rep)
+		ap.markApplied(seq, rep, op.Key)
+	case PutBatch:
+		kvs := op.Extra.(PutBatchArgs).KVs
+		for _, kv := range kvs {
+			ap.expire(seq, kv.Key)
+		}
+		rep = ap.doPutBatch(kvs)
+		shard := -1
+		for i, kv := range kvs {
+			if i == 0 {
+				shard = key2shard(kv.Key)
+			} else if key2shard(kv.Key) != shard {
+				shard = -1
+				break
+			}
+		}
+		ap.recordOperation(op.CID, op.Seq, shard, rep)
+		for _, kv := range kvs {
+			ap.noteShards(op.CID, op.Seq, key2shard(kv.Key))
+			ap.markApplied(seq, rep, kv.Key)
+		}
+	case CondTxn:
+		args := op.Extra.(CondTxnArgs)
+		keys := args.keys()
+		for _, key := range keys {
+			ap.expire(seq, key)
+		}
+		rep = ap.doCondTxn(&args)
+		ap.recordOperation(op.CID, op.Seq, args.shard(), rep)
+		ap.markApplied(seq, rep, keys[0])
+	case Delete:
+		rep = ap.doDelete(op.Key)
+		ap.recordOperation(op.CID, op.Seq, key2shard(op.Key), rep)
+		ap.markApplied(seq, rep, op.Key)
+	case Incr:
+		rep = ap.doIncr(op.Key, op.Extra.(int64))
+		ap.recordOperation(op.CID, op.Seq, key2shard(op.Key), rep)
+		ap.markApplied(seq, rep, op.Key)
+	case Apply:
+		rep = ap.doApply(op.Key, op.Extra.(string), op.Value)
+		ap.recordOperation(op.CID, op.Seq, key2shard(op.Key), rep)
+		ap.markApplied(seq, rep, op.Key)
+	case Prepare, Commit, Abort, Decide:
+		args := op.Extra.(TxnArgs)
+		rep = ap.doTxn(op.Op, &args)
+		ap.recordOperation(op.CID, op.Seq, -1, rep)
+		if op.Op == Decide {
+			ap.noteShards(op.CID, op.Seq, key2shard(args.Coord))
+			ap.markApplied(seq, rep, args.Coord)
+		}
+		for key := range args.Writes {
+			ap.noteShards(op.CID, op.Seq, key2shard(key))
+			ap.markApplied(seq, rep, key)
+		}
+	case ClearShard:
+		shard := op.Extra.(int)
+		rep = ap.doClearShard(shard)
+		ap.recordOperation(op.CID, op.Seq, -1, rep)
+		ap.noteShards(op.CID, op.Seq, shard)
+		if rep.Err == OK {
+			ap.applied[shard] = seq
+		}
+	case Import:
+		xs := op.Extra.(XState)
+		rep = ap.doImport(seq, &xs)
+		ap.recordOperation(op.CID, op.Seq, -1, rep)
+	case Freeze:
+		extra := op.Extra.(FreezeExtra)
+		if extra.ConfigNum == ap.config.Num {
+			ap.frozen[extra.Shard] = true
+		}
+	case Mirror:
+		rep = ap.doMirror(op.Key, op.Extra.(int64))
+		ap.recordOperation(op.CID, op.Seq, key2shard(op.Key), rep)
+		ap.markApplied(seq, rep, op.Key)
+	case MirrorWrite:
+		c := op.Extra.(MirrorCopy)
+		if newerCopy(c, ap.xstate.Copies[op.Key]) {
+			ap.xstate.Copies[op.Key] = c
+		}
+	case Noop:
+	case FetchClaim:
+		// a hint to the servers; see claimFetch()
+	case Lease:
+		ap.lease = leaseState{op.Proposer, op.Time + ap.leaseMillis}
+	case SweepExpired:
+		for key := range ap.xstate.Expires {
+			ap.expire(seq, key)
+		}
+		for key := range ap.xstate.Deadlines {
+			ap.expire(seq, key)
+		}
+	case RepairSharding:
+		ap.orphans = ap.findOrphans()
+		if len(ap.orphans) > 0 {
+			ap.logEvent(LevelWarn, "orphaned keys", Field{"seq", seq}, Field{"keys", len(ap.orphans)})
+		}
+	case RebuildDedup:
+		ap.xstate.Replies = map[string]Rep{}
+		for cid := range ap.xstate.Recent {
+			ap.dropRecent(cid)
+		}
+		ap.logEvent(LevelInfo, "replies dropped", Field{"seq", seq})
+	case ClientDone:
+		ap.forgetClient(op.Extra.(string))
+	default:
+		rep = withDefault(ap.doGet(op.Key), op)
+		ap.recordOperation(op.CID, op.Seq, key2shard(op.Key), rep)
+		ap.markApplied(seq, rep, op.Key)
+	}
+	ap.touchClient(seq, op)
+	return
+}
+
+//
+// drop the replies among cid's Recent ones, keeping their
+// seqs, so that retries of those ops are still known to be
+// applied. the slice is made anew, as a transfer may share
+// the old one.
+//
+func (ap *applier) dropRecent(cid string) {
+	old := ap.xstate.Recent[cid]
+	if len(old) == 0 {
+		return
+	}
+	recent := make([]SeqRep, len(old))
+	for i, sr := range old {
+		recent[i] = SeqRep{Seq:sr.Seq, Dropped:true}
+	}
+	ap.xstate.Recent[cid] = recent
+}
+
+// note that the op at seq was applied to key's shard
+func (ap *applier) markApplied(seq int, reply *Rep, key string) {
+	if reply.Err != ErrWrongGroup && reply.Err != ErrLocked {
+		ap.applied[key2shard(key)] = seq
+	}
+}
+
+//
+// shard is the shard the op touched, or -1 if it touched
+// none or several.
+//
+func (ap *applier) recordOperation(cid string, seq int, shard int, reply *Rep) {
+	// we do not update the client state when ErrWrongGroup or
+	// ErrLocked occurs, nor for ops logged by servers (no cid)
+	if cid != "" && reply.Err != ErrWrongGroup && reply.Err != ErrLocked {
+		if ap.xstate.MRRSMap[cid] > seq {
+			// sent before the client's most recent op, and
+			// decided after it
+			ap.xstate.keepRecent(cid, SeqRep{Seq:seq, Rep:*reply})
+			return
+		}
+		if ap.xstate.MRRSMap[cid] < seq {
+			ap.xstate.retire(cid)
+		}
+		ap.xstate.MRRSMap[cid] = seq
+		ap.xstate.Replies[cid] = *reply
+		ap.xstate.LastShard[cid] = shard
+		if shard >= 0 {
+			ap.xstate.noteShardSeq(shard, cid, seq)
+		}
+	}
+}
+
+//
+// note an op recorded with shard -1 as its client's most
+// recent on each of the shards it touched.
+//
+func (ap *applier) noteShards(cid string, seq int, shards ...int) {
+	if cid == "" || ap.xstate.MRRSMap[cid] != seq {
+		return
+	}
+	for _, shard := range shards {
+		ap.xstate.noteShardSeq(shard, cid, seq)
+	}
+}
+
+func (ap *applier) filterDuplicate(xop *Op) (*Rep, bool) {
+	last_seq := ap.xstate.MRRSMap[xop.CID]
+	if xop.Seq < last_seq { 
+		// one of the client's recent ops, one it sent before
+		// its most recent that is not applied yet, or one so
+		// old its reply is gone
+		for _, sr := range ap.xstate.Recent[xop.CID] {
+			if sr.Seq == xop.Seq && sr.Dropped {
+				return ap.droppedReply(xop)
+			}
+			if sr.Seq == xop.Seq {
+				rep := sr.Rep
+				return &rep, true
+			}
+		}
+		if last_seq - xop.Seq < ReplyHistory {
+			return nil, false
+		}
+		return nil, true 
+	} else if xop.Seq == last_seq {
+		rep, ok := ap.xstate.Replies[xop.CID]
+		if !ok {
+			return ap.droppedReply(xop)
+		}
+		return &rep, true
+	} 
+	return nil, false
+}
+
+//
+// answer a retry of a client's most recent op, or one of
+// its Recent ones, whose reply RebuildDedup or ClearShard
+// dropped. the op was applied, so it must not
+// be applied again: writes are answered OK, except that
+// Apply and Incr return the key's value at the time of the retry
+// (which may include later writes, or lag behind them on a
+// replica that has not caught up). reads, and Decide, which
+// only ever records the first outcome proposed, are logged
+// again (returns false) and so answered as of the retry.
+// a PutIfAbsent or CAS is answered OK if the key still holds
+// its value, which may be wrong if another client later wrote
+// the same value.
+//
+func (ap *applier) droppedReply(xop *Op) (*Rep, bool) {
+	switch xop.Op {
+	case Get, Decide:
+		return nil, false
+	case Apply, Incr:
+		return &Rep{Err:OK, Value:ap.xstate.KVStore[xop.Key]}, true
+	case ClearShard:
+		return &Rep{Err:OK, Value:"0"}, true
+	case PutIfAbsent:
+		if value, ok := ap.xstate.KVStore[xop.Key]; !ok || value != xop.Value {
+			return &Rep{Err:ErrKeyExists}, true
+		}
+	case CAS:
+		if value := ap.xstate.KVStore[xop.Key]; value != xop.Value {
+			return &Rep{Err:ErrMismatch, Value:value}, true
+		}
+	case CondTxn:
+		for _, kv := range xop.Extra.(CondTxnArgs).Writes {
+			if ap.xstate.KVStore[kv.Key] != kv.Value {
+				return &Rep{Err:ErrMismatch}, true
+			}
+		}
+	}
+	return &Rep{Err:OK}, true
+}
+
+func (ap *applier) doGet(key string) (*Rep) {
+	var rep Rep
+	if !ap.owns(key2shard(key)) {
+		ap.wrongGroup(Get, key)
+		rep.Err = ErrWrongGroup
+	} else if ap.isLocked(key) {
+		rep.Err = ErrLocked
+	} else {
+		value, ok := ap.xstate.KVStore[key]
+		ap.logEvent(LevelDebug, "applied", Field{"op", Get}, Field{"key", key})
+		rep.Version = ap.xstate.Versions[key]
+		if ok {
+			rep.Err, rep.Value = OK, value
+		} else {
+			rep.Err = ErrNoKey
+		}
+	}
+	return &rep
+}
+
+// turn an ErrNoKey reply to Get op into OK with its default, if any
+func withDefault(rep *Rep, op *Op) *Rep {
+	if rep.Err == ErrNoKey && op.HasDefault {
+		rep.Err, rep.Value = OK, op.Default
+	}
+	return rep
+}
+
+//
+// if xop.CheckVersion, the write is only done if the key's
+// version is xop.Version. a CAS that finds another value than
+// xop.Expected returns ErrMismatch with the value it found.
+// an AppendBounded keeps only the last xop.MaxLen bytes of
+// the appended value.
+//
+func (ap *applier) doPutAppend(xop *Op) (*Rep) {
+	var rep Rep
+	op, key, value := xop.Op, xop.Key, xop.Value
+	if !ap.owns(key2shard(key)) {
+		ap.wrongGroup(op, key)
+		rep.Err = ErrWrongGroup
+	} else if ap.isLocked(key) {
+		rep.Err = ErrLocked
+	} else if xop.CheckVersion && xop.Version != ap.xstate.Versions[key] {
+		rep.Err = ErrVersion
+	} else if _, ok := ap.xstate.KVStore[key]; ok && op == PutIfAbsent {
+		rep.Err = ErrKeyExists
+	} else if op == CAS && ap.xstate.KVStore[key] != xop.Expected {
+		rep.Err, rep.Value = ErrMismatch, ap.xstate.KVStore[key]
+	} else if ap.tooLarge(len(value)) ||
+		(op == Append && ap.tooLarge(len(ap.xstate.KVStore[key]) + len(value))) ||
+		(op == AppendBounded && ap.tooLarge(len(bounded(ap.xstate.KVStore[key] + value, xop.MaxLen)))) {
+		rep.Err = ErrValueTooLarge
+	} else {
+		value1 := ap.xstate.KVStore[key]
+		if op == Put || op == PutIfAbsent || op == CAS {
+			ap.setKey(key, value)
+		} else if op == Append {
+			ap.setKey(key, value1 + value)
+		} else if op == AppendBounded {
+			ap.setKey(key, bounded(value1 + value, xop.MaxLen))
+		}
+		ap.logEvent(LevelDebug, "applied", Field{"op", op}, Field{"key", key},
+			Field{"client", xop.CID}, Field{"client_seq", xop.Seq})
+		rep.Err = OK
+	}
+	return &rep
+}
+
+// the last max bytes of value, or all of it if max <= 0
+func bounded(value string, max int) string {
+	if max > 0 && len(value) > max {
+		return value[len(value) - max:]
+	}
+	return value
+}
+
+//
+// would a value of n bytes be past Options.MaxValueBytes?
+// checked as ops are applied, so that every replica refuses
+// the same writes.
+//
+func (ap *applier) tooLarge(n int) bool {
+	return ap.maxValue > 0 && n > ap.maxValue
+}
+
+//
+// Put each of kvs, or none of them if any key is not served
+// by this group, is locked, or would get too large a value.
+//
+func (ap *applier) doPutBatch(kvs []KeyValue) (*Rep) {
+	for _, kv := range kvs {
+		if !ap.owns(key2shard(kv.Key)) {
+			ap.wrongGroup(PutBatch, kv.Key)
+			return &Rep{Err:ErrWrongGroup}
+		}
+		if ap.isLocked(kv.Key) {
+			return &Rep{Err:ErrLocked}
+		}
+		if ap.tooLarge(len(kv.Value)) {
+			return &Rep{Err:ErrValueTooLarge}
+		}
+	}
+	for _, kv := range kvs {
+		ap.doPutAppend(&Op{Op:Put, Key:kv.Key, Value:kv.Value})
+		ap.clearTTL(kv.Key)
+	}
+	return &Rep{Err:OK}
+}
+
+func (ap *applier) doCondTxn(args *CondTxnArgs) (*Rep) {
+	keys := args.keys()
+	if args.shard() < 0 || !ap.owns(key2shard(keys[0])) {
+		ap.wrongGroup(CondTxn, keys[0])
+		return &Rep{Err:ErrWrongGroup}
+	}
+	for _, key := range keys {
+		if ap.isLocked(key) {
+			return &Rep{Err:ErrLocked}
+		}
+	}
+	for _, kv := range args.Writes {
+		if ap.tooLarge(len(kv.Value)) {
+			return &Rep{Err:ErrValueTooLarge}
+		}
+	}
+	for _, kv := range args.Reads {
+		if ap.xstate.KVStore[kv.Key] != kv.Value {
+			return &Rep{Err:ErrMismatch}
+		}
+	}
+	for _, kv := range args.Writes {
+		ap.doPutAppend(&Op{Op:Put, Key:kv.Key, Value:kv.Value})
+		ap.clearTTL(kv.Key)
+	}
+	ap.logEvent(LevelDebug, "applied", Field{"op", CondTxn}, Field{"keys", len(keys)})
+	return &Rep{Err:OK}
+}
+
+func (ap *applier) doDelete(key string) (*Rep) {
+	var rep Rep
+	if !ap.owns(key2shard(key)) {
+		ap.wrongGroup(Delete, key)
+		rep.Err = ErrWrongGroup
+	} else if ap.isLocked(key) {
+		rep.Err = ErrLocked
+	} else if _, ok := ap.xstate.KVStore[key]; !ok {
+		rep.Err = ErrNoKey
+	} else {
+		ap.logEvent(LevelDebug, "applied", Field{"op", Delete}, Field{"key", key})
+		ap.deleteKey(key)
+		ap.clearTTL(key)
+		rep.Err = OK
+	}
+	return &rep
+}
+
+func (ap *applier) doIncr(key string, delta int64) (*Rep) {
+	var rep Rep
+	value, ok := ap.xstate.KVStore[key]
+	n, err := int64(0), error(nil)
+	if ok {
+		n, err = strconv.ParseInt(value, 10, 64)
+	}
+	if !ap.owns(key2shard(key)) {
+		ap.wrongGroup(Incr, key)
+		rep.Err = ErrWrongGroup
+	} else if ap.isLocked(key) {
+		rep.Err = ErrLocked
+	} else if err != nil {
+		rep.Err = ErrNotNumber
+	} else {
+		value = strconv.FormatInt(n + delta, 10)
+		ap.logEvent(LevelDebug, "applied", Field{"op", Incr}, Field{"key", key}, Field{"delta", delta})
+		ap.setKey(key, value)
+		rep.Err, rep.Value = OK, value
+	}
+	return &rep
+}
+
+func (ap *applier) doApply(key string, fn string, arg string) (*Rep) {
+	var rep Rep
+	f, ok := ap.funcs[fn]
+	if !ap.owns(key2shard(key)) {
+		ap.wrongGroup(Apply, key)
+		rep.Err = ErrWrongGroup
+	} else if ap.isLocked(key) {
+		rep.Err = ErrLocked
+	} else if !ok {
+		rep.Err = ErrUnknownFunc
+	} else if value := f(ap.xstate.KVStore[key], arg); ap.tooLarge(len(value)) {
+		rep.Err = ErrValueTooLarge
+	} else {
+		ap.logEvent(LevelDebug, "applied", Field{"op", Apply}, Field{"key", key}, Field{"func", fn})
+		ap.setKey(key, value)
+		rep.Err, rep.Value = OK, value
+	}
+	return &rep
+}
+
+//
+// drop every key of shard, with the 2PC state and cached
+// client replies belonging to it. the clients' seqs are
+// kept, so retries of their ops are still filtered, and
+// answered by droppedReply().
+//
+func (ap *applier) doClearShard(shard int) (*Rep) {
+	var rep Rep
+	if !ap.owns(shard) {
+		ap.logEvent(LevelInfo, "wrong group", Field{"op", ClearShard}, Field{"shard", shard},
+			Field{"config", ap.config.Num}, Field{"owner", ap.config.Shards[shard]},
+			Field{"frozen", ap.frozen[shard]})
+		rep.Err = ErrWrongGroup
+		return &rep
+	}
+	removed := 0
+	for key := range ap.xstate.KVStore {
+		if key2shard(key) == shard {
+			ap.deleteKey(key)
+			removed++
+		}
+	}
+	for key := range ap.xstate.Expires {
+		if key2shard(key) == shard {
+			delete(ap.xstate.Expires, key)
+		}
+	}
+	for key := range ap.xstate.Deadlines {
+		if key2shard(key) == shard {
+			delete(ap.xstate.Deadlines, key)
+		}
+	}
+	for key := range ap.xstate.Locks {
+		if key2shard(key) == shard {
+			delete(ap.xstate.Locks, key)
+		}
+	}
+	for txn, outcome := range ap.xstate.Outcomes {
+		if key2shard(outcome.Coord) == shard {
+			delete(ap.xstate.Outcomes, txn)
+		}
+	}
+	for cid, xshard := range ap.xstate.LastShard {
+		if xshard == shard {
+			delete(ap.xstate.Replies, cid)
+			ap.dropRecent(cid)
+		}
+	}
+	ap.logEvent(LevelInfo, "shard cleared", Field{"shard", shard}, Field{"keys", removed})
+	rep.Err, rep.Value = OK, strconv.Itoa(removed)
+	return &rep
+}
+
+//
+// forget the keys of shard, and their TTLs and mirrors,
+// before taking in the shard from its last owner.
+//
+func (ap *applier) dropShard(shard int) {
+	for key := range ap.xstate.KVStore {
+		if key2shard(key) == shard {
+			delete(ap.xstate.KVStore, key)
+		}
+	}
+	ap.sizes[shard] = shardSize{}
+	for key := range ap.xstate.Expires {
+		if key2shard(key) == shard {
+			delete(ap.xstate.Expires, key)
+		}
+	}
+	for key := range ap.xstate.Deadlines {
+		if key2shard(key) == shard {
+			delete(ap.xstate.Deadlines, key)
+		}
+	}
+	for key := range ap.xstate.Mirrors {
+		if key2shard(key) == shard {
+			delete(ap.xstate.Mirrors, key)
+		}
+	}
+	for key := range ap.xstate.Unmirrored {
+		if key2shard(key) == shard {
+			delete(ap.xstate.Unmirrored, key)
+		}
+	}
+	for key := range ap.xstate.MirrorEpochs {
+		if key2shard(key) == shard {
+			delete(ap.xstate.MirrorEpochs, key)
+		}
+	}
+}
+
+//
+// the keys the group holds in shards it doesn't serve, by
+// key2shard(), and the group serving each one's shard.
+//
+func (ap *applier) findOrphans() map[string]int64 {
+	orphans := map[string]int64{}
+	for key := range ap.xstate.KVStore {
+		if gid := ap.config.Shards[key2shard(key)]; gid != ap.gid {
+			orphans[key] = gid
+		}
+	}
+	return orphans
+}
+
+// mirror key onto group gid, or stop mirroring it if gid is 0
+func (ap *applier) doMirror(key string, gid int64) (*Rep) {
+	var rep Rep
+	if !ap.owns(key2shard(key)) {
+		ap.wrongGroup(Mirror, key)
+		rep.Err = ErrWrongGroup
+	} else {
+		// the slices are made anew, as a transfer may share
+		// the old ones
+		gids := []int64{}
+		for _, gid1 := range ap.xstate.Unmirrored[key] {
+			if gid1 != gid {
+				gids = append(gids, gid1)
+			}
+		}
+		if old, ok := ap.xstate.Mirrors[key]; ok && old != gid {
+			gids = append(gids, old)
+		}
+		if len(gids) == 0 {
+			delete(ap.xstate.Unmirrored, key)
+		} else {
+			ap.xstate.Unmirrored[key] = gids
+		}
+		if gid == 0 {
+			delete(ap.xstate.Mirrors, key)
+		} else {
+			ap.xstate.Mirrors[key] = gid
+		}
+		ap.xstate.MirrorEpochs[key]++
+		rep.Err = OK
+	}
+	return &rep
+}
+
+//
+// every change to a key's value goes through setKey() or
+// deleteKey(), which bump its version. versions outlive
+// deleted keys, so a key's version never repeats.
+//
+func (ap *applier) setKey(key string, value string) {
+	if old, ok := ap.xstate.KVStore[key]; ok {
+		ap.countKey(key, old, -1)
+	}
+	ap.countKey(key, value, 1)
+	ap.xstate.KVStore[key] = value
+	ap.xstate.Versions[key]++
+}
+
+func (ap *applier) deleteKey(key string) {
+	if old, ok := ap.xstate.KVStore[key]; ok {
+		ap.countKey(key, old, -1)
+		delete(ap.xstate.KVStore, key)
+		ap.xstate.Versions[key]++
+	}
+}
+
+// drop key if its TTL ran out before seq
+func (ap *applier) expire(seq int, key string) {
+	if ap.expired(seq, key) {
+		ap.logEvent(LevelDebug, "key expired", Field{"seq", seq}, Field{"key", key})
+		ap.deleteKey(key)
+		ap.clearTTL(key)
+	}
+}
+
+//
+// has key's TTL run out before seq? a TTL in milliseconds
+// is measured on the log's clock (see Op.Time), so this too
+// depends only on the log.
+//
+func (ap *applier) expired(seq int, key string) bool {
+	if last, ok := ap.xstate.Expires[key]; ok && seq > last {
+		return true
+	}
+	if deadline, ok := ap.xstate.Deadlines[key]; ok && ap.clock > deadline {
+		return true
+	}
+	return false
+}
+
+func (ap *applier) clearTTL(key string) {
+	delete(ap.xstate.Expires, key)
+	delete(ap.xstate.Deadlines, key)
+}
+
+//
+// TTLs another group's state brought in count from seq:
+// shardState() sends the seqs each key has left, since seqs
+// in that group's log mean nothing in this one.
+//
+func (ap *applier) rebaseTTLs(seq int, other *XState) {
+	for key, left := range other.Expires {
+		ap.xstate.Expires[key] = seq + left
+	}
+}
+
+// does this group serve shard?
+func (ap *applier) owns(shard int) bool {
+	return ap.config.Shards[shard] == ap.gid && !ap.frozen[shard]
+}
+
+func (ap *applier) isLocked(key string) bool {
+	_, locked := ap.xstate.Locks[key]
+	return locked
+}
+
+//
+// apply a two-phase commit op. all keys in args.Writes
+// (or args.Coord, for Decide) must be owned by this group.
+//
+func (ap *applier) doTxn(op string, args *TxnArgs) (*Rep) {
+	var rep Rep
+	keys := args.Writes
+	if op == Decide {
+		keys = map[string]string{args.Coord: ""}
+	}
+	for key := range keys {
+		if !ap.owns(key2shard(key)) {
+			ap.wrongGroup(op, key)
+			rep.Err = ErrWrongGroup
+			return &rep
+		}
+	}
+
+	switch op {
+	case Prepare:
+		for key := range keys {
+			lock, locked := ap.xstate.Locks[key]
+			if locked && lock.Txn != args.TxnID {
+				rep.Err = ErrLocked
+				return &rep
+			}
+		}
+		for key, value := range keys {
+			ap.xstate.Locks[key] = TxnLock{args.TxnID, args.Coord, value}
+		}
+	case Commit, Abort:
+		for key := range keys {
+			lock, locked := ap.xstate.Locks[key]
+			if locked && lock.Txn == args.TxnID {
+				if op == Commit {
+					ap.setKey(key, lock.Value)
+					ap.clearTTL(key)
+				}
+				delete(ap.xstate.Locks, key)
+			}
+		}
+	case Decide:
+		// the first outcome proposed for a transaction wins
+		outcome, ok := ap.xstate.Outcomes[args.TxnID]
+		if !ok {
+			outcome = TxnOutcome{args.Coord, args.Commit}
+			ap.xstate.Outcomes[args.TxnID] = outcome
+		}
+		if outcome.Commit {
+			rep.Value = Commit
+		} else {
+			rep.Value = Abort
+		}
+	}
+	ap.logEvent(LevelDebug, "applied", Field{"op", op}, Field{"txn", args.TxnID},
+		Field{"keys", len(keys)})
+	rep.Err = OK
+	return &rep
+}
+
+//
+// a hash of the keys and values of shard in kvstore, the
+// same on any server holding the same shard contents.
+//
+func shardDigest(kvstore map[string]string, shard int) string {
+	keys := []string{}
+	for key := range kvstore {
+		if key2shard(key) == shard {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	h := sha256.New()
+	for _, key := range keys {
+		value := kvstore[key]
+		h.Write([]byte(strconv.Itoa(len(key)) + ":" + key))
+		h.Write([]byte(strconv.Itoa(len(value)) + ":" + value))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+//
+// a hash of the whole state: config, every shard's contents
+// and the clients' most recent request seqs. replicas that
+// applied the same log prefix have the same one.
+//
+func (ap *applier) stateDigest() string {
+	h := sha256.New()
+	h.Write([]byte(strconv.Itoa(ap.config.Num) + ";"))
+	for shard := 0; shard < shardmaster.NShards; shard++ {
+		h.Write([]byte(shardDigest(ap.xstate.KVStore, shard) + ";"))
+	}
+	cids := []string{}
+	for cid := range ap.xstate.MRRSMap {
+		cids = append(cids, cid)
+	}
+	sort.Strings(cids)
+	for _, cid := range cids {
+		h.Write([]byte(cid + ":" + strconv.Itoa(ap.xstate.MRRSMap[cid]) + ";"))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
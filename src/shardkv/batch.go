@@ -0,0 +1,101 @@
+package shardkv
+
+import "context"
+import "time"
+
+//
+// batching client ops, for servers started with a
+// BatchWindow. rather than log each op in a slot of its
+// own, handlers proposing at about the same time share one:
+// the first waits BatchWindow for others to join it, then
+// logs all their ops as one Batch op, which catchUp()
+// applies op by op, as if each had a slot of its own.
+//
+// the ops keep their CIDs and Seqs inside a batch, so the
+// duplicate filter sees each as usual, and a retry logged
+// in another slot or batch is answered as a duplicate. a
+// client has one request outstanding at a time, so its ops
+// are in the log in the order it sent them.
+//
+
+// Op.Extra of a Batch op
+type BatchExtra struct {
+	Ops []Op
+}
+
+// ops gathered for one Batch op. under kv.mu
+type opBatch struct {
+	ops    []Op
+	logged bool // decided in the log
+	over   bool // no longer proposed
+}
+
+//
+// the ops op stands for: a Batch's, or op itself. the ops
+// are copies, which may be changed (e.g. by PostDecode)
+// without changing the op paxos holds.
+//
+func (op *Op) unbatch() []Op {
+	return op.appendUnbatched(nil)
+}
+
+// unbatch(), appending the ops to ops rather than a new slice
+func (op *Op) appendUnbatched(ops []Op) []Op {
+	if op.Op == Batch {
+		return append(ops, op.Extra.(BatchExtra).Ops...)
+	}
+	return append(ops, *op)
+}
+
+//
+// one round of propose() for a server with a BatchWindow:
+// add xop to the batch being gathered, or start one and log
+// it, and wait until r is answered if the batch is logged.
+// returns OK with r unanswered if the batch could not be
+// logged, for propose() to try again. kv.mu must be held.
+//
+func (kv *ShardKV) proposeBatched(ctx context.Context, xop *Op, r *opResult) Err {
+	b := kv.gathering
+	lead := b == nil
+	if lead {
+		b = &opBatch{}
+		kv.gathering = b
+	}
+	b.ops = append(b.ops, *xop)
+
+	if lead {
+		kv.mu.Unlock()
+		time.Sleep(kv.batchWindow)
+		kv.mu.Lock()
+		kv.gathering = nil
+
+		kv.batches++
+		bop := &Op{CID:kv.batchCID, Seq:kv.batches, Op:Batch, Extra:BatchExtra{b.ops}}
+		kv.logEvent(LevelDebug, "batch", Field{"batch", kv.batches}, Field{"ops", len(b.ops)})
+		for !b.logged && !kv.halted() {
+			mine, err := kv.proposeInSlot(ctx, bop)
+			if err != OK {
+				// the others retry in batches of their own
+				b.over = true
+				return err
+			}
+			kv.learn()
+			b.logged = mine
+		}
+		b.over = true
+	}
+
+	for !b.over && !kv.halted() {
+		if ctx.Err() != nil {
+			return ErrTimeout
+		}
+		kv.mu.Unlock()
+		time.Sleep(kv.backoff)
+		kv.mu.Lock()
+	}
+	kv.learn()
+	if b.logged {
+		return kv.awaitResult(ctx, r)
+	}
+	return OK
+}
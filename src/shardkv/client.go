@@ -1,21 +1,38 @@
 package shardkv
 
 import "shardmaster"
+import "context"
 import "net/rpc"
 import "time"
 import "sync"
+import "sync/atomic"
 import "crypto/rand"
+import "encoding/hex"
 import "math/big"
+import "sort"
 
 import "strconv"
+import "strings"
 
 type Clerk struct {
 	mu     sync.Mutex // one RPC at a time
 	sm     *shardmaster.Clerk
 	config shardmaster.Config
 	// You'll have to modify Clerk.
-	me     string     // client identifier
+	me     string     // client identifier, unique among all clerks
 	seq    int        // request seq
+	fetched time.Time // when config was last fetched
+	// per group, the PutAppendReply.Seq of this clerk's last
+	// write there: its Gets from the group read at least that
+	// far into the log (GetArgs.MinSeq).
+	written map[int64]int
+	// per group, the server that last answered this clerk,
+	// which get() and putAppend() try first
+	leaders map[int64]string
+	queries int // configs asked of the shardmaster
+	sent    int // requests get() and putAppend() sent
+	backoff    time.Duration // see SetBackoff()
+	maxBackoff time.Duration
 }
 
 func nrand() int64 {
@@ -25,11 +42,34 @@ func nrand() int64 {
 	return x
 }
 
+// a random 128-bit client identifier, in hex
+func newCID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
 func MakeClerk(shardmasters []string) *Clerk {
+	return MakeClerkWithID(shardmasters, newCID())
+}
+
+//
+// like MakeClerk(), but with client identifier cid rather
+// than a random one. servers filter duplicate requests by
+// cid, so it must be unique among all clerks ever made:
+// two clerks sharing one would be handed each other's
+// replies, and as a clerk's request seqs start from 1, one
+// reusing an old clerk's would have requests taken for
+// duplicates.
+//
+func MakeClerkWithID(shardmasters []string, cid string) *Clerk {
 	ck := new(Clerk)
 	ck.sm = shardmaster.MakeClerk(shardmasters)
 	// You'll have to modify MakeClerk.
-	ck.me = strconv.FormatInt(nrand(), 16)
+	ck.me = cid
+	ck.written = map[int64]int{}
+	ck.leaders = map[int64]string{}
+	ck.backoff, ck.maxBackoff = RetryBackoff, RetryMaxBackoff
 	return ck
 }
 
@@ -67,12 +107,111 @@ func call(srv string, rpcname string,
 	return false
 }
 
+//
+// a server address may be socket@tag, for a server that
+// shares a Transport with others; its services are then
+// registered as name@tag. returns the socket to dial and
+// the RPC name to call for rpcname at srv.
+//
+func rpcTarget(srv string, rpcname string) (string, string) {
+	i := strings.LastIndex(srv, "@")
+	if i < 0 {
+		return srv, rpcname
+	}
+	service, method := rpcname, ""
+	if j := strings.Index(rpcname, "."); j >= 0 {
+		service, method = rpcname[:j], rpcname[j:]
+	}
+	return srv[:i], service + srv[i:] + method
+}
+
+// call() for a server address that may carry a tag
+func send(srv string, rpcname string, args interface{}, reply interface{}) bool {
+	sock, name := rpcTarget(srv, rpcname)
+	return call(sock, name, args, reply)
+}
+
+//
+// send(), but returns false as soon as ctx is done. the RPC
+// may still complete after that, so the caller must not
+// touch args or reply again.
+//
+func sendCtx(ctx context.Context, srv string, rpcname string,
+	args interface{}, reply interface{}) bool {
+	done := make(chan bool, 1)
+	go func() {
+		done <- send(srv, rpcname, args, reply)
+	}()
+	select {
+	case ok := <-done:
+		return ok
+	case <-ctx.Done():
+		return false
+	}
+}
+
+//
+// the Timeout to send with a request under ctx: what is
+// left of its deadline, or 0 if it has none.
+//
+func ctxTimeout(ctx context.Context) time.Duration {
+	if deadline, ok := ctx.Deadline(); ok {
+		if left := time.Until(deadline); left > 0 {
+			return left
+		}
+		return time.Nanosecond
+	}
+	return 0
+}
+
+// default backoff of a Clerk's Get and PutAppend retries
+const (
+	RetryBackoff    = 100 * time.Millisecond
+	RetryMaxBackoff = time.Second
+)
+
+//
+// have get() and putAppend() wait base before their first
+// retry, doubling the wait for each further one up to max.
+// each request starts over from base.
+//
+func (ck *Clerk) SetBackoff(base time.Duration, max time.Duration) {
+	ck.mu.Lock()
+	defer ck.mu.Unlock()
+	ck.backoff, ck.maxBackoff = base, max
+}
+
+//
+// wait before retrying, or until ctx is done, and return the
+// wait before the retry after. waits are jittered, between
+// wait/2 and wait, so that clerks turned away together don't
+// all come back at once.
+//
+func (ck *Clerk) retryWait(ctx context.Context, wait time.Duration) time.Duration {
+	jittered := wait/2 + time.Duration(nrand() % (int64(wait/2) + 1))
+	select {
+	case <-time.After(jittered):
+	case <-ctx.Done():
+	}
+	if wait *= 2; wait > ck.maxBackoff {
+		wait = ck.maxBackoff
+	}
+	return wait
+}
+
+// if set, the func(string) int key2shard() defers to. for
+// testing a change of sharding; see RepairSharding().
+var shardFunc atomic.Value
+
 //
 // which shard is a key in?
 // please use this function,
 // and please do not change it.
 //
 func key2shard(key string) int {
+	if f, _ := shardFunc.Load().(func(string) int); f != nil {
+		return f(key)
+	}
 	shard := 0
 	if len(key) > 0 {
 		shard = int(key[0])
@@ -87,69 +226,341 @@ func key2shard(key string) int {
 // keeps trying forever in the face of all other errors.
 //
 func (ck *Clerk) Get(key string) string {
+	value, _ := ck.GetE(key)
+	return value
+}
+
+//
+// like Get(), but also returns the error of a request the
+// servers refused (ErrRejected), or ErrNoKey.
+//
+func (ck *Clerk) GetE(key string) (string, Err) {
+	return ck.GetCtx(context.Background(), key)
+}
+
+//
+// like GetE(), but gives up with ErrTimeout once ctx is done,
+// e.g. when the key's group can't decide the Get in time.
+//
+func (ck *Clerk) GetCtx(ctx context.Context, key string) (string, Err) {
+	reply := ck.get(ctx, &GetArgs{Key:key})
+	return reply.Value, reply.Err
+}
+
+//
+// like Get(), but also returns the key's version, the
+// number of changes to its value so far.
+//
+func (ck *Clerk) GetVersion(key string) (string, int) {
+	reply := ck.get(context.Background(), &GetArgs{Key:key})
+	return reply.Value, reply.Version
+}
+
+//
+// like Get(), but the servers serve the read from their
+// state after logging a no-op shared with other reads
+// arriving at the same time, instead of logging the Get.
+//
+func (ck *Clerk) GetConfirm(key string) string {
+	return ck.get(context.Background(), &GetArgs{Key:key, Consistency:ReadConfirm}).Value
+}
+
+//
+// like Get(), but a missing key reads as def.
+//
+func (ck *Clerk) GetOr(key string, def string) string {
+	return ck.get(context.Background(), &GetArgs{Key:key, UseDefault:true, Default:def}).Value
+}
+
+//
+// like Get(), but may return before the read is logged,
+// with a value read from the applied state of one server of
+// the key's group (see ReadSpeculative). that value may be
+// stale. the returned channel delivers the value of a logged
+// Get; if it differs, the first value is retracted. when no
+// server could answer speculatively, the value returned has
+// already been confirmed, and the channel delivers it again.
+//
+func (ck *Clerk) GetSpeculative(key string) (string, <-chan string) {
+	ck.mu.Lock()
+	config := ck.config
+	gid := config.Shards[key2shard(key)]
+	written := ck.written[gid]
+	ck.mu.Unlock()
+
+	confirmed := make(chan string, 1)
+	go func() {
+		confirmed <- ck.Get(key)
+	}()
+
+	// start at a random server, to spread the load
+	servers := config.Groups[gid]
+	start := int(nrand() % int64(len(servers) + 1))
+	for i := 0; i < len(servers); i++ {
+		srv := servers[(start + i) % len(servers)]
+		args := &GetArgs{Key:key, Consistency:ReadSpeculative, MinSeq:written}
+		var reply GetReply
+		ok := send(srv, "ShardKV.Get", args, &reply)
+		if ok && (reply.Err == OK || reply.Err == ErrNoKey) {
+			return reply.Value, confirmed
+		}
+		if ok && reply.Err == ErrWrongGroup {
+			break
+		}
+	}
+
+	value := <-confirmed
+	confirmed <- value
+	return value, confirmed
+}
+
+//
+// send a Get RPC with args, setting its CID and Seq, until
+// it is answered or ctx is done.
+//
+func (ck *Clerk) get(ctx context.Context, args *GetArgs) GetReply {
 	ck.mu.Lock()
 	defer ck.mu.Unlock()
 
 	// You'll have to modify Get().
 	ck.seq++
+	args.CID, args.Seq = ck.me, ck.seq
 
+	wait := ck.backoff
 	for {
-		shard := key2shard(key)
+		shard := key2shard(args.Key)
 
 		gid := ck.config.Shards[shard]
 
 		servers, ok := ck.config.Groups[gid]
 
+		moved, stale := false, true
 		if ok {
 			// try each server in the shard's replication group.
-			for _, srv := range servers {
-				args := &GetArgs{}
-				args.Key, args.CID, args.Seq = key, ck.me, ck.seq
+			for _, srv := range ck.preferred(gid, servers) {
+				if ctx.Err() != nil {
+					break
+				}
+				args.Timeout = ctxTimeout(ctx)
+				args.Deadline, _ = ctx.Deadline()
+				args.MinSeq = ck.written[gid]
 				var reply GetReply
-				ok := call(srv, "ShardKV.Get", args, &reply)
-				if ok && (reply.Err == OK || reply.Err == ErrNoKey) {
-					return reply.Value
+				ck.sent++
+				ok := sendCtx(ctx, srv, "ShardKV.Get", args, &reply)
+				if ok {
+					ck.leaders[gid] = srv
+					stale = reply.Err == ErrWrongGroup
+				}
+				if ok && (reply.Err == OK || reply.Err == ErrNoKey ||
+					reply.Err == ErrRejected) {
+					return reply
 				}
 				if ok && reply.Err == ErrWrongGroup {
+					moved = reply.ConfigNum > ck.config.Num
+					break
+				}
+				if ok && reply.Err == ErrRateLimited {
+					// back off, rather than try the others
+					break
+				}
+				if ok && reply.Err == ErrNotReady {
+					// the group is still taking the shard in:
+					// back off and come back to it, rather than
+					// look for another owner
 					break
 				}
 			}
 		}
 
-		time.Sleep(100 * time.Millisecond)
+		// a group in a newer config than ours has given the
+		// shard away: ask for that config at once. one behind
+		// ours may yet catch up, so wait for it, longer each
+		// time, as for a group that didn't answer.
+		if !moved {
+			wait = ck.retryWait(ctx, wait)
+		}
+		if ctx.Err() != nil {
+			return GetReply{Err:ErrTimeout}
+		}
 
-		// ask master for a new configuration.
-		ck.config = ck.sm.Query(-1)
+		// ask master for a new configuration, unless the group
+		// answered without saying it had given the shard away
+		// (as with ErrNotReady).
+		if stale {
+			ck.refresh()
+		}
 	}
 }
 
 // send a Put or Append request.
 func (ck *Clerk) PutAppend(key string, value string, op string) {
+	ck.PutAppendE(key, value, op)
+}
+
+//
+// like PutAppend(), but returns the error of a request the
+// servers refused (ErrRejected, or ErrMemoryPressure if the
+// write would grow a server past its MemoryLimit, or
+// ErrValueTooLarge if the value would be past its
+// MaxValueBytes), or OK.
+//
+func (ck *Clerk) PutAppendE(key string, value string, op string) Err {
+	return ck.PutAppendWithin(key, value, op, 0)
+}
+
+//
+// like PutAppendE(), but gives up with ErrTimeout once ctx
+// is done. the write may then still be done later.
+//
+func (ck *Clerk) PutAppendCtx(ctx context.Context, key string, value string, op string) Err {
+	return ck.putAppend(ctx, &PutAppendArgs{Key:key, Value:value, Op:op})
+}
+
+//
+// like PutAppendE(), but if within > 0 the write is only
+// done if the group decides it within that many paxos log
+// slots of where it is received; otherwise it returns
+// ErrExpired, and the write will never be done.
+//
+func (ck *Clerk) PutAppendWithin(key string, value string, op string, within int) Err {
+	args := &PutAppendArgs{Key:key, Value:value, Op:op, Within:within}
+	return ck.putAppend(context.Background(), args)
+}
+
+//
+// like PutAppendE(), with one of the Durability levels. a
+// DurabilityFlushed write gets ErrNotDurable from servers
+// not taking snapshots, without being done, or if writing
+// the snapshot failed, after being done.
+//
+func (ck *Clerk) PutAppendDurable(key string, value string, op string, durability string) Err {
+	args := &PutAppendArgs{Key:key, Value:value, Op:op, Durability:durability}
+	return ck.putAppend(context.Background(), args)
+}
+
+//
+// Put key, and drop it once ttl paxos log slots follow the
+// Put in its group's log. servers started with a
+// SweepInterval reclaim the key's memory some time after.
+//
+func (ck *Clerk) PutTTL(key string, value string, ttl int) {
+	ck.putAppend(context.Background(), &PutAppendArgs{Key:key, Value:value, Op:"Put", TTL:ttl})
+}
+
+//
+// like PutTTL(), with the TTL in milliseconds of the log's
+// clock (see PutAppendArgs.TTLMillis).
+//
+func (ck *Clerk) PutTTLMillis(key string, value string, ttl int) {
+	ck.putAppend(context.Background(), &PutAppendArgs{Key:key, Value:value, Op:"Put", TTLMillis:ttl})
+}
+
+//
+// send a PutAppend RPC with args, setting its CID and Seq,
+// until it is answered or ctx is done.
+//
+func (ck *Clerk) putAppend(ctx context.Context, args *PutAppendArgs) Err {
 	ck.mu.Lock()
 	defer ck.mu.Unlock()
 
 	// You'll have to modify PutAppend().
 	ck.seq++
+	args.CID, args.Seq = ck.me, ck.seq
 	
+	wait := ck.backoff
 	for {
-		shard := key2shard(key)
+		shard := key2shard(args.Key)
 
 		gid := ck.config.Shards[shard]
 
 		servers, ok := ck.config.Groups[gid]
 
+		moved, stale := false, true
 		if ok {
 			// try each server in the shard's replication group.
-			for _, srv := range servers {
-				args := &PutAppendArgs{}
-				args.Key, args.Value, args.Op = key, value, op
-				args.CID, args.Seq = ck.me, ck.seq
+			for _, srv := range ck.preferred(gid, servers) {
+				if ctx.Err() != nil {
+					break
+				}
+				args.Timeout = ctxTimeout(ctx)
+				args.Deadline, _ = ctx.Deadline()
 				var reply PutAppendReply
-				ok := call(srv, "ShardKV.PutAppend", args, &reply)
-				if ok && reply.Err == OK {
-					return
+				ck.sent++
+				ok := sendCtx(ctx, srv, "ShardKV.PutAppend", args, &reply)
+				if ok {
+					ck.leaders[gid] = srv
+					stale = reply.Err == ErrWrongGroup
+				}
+				if ok && (reply.Err == OK || reply.Err == ErrRejected ||
+					reply.Err == ErrExpired || reply.Err == ErrVersion ||
+					reply.Err == ErrMemoryPressure || reply.Err == ErrKeyExists ||
+					reply.Err == ErrMismatch || reply.Err == ErrValueTooLarge ||
+					reply.Err == ErrNotDurable) {
+					if reply.Err == OK && reply.Seq > ck.written[gid] {
+						ck.written[gid] = reply.Seq
+					}
+					return reply.Err
 				}
 				if ok && (reply.Err == ErrWrongGroup) {
+					moved = reply.ConfigNum > ck.config.Num
+					break
+				}
+				if ok && (reply.Err == ErrRateLimited || reply.Err == ErrNotReady) {
+					break
+				}
+			}
+		}
+
+		// as in get()
+		if !moved {
+			wait = ck.retryWait(ctx, wait)
+		}
+		if ctx.Err() != nil {
+			return ErrTimeout
+		}
+
+		if stale {
+			ck.refresh()
+		}
+	}
+}
+
+//
+// Put every key in kvs, in order, as one op of one group:
+// all are written or (if the keys aren't all served by one
+// group) none is and ErrWrongGroup is returned. ErrValueTooLarge
+// if one of the values is past the servers' MaxValueBytes.
+//
+func (ck *Clerk) PutBatch(kvs []KeyValue) Err {
+	ck.mu.Lock()
+	defer ck.mu.Unlock()
+
+	if len(kvs) == 0 {
+		return OK
+	}
+	ck.seq++
+
+	for {
+		gid := ck.batchGroup(kvs)
+		if gid < 0 {
+			ck.refresh()
+			if gid = ck.batchGroup(kvs); gid < 0 {
+				return ErrWrongGroup
+			}
+		}
+
+		servers, ok := ck.config.Groups[gid]
+
+		if ok {
+			// try each server in the shard's replication group.
+			for _, srv := range servers {
+				args := &PutBatchArgs{KVs:kvs, CID:ck.me, Seq:ck.seq}
+				var reply PutBatchReply
+				ok := send(srv, "ShardKV.PutBatch", args, &reply)
+				if ok && (reply.Err == OK || reply.Err == ErrValueTooLarge) {
+					return reply.Err
+				}
+				if ok && reply.Err == ErrWrongGroup {
 					break
 				}
 			}
@@ -158,13 +569,763 @@ func (ck *Clerk) PutAppend(key string, value string, op string) {
 		time.Sleep(100 * time.Millisecond)
 
 		// ask master for a new configuration.
-		ck.config = ck.sm.Query(-1)
+		ck.refresh()
 	}
 }
 
-func (ck *Clerk) Put(key string, value string) {
-	ck.PutAppend(key, value, "Put")
+// the group serving all of kvs in ck.config, or -1 if none does
+func (ck *Clerk) batchGroup(kvs []KeyValue) int64 {
+	gid := ck.config.Shards[key2shard(kvs[0].Key)]
+	for _, kv := range kvs {
+		if ck.config.Shards[key2shard(kv.Key)] != gid {
+			return -1
+		}
+	}
+	return gid
 }
-func (ck *Clerk) Append(key string, value string) {
-	ck.PutAppend(key, value, "Append")
+
+//
+// if every key in reads holds its value ("" for a missing
+// key), Put every key in writes, all in one op; else write
+// none and return ErrMismatch. the keys must all be of one
+// shard, else ErrWrongGroup. ErrValueTooLarge if one of the
+// values is past the servers' MaxValueBytes.
+//
+func (ck *Clerk) CondTxn(reads []KeyValue, writes []KeyValue) Err {
+	ck.mu.Lock()
+	defer ck.mu.Unlock()
+
+	args := &CondTxnArgs{Reads:reads, Writes:writes}
+	if len(args.keys()) == 0 {
+		return OK
+	}
+	shard := args.shard()
+	if shard < 0 {
+		return ErrWrongGroup
+	}
+	ck.seq++
+	args.CID, args.Seq = ck.me, ck.seq
+
+	for {
+		gid := ck.config.Shards[shard]
+
+		servers, ok := ck.config.Groups[gid]
+
+		if ok {
+			// try each server in the shard's replication group.
+			for _, srv := range servers {
+				var reply CondTxnReply
+				ok := send(srv, "ShardKV.CondTxn", args, &reply)
+				if ok && (reply.Err == OK || reply.Err == ErrMismatch ||
+					reply.Err == ErrValueTooLarge) {
+					return reply.Err
+				}
+				if ok && reply.Err == ErrWrongGroup {
+					break
+				}
+			}
+		}
+
+		time.Sleep(100 * time.Millisecond)
+
+		// ask master for a new configuration.
+		ck.refresh()
+	}
+}
+
+// every key args reads or writes
+func (args *CondTxnArgs) keys() []string {
+	keys := []string{}
+	for _, kv := range args.Reads {
+		keys = append(keys, kv.Key)
+	}
+	for _, kv := range args.Writes {
+		keys = append(keys, kv.Key)
+	}
+	return keys
+}
+
+// the one shard of args's keys, or -1 if they are of several
+func (args *CondTxnArgs) shard() int {
+	keys := args.keys()
+	if len(keys) == 0 {
+		return -1
+	}
+	shard := key2shard(keys[0])
+	for _, key := range keys {
+		if key2shard(key) != shard {
+			return -1
+		}
+	}
+	return shard
+}
+
+//
+// remove key. returns false if there was no key to remove.
+//
+func (ck *Clerk) Delete(key string) bool {
+	ck.mu.Lock()
+	defer ck.mu.Unlock()
+
+	ck.seq++
+
+	for {
+		shard := key2shard(key)
+
+		gid := ck.config.Shards[shard]
+
+		servers, ok := ck.config.Groups[gid]
+
+		if ok {
+			// try each server in the shard's replication group.
+			for _, srv := range servers {
+				args := &DeleteArgs{Key:key, CID:ck.me, Seq:ck.seq}
+				var reply DeleteReply
+				ok := send(srv, "ShardKV.Delete", args, &reply)
+				if ok && (reply.Err == OK || reply.Err == ErrNoKey) {
+					return reply.Err == OK
+				}
+				if ok && reply.Err == ErrWrongGroup {
+					break
+				}
+			}
+		}
+
+		time.Sleep(100 * time.Millisecond)
+
+		// ask master for a new configuration.
+		ck.refresh()
+	}
+}
+
+//
+// atomically add delta (which may be negative) to the base-10
+// integer held by key, a missing key holding 0. returns the
+// new value, or ErrNotNumber if key holds something else.
+//
+func (ck *Clerk) Incr(key string, delta int64) (int64, Err) {
+	ck.mu.Lock()
+	defer ck.mu.Unlock()
+
+	ck.seq++
+
+	for {
+		shard := key2shard(key)
+
+		gid := ck.config.Shards[shard]
+
+		servers, ok := ck.config.Groups[gid]
+
+		if ok {
+			// try each server in the shard's replication group.
+			for _, srv := range servers {
+				args := &IncrArgs{Key:key, Delta:delta, CID:ck.me, Seq:ck.seq}
+				var reply IncrReply
+				ok := send(srv, "ShardKV.Incr", args, &reply)
+				if ok && (reply.Err == OK || reply.Err == ErrNotNumber) {
+					n, _ := strconv.ParseInt(reply.Value, 10, 64)
+					return n, reply.Err
+				}
+				if ok && reply.Err == ErrWrongGroup {
+					break
+				}
+			}
+		}
+
+		time.Sleep(100 * time.Millisecond)
+
+		// ask master for a new configuration.
+		ck.refresh()
+	}
+}
+
+//
+// atomically replace key's value with fn(value, arg), where
+// fn is the transform registered as fn on the servers.
+// returns the new value, or ErrUnknownFunc if no such
+// transform is registered, or ErrValueTooLarge if the new
+// value would be past the servers' MaxValueBytes.
+//
+func (ck *Clerk) Apply(key string, fn string, arg string) (string, Err) {
+	ck.mu.Lock()
+	defer ck.mu.Unlock()
+
+	ck.seq++
+
+	for {
+		shard := key2shard(key)
+
+		gid := ck.config.Shards[shard]
+
+		servers, ok := ck.config.Groups[gid]
+
+		if ok {
+			// try each server in the shard's replication group.
+			for _, srv := range servers {
+				args := &ApplyArgs{Key:key, Func:fn, Arg:arg, CID:ck.me, Seq:ck.seq}
+				var reply ApplyReply
+				ok := send(srv, "ShardKV.Apply", args, &reply)
+				if ok && (reply.Err == OK || reply.Err == ErrUnknownFunc ||
+					reply.Err == ErrValueTooLarge) {
+					return reply.Value, reply.Err
+				}
+				if ok && reply.Err == ErrWrongGroup {
+					break
+				}
+			}
+		}
+
+		time.Sleep(100 * time.Millisecond)
+
+		// ask master for a new configuration.
+		ck.refresh()
+	}
+}
+
+//
+// block until key's value is expected, or until timeout
+// has passed (returning ErrTimeout). long-polls the key's
+// group instead of busy-polling with Get.
+//
+func (ck *Clerk) WaitForValue(key string, expected string, timeout time.Duration) Err {
+	deadline := time.Now().Add(timeout)
+	for {
+		// confirm with a linearizable read
+		value := ck.Get(key)
+		if value == expected {
+			return OK
+		}
+		left := deadline.Sub(time.Now())
+		if left <= 0 {
+			return ErrTimeout
+		}
+		ck.waitChange(key, value, left)
+	}
+}
+
+// wait for key to change from value, for at most timeout.
+func (ck *Clerk) waitChange(key string, value string, timeout time.Duration) {
+	ck.mu.Lock()
+	defer ck.mu.Unlock()
+
+	gid := ck.config.Shards[key2shard(key)]
+	for _, srv := range ck.config.Groups[gid] {
+		args := &WaitChangeArgs{Key:key, Value:value, Timeout:timeout}
+		var reply WaitChangeReply
+		ok := send(srv, "ShardKV.WaitChange", args, &reply)
+		if ok && reply.Err == ErrWrongGroup {
+			// ask master for a new configuration.
+			ck.refresh()
+			return
+		}
+		if ok {
+			return
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+}
+
+//
+// wait, for at most timeout, for key to change from version
+// (as GetVersion() returns it), and return the key's value
+// and version then, or its value and version unchanged if
+// timeout ran out. the value may be stale, as after
+// WaitChange(); ErrNoKey if the key was deleted.
+//
+func (ck *Clerk) Watch(key string, version int, timeout time.Duration) (string, int, Err) {
+	ck.mu.Lock()
+	defer ck.mu.Unlock()
+
+	deadline := time.Now().Add(timeout)
+	var last *WatchReply // the last answer, with the version unchanged
+	for {
+		left := deadline.Sub(time.Now())
+		if left < 0 {
+			left = 0
+		}
+		gid := ck.config.Shards[key2shard(key)]
+		for _, srv := range ck.config.Groups[gid] {
+			args := &WatchArgs{Key:key, Version:version, Timeout:left}
+			var reply WatchReply
+			ok := send(srv, "ShardKV.Watch", args, &reply)
+			if ok && reply.Err != ErrWrongGroup {
+				if reply.Version != version {
+					return reply.Value, reply.Version, reply.Err
+				}
+				// held for at most MaxWaitChange
+				last = &reply
+				break
+			}
+			if ok {
+				// the shard has moved
+				break
+			}
+		}
+		if !time.Now().Before(deadline) {
+			if last == nil {
+				return "", version, ErrTimeout
+			}
+			return last.Value, last.Version, last.Err
+		}
+		if last == nil {
+			time.Sleep(10 * time.Millisecond)
+			ck.refresh()
+		}
+		last = nil
+	}
+}
+
+//
+// remove all keys of shard, wherever it is served. returns
+// the number of keys removed, or ErrBadShard. nothing but
+// the shard number is checked: any client can wipe any
+// shard, so only hand this to trusted admin tools.
+//
+func (ck *Clerk) ClearShard(shard int) (int, Err) {
+	ck.mu.Lock()
+	defer ck.mu.Unlock()
+
+	if shard < 0 || shard >= shardmaster.NShards {
+		return 0, ErrBadShard
+	}
+
+	ck.seq++
+
+	for {
+		gid := ck.config.Shards[shard]
+
+		servers, ok := ck.config.Groups[gid]
+
+		if ok {
+			// try each server in the shard's replication group.
+			for _, srv := range servers {
+				args := &ClearShardArgs{Shard:shard, CID:ck.me, Seq:ck.seq}
+				var reply ClearShardReply
+				ok := send(srv, "ShardKV.ClearShard", args, &reply)
+				if ok && (reply.Err == OK || reply.Err == ErrBadShard) {
+					return reply.Removed, reply.Err
+				}
+				if ok && reply.Err == ErrWrongGroup {
+					break
+				}
+			}
+		}
+
+		time.Sleep(100 * time.Millisecond)
+
+		// ask master for a new configuration.
+		ck.refresh()
+	}
+}
+
+//
+// the n keys group gid is asked about most, and their
+// request rates summed over the group's servers.
+//
+func (ck *Clerk) HotKeys(gid int64, n int) []KeyRate {
+	ck.mu.Lock()
+	defer ck.mu.Unlock()
+
+	if _, ok := ck.config.Groups[gid]; !ok {
+		ck.refresh()
+	}
+	rates := map[string]float64{}
+	for _, srv := range ck.config.Groups[gid] {
+		args := &HotKeysArgs{N:n}
+		var reply HotKeysReply
+		ok := send(srv, "ShardKV.HotKeys", args, &reply)
+		if ok && reply.Err == OK {
+			for _, kr := range reply.Keys {
+				rates[kr.Key] += kr.Rate
+			}
+		}
+	}
+	keys := []KeyRate{}
+	for key, rate := range rates {
+		keys = append(keys, KeyRate{key, rate})
+	}
+	sort.Sort(byRate(keys))
+	if len(keys) > n {
+		keys = keys[:n]
+	}
+	return keys
+}
+
+//
+// keep key mirrored onto group gid (or stop, if gid is 0),
+// so that GetMirrored() can read it while its own group is
+// down. the mirror is updated asynchronously; see mirror.go.
+//
+func (ck *Clerk) Mirror(key string, gid int64) Err {
+	ck.mu.Lock()
+	defer ck.mu.Unlock()
+
+	ck.seq++
+
+	for {
+		shard := key2shard(key)
+
+		gid1 := ck.config.Shards[shard]
+
+		servers, ok := ck.config.Groups[gid1]
+
+		if ok {
+			// try each server in the shard's replication group.
+			for _, srv := range servers {
+				args := &MirrorArgs{Key:key, Gid:gid, CID:ck.me, Seq:ck.seq}
+				var reply MirrorReply
+				ok := send(srv, "ShardKV.Mirror", args, &reply)
+				if ok && reply.Err == OK {
+					return reply.Err
+				}
+				if ok && reply.Err == ErrWrongGroup {
+					break
+				}
+			}
+		}
+
+		time.Sleep(100 * time.Millisecond)
+
+		// ask master for a new configuration.
+		ck.refresh()
+	}
+}
+
+//
+// like GetE(), but if no server of the key's group answers,
+// reads the key's mirror copy from whichever other group
+// holds it. the copy may be stale, and may even lag behind
+// a value an earlier GetMirrored() read from the key's own
+// group. keeps trying while neither is available.
+//
+func (ck *Clerk) GetMirrored(key string) (string, Err) {
+	ck.mu.Lock()
+	defer ck.mu.Unlock()
+
+	ck.seq++
+
+	for {
+		shard := key2shard(key)
+
+		gid := ck.config.Shards[shard]
+
+		servers, ok := ck.config.Groups[gid]
+
+		if ok {
+			answered := false
+			// try each server in the shard's replication group.
+			for _, srv := range servers {
+				args := &GetArgs{Key:key, CID:ck.me, Seq:ck.seq}
+				var reply GetReply
+				ok := send(srv, "ShardKV.Get", args, &reply)
+				if ok && (reply.Err == OK || reply.Err == ErrNoKey ||
+					reply.Err == ErrRejected) {
+					return reply.Value, reply.Err
+				}
+				if ok {
+					answered = true
+				}
+				if ok && reply.Err == ErrWrongGroup {
+					break
+				}
+			}
+			if !answered {
+				if c, found := ck.readMirror(key, gid); found && c.Present {
+					return c.Value, OK
+				} else if found {
+					return "", ErrNoKey
+				}
+			}
+		}
+
+		time.Sleep(100 * time.Millisecond)
+
+		// ask master for a new configuration.
+		ck.refresh()
+	}
+}
+
+//
+// the newest copy of key held by a group other than gid.
+// ck.mu must be held.
+//
+func (ck *Clerk) readMirror(key string, gid int64) (MirrorCopy, bool) {
+	var newest MirrorCopy
+	found := false
+	for gid1, servers := range ck.config.Groups {
+		if gid1 == gid {
+			continue
+		}
+		for _, srv := range servers {
+			args := &GetMirrorArgs{Key:key}
+			var reply GetMirrorReply
+			ok := send(srv, "ShardKV.GetMirror", args, &reply)
+			if ok && reply.Err == OK && (!found || newerCopy(reply.Copy, newest)) {
+				newest, found = reply.Copy, true
+			}
+			if ok {
+				break
+			}
+		}
+	}
+	return newest, found
+}
+
+// ask master for a new configuration. ck.mu must be held.
+func (ck *Clerk) refresh() {
+	ck.config = ck.sm.Query(-1)
+	ck.fetched = time.Now()
+	ck.queries++
+}
+
+//
+// servers, the servers of group gid, starting with the one
+// that last answered this clerk. ck.mu must be held.
+//
+func (ck *Clerk) preferred(gid int64, servers []string) []string {
+	for i, srv := range servers {
+		if srv == ck.leaders[gid] {
+			return append(append([]string{}, servers[i:]...), servers[:i]...)
+		}
+	}
+	return servers
+}
+
+//
+// the configuration this Clerk routes requests by, fetched
+// anew if it is older than maxAge, and how old it is.
+//
+func (ck *Clerk) CurrentConfig(maxAge time.Duration) (shardmaster.Config, time.Duration) {
+	ck.mu.Lock()
+	defer ck.mu.Unlock()
+
+	if ck.fetched.IsZero() || time.Since(ck.fetched) > maxAge {
+		ck.refresh()
+	}
+	config := ck.config
+	config.Groups = map[int64][]string{}
+	for gid, servers := range ck.config.Groups {
+		config.Groups[gid] = servers
+	}
+	return config, time.Since(ck.fetched)
+}
+
+// most tries Update() makes before giving up
+const UpdateAttempts = 20
+
+//
+// replace key's value with fn(old value), retrying with
+// random backoff if another client changed the key between
+// the Get and the Put. returns the value written and true,
+// or false if fn returned false or all UpdateAttempts tries
+// met a conflict. fn may be called several times.
+//
+func (ck *Clerk) Update(key string, fn func(old string) (string, bool)) (string, bool) {
+	wait := 10 * time.Millisecond
+	for i := 0; i < UpdateAttempts; i++ {
+		old, version := ck.GetVersion(key)
+		value, ok := fn(old)
+		if !ok {
+			return old, false
+		}
+		args := &PutAppendArgs{Key:key, Value:value, Op:"Put", CheckVersion:true, Version:version}
+		if ck.putAppend(context.Background(), args) == OK {
+			return value, true
+		}
+		time.Sleep(time.Duration(nrand() % int64(wait)))
+		if wait < time.Second {
+			wait *= 2
+		}
+	}
+	return "", false
+}
+
+//
+// set key to value only if key doesn't exist. returns true
+// if this call created the key.
+//
+func (ck *Clerk) PutIfAbsent(key string, value string) bool {
+	return ck.PutAppendE(key, value, PutIfAbsent) == OK
+}
+
+//
+// set key to value only if key holds old (a missing key
+// holds ""). returns true if this call set it.
+//
+func (ck *Clerk) CAS(key string, old string, value string) bool {
+	args := &PutAppendArgs{Key:key, Value:value, Op:CAS, Expected:old}
+	return ck.putAppend(context.Background(), args) == OK
+}
+
+//
+// append value to key's, keeping only the last max bytes of
+// the result, as for a rolling log. every replica cuts the
+// value alike.
+//
+func (ck *Clerk) AppendBounded(key string, value string, max int) {
+	args := &PutAppendArgs{Key:key, Value:value, Op:AppendBounded, MaxLen:max}
+	ck.putAppend(context.Background(), args)
+}
+
+func (ck *Clerk) Put(key string, value string) {
+	ck.PutAppend(key, value, "Put")
+}
+func (ck *Clerk) Append(key string, value string) {
+	ck.PutAppend(key, value, "Append")
+}
+
+//
+// Put, Append and Get for binary values. servers keep values
+// as Go strings, which hold any bytes, not only UTF-8, so
+// these values come back as they went in; Append concatenates
+// the bytes. GetBytes returns nil for a missing key.
+//
+func (ck *Clerk) PutBytes(key string, value []byte) {
+	ck.Put(key, string(value))
+}
+func (ck *Clerk) AppendBytes(key string, value []byte) {
+	ck.Append(key, string(value))
+}
+func (ck *Clerk) GetBytes(key string) []byte {
+	value, err := ck.GetE(key)
+	if err == ErrNoKey {
+		return nil
+	}
+	return []byte(value)
+}
+
+//
+// atomically apply a set of writes that may span several
+// shards, using two-phase commit coordinated by this Clerk.
+// returns true if the writes were committed.
+//
+// Prepare locks the written keys in each owning group;
+// until the transaction commits or aborts, Get and Put on
+// those keys are refused with ErrLocked (and retried by
+// the Clerk), so no reader observes a partial transaction.
+// transactions are thus atomic and serializable with
+// respect to single-key operations on the keys they write.
+// a transaction aborts if any of its keys is locked by
+// another one.
+//
+// the outcome is recorded by the group owning the smallest
+// written key (the coordinator key). if this Clerk dies
+// mid-transaction, the participants ask that group for the
+// outcome after TxnTimeout, which aborts a transaction
+// whose outcome was never recorded.
+//
+func (ck *Clerk) Transaction(writes map[string]string) bool {
+	ck.mu.Lock()
+	defer ck.mu.Unlock()
+
+	if len(writes) == 0 {
+		return true
+	}
+	coord := ""
+	for key := range writes {
+		if coord == "" || key < coord {
+			coord = key
+		}
+	}
+	ck.seq++
+	txn := ck.me + "-" + strconv.Itoa(ck.seq)
+
+	prepared := ck.txnSend("ShardKV.Prepare", txn, coord, writes) == OK
+	commit := ck.txnDecide(txn, coord, prepared)
+	if commit {
+		ck.txnSend("ShardKV.Commit", txn, coord, writes)
+	} else {
+		ck.txnSend("ShardKV.Abort", txn, coord, writes)
+	}
+	return commit
+}
+
+//
+// send a transaction RPC to the groups owning the given
+// keys, each group getting its own keys. returns ErrLocked
+// as soon as a group reports a lock conflict.
+//
+func (ck *Clerk) txnSend(rpcname string, txn string, coord string, 
+	writes map[string]string) Err {
+	pending := map[string]string{}
+	for key, value := range writes {
+		pending[key] = value
+	}
+
+	for {
+		parts := map[int64]map[string]string{}
+		for key, value := range pending {
+			gid := ck.config.Shards[key2shard(key)]
+			if parts[gid] == nil {
+				parts[gid] = map[string]string{}
+			}
+			parts[gid][key] = value
+		}
+
+		for gid, part := range parts {
+			servers, ok := ck.config.Groups[gid]
+			if !ok {
+				continue
+			}
+			ck.seq++
+			args := &TxnArgs{TxnID:txn, Coord:coord, Writes:part, CID:ck.me, Seq:ck.seq}
+			for _, srv := range servers {
+				var reply TxnReply
+				ok := send(srv, rpcname, args, &reply)
+				if ok && reply.Err == OK {
+					for key := range part {
+						delete(pending, key)
+					}
+					break
+				}
+				if ok && reply.Err == ErrLocked {
+					return ErrLocked
+				}
+				if ok && reply.Err == ErrWrongGroup {
+					break
+				}
+			}
+		}
+		if len(pending) == 0 {
+			return OK
+		}
+
+		time.Sleep(100 * time.Millisecond)
+
+		// ask master for a new configuration.
+		ck.refresh()
+	}
+}
+
+//
+// propose an outcome to the coordinator key's group, and
+// return the outcome it recorded (the first one proposed).
+//
+func (ck *Clerk) txnDecide(txn string, coord string, commit bool) bool {
+	ck.seq++
+	for {
+		gid := ck.config.Shards[key2shard(coord)]
+
+		servers, ok := ck.config.Groups[gid]
+
+		if ok {
+			for _, srv := range servers {
+				args := &TxnArgs{TxnID:txn, Coord:coord, Commit:commit}
+				args.CID, args.Seq = ck.me, ck.seq
+				var reply TxnReply
+				ok := send(srv, "ShardKV.Decide", args, &reply)
+				if ok && reply.Err == OK {
+					return reply.Commit
+				}
+				if ok && reply.Err == ErrWrongGroup {
+					break
+				}
+			}
+		}
+
+		time.Sleep(100 * time.Millisecond)
+
+		// ask master for a new configuration.
+		ck.refresh()
+	}
 }
@@ -1,5 +1,7 @@
 package shardkv
 
+import "time"
+
 //
 // Sharded key/value server.
 // Lots of replica groups, each running op-at-a-time paxos.
@@ -15,36 +17,263 @@ const (
 	ErrWrongGroup = "ErrWrongGroup"
 
 	ErrNotReady   = "ErrNotReady"
+	ErrLocked     = "ErrLocked"
+	ErrUnknownFunc = "ErrUnknownFunc"
+	ErrTimeout    = "ErrTimeout"
+	ErrBadShard   = "ErrBadShard"
+	ErrRejected   = "ErrRejected"
+	ErrTransferBusy = "ErrTransferBusy"
+	ErrExpired    = "ErrExpired"
+	ErrVersion    = "ErrVersion"
+	ErrMemoryPressure = "ErrMemoryPressure"
+	ErrKeyExists  = "ErrKeyExists"
+	ErrMismatch   = "ErrMismatch"
+	ErrNotNumber  = "ErrNotNumber"
+	ErrNotLeader  = "ErrNotLeader"
+	ErrValueTooLarge = "ErrValueTooLarge"
+	ErrShutdown   = "ErrShutdown"
+	ErrRateLimited = "ErrRateLimited"
+	ErrNotDurable = "ErrNotDurable"
 )
 
 type Err string
 
+// GetArgs.Consistency levels
+const (
+	ReadLogged  = ""        // log the Get itself
+	ReadConfirm = "confirm" // read after a shared no-op is logged
+	// read the server's applied state without logging. may be
+	// stale: the client must confirm it with a logged Get.
+	ReadSpeculative = "speculative"
+)
+
 type GetArgs struct {
 	Key    string
 	// You'll have to add definitions here.
 	CID    string  // client identifier
 	Seq    int     // request seq
+	Consistency string
+	// if UseDefault, a missing key reads as OK with Default
+	// rather than ErrNoKey. (not a *string: gob would drop
+	// a pointer to "".)
+	UseDefault bool
+	Default    string
+	// if > 0, the server gives up on a logged Get that isn't
+	// decided this long after it arrives, with ErrTimeout.
+	Timeout time.Duration
+	// if set, a request arriving after Deadline (by the
+	// server's clock) is answered ErrTimeout without being
+	// logged, as its client has given up on it.
+	Deadline time.Time
+	// if > 0, the server first applies its group's log up to
+	// MinSeq (a PutAppendReply.Seq from the same group), so the
+	// read sees that write whatever the Consistency.
+	MinSeq int
 }
 
 type GetReply struct {
 	Err   Err
 	Value string
+	Version int // number of changes to the key's value so far
+	ConfigNum int // the config the server was in
 }
 
+//
+// PutAppendArgs.Durability levels. servers keep their state
+// in memory (paxos too), so an acknowledged write survives
+// as long as a majority of its group's replicas that applied
+// it, or will learn it, stay up. servers taking snapshots
+// (Options.SnapshotInterval) can also be restarted from
+// disk, but a snapshot lags the writes a server applied,
+// unless the write asks for it to be flushed.
+//
+const (
+	DurabilityDefault = ""        // the server's Options.Durability
+	DurabilityMemory  = "memory"  // acknowledged once applied
+	// acknowledged once a snapshot holding it is synced to the
+	// answering server's disk. servers not taking snapshots
+	// refuse the write with ErrNotDurable.
+	DurabilityFlushed = "flushed"
+)
+
 type PutAppendArgs struct {
 	Key    string
 	Value  string
-	Op     string // "Put" or "Append"
+	Op     string // "Put", "Append", "AppendBounded", "PutIfAbsent" or "CAS"
 	// You'll have to add definitions here.
 	CID    string
 	Seq    int
 	// Field names must start with capital letters,
 	// otherwise RPC will break.
 
+	// if > 0, the write is dropped (ErrExpired) unless it
+	// is decided within this many paxos log slots of the
+	// ones the server knows of when it receives it.
+	Within int
+	// if > 0, the key is dropped once this many log slots
+	// follow the write's. a Put with no TTL clears the key's
+	// TTL; an Append with none keeps it.
+	TTL    int
+	// like TTL, but in milliseconds, measured on the log's
+	// clock: the latest time at which a server proposed one
+	// of the group's logged ops. replicas thus agree on when
+	// the key goes, though it only goes once later ops are
+	// logged, and only as precisely as the servers' clocks
+	// agree.
+	TTLMillis int
+	// if CheckVersion, the write is only done if the key's
+	// version (see GetReply) is Version; else ErrVersion.
+	CheckVersion bool
+	Version      int
+	// for CAS, the value the key must hold for the Put to be
+	// done (a missing key holds ""); else ErrMismatch.
+	Expected     string
+	// for AppendBounded, the value is cut to its last MaxLen
+	// bytes after the append; if MaxLen <= 0, it isn't cut.
+	MaxLen       int
+	// if > 0, the server stops waiting for the write to be
+	// decided this long after it arrives, with ErrTimeout.
+	// the write may still be done later.
+	Timeout time.Duration
+	// as for GetArgs
+	Deadline time.Time
+	// one of the Durability levels
+	Durability string
 }
 
 type PutAppendReply struct {
 	Err Err
+	ConfigNum int // the config the server was in
+	Seq int // the server's applied log seq; the write is before it
+}
+
+type PingArgs struct {
+	Probe bool // from a peer: just answer, without probing others
+}
+
+type PingReply struct {
+	Err       Err
+	Alive     bool
+	Quorum    bool // a majority of the group answered Ping (best-effort)
+	Ready     bool // able to serve the shards its config gives the group
+	ConfigNum int
+}
+
+type StatusArgs struct {
+}
+
+type StatusReply struct {
+	Err      Err
+	ConfigNum int   // the config the server is in
+	Shards   []int  // the shards that config gives its group
+	// Reconfiguring if the server has started moving to config
+	// Target and not got there; Waiting are the shards it has
+	// yet to receive from other groups for it.
+	Reconfiguring bool
+	Target   int
+	Waiting  []int
+}
+
+type ClientDoneArgs struct {
+	CID    string // the clerk that is done
+}
+
+type ClientDoneReply struct {
+	Err    Err
+}
+
+type GetSnapshotArgs struct {
+}
+
+type GetSnapshotReply struct {
+	Err  Err
+	Data []byte // the gob-encoded state (see snapshot.go)
+}
+
+type DecisionArgs struct {
+	Seq int
+}
+
+type DecisionReply struct {
+	Err      Err // ErrNotReady if the server doesn't hold the slot decided
+	Proposal int // the proposal number that won
+	Proposer int // the index in its group of the server that proposed it
+}
+
+type LogStatusArgs struct {
+}
+
+// a server's place in its group's paxos log. one whose
+// LastSeq nears Min is about to need a peer's snapshot.
+type LogStatusReply struct {
+	Err     Err
+	Min     int // slots before it are forgotten by the group
+	Max     int // highest slot the server has heard of
+	Seq     int // next slot not known decided
+	LastSeq int // next slot to apply
+}
+
+type ShardStatsArgs struct {
+}
+
+type ShardStatsReply struct {
+	Err       Err
+	ConfigNum int         // the config the server is in
+	Shards    []ShardStat // the shards that config gives its group
+}
+
+type ShardStat struct {
+	Shard int
+	Keys  int
+	Bytes int // of the keys and their values
+}
+
+type HotKeysArgs struct {
+	N int
+}
+
+type HotKeysReply struct {
+	Err  Err
+	Keys []KeyRate // hottest first
+}
+
+type KeyRate struct {
+	Key  string
+	Rate float64 // recent requests per second
+}
+
+type MirrorArgs struct {
+	Key    string
+	Gid    int64 // group to mirror Key onto; 0 stops mirroring
+	CID    string
+	Seq    int
+}
+
+type MirrorReply struct {
+	Err Err
+}
+
+//
+// a key's group pushes its value to the key's mirror group
+// with MirrorWrite, and clients read the copy back with
+// GetMirror.
+//
+type MirrorWriteArgs struct {
+	Key    string
+	Copy   MirrorCopy
+}
+
+type MirrorWriteReply struct {
+	Err Err
+}
+
+type GetMirrorArgs struct {
+	Key    string
+}
+
+type GetMirrorReply struct {
+	Err    Err
+	Copy   MirrorCopy
 }
 
 type TransferStateArgs struct {
@@ -53,6 +282,166 @@ type TransferStateArgs struct {
 }
 
 type TransferStateReply struct {
+	Err      Err
+	XState   XState
+	Digest   string // shardDigest() of the shard sent
+	Checksum uint32 // transferChecksum() of XState
+}
+
+//
+// ask for the state of Shard's keys Offset to Offset+Max in
+// the server's Snapshot of it (0: take one); see transfer.go.
+//
+type TransferChunkArgs struct {
+	ConfigNum  int
+	Shard      int
+	Snapshot   int64
+	Offset     int
+	Max        int
+}
+
+type TransferChunkReply struct {
+	Err      Err
+	Snapshot int64
+	XState   XState // the chunk's keys; with Done, the client states
+	Next     int    // Offset of the next chunk
+	Done     bool   // the last chunk
+	Digest   string // with Done, shardDigest() of the whole shard
+	Checksum uint32 // transferChecksum() of XState
+}
+
+//
+// Put every key in KVs, in order, as one op. the keys must
+// all be served by the group the batch is sent to; else
+// none is written and the reply is ErrWrongGroup.
+//
+type PutBatchArgs struct {
+	KVs    []KeyValue
+	CID    string
+	Seq    int
+}
+
+type PutBatchReply struct {
+	Err    Err
+}
+
+//
+// a conditional write of keys of one shard, as one op: if
+// every key in Reads holds its Value (a missing key holds
+// ""), every key in Writes is Put; else none is and the
+// reply is ErrMismatch. keys of more than one shard, or of
+// one the group doesn't serve, get ErrWrongGroup.
+//
+type CondTxnArgs struct {
+	Reads  []KeyValue
+	Writes []KeyValue
+	CID    string
+	Seq    int
+}
+
+type CondTxnReply struct {
+	Err    Err
+}
+
+type DeleteArgs struct {
+	Key    string
+	CID    string
+	Seq    int
+}
+
+type DeleteReply struct {
+	Err    Err // OK, or ErrNoKey if there was no key to delete
+}
+
+//
+// add Delta to the base-10 integer held by Key (0 if the key
+// is missing). ErrNotNumber if Key holds something else.
+//
+type IncrArgs struct {
+	Key    string
+	Delta  int64
+	CID    string
+	Seq    int
+}
+
+type IncrReply struct {
+	Err    Err
+	Value  string // the new value
+}
+
+type ApplyArgs struct {
+	Key    string
+	Func   string // name of a transform registered on the servers
+	Arg    string
+	CID    string
+	Seq    int
+}
+
+type ApplyReply struct {
+	Err   Err
+	Value string // the new value
+}
+
+//
+// long poll: the server replies once key's value differs
+// from Value, or after Timeout with the unchanged value.
+//
+type WaitChangeArgs struct {
+	Key     string
+	Value   string
+	Timeout time.Duration
+}
+
+type WaitChangeReply struct {
+	Err   Err
+	Value string
+}
+
+//
+// long poll: the server replies once key's version (see
+// GetReply) differs from Version, with the key's value
+// (ErrNoKey if it was deleted), or after Timeout with the
+// version unchanged. ErrWrongGroup once the group no longer
+// serves the key.
+//
+type WatchArgs struct {
+	Key     string
+	Version int
+	Timeout time.Duration
+}
+
+type WatchReply struct {
+	Err     Err
+	Value   string
+	Version int
+}
+
+type ClearShardArgs struct {
+	Shard  int
+	CID    string
+	Seq    int
+}
+
+type ClearShardReply struct {
 	Err     Err
-	XState  XState
+	Removed int // number of keys removed
+}
+
+//
+// transaction RPCs (Prepare/Commit/Abort/Decide) all take
+// TxnArgs. Writes holds the keys handled by the receiving
+// group; their new values only matter for Prepare.
+//
+type TxnArgs struct {
+	TxnID  string
+	Coord  string            // key whose group records the outcome
+	Writes map[string]string
+	Commit bool              // proposed outcome, for Decide
+	CID    string
+	Seq    int
+}
+
+type TxnReply struct {
+	Err    Err
+	Commit bool              // recorded outcome, for Decide
 }
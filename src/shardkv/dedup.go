@@ -0,0 +1,164 @@
+package shardkv
+
+import "sort"
+import "strconv"
+import "time"
+
+//
+// forgetting clients. a group remembers the last request of
+// every client it has served (MRRSMap, Replies, Recent,
+// LastShard, ShardSeqs), to filter retries. left alone, these grow with
+// every clerk ever made. a clerk that is done calls
+// Clerk.Done(), which logs a ClientDone in each group; and
+// with MaxClients set, a group that remembers more clients
+// forgets the ones idle longest, by log seq of their last
+// recorded op.
+//
+// both happen as ops are applied, so every replica forgets
+// the same clients at the same point in the log. a client
+// that is forgotten and then retries its last request has
+// the request applied again, so MaxClients should be well
+// above the number of clients active at once.
+//
+
+// replies a group keeps per client, for retries of ops the
+// client sent before its most recent (see XState.Recent)
+const ReplyHistory = 4
+
+// note the log seq at which op's client was last recorded,
+// and forget the idlest clients past ap.maxClients
+func (ap *applier) touchClient(seq int, op *Op) {
+	if op.CID != "" && ap.xstate.MRRSMap[op.CID] == op.Seq {
+		ap.xstate.Seen[op.CID] = seq
+	}
+	if ap.maxClients > 0 && len(ap.xstate.MRRSMap) > ap.maxClients {
+		ap.evictClients()
+	}
+}
+
+//
+// clients another group's state brought in count as seen
+// at seq, since their seqs in that group's log mean nothing
+// in this one.
+//
+func (ap *applier) adoptClients(seq int, other *XState) {
+	adopt := func(cid string) {
+		if _, ok := ap.xstate.Seen[cid]; !ok {
+			ap.xstate.Seen[cid] = seq
+		}
+	}
+	for cid := range other.MRRSMap {
+		adopt(cid)
+	}
+	for _, seqs := range other.ShardSeqs {
+		for cid := range seqs {
+			adopt(cid)
+		}
+	}
+}
+
+//
+// forget the idlest clients, down to 9/10 of ap.maxClients
+// so that the sort is not redone on every op. ties go by
+// client ID, so that every replica picks the same ones.
+//
+func (ap *applier) evictClients() {
+	cids := make([]string, 0, len(ap.xstate.MRRSMap))
+	for cid := range ap.xstate.MRRSMap {
+		cids = append(cids, cid)
+	}
+	seen := ap.xstate.Seen
+	sort.Slice(cids, func(i, j int) bool {
+		if seen[cids[i]] != seen[cids[j]] {
+			return seen[cids[i]] < seen[cids[j]]
+		}
+		return cids[i] < cids[j]
+	})
+	n := len(cids) - ap.maxClients + ap.maxClients / 10
+	for _, cid := range cids[:n] {
+		ap.forgetClient(cid)
+	}
+	ap.logEvent(LevelInfo, "clients evicted", Field{"clients", n})
+}
+
+func (ap *applier) forgetClient(cid string) {
+	delete(ap.xstate.MRRSMap, cid)
+	delete(ap.xstate.Replies, cid)
+	delete(ap.xstate.Recent, cid)
+	delete(ap.xstate.LastShard, cid)
+	delete(ap.xstate.Seen, cid)
+	for _, seqs := range ap.xstate.ShardSeqs {
+		delete(seqs, cid)
+	}
+}
+
+//
+// RPC handler for a clerk that will send no more requests.
+// logged by the server, not as the client's own op, so that
+// it is not itself remembered.
+//
+func (kv *ShardKV) ClientDone(args *ClientDoneArgs, reply *ClientDoneReply) error {
+	defer kv.handling()()
+
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	kv.logEvent(LevelDebug, "rpc", Field{"op", ClientDone}, Field{"client", args.CID})
+
+	kv.catchUp()
+	if _, ok := kv.xstate.MRRSMap[args.CID]; ok {
+		cid := "done-" + strconv.FormatInt(nrand(), 16)
+		if err := kv.logOperation(&Op{CID:cid, Seq:1, Op:ClientDone, Extra:args.CID}); err != OK {
+			reply.Err = err
+			return nil
+		}
+		kv.catchUp()
+		if _, ok := kv.xstate.MRRSMap[args.CID]; ok {
+			// fenced off by another server's read lease
+			reply.Err = ErrNotLeader
+			return nil
+		}
+	}
+	reply.Err = OK
+	return nil
+}
+
+//
+// tell every group that this clerk is done, so that they
+// forget it. the clerk must not be used afterwards.
+//
+func (ck *Clerk) Done() {
+	ck.mu.Lock()
+	defer ck.mu.Unlock()
+
+	ck.refresh()
+	told := map[int64]bool{}
+	for {
+		for gid, servers := range ck.config.Groups {
+			if told[gid] {
+				continue
+			}
+			for _, srv := range servers {
+				args := &ClientDoneArgs{CID:ck.me}
+				var reply ClientDoneReply
+				ok := send(srv, "ShardKV.ClientDone", args, &reply)
+				if ok && reply.Err == OK {
+					told[gid] = true
+					break
+				}
+			}
+		}
+		done := true
+		for gid := range ck.config.Groups {
+			done = done && told[gid]
+		}
+		if done {
+			return
+		}
+
+		time.Sleep(100 * time.Millisecond)
+
+		// ask master for a new configuration.
+		ck.refresh()
+	}
+}
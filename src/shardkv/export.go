@@ -0,0 +1,76 @@
+package shardkv
+
+import "shardmaster"
+import "strconv"
+import "crypto/sha256"
+import "encoding/hex"
+
+//
+// a point-in-time copy of the shards this server's group
+// serves, with the states of the clients that used them, for
+// a backup or for moving the data to another group with
+// Import(). it is taken after catching up with the group's
+// log, so it holds every write decided before the call.
+//
+func (kv *ShardKV) Export() *XState {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	kv.catchUp()
+	xs := MakeXState()
+	for shard, gid := range kv.config.Shards {
+		if gid == kv.gid {
+			xs.Update(kv.shardState(shard))
+		}
+	}
+	return xs
+}
+
+//
+// merge xs, as from Export(), into the group's state. every
+// key in it must belong to a shard the group serves, or
+// nothing is merged (ErrWrongGroup). the Import is logged as
+// an op of a client named after xs's contents, so importing
+// the same state again is filtered as a duplicate rather
+// than undoing the writes made since.
+//
+func (kv *ShardKV) Import(xs *XState) Err {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	cid := "import-" + importID(xs)
+	kv.logEvent(LevelInfo, "import", Field{"client", cid}, Field{"keys", len(xs.KVStore)})
+	return kv.execute(&Op{CID:cid, Seq:1, Op:Import, Extra:*xs}).Err
+}
+
+// a hash of xs's contents
+func importID(xs *XState) string {
+	h := sha256.New()
+	for shard := 0; shard < shardmaster.NShards; shard++ {
+		h.Write([]byte(shardDigest(xs.KVStore, shard) + ";"))
+	}
+	h.Write([]byte(strconv.FormatUint(uint64(transferChecksum(xs)), 16)))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (ap *applier) doImport(seq int, xs *XState) (*Rep) {
+	for key := range xs.KVStore {
+		if !ap.owns(key2shard(key)) {
+			ap.wrongGroup(Import, key)
+			return &Rep{Err:ErrWrongGroup}
+		}
+	}
+	ap.xstate.Update(xs)
+	ap.rebaseTTLs(seq, xs)
+	ap.adoptClients(seq, xs)
+	shards := map[int]bool{}
+	for key := range xs.KVStore {
+		shards[key2shard(key)] = true
+	}
+	for shard := range shards {
+		ap.recount(shard)
+		ap.applied[shard] = seq
+	}
+	ap.logEvent(LevelInfo, "imported", Field{"seq", seq}, Field{"keys", len(xs.KVStore)})
+	return &Rep{Err:OK}
+}
@@ -0,0 +1,67 @@
+package shardkv
+
+import "context"
+import "time"
+
+//
+// a cheap health check, for load balancers. Ping takes none
+// of the locks tick() or the log hold for long, and proposes
+// nothing: whether the group has a quorum is a best guess
+// from its servers answering a Ping of their own within
+// PingTimeout, and readiness is from the server's own view
+// of its config and any reconfiguration under way.
+//
+
+// how long Ping waits for the group's other servers
+const PingTimeout = 100 * time.Millisecond
+
+func (kv *ShardKV) Ping(args *PingArgs, reply *PingReply) error {
+	defer kv.handling()()
+
+	reply.Err = OK
+	reply.Alive = !kv.isdead()
+	if args.Probe {
+		return nil
+	}
+
+	kv.smu.RLock()
+	kv.pmu.Lock()
+	reply.ConfigNum = kv.config.Num
+	_, _, waiting := kv.reconfiguring()
+	kv.pmu.Unlock()
+	kv.smu.RUnlock()
+
+	reply.Quorum = kv.quorumAnswers()
+	reply.Ready = reply.Alive && reply.Quorum && len(waiting) == 0
+	return nil
+}
+
+// whether a majority of the group, counting this server,
+// answers a probe Ping within PingTimeout
+func (kv *ShardKV) quorumAnswers() bool {
+	ctx, cancel := context.WithTimeout(context.Background(), PingTimeout)
+	defer cancel()
+
+	answers := make(chan bool, len(kv.servers))
+	for i, srv := range kv.servers {
+		if i == kv.me {
+			continue
+		}
+		go func(srv string) {
+			var reply PingReply
+			ok := sendCtx(ctx, srv, "ShardKV.Ping", &PingArgs{Probe:true}, &reply)
+			answers <- ok && reply.Alive
+		}(srv)
+	}
+
+	n := 1
+	for i := 1; i < len(kv.servers); i++ {
+		if <-answers {
+			n++
+		}
+		if n > len(kv.servers) / 2 {
+			return true
+		}
+	}
+	return n > len(kv.servers) / 2
+}
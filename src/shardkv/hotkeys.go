@@ -0,0 +1,101 @@
+package shardkv
+
+import "sync"
+import "time"
+import "math"
+import "math/rand"
+import "sort"
+
+// half-life of the access counts behind HotKeys()
+const HotKeyHalfLife = 10 * time.Second
+
+// most keys a server keeps access counts for
+const MaxHotKeys = 1000
+
+//
+// decaying access counts of the keys a server is asked
+// about. only one access in sample is counted (as sample
+// accesses), so the hot path is usually just a random draw.
+//
+type hotKeys struct {
+	mu     sync.Mutex
+	sample int
+	counts map[string]*keyCount
+}
+
+type keyCount struct {
+	count float64   // decayed count as of last
+	last  time.Time
+}
+
+func makeHotKeys(sample int) *hotKeys {
+	if sample < 1 {
+		sample = 1
+	}
+	return &hotKeys{sample:sample, counts:map[string]*keyCount{}}
+}
+
+// the count of kc decayed to now
+func (kc *keyCount) at(now time.Time) float64 {
+	halves := float64(now.Sub(kc.last)) / float64(HotKeyHalfLife)
+	return kc.count * math.Pow(0.5, halves)
+}
+
+// note an access to key
+func (hk *hotKeys) touch(key string) {
+	if hk.sample > 1 && rand.Intn(hk.sample) != 0 {
+		return
+	}
+
+	hk.mu.Lock()
+	defer hk.mu.Unlock()
+
+	now := time.Now()
+	kc, ok := hk.counts[key]
+	if !ok {
+		if len(hk.counts) >= MaxHotKeys {
+			hk.evict(now)
+		}
+		kc = &keyCount{last:now}
+		hk.counts[key] = kc
+	}
+	kc.count = kc.at(now) + float64(hk.sample)
+	kc.last = now
+}
+
+// drop the coldest key
+func (hk *hotKeys) evict(now time.Time) {
+	coldest, min := "", math.Inf(1)
+	for key, kc := range hk.counts {
+		if c := kc.at(now); c < min {
+			coldest, min = key, c
+		}
+	}
+	delete(hk.counts, coldest)
+}
+
+// the n most accessed keys, hottest first
+func (hk *hotKeys) top(n int) []KeyRate {
+	hk.mu.Lock()
+	defer hk.mu.Unlock()
+
+	// a count decaying with half-life h, fed r accesses a
+	// second, levels off at r*h/ln(2)
+	now := time.Now()
+	scale := math.Ln2 / HotKeyHalfLife.Seconds()
+	rates := []KeyRate{}
+	for key, kc := range hk.counts {
+		rates = append(rates, KeyRate{key, kc.at(now) * scale})
+	}
+	sort.Sort(byRate(rates))
+	if len(rates) > n {
+		rates = rates[:n]
+	}
+	return rates
+}
+
+type byRate []KeyRate
+
+func (a byRate) Len() int           { return len(a) }
+func (a byRate) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byRate) Less(i, j int) bool { return a[i].Rate > a[j].Rate }
@@ -0,0 +1,117 @@
+package shardkv
+
+import "strconv"
+import "time"
+
+//
+// read leases. with Options.LeaseDuration set, one server of
+// a group at a time holds a lease, agreed by logging a Lease
+// op, and serves Gets from its applied state without logging
+// them, until the lease runs out. the holder renews it
+// through the log well before then.
+//
+// while a lease is in effect, the log fences off the other
+// servers: an op they logged (other than a Get or no-op)
+// whose Op.Time falls within the lease is decided but not
+// applied, and their clients get ErrNotLeader and go on to
+// the next server. so every write that completes during the
+// lease went through the holder, which has applied it before
+// replying. the holder stops reading locally LeaseMargin
+// before its lease ends, so servers' clocks may be that far
+// apart.
+//
+// a Get falls back to the log while a config the holder has
+// seen is not applied yet, or its key has a TTL.
+//
+
+// how far apart the servers' clocks may be
+const LeaseMargin = 50 * time.Millisecond
+
+// the lease as of the last op applied
+type leaseState struct {
+	Holder int   // Op.Proposer of the holder; 0 if none yet
+	Until  int64 // log clock (ms) at which it ends
+}
+
+// the current time in ms, as stamped on ops (see Op.Time)
+func nowMillis() int64 {
+	return time.Now().UnixNano() / int64(time.Millisecond)
+}
+
+//
+// is op logged by a server other than the holder during its
+// lease? ops of unknown proposer (Proposer 0) never are,
+// nor those that change nothing.
+//
+func (ap *applier) fenced(op *Op) bool {
+	switch op.Op {
+	case Get, Noop, RepairSharding:
+		return false
+	}
+	if op.Proposer == 0 || op.Proposer == ap.lease.Holder {
+		return false
+	}
+	return op.Time < ap.lease.Until
+}
+
+// does another server hold the lease? kv.mu must be held.
+func (kv *ShardKV) leasedElsewhere() bool {
+	return kv.lease.Holder != 0 && kv.lease.Holder != kv.me + 1 &&
+		nowMillis() < kv.lease.Until
+}
+
+//
+// serve a Get from the applied state, if this server holds
+// the lease and nothing may have changed the key that it
+// hasn't applied. false if the Get must be logged.
+// kv.mu must be held.
+//
+func (kv *ShardKV) leaseRead(args *GetArgs, reply *GetReply) bool {
+	if kv.leaseMillis == 0 || kv.lease.Holder != kv.me + 1 {
+		return false
+	}
+	kv.learn()
+	margin := int64(LeaseMargin / time.Millisecond)
+	if nowMillis() >= kv.lease.Until - margin || kv.config.Num < kv.latest {
+		return false
+	}
+	if _, ok := kv.xstate.Expires[args.Key]; ok {
+		return false
+	}
+	if _, ok := kv.xstate.Deadlines[args.Key]; ok {
+		return false
+	}
+	xop := &Op{Op:Get, Key:args.Key}
+	xop.HasDefault, xop.Default = kv.missingDefault(args)
+	if !kv.admit(xop) {
+		reply.Err = ErrRejected
+		return true
+	}
+	rep := withDefault(kv.doGet(args.Key), xop)
+	reply.Err, reply.Value, reply.Version = rep.Err, rep.Value, rep.Version
+	kv.countReply(key2shard(args.Key), reply.Err)
+	kv.leaseReads++
+	return true
+}
+
+//
+// take the lease if no other server holds it, or renew it
+// once half of it has gone by.
+//
+func (kv *ShardKV) renewLease() {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	kv.learn()
+	now := nowMillis()
+	if kv.lease.Holder == kv.me + 1 && now < kv.lease.Until - kv.leaseMillis / 2 {
+		return
+	}
+	if kv.lease.Holder != kv.me + 1 && now < kv.lease.Until + int64(LeaseMargin / time.Millisecond) {
+		// another's, or only just run out
+		return
+	}
+	cid := "lease-" + strconv.FormatInt(nrand(), 16)
+	kv.logOperation(&Op{CID:cid, Seq:1, Op:Lease, Time:now})
+	kv.catchUp()
+}
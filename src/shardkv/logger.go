@@ -0,0 +1,107 @@
+package shardkv
+
+import "fmt"
+import "io"
+import "sync"
+
+//
+// leveled, structured logging.
+//
+// a server reports what it does as events to the Logger in
+// its Options: a level, a fixed message, and fields such as
+// the group, server, log seq, shard and client involved.
+// messages don't vary, so that events can be matched on
+// them; the details are in the fields. every event carries
+// "gid" and "me". without a Logger, events are dropped.
+//
+// at LevelInfo a server reports reconfigurations and ops
+// refused because the group doesn't own the key's shard, which
+// is enough to follow shard ownership; LevelDebug adds each RPC
+// and op applied.
+//
+
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "DEBUG"
+	case LevelInfo:
+		return "INFO"
+	case LevelWarn:
+		return "WARN"
+	case LevelError:
+		return "ERROR"
+	}
+	return fmt.Sprintf("Level(%d)", int(l))
+}
+
+// a named value attached to an event
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+// receives a server's events. called from many goroutines,
+// sometimes with kv.mu held: it must not call back into the
+// server.
+type Logger interface {
+	Log(level Level, msg string, fields []Field)
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Log(Level, string, []Field) {}
+
+type textLogger struct {
+	mu  sync.Mutex
+	w   io.Writer
+	min Level
+}
+
+//
+// a Logger that writes each event at min or above to w as
+// one line: the level, the message, then key=value fields.
+//
+func NewTextLogger(w io.Writer, min Level) Logger {
+	return &textLogger{w: w, min: min}
+}
+
+func (tl *textLogger) Log(level Level, msg string, fields []Field) {
+	if level < tl.min {
+		return
+	}
+	line := level.String() + " " + msg
+	for _, f := range fields {
+		line += fmt.Sprintf(" %s=%v", f.Key, f.Value)
+	}
+	tl.mu.Lock()
+	defer tl.mu.Unlock()
+	fmt.Fprintln(tl.w, line)
+}
+
+// report an event, with this server's gid and me
+func (ap *applier) logEvent(level Level, msg string, fields ...Field) {
+	all := make([]Field, 0, len(fields) + 2)
+	all = append(all, Field{"gid", ap.gid}, Field{"me", ap.me})
+	ap.log.Log(level, msg, append(all, fields...))
+}
+
+//
+// report that an op on key was refused with ErrWrongGroup,
+// with the config that refused it and the shard's owner.
+//
+func (ap *applier) wrongGroup(op string, key string) {
+	shard := key2shard(key)
+	ap.logEvent(LevelInfo, "wrong group",
+		Field{"op", op}, Field{"key", key}, Field{"shard", shard},
+		Field{"config", ap.config.Num}, Field{"owner", ap.config.Shards[shard]},
+		Field{"frozen", ap.frozen[shard]})
+}
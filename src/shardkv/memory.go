@@ -0,0 +1,206 @@
+package shardkv
+
+import "time"
+import "paxos"
+
+//
+// memory accounting, for servers started with a MemoryLimit.
+//
+// every MemoryCheckInterval a server estimates the bytes its
+// state holds: the key/value store and the other per-key
+// maps, the duplicate-detection tables, and the ops paxos
+// still holds for it. the estimate counts the strings and a
+// fixed overhead per map entry and log op; it is meant for
+// comparing against a limit, not for exact accounting.
+//
+// once the estimate reaches MemoryHighWater of the limit,
+// the server relieves memory: it applies every op decided
+// so far and tells paxos it is done with them, so that the
+// log can be forgotten as far as the other peers allow, and
+// it logs a RebuildDedup to drop the recorded replies. (paxos
+// has no snapshots, so the store itself can't be compacted.)
+// once the estimate reaches the limit, writes that would
+// grow the store get ErrMemoryPressure without being logged;
+// writes that keep or shrink a value still go through. a
+// growing write a server admits counts, once, towards its
+// estimate until the next check, which one reaching
+// MemoryHighWater brings forward, so a burst can't get far
+// past the limit.
+//
+
+// how often a server with a MemoryLimit estimates its memory
+const MemoryCheckInterval = 100 * time.Millisecond
+
+// fraction of the MemoryLimit at which mitigations start
+const MemoryHighWater = 0.9
+
+// rough bytes of bookkeeping per map entry or log op
+const entryOverhead = 48
+
+// the estimated bytes held in xs
+func (xs *XState) bytes() int {
+	n := 0
+	for key, value := range xs.KVStore {
+		n += entryOverhead + len(key) + len(value)
+	}
+	for key := range xs.Versions {
+		n += entryOverhead + len(key)
+	}
+	for key := range xs.Expires {
+		n += entryOverhead + len(key)
+	}
+	for key := range xs.Deadlines {
+		n += entryOverhead + len(key)
+	}
+	for key := range xs.Mirrors {
+		n += entryOverhead + len(key)
+	}
+	for key, gids := range xs.Unmirrored {
+		n += entryOverhead + len(key) + 8 * len(gids)
+	}
+	for key := range xs.MirrorEpochs {
+		n += entryOverhead + len(key)
+	}
+	for key, c := range xs.Copies {
+		n += entryOverhead + len(key) + len(c.Value)
+	}
+	for cid := range xs.MRRSMap {
+		n += 4 * entryOverhead + 4 * len(cid)
+	}
+	for _, rep := range xs.Replies {
+		n += len(rep.Err) + len(rep.Value)
+	}
+	for _, recent := range xs.Recent {
+		for _, sr := range recent {
+			n += entryOverhead + len(sr.Rep.Err) + len(sr.Rep.Value)
+		}
+	}
+	for _, seqs := range xs.ShardSeqs {
+		for cid := range seqs {
+			n += entryOverhead + len(cid)
+		}
+	}
+	for key, lock := range xs.Locks {
+		n += entryOverhead + len(key) + len(lock.Txn) + len(lock.Coord) + len(lock.Value)
+	}
+	for txn, outcome := range xs.Outcomes {
+		n += entryOverhead + len(txn) + len(outcome.Coord)
+	}
+	return n
+}
+
+// the estimated bytes of op, as held in the paxos log
+func opBytes(op *Op) int {
+	n := entryOverhead + len(op.CID) + len(op.Op) + len(op.Key) + len(op.Value) + len(op.Default) + len(op.Expected)
+	switch extra := op.Extra.(type) {
+	case ReconfExtra:
+		n += extra.XState.bytes()
+	case TxnArgs:
+		for key, value := range extra.Writes {
+			n += entryOverhead + len(key) + len(value)
+		}
+	case PutBatchArgs:
+		for _, kv := range extra.KVs {
+			n += entryOverhead + len(kv.Key) + len(kv.Value)
+		}
+	case CondTxnArgs:
+		for _, kv := range append(extra.Reads, extra.Writes...) {
+			n += entryOverhead + len(kv.Key) + len(kv.Value)
+		}
+	case BatchExtra:
+		for i := range extra.Ops {
+			n += opBytes(&extra.Ops[i])
+		}
+	case MirrorCopy:
+		n += len(extra.Value)
+	case string:
+		n += len(extra)
+	}
+	return n
+}
+
+//
+// the estimated bytes of this server's state, including the
+// decided ops paxos still holds. kv.mu must be held.
+//
+func (kv *ShardKV) memoryEstimate() int {
+	n := kv.xstate.bytes()
+	for seq := kv.px.Min(); seq <= kv.px.Max(); seq++ {
+		if fate, v := kv.px.Status(seq); fate == paxos.Decided {
+			op := v.(Op)
+			n += opBytes(&op)
+		}
+	}
+	return n
+}
+
+//
+// update the memory estimate, and relieve memory if it is
+// past MemoryHighWater of the limit.
+//
+func (kv *ShardKV) checkMemory() {
+	kv.mu.Lock()
+	kv.memBytes = kv.memoryEstimate()
+	kv.charged = map[opKey]bool{}
+	high := float64(kv.memBytes) >= MemoryHighWater * float64(kv.memLimit)
+	if high {
+		// lets paxos forget the ops applied
+		kv.learn()
+	}
+	prune := high && len(kv.xstate.Replies) > 0
+	kv.mu.Unlock()
+
+	if prune {
+		kv.RebuildDedup()
+	}
+	if high {
+		kv.mu.Lock()
+		kv.mitigations++
+		kv.memBytes = kv.memoryEstimate()
+		kv.charged = map[opKey]bool{}
+		kv.mu.Unlock()
+	}
+}
+
+//
+// would xop, a Put or Append, be refused for lack of memory?
+// kv.mu must be held.
+//
+func (kv *ShardKV) memoryPressure(xop *Op) bool {
+	return kv.memLimit > 0 && kv.grows(xop) && kv.memBytes >= kv.memLimit
+}
+
+// would xop, a Put or Append, grow the store?
+func (kv *ShardKV) grows(xop *Op) bool {
+	if xop.Op == Append || xop.Op == AppendBounded {
+		return len(xop.Value) > 0
+	}
+	old, ok := kv.xstate.KVStore[xop.Key]
+	return !ok || len(xop.Value) > len(old)
+}
+
+//
+// count the bytes of xop, a Put or Append about to be logged,
+// towards the estimate at once if it grows the store, since
+// writes may come in faster than checkMemory() runs. a retry
+// of an op already counted since the last check is not
+// counted again. kv.mu must be held.
+//
+func (kv *ShardKV) chargeMemory(xop *Op) {
+	if kv.memLimit <= 0 || !kv.grows(xop) {
+		return
+	}
+	key := opKey{xop.CID, xop.Seq}
+	if kv.charged[key] {
+		return
+	}
+	kv.charged[key] = true
+	kv.memBytes += opBytes(xop)
+	if float64(kv.memBytes) >= MemoryHighWater * float64(kv.memLimit) {
+		// relieve memory now rather than at the next check
+		select {
+		case kv.memPoke <- true:
+		default:
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package shardkv
+
+import "fmt"
+import "net/http"
+import "shardmaster"
+import "time"
+
+//
+// counters for monitoring a server. ops are counted as this
+// server applies them from the log, so every replica of a
+// group counts the same ones; ErrWrongGroup replies are
+// counted by the server that sent them.
+//
+// a server also watches for a shard it answers nothing but
+// ErrWrongGroup for, as when clients' configs and the
+// groups' disagree for a while, or a migration is stuck:
+// once such a run of replies lasts StuckShardAfter, the
+// server warns "shard stuck" and counts the shard in
+// StuckShards until it serves the shard again or the
+// replies stop.
+//
+
+// how long a shard is answered only ErrWrongGroup before
+// a server warns it is stuck, unless Options say otherwise
+const StuckShardAfter = 10 * time.Second
+
+type Metrics struct {
+	Gets        int // Get ops applied
+	Puts        int // Put ops applied
+	Appends     int // Append and AppendBounded ops applied
+	Reconfigs   int // Reconf ops applied
+	WrongGroup  int // client requests answered ErrWrongGroup
+	ConfigNum   int
+	OwnedShards int // shards served in ConfigNum
+	Gap         int // log slots decided but not yet applied
+	StuckShards int // shards answered only ErrWrongGroup for StuckShardAfter
+}
+
+// a run of ErrWrongGroup replies for one shard. under kv.mu
+type wrongRun struct {
+	n     int       // replies in the run
+	since time.Time // of the first
+	last  time.Time // of the latest
+	stuck bool      // warned of
+}
+
+// count an op applied from the log. kv.mu must be held.
+func (kv *ShardKV) countApplied(op *Op) {
+	switch op.Op {
+	case Get:
+		kv.counts.Gets++
+	case Put:
+		kv.counts.Puts++
+	case Append, AppendBounded:
+		kv.counts.Appends++
+	case Reconf:
+		kv.counts.Reconfigs++
+	}
+}
+
+//
+// count a reply to a client request for shard (AllShards for
+// none in particular). kv.mu must be held.
+//
+func (kv *ShardKV) countReply(shard int, err Err) {
+	if err == ErrWrongGroup {
+		kv.counts.WrongGroup++
+	}
+	if shard == AllShards || (err != ErrWrongGroup && err != OK) {
+		return
+	}
+
+	run := &kv.wrongRuns[shard]
+	now := time.Now()
+	if err == OK || now.Sub(run.last) > kv.stuckAfter {
+		// served, or no longer asked for here
+		if run.stuck {
+			kv.logEvent(LevelInfo, "shard unstuck", Field{"shard", shard},
+				Field{"replies", run.n}, Field{"config", kv.config.Num})
+		}
+		*run = wrongRun{}
+		if err == OK {
+			return
+		}
+	}
+
+	if run.n == 0 {
+		run.since = now
+	}
+	run.n++
+	run.last = now
+	if !run.stuck && now.Sub(run.since) >= kv.stuckAfter {
+		run.stuck = true
+		kv.logEvent(LevelWarn, "shard stuck", Field{"shard", shard},
+			Field{"replies", run.n}, Field{"for", now.Sub(run.since)},
+			Field{"config", kv.config.Num}, Field{"owner", kv.config.Shards[shard]})
+	}
+}
+
+// the shard a client op given to execute() is for, or
+// AllShards if it's for no one shard
+func opShard(xop *Op) int {
+	switch xop.Op {
+	case Mirror, Apply, Incr, Delete:
+		return key2shard(xop.Key)
+	case ClearShard:
+		return xop.Extra.(int)
+	case CondTxn:
+		args := xop.Extra.(CondTxnArgs)
+		return args.shard()
+	}
+	return AllShards
+}
+
+// whether shard's run of ErrWrongGroup replies has gone on
+// too long, and is still going. kv.mu must be held.
+func (kv *ShardKV) stuck(shard int) bool {
+	run := &kv.wrongRuns[shard]
+	return run.stuck && time.Since(run.last) <= kv.stuckAfter
+}
+
+func (kv *ShardKV) Metrics() Metrics {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	m := kv.counts
+	m.ConfigNum = kv.config.Num
+	for shard := 0; shard < shardmaster.NShards; shard++ {
+		if kv.config.Shards[shard] == kv.gid {
+			m.OwnedShards++
+		}
+	}
+	m.Gap = kv.seq - kv.last_seq
+	for shard := 0; shard < shardmaster.NShards; shard++ {
+		if kv.stuck(shard) {
+			m.StuckShards++
+		}
+	}
+	return m
+}
+
+//
+// an HTTP handler serving Metrics() as text, one
+// "name{labels} value" line per metric, for scraping.
+//
+func (kv *ShardKV) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m := kv.Metrics()
+		labels := fmt.Sprintf("{gid=\"%d\",server=\"%d\"}", kv.gid, kv.me)
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		for _, metric := range []struct {
+			name  string
+			value int
+		}{
+			{"shardkv_gets_total", m.Gets},
+			{"shardkv_puts_total", m.Puts},
+			{"shardkv_appends_total", m.Appends},
+			{"shardkv_reconfigurations_total", m.Reconfigs},
+			{"shardkv_wrong_group_total", m.WrongGroup},
+			{"shardkv_config_num", m.ConfigNum},
+			{"shardkv_owned_shards", m.OwnedShards},
+			{"shardkv_apply_gap", m.Gap},
+			{"shardkv_stuck_shards", m.StuckShards},
+		} {
+			fmt.Fprintf(w, "%s%s %d\n", metric.name, labels, metric.value)
+		}
+	})
+}
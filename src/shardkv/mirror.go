@@ -0,0 +1,168 @@
+package shardkv
+
+import "strconv"
+import "time"
+
+//
+// mirroring: a key's group can keep a copy of the key on a
+// second group, so that the key stays readable (if stale)
+// while its own group is down.
+//
+// the mirror is asynchronous. a write is acknowledged once
+// its own group has logged it; each replica of that group
+// then pushes the key's value and version to the mirror
+// group every MirrorInterval or so, until one push has been
+// logged there. a mirror copy may therefore lag behind the
+// key by any number of writes, and a write acknowledged
+// just before the key's group went down may never reach
+// the mirror. copies only ever move forward in version
+// while the key stays mirrored onto the group, so a read of
+// the mirror never goes back to an older value than an
+// earlier read of the same mirror returned.
+//
+// when a key stops being mirrored onto a group, or is
+// mirrored onto another, its group pushes the old mirror
+// group a Dropped copy in the same way, which leaves the
+// key unreadable there. copies carry the number of Mirror
+// ops on the key so far, and one pushed after a later
+// Mirror op wins whatever its version, so a late push from
+// before the mirroring stopped can't bring the copy back.
+//
+
+// how often each server pushes changed mirrored keys
+const MirrorInterval = 100 * time.Millisecond
+
+// a key and a group it is (or was) mirrored onto
+type mirrorTarget struct {
+	key string
+	gid int64
+}
+
+// a push of a key's version to a mirror group
+type mirrorPush struct {
+	epoch   int
+	version int
+	dropped bool
+}
+
+// RPC handler for mirroring a key onto another group
+func (kv *ShardKV) Mirror(args *MirrorArgs, reply *MirrorReply) error {
+	defer kv.handling()()
+
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	kv.logEvent(LevelDebug, "rpc", Field{"op", Mirror}, Field{"client", args.CID},
+		Field{"client_seq", args.Seq}, Field{"key", args.Key}, Field{"to", args.Gid})
+
+	rep := kv.execute(&Op{CID:args.CID, Seq:args.Seq, Op:Mirror, Key:args.Key, Extra:args.Gid})
+	reply.Err = rep.Err
+
+	return nil
+}
+
+//
+// RPC handler for a push from the group of a key mirrored
+// onto this one. pushes older than the copy held are
+// ignored, so retries and pushes from several replicas of
+// the sender are harmless.
+//
+func (kv *ShardKV) MirrorWrite(args *MirrorWriteArgs, reply *MirrorWriteReply) error {
+	defer kv.handling()()
+
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	kv.catchUp()
+	if newerCopy(args.Copy, kv.xstate.Copies[args.Key]) {
+		cid := "mirror-" + strconv.FormatInt(nrand(), 16)
+		if err := kv.logOperation(&Op{CID:cid, Seq:1, Op:MirrorWrite, Key:args.Key, Extra:args.Copy}); err != OK {
+			reply.Err = err
+			return nil
+		}
+		kv.catchUp()
+		if newerCopy(args.Copy, kv.xstate.Copies[args.Key]) {
+			// fenced off by another server's read lease
+			reply.Err = ErrNotLeader
+			return nil
+		}
+	}
+	reply.Err = OK
+	return nil
+}
+
+//
+// RPC handler for reading this group's copy of a mirrored
+// key. logs nothing, so it answers even if the group has
+// lost its majority, from whatever copy this server knows.
+//
+func (kv *ShardKV) GetMirror(args *GetMirrorArgs, reply *GetMirrorReply) error {
+	defer kv.handling()()
+
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	kv.learn()
+	c, ok := kv.xstate.Copies[args.Key]
+	if !ok || c.Dropped {
+		reply.Err = ErrNoKey
+		return nil
+	}
+	reply.Err, reply.Copy = OK, c
+	return nil
+}
+
+//
+// push the mirrored keys this group serves whose version
+// their mirror group has not acknowledged to this server,
+// and the drops of keys no longer mirrored onto a group.
+// does not hold kv.mu while waiting on the mirror groups.
+//
+func (kv *ShardKV) pushMirrors() {
+	kv.mu.Lock()
+	kv.learn()
+	pushes := map[mirrorTarget]mirrorPush{}
+	copies := map[mirrorTarget]MirrorCopy{}
+	servers := map[int64][]string{}
+	add := func(key string, gid int64, dropped bool) {
+		t := mirrorTarget{key, gid}
+		push := mirrorPush{kv.xstate.MirrorEpochs[key], kv.xstate.Versions[key], dropped}
+		if kv.pushed[t] == push {
+			return
+		}
+		value, ok := kv.xstate.KVStore[key]
+		if dropped {
+			value, ok = "", false
+		}
+		pushes[t] = push
+		copies[t] = MirrorCopy{value, ok, push.version, push.epoch, dropped}
+		servers[gid] = kv.config.Groups[gid]
+	}
+	for key, gid := range kv.xstate.Mirrors {
+		if kv.owns(key2shard(key)) {
+			add(key, gid, false)
+		}
+	}
+	for key, gids := range kv.xstate.Unmirrored {
+		if kv.owns(key2shard(key)) {
+			for _, gid := range gids {
+				add(key, gid, true)
+			}
+		}
+	}
+	kv.mu.Unlock()
+
+	for t, push := range pushes {
+		for _, srv := range servers[t.gid] {
+			args := &MirrorWriteArgs{Key:t.key, Copy:copies[t]}
+			var reply MirrorWriteReply
+			ok := send(srv, "ShardKV.MirrorWrite", args, &reply)
+			if ok && reply.Err == OK {
+				kv.mu.Lock()
+				kv.pushed[t] = push
+				kv.mu.Unlock()
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package shardkv
+
+import "context"
+
+//
+// reads of several keys in one round trip. a group serves a
+// MultiGet as one confirmed read (see ConfirmLeadership()):
+// a shared no-op is logged, and every key is then read from
+// the state it leaves, so the reads are as up to date as a
+// Get each. keys of shards the group doesn't serve are
+// answered ErrWrongGroup one by one, for the clerk to ask
+// their groups.
+//
+
+type MultiGetArgs struct {
+	Keys []string
+	CID  string // for rate limiting
+}
+
+// the answer for one of MultiGetArgs.Keys, as for a Get
+type GetResult struct {
+	Err     Err
+	Value   string
+	Version int
+}
+
+type MultiGetReply struct {
+	Err       Err         // OK if Results holds an answer per key
+	Results   []GetResult // in the order of MultiGetArgs.Keys
+	ConfigNum int         // the config the server was in
+}
+
+func (kv *ShardKV) MultiGet(args *MultiGetArgs, reply *MultiGetReply) error {
+	defer kv.handling()()
+	for _, key := range args.Keys {
+		kv.hot.touch(key)
+	}
+
+	if !kv.limiter.allow(args.CID) {
+		reply.Err = ErrRateLimited
+		return nil
+	}
+	if err := kv.ConfirmLeadership(); err != OK {
+		reply.Err = err
+		return nil
+	}
+
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	kv.logEvent(LevelDebug, "rpc", Field{"op", "MultiGet"}, Field{"client", args.CID},
+		Field{"keys", len(args.Keys)})
+
+	reply.ConfigNum = kv.config.Num
+	reply.Results = make([]GetResult, len(args.Keys))
+	for i, key := range args.Keys {
+		res := &reply.Results[i]
+		xop := &Op{Op:Get, Key:key}
+		xop.HasDefault, xop.Default = kv.missingDefault(&GetArgs{Key:key})
+		if !kv.admit(xop) {
+			res.Err = ErrRejected
+			continue
+		}
+		rep := kv.doGet(key)
+		if rep.Err == OK && kv.expired(kv.last_seq, key) {
+			rep = &Rep{Err:ErrNoKey}
+		}
+		rep = withDefault(rep, xop)
+		res.Err, res.Value, res.Version = kv.arriving(key, rep.Err), rep.Value, rep.Version
+		kv.countReply(key2shard(key), res.Err)
+	}
+	reply.Err = OK
+	return nil
+}
+
+//
+// fetch the values of keys, in one MultiGet per group serving
+// some of them (more if shards move meanwhile). a missing key
+// reads as "", as with Get().
+//
+func (ck *Clerk) MultiGet(keys []string) []string {
+	ck.mu.Lock()
+	defer ck.mu.Unlock()
+
+	values := make([]string, len(keys))
+	left := map[int]bool{} // indices into keys still to read
+	for i := range keys {
+		left[i] = true
+	}
+
+	wait := ck.backoff
+	for len(left) > 0 {
+		byGroup := map[int64][]int{}
+		for i := range left {
+			gid := ck.config.Shards[key2shard(keys[i])]
+			byGroup[gid] = append(byGroup[gid], i)
+		}
+
+		stale := false
+		for gid, idx := range byGroup {
+			servers, ok := ck.config.Groups[gid]
+			if !ok {
+				stale = true
+				continue
+			}
+			args := &MultiGetArgs{CID:ck.me}
+			for _, i := range idx {
+				args.Keys = append(args.Keys, keys[i])
+			}
+			answered := false
+			for _, srv := range ck.preferred(gid, servers) {
+				var reply MultiGetReply
+				ck.sent++
+				if !send(srv, "ShardKV.MultiGet", args, &reply) || reply.Err != OK {
+					continue
+				}
+				ck.leaders[gid] = srv
+				answered = true
+				for j, res := range reply.Results {
+					switch res.Err {
+					case OK, ErrNoKey, ErrRejected:
+						values[idx[j]] = res.Value
+						delete(left, idx[j])
+					case ErrWrongGroup:
+						stale = true
+					}
+				}
+				break
+			}
+			if !answered {
+				stale = true
+			}
+		}
+
+		if len(left) > 0 {
+			wait = ck.retryWait(context.Background(), wait)
+			if stale {
+				ck.refresh()
+			}
+		}
+	}
+	return values
+}
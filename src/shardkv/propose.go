@@ -0,0 +1,192 @@
+package shardkv
+
+import "context"
+import "time"
+import "paxos"
+
+//
+// data-plane ops (Get and PutAppend) don't hold kv.mu while
+// paxos decides them, so that ops on different shards are in
+// the log at once. each holds the lock of its key's shard
+// instead, and claims a log slot of its own (kv.next) that
+// no other handler of this server proposes into. ops whose
+// slots are decided out of order wait for the slots before
+// theirs; kv.seq only ever covers decided slots. a retried
+// op may so be decided twice (see applier.apply()).
+//
+// locks are taken in this order, and none is taken while a
+// later one is held:
+//
+//   kv.shardMu[shard]  one data-plane op per shard
+//   kv.mu              everything else, incl. logging other ops
+//   kv.smu             the applier, for speculative reads
+//   kv.cmu, kv.pmu     ConfirmLeadership() rounds, progress
+//
+// kv.mu is released while waiting on paxos or on other
+// servers, so a handler that holds it must not assume state
+// it read before such a wait is still current.
+//
+
+// a client op a handler is waiting on
+type opKey struct {
+	cid string
+	seq int
+}
+
+// the reply to an op, once applied
+type opResult struct {
+	rep     *Rep
+	waiters int
+}
+
+//
+// a context for a request that gives up after timeout,
+// if timeout > 0.
+//
+func requestContext(timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout > 0 {
+		return context.WithTimeout(context.Background(), timeout)
+	}
+	return context.WithCancel(context.Background())
+}
+
+//
+// whether a request with deadline (zero for none) arrived too
+// late to be worth logging. checked on arrival only, by this
+// server's clock.
+//
+func pastDeadline(deadline time.Time) bool {
+	return !deadline.IsZero() && time.Now().After(deadline)
+}
+
+//
+// log a client op and return its reply, releasing kv.mu
+// while paxos decides it. gives up with ErrTimeout once ctx
+// is done, or after Options.ProposeTimeout; the op may still
+// be decided and applied later. ErrNotReady if paxos won't
+// start a slot that far ahead of the log's forgotten prefix.
+// kv.mu and the op's shard lock must be held.
+//
+func (kv *ShardKV) propose(ctx context.Context, xop *Op) *Rep {
+	if kv.proposeTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, kv.proposeTimeout)
+		defer cancel()
+	}
+
+	k := opKey{xop.CID, xop.Seq}
+	r, ok := kv.results[k]
+	if !ok {
+		r = &opResult{}
+		kv.results[k] = r
+	}
+	r.waiters++
+	defer func() {
+		if r.waiters--; r.waiters == 0 {
+			delete(kv.results, k)
+		}
+	}()
+
+	if xop.Time == 0 {
+		xop.Time = nowMillis()
+	}
+	xop.Proposer = kv.me + 1
+
+	for r.rep == nil && !kv.halted() {
+		var err Err
+		if kv.batchWindow > 0 {
+			err = kv.proposeBatched(ctx, xop, r)
+		} else {
+			var mine bool
+			mine, err = kv.proposeInSlot(ctx, xop)
+			if err == OK {
+				// ours is applied once the slots before it are decided
+				kv.learn()
+				if mine {
+					err = kv.awaitResult(ctx, r)
+				}
+			}
+		}
+		if err == ErrTimeout || err == ErrNotReady {
+			return &Rep{Err:err}
+		}
+	}
+	if r.rep == nil {
+		// killed
+		return &Rep{Err:ErrShutdown}
+	}
+	return r.rep
+}
+
+//
+// claim the next log slot of this server's own, propose xop
+// in it, and wait until it is decided. returns whether xop
+// won it; ErrTimeout once ctx is done, ErrShutdown if the
+// server is killed, ErrNotReady if paxos won't start seq.
+// kv.mu must be held.
+//
+func (kv *ShardKV) proposeInSlot(ctx context.Context, xop *Op) (bool, Err) {
+	if kv.next < kv.seq {
+		kv.next = kv.seq
+	}
+	seq := kv.next
+	kv.next++
+	kv.logEvent(LevelDebug, "proposing", Field{"seq", seq}, Field{"op", xop.Op},
+		Field{"client", xop.CID}, Field{"client_seq", xop.Seq})
+	var started bool
+	if seq < kv.px.Max() {
+		// a gap behind instances already known, as in
+		// logOperation()
+		kv.throttleFill()
+		started = kv.px.StartPriority(seq, *xop, paxos.PriorityHigh)
+	} else {
+		started = kv.px.Start(seq, *xop)
+	}
+	if !started {
+		// too far past what paxos keeps; the log must catch up
+		kv.logEvent(LevelWarn, "slot refused", Field{"seq", seq}, Field{"op", xop.Op})
+		kv.next = seq
+		return false, ErrNotReady
+	}
+
+	wait := kv.backoff
+	for !kv.halted() {
+		fate, v := kv.px.Status(seq)
+		if fate == paxos.Forgotten {
+			// the peers forgot ops this server never applied
+			kv.catchUpFromPeer()
+			return false, OK
+		}
+		if fate == paxos.Decided {
+			op := v.(Op)
+			return xop.IsSame(&op), OK
+		}
+		if ctx.Err() != nil {
+			return false, ErrTimeout
+		}
+		kv.mu.Unlock()
+		kv.awaitDecided(seq, wait)
+		kv.mu.Lock()
+		wait = kv.backOff(wait)
+	}
+	return false, ErrShutdown
+}
+
+//
+// apply the log until r's op, decided in it, is applied.
+// ErrTimeout once ctx is done. kv.mu must be held.
+//
+func (kv *ShardKV) awaitResult(ctx context.Context, r *opResult) Err {
+	for r.rep == nil && !kv.halted() {
+		if ctx.Err() != nil {
+			return ErrTimeout
+		}
+		// the first slot not yet decided holds r's op back
+		next := kv.seq
+		kv.mu.Unlock()
+		kv.awaitDecided(next, kv.backoff)
+		kv.mu.Lock()
+		kv.learn()
+	}
+	return OK
+}
@@ -0,0 +1,103 @@
+package shardkv
+
+import "sync"
+import "time"
+
+//
+// per-client rate limits, for servers started with a
+// ClientRate. each client (by CID) has a token bucket of
+// ClientBurst tokens, refilled at ClientRate a second; a Get
+// or PutAppend takes a token, and one arriving to an empty
+// bucket gets ErrRateLimited without being logged, so a
+// client flooding its group doesn't crowd the others out of
+// the log. Clerks back off and retry.
+//
+// the buckets are each server's own, not replicated: a
+// client spreading its requests over a group's servers may
+// get up to one ClientRate from each.
+//
+
+// most clients a server keeps buckets for
+const MaxRateClients = 10000
+
+type rateLimiter struct {
+	mu      sync.Mutex
+	rate    float64 // tokens a second
+	burst   float64
+	buckets map[string]*bucket
+	refused int
+}
+
+type bucket struct {
+	tokens float64 // as of last
+	last   time.Time
+}
+
+// a limiter of rate requests a second per client, or nil for none
+func makeRateLimiter(rate int, burst int) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = rate
+	}
+	return &rateLimiter{rate:float64(rate), burst:float64(burst), buckets:map[string]*bucket{}}
+}
+
+// the tokens of b refilled to now
+func (rl *rateLimiter) at(b *bucket, now time.Time) float64 {
+	tokens := b.tokens + now.Sub(b.last).Seconds() * rl.rate
+	if tokens > rl.burst {
+		tokens = rl.burst
+	}
+	return tokens
+}
+
+// take a token of cid's, if it has one
+func (rl *rateLimiter) allow(cid string) bool {
+	if rl == nil {
+		return true
+	}
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	now := time.Now()
+	b, ok := rl.buckets[cid]
+	if !ok {
+		if len(rl.buckets) >= MaxRateClients {
+			rl.evict()
+		}
+		b = &bucket{tokens:rl.burst, last:now}
+		rl.buckets[cid] = b
+	}
+	b.tokens, b.last = rl.at(b, now), now
+	if b.tokens < 1 {
+		rl.refused++
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// drop the bucket of the client idle longest
+func (rl *rateLimiter) evict() {
+	var idlest string
+	var oldest *bucket
+	for cid, b := range rl.buckets {
+		if oldest == nil || b.last.Before(oldest.last) {
+			idlest, oldest = cid, b
+		}
+	}
+	delete(rl.buckets, idlest)
+}
+
+// requests refused so far
+func (rl *rateLimiter) count() int {
+	if rl == nil {
+		return 0
+	}
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	return rl.refused
+}
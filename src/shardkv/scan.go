@@ -0,0 +1,226 @@
+package shardkv
+
+import "container/heap"
+import "strings"
+import "time"
+import "shardmaster"
+
+//
+// streaming scans. a Scanner pulls the keys with a prefix
+// from their groups in batches of at most ScanBatchKeys
+// keys, asking for the next batch only once its caller has
+// consumed the last one. servers keep no state between
+// batches, so a slow or abandoned scan costs them nothing.
+//
+// a scan is not a snapshot: each batch is read from its
+// group's state at the time (as up to date as a Get), so
+// a scan reflects writes made while it runs. a key that
+// exists and is unchanged for the whole scan is returned
+// exactly once; a key written during the scan may be
+// returned with its old or its new value, or missed if it
+// is created or deleted. keys come in shard order, and in
+// key order within a shard.
+//
+
+// most keys in one Scan reply
+const ScanBatchKeys = 1000
+
+// ScanArgs.Shard asking for every shard the group serves
+const AllShards = -1
+
+type KeyValue struct {
+	Key   string
+	Value string
+}
+
+type ScanArgs struct {
+	Prefix string
+	Shard  int    // or AllShards
+	Start  string // smallest key wanted
+	Max    int    // at most ScanBatchKeys
+}
+
+type ScanReply struct {
+	Err  Err
+	KVs  []KeyValue // in key order
+	More bool       // keys remain after KVs
+	Shards []int    // the shards scanned, for AllShards
+}
+
+//
+// RPC handler returning the first args.Max keys of
+// args.Shard that have args.Prefix and are >= args.Start.
+// for AllShards, the keys are those of every shard this
+// group serves, listed in reply.Shards, and keys this
+// server still holds for other shards are left out; a
+// backup of the whole store scans each group this way.
+//
+func (kv *ShardKV) Scan(args *ScanArgs, reply *ScanReply) error {
+	defer kv.handling()()
+
+	max := args.Max
+	if max <= 0 || max > ScanBatchKeys {
+		max = ScanBatchKeys
+	}
+
+	// serve the batch as a confirmed read
+	if err := kv.ConfirmLeadership(); err != OK {
+		reply.Err = err
+		kv.countReply(args.Shard, reply.Err)
+		return nil
+	}
+
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	if args.Shard != AllShards && !kv.owns(args.Shard) {
+		reply.Err = ErrWrongGroup
+		kv.countReply(args.Shard, reply.Err)
+		return nil
+	}
+
+	// keep the max smallest matching keys in a heap, rather
+	// than sorting every match
+	h := &keyHeap{}
+	more := false
+	for key := range kv.xstate.KVStore {
+		if key < args.Start || !strings.HasPrefix(key, args.Prefix) {
+			continue
+		}
+		if shard := key2shard(key); args.Shard == AllShards && !kv.owns(shard) ||
+			args.Shard != AllShards && shard != args.Shard {
+			continue
+		}
+		if kv.expired(kv.last_seq, key) {
+			continue
+		}
+		if h.Len() < max {
+			heap.Push(h, key)
+		} else if key < (*h)[0] {
+			(*h)[0] = key
+			heap.Fix(h, 0)
+			more = true
+		} else {
+			more = true
+		}
+	}
+
+	reply.KVs = make([]KeyValue, h.Len())
+	for i := h.Len() - 1; i >= 0; i-- {
+		key := heap.Pop(h).(string)
+		reply.KVs[i] = KeyValue{key, kv.xstate.KVStore[key]}
+	}
+	if args.Shard == AllShards {
+		for shard := 0; shard < shardmaster.NShards; shard++ {
+			if kv.owns(shard) {
+				reply.Shards = append(reply.Shards, shard)
+			}
+		}
+	}
+	reply.More = more
+	reply.Err = OK
+	return nil
+}
+
+// a max-heap of keys
+type keyHeap []string
+
+func (h keyHeap) Len() int            { return len(h) }
+func (h keyHeap) Less(i, j int) bool  { return h[i] > h[j] }
+func (h keyHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *keyHeap) Push(x interface{}) { *h = append(*h, x.(string)) }
+func (h *keyHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old) - 1]
+	*h = old[:len(old) - 1]
+	return x
+}
+
+//
+// an iterator over the keys with a prefix; see ScanStream().
+//
+type Scanner struct {
+	ck      *Clerk
+	prefix  string
+	shard   int        // shard being scanned
+	last    int        // last shard to scan
+	start   string     // next key wanted in shard
+	batch   []KeyValue // fetched, not yet returned
+	more    bool       // shard has keys past batch
+	batches int        // Scan replies fetched
+}
+
+//
+// start a scan of the keys beginning with prefix. nothing
+// is fetched until the first Next(). see scan.go for what
+// the scan sees of writes made while it runs.
+//
+func (ck *Clerk) ScanStream(prefix string) *Scanner {
+	sc := &Scanner{ck:ck, prefix:prefix, start:prefix, more:true}
+	sc.last = shardmaster.NShards - 1
+	if prefix != "" {
+		// key2shard() only looks at a key's first byte
+		sc.shard = key2shard(prefix)
+		sc.last = sc.shard
+	}
+	return sc
+}
+
+//
+// the next key and its value, or false once the scan is
+// over. fetches the next batch when the last one is used up.
+//
+func (sc *Scanner) Next() (string, string, bool) {
+	for len(sc.batch) == 0 {
+		if !sc.more {
+			if sc.shard == sc.last {
+				return "", "", false
+			}
+			sc.shard++
+			sc.start, sc.more = sc.prefix, true
+		}
+		sc.fetch()
+	}
+	kv := sc.batch[0]
+	sc.batch = sc.batch[1:]
+	return kv.Key, kv.Value, true
+}
+
+// fetch the next batch of sc.shard from its group
+func (sc *Scanner) fetch() {
+	ck := sc.ck
+	ck.mu.Lock()
+	defer ck.mu.Unlock()
+
+	for {
+		gid := ck.config.Shards[sc.shard]
+
+		servers, ok := ck.config.Groups[gid]
+
+		if ok {
+			// try each server in the shard's replication group.
+			for _, srv := range servers {
+				args := &ScanArgs{Prefix:sc.prefix, Shard:sc.shard, Start:sc.start, Max:ScanBatchKeys}
+				var reply ScanReply
+				ok := send(srv, "ShardKV.Scan", args, &reply)
+				if ok && reply.Err == OK {
+					sc.batch, sc.more = reply.KVs, reply.More
+					if len(reply.KVs) > 0 {
+						// the smallest key after the last one
+						sc.start = reply.KVs[len(reply.KVs) - 1].Key + "\x00"
+					}
+					sc.batches++
+					return
+				}
+				if ok && reply.Err == ErrWrongGroup {
+					break
+				}
+			}
+		}
+
+		time.Sleep(100 * time.Millisecond)
+
+		// ask master for a new configuration.
+		ck.refresh()
+	}
+}
@@ -13,23 +13,70 @@ import "syscall"
 import "encoding/gob"
 import "math/rand"
 import "shardmaster"
-
-const Debug = 0
-
-func DPrintf(format string, a ...interface{}) (n int, err error) {
-	if Debug > 0 {
-		fmt.Printf(format, a...)
-	}
-	return
-}
+import "strconv"
+import "context"
+import "sort"
 
 const (
 	Get    = "Get"
 	Put    = "Put"
+	PutIfAbsent = "PutIfAbsent"
+	CAS    = "CAS"
 	Append = "Append"
+	AppendBounded = "AppendBounded"
+	Delete = "Delete"
+	Incr   = "Incr"
+	PutBatch = "PutBatch"
+	CondTxn  = "CondTxn"
 	Reconf = "Reconf"
+
+	// client ops logged together; see batch.go
+	Batch  = "Batch"
+
+	// two-phase commit
+	Prepare = "Prepare"
+	Commit  = "Commit"
+	Abort   = "Abort"
+	Decide  = "Decide"
+
+	// registered transform
+	Apply   = "Apply"
+
+	// administrative
+	ClearShard = "ClearShard"
+	RebuildDedup = "RebuildDedup"
+	RepairSharding = "RepairSharding"
+	ClientDone = "ClientDone"
+	SweepExpired = "SweepExpired"
+	Noop = "Noop"
+	FetchClaim = "FetchClaim"
+	Lease = "Lease"
+	Import = "Import"
+
+	// stop serving a shard about to move to another group
+	Freeze = "Freeze"
+
+	// mirroring keys onto other groups
+	Mirror = "Mirror"
+	MirrorWrite = "MirrorWrite"
 )
 
+// how long a prepared transaction may hold its locks before
+// the group asks the coordinator's group for the outcome.
+const TxnTimeout = 3 * time.Second
+
+// how often a server asks the shardmaster for a new config,
+// unless Options.TickInterval
+const TickInterval = 250 * time.Millisecond
+
+// how long a server waits on each shardmaster cluster for a
+// config
+const ConfigQueryTimeout = time.Second
+
+// ticks a replica leaves a config's shards to the replica
+// that claimed them before fetching them itself
+const ReconfHandoffTicks = 4
+
 //
 // Data structure for logging Get/Put/Append/Reconfigure ops
 // using Paxos  
@@ -41,6 +88,17 @@ type Op struct {
 	Key   string
 	Value string
 	Extra interface{}
+	Deadline int // if > 0, a write decided after this seq is skipped
+	TTL      int // if > 0, log slots the written key lives for
+	TTLMillis int // if > 0, ms of the log's clock the written key lives for
+	Time     int64 // ms since the epoch when proposed; the log's clock
+	HasDefault bool  // for Get, whether a missing key reads as Default (with OK)
+	Default  string
+	CheckVersion bool // for Put/Append, whether the key must be at Version
+	Version  int
+	Expected string // for CAS, the value the key must hold
+	MaxLen   int    // for AppendBounded, the bytes of the value kept
+	Proposer int    // 1 + me of the server that logged it; 0 if unknown
 }
 
 func (op *Op) IsSame(other* Op) bool {
@@ -61,6 +119,17 @@ func (op *Op) IsSame(other* Op) bool {
 type Rep struct {
 	Err   Err
 	Value string
+	Version int // of the key read, for Gets
+}
+
+//
+// a key locked by a prepared transaction, with the value
+// it takes if the transaction commits
+//
+type TxnLock struct {
+	Txn   string
+	Coord string
+	Value string
 }
 
 //
@@ -71,6 +140,25 @@ type Rep struct {
 type XState struct { 	
 	// key-value store
 	KVStore  map[string]string 
+	// map key -> number of changes to its value so far
+	Versions map[string]int
+	// map key -> the last seq at which it is live, for keys
+	// written with a TTL. in a shard's state sent to another
+	// group, the number of seqs it has left instead.
+	Expires  map[string]int
+	// map key -> the log's clock (ms) at which it is live
+	// last, for keys written with a TTLMillis
+	Deadlines map[string]int64
+	// map key -> the group it is mirrored onto
+	Mirrors  map[string]int64
+	// map key -> the groups it was mirrored onto before, which
+	// are told to drop their copies
+	Unmirrored map[string][]int64
+	// map key -> number of Mirror ops on it so far
+	MirrorEpochs map[string]int
+	// map key -> this group's copy of a key mirrored onto it.
+	// copies stay with the group, not with the key's shard.
+	Copies   map[string]MirrorCopy
 	//_________________________________________________________
 	// client states for filtering duplicate ops
 
@@ -78,29 +166,247 @@ type XState struct {
 	MRRSMap  map[string]int     	
 	// map client -> the most recent apply to the client
 	Replies  map[string]Rep
+	// map client -> replies to the client's ops before its
+	// most recent, up to ReplyHistory - 1 of them, oldest
+	// first, for retries of ops it sent without waiting. an
+	// op less than ReplyHistory seqs before the most recent
+	// and not among them has not been applied yet.
+	Recent   map[string][]SeqRep
+	// map client -> the shard its most recent op touched (or -1)
+	LastShard map[string]int
+	// map shard -> client -> the seq of the client's most
+	// recent op on the shard. a shard's transfer carries its
+	// map, and the three above only for clients whose most
+	// recent op was on it, so that stale copies of a client's
+	// older ops on the shard are still filtered
+	ShardSeqs map[int]map[string]int
+	// map client -> the log seq at which its most recent op was
+	// recorded here, to find the idlest clients (see dedup.go)
+	Seen     map[string]int
 	//_________________________________________________________
+	// two-phase commit state
+
+	// map key -> the prepared transaction holding it
+	Locks    map[string]TxnLock
+	// map txn -> outcome, kept by the group owning txn's Coord
+	Outcomes map[string]TxnOutcome
+	//_________________________________________________________
+}
+
+//
+// Extra of a Reconf op: the new config, and the state
+// fetched for the shards it brings to the group
+//
+type ReconfExtra struct {
+	Config shardmaster.Config
+	XState XState
+}
+
+//
+// Extra of a Freeze op: the shard, and the config it is
+// frozen in (a Freeze logged after the group has left that
+// config does nothing)
+//
+type FreezeExtra struct {
+	Shard     int
+	ConfigNum int
+}
+
+//
+// a mirrored key as last pushed to its mirror group
+//
+type MirrorCopy struct {
+	Value   string
+	Present bool // false if the key was deleted
+	Version int  // the key's version at its own group
+	Epoch   int  // the key's MirrorEpochs at its own group
+	Dropped bool // the key is no longer mirrored onto the group
+}
+
+//
+// should c replace held as a group's copy of a key? a copy
+// pushed after a later Mirror op on the key does, whatever
+// its version; and so does a later version pushed after
+// the same one.
+//
+func newerCopy(c MirrorCopy, held MirrorCopy) bool {
+	if c.Epoch != held.Epoch {
+		return c.Epoch > held.Epoch
+	}
+	return c.Version > held.Version
+}
+
+// a client op's seq and the reply to it
+type SeqRep struct {
+	Seq int
+	Rep Rep
+	Dropped bool // the op was applied, but Rep was dropped
+}
+
+type TxnOutcome struct {
+	Coord  string
+	Commit bool
 }
 
 func (xs *XState) Init() {
 	xs.KVStore = map[string]string{}
+	xs.Versions = map[string]int{}
+	xs.Expires = map[string]int{}
+	xs.Deadlines = map[string]int64{}
+	xs.Mirrors = map[string]int64{}
+	xs.Unmirrored = map[string][]int64{}
+	xs.MirrorEpochs = map[string]int{}
+	xs.Copies = map[string]MirrorCopy{}
 	xs.MRRSMap = map[string]int{}
 	xs.Replies = map[string]Rep{}
+	xs.Recent = map[string][]SeqRep{}
+	xs.LastShard = map[string]int{}
+	xs.ShardSeqs = map[int]map[string]int{}
+	xs.Seen = map[string]int{}
+	xs.Locks = map[string]TxnLock{}
+	xs.Outcomes = map[string]TxnOutcome{}
 }
 
 func (xs *XState) Update(other *XState) {
 	for key, value := range other.KVStore {
 		xs.KVStore[key] = value
 	}
+	for key, seq := range other.Expires {
+		xs.Expires[key] = seq
+	}
+	for key, deadline := range other.Deadlines {
+		xs.Deadlines[key] = deadline
+	}
+	for key, version := range other.Versions {
+		xs.Versions[key] = version
+	}
+	for key, gid := range other.Mirrors {
+		xs.Mirrors[key] = gid
+	}
+	for key, gids := range other.Unmirrored {
+		xs.Unmirrored[key] = gids
+	}
+	for key, epoch := range other.MirrorEpochs {
+		xs.MirrorEpochs[key] = epoch
+	}
+	for key, c := range other.Copies {
+		if newerCopy(c, xs.Copies[key]) {
+			xs.Copies[key] = c
+		}
+	}
+	for key, lock := range other.Locks {
+		xs.Locks[key] = lock
+	}
+	for txn, outcome := range other.Outcomes {
+		xs.Outcomes[txn] = outcome
+	}
 
 	for cli, seq := range other.MRRSMap {
 		xseq := xs.MRRSMap[cli] 
+		for _, sr := range other.Recent[cli] {
+			xs.keepRecent(cli, sr)
+		}
+		if xseq > seq {
+			// ops the client sent before its most recent here
+			// may have been applied there
+			if reply, ok := other.Replies[cli]; ok {
+				xs.keepRecent(cli, SeqRep{Seq:seq, Rep:reply})
+			} else {
+				xs.keepRecent(cli, SeqRep{Seq:seq, Dropped:true})
+			}
+		}
 		if xseq < seq {
+			xs.retire(cli)
 			xs.MRRSMap[cli] = seq
-			xs.Replies[cli] = other.Replies[cli]
+			if reply, ok := other.Replies[cli]; ok {
+				xs.Replies[cli] = reply
+			} else {
+				// dropped by RebuildDedup
+				delete(xs.Replies, cli)
+			}
+			xs.LastShard[cli] = other.LastShard[cli]
+		}
+	}
+	for shard, seqs := range other.ShardSeqs {
+		for cli, seq := range seqs {
+			xs.noteShardSeq(shard, cli, seq)
+			if xs.MRRSMap[cli] < seq {
+				// the client has had its reply, and moved on
+				// to another shard: only stale copies of this
+				// op can still come. whether the ops it sent
+				// just before were applied is not known here,
+				// so they count as applied.
+				xs.retire(cli)
+				for prev := seq - ReplyHistory + 1; prev < seq; prev++ {
+					if prev > xs.MRRSMap[cli] {
+						xs.keepRecent(cli, SeqRep{Seq:prev, Dropped:true})
+					}
+				}
+				xs.MRRSMap[cli] = seq
+				delete(xs.Replies, cli)
+				xs.LastShard[cli] = shard
+			}
 		}
 	}
 }
 
+//
+// keep cli's most recent reply among its Recent ones, as its
+// MRRSMap seq is about to move on.
+//
+func (xs *XState) retire(cli string) {
+	seq, ok := xs.MRRSMap[cli]
+	if !ok {
+		return
+	}
+	if reply, ok := xs.Replies[cli]; ok {
+		xs.keepRecent(cli, SeqRep{Seq:seq, Rep:reply})
+	} else {
+		xs.keepRecent(cli, SeqRep{Seq:seq, Dropped:true})
+	}
+}
+
+//
+// add sr, the reply to one of cli's ops, to its Recent
+// replies, dropping the oldest past ReplyHistory - 1. the
+// slice is made anew, as a transfer may share the old one.
+//
+func (xs *XState) keepRecent(cli string, sr SeqRep) {
+	if xs.Recent == nil {
+		xs.Recent = map[string][]SeqRep{}
+	}
+	old := xs.Recent[cli]
+	i := sort.Search(len(old), func(i int) bool { return old[i].Seq >= sr.Seq })
+	if i < len(old) && old[i].Seq == sr.Seq {
+		return
+	}
+	recent := make([]SeqRep, 0, len(old) + 1)
+	recent = append(recent, old[:i]...)
+	recent = append(recent, sr)
+	recent = append(recent, old[i:]...)
+	if len(recent) > ReplyHistory - 1 {
+		recent = recent[len(recent) - (ReplyHistory - 1):]
+	}
+	if len(recent) == 0 {
+		delete(xs.Recent, cli)
+	} else {
+		xs.Recent[cli] = recent
+	}
+}
+
+// note seq as cli's most recent op on shard, if it is
+func (xs *XState) noteShardSeq(shard int, cli string, seq int) {
+	if xs.ShardSeqs == nil {
+		xs.ShardSeqs = map[int]map[string]int{}
+	}
+	if xs.ShardSeqs[shard] == nil {
+		xs.ShardSeqs[shard] = map[string]int{}
+	}
+	if xs.ShardSeqs[shard][cli] < seq {
+		xs.ShardSeqs[shard][cli] = seq
+	}
+}
+
 func MakeXState() (*XState) {
 	var xstate XState
 	xstate.Init()
@@ -110,313 +416,1957 @@ func MakeXState() (*XState) {
 type ShardKV struct {
 	mu         sync.Mutex
 	l          net.Listener
-	me         int
 	dead       int32 // for testing
 	unreliable int32 // for testing
-	sm         *shardmaster.Clerk
+	masters    []*shardmaster.Clerk // one per shardmaster cluster, primary first
 	px         *paxos.Paxos
 
-	gid int64 // my replica group ID
+	// state machine: my gid, me, config, xstate, ...
+	applier
+	// guards the applier and last_seq for speculative reads,
+	// which don't take mu. catchUp() write-locks it (under mu)
+	// around each op it applies.
+	smu        sync.RWMutex
 
 	last_seq   int   // seq for next op to be applied
 	seq        int   // next seq in paxos log
+	applyBatch int   // ops applied per hold of kv.smu and px.Done()
+	applying   []Op  // catchUp()'s ops, kept to reuse the array
+	applyEnds  []int // where each slot's ops end in applying
 
-	config     shardmaster.Config
-	
-	xstate     XState
-}
+	txnSeen    map[string]time.Time // txn -> when its locks were first seen
 
-func (kv *ShardKV) logOperation(xop *Op) {
-	seq := kv.seq
+	preLog     func(op *Op) error
+	postDecode func(op *Op)
 
-	wait_init := 10 * time.Millisecond
+	transfers  chan bool // TransferState slots; nil if unlimited
+	outgoing   map[int]*outgoing // shard -> state being sent; see transfer.go
+	chunkKeys  int               // Options.TransferChunk
 
-	DPrintf("----- server %d:%d logOperation %v\n", kv.gid, kv.me, xop)
-	wait := wait_init
-	for {
-		fate, v := kv.px.Status(seq)
-		if fate == paxos.Decided {
-			op := v.(Op)
-			DPrintf("----- server %d:%d : seq %d : %v\n", kv.gid, kv.me, seq, op)
-			if xop.IsSame(&op) {
-				break
-			}			
-			seq++
-			wait = wait_init
-		} else { // Pending
-			DPrintf("----- server %d:%d starts a new paxos instance : %d %v\n", kv.gid, kv.me, seq, xop)
-			kv.px.Start(seq, *xop)
-			time.Sleep(wait)
-			if wait < time.Second {
-				wait *= 2
-			}
-		}
-	}
-	kv.seq = seq + 1
+	backoff        time.Duration // Options.ProposeBackoff
+	maxBackoff     time.Duration // Options.ProposeMaxBackoff
+	proposeTimeout time.Duration // Options.ProposeTimeout
+
+	cmu        sync.Mutex
+	round      *confirmRound // next ConfirmLeadership() no-op, under cmu
+
+	missing    *string // Options.MissingDefault
+
+	pushed     map[mirrorTarget]mirrorPush // last push acked
+
+	memLimit   int // Options.MemoryLimit
+	memBytes   int // memoryEstimate() as of the last checkMemory()
+	charged    map[opKey]bool // writes counted in memBytes since then
+	mitigations int // checkMemory() calls that relieved memory
+	speculated int32 // ReadSpeculative Gets answered
+
+	fillGap    time.Duration // between gap proposals; 0 if unthrottled
+	nextFill   time.Time     // earliest time for the next one
+	filled     int           // gap proposals made
+
+	hot        *hotKeys // keys clients ask this server about
+
+	snapFile   string // where snapshots go; "" if none are taken
+	saved      int    // last_seq of the last snapshot written
+	snapMu     sync.Mutex // one snapshot written at a time
+	durability string // Options.Durability
+	servers    []string // the group's servers, for catchUpFromPeer()
+	installed  int      // snapshots installed from peers
+
+	draining   int32 // dead, but finishing the RPCs taken; see Shutdown()
+	handlers   int32 // client RPC handlers running
+
+	counts     Metrics // the counters of Metrics(), under mu
+	wrongRuns  [shardmaster.NShards]wrongRun // see metrics.go
+	stuckAfter time.Duration
+
+	latest     int // newest config num seen by tick()
+	claims     map[int]fetchClaim // config num -> first claim to fetch its shards
+	sent       int       // shard transfers served, from their first chunk
+	tickEvery  time.Duration // Options.TickInterval
+	poke       chan bool     // PokeReconfigure() requests, coalesced
+	limiter    *rateLimiter  // nil if no ClientRate; see ratelimit.go
+	memPoke    chan bool     // early checkMemory() requests, coalesced
+	leaseReads int // Gets served under the lease (see lease.go)
+
+	// see propose.go
+	shardMu    [shardmaster.NShards]sync.Mutex
+	next       int                   // next log slot for propose() to claim
+	results    map[opKey]*opResult   // ops propose() waits on -> reply
+
+	// see batch.go
+	batchWindow time.Duration // Options.BatchWindow
+	gathering  *opBatch // the batch ops are joining, if any
+	batchCID   string   // CID of this server's Batch ops
+	batches    int      // Seq of its last one
+
+	// progress of the current reconfiguration, under pmu
+	// since reconfigure() fetches shards without mu
+	pmu        sync.Mutex
+	progress   ReconfigProgress
+	needed     []int       // shards to fetch, for progress.Target
+	fetched    map[int]int // shard -> bytes, for progress.Target
 }
 
-// 
-// we let this func return the reply of the last Get/Put/Append op
-// for simplifying our implementation of RPC Get/PutAppend 
-//
-func (kv *ShardKV) catchUp() (rep *Rep) {
-	seq := kv.last_seq
-	for seq < kv.seq {
-		_, v := kv.px.Status(seq)
-		op := v.(Op)
-		if op.Op == Reconf {
-			kv.config = kv.sm.Query(op.Seq)
-			extra := op.Extra.(XState)
-			kv.xstate.Update(&extra)
-			DPrintf("doReconf : server %d:%d : config %d\n", kv.gid, kv.me, kv.config.Num)
-		} else if op.Op == Put || op.Op == Append {
-			rep = kv.doPutAppend(op.Op, op.Key, op.Value)
-			kv.recordOperation(op.CID, op.Seq, rep)
-		} else {
-			rep = kv.doGet(op.Key)
-			kv.recordOperation(op.CID, op.Seq, rep)
-		}
-		kv.px.Done(seq)
-		seq++
-	}
-	kv.last_seq = seq
-	return
+type ReconfigProgress struct {
+	Target   int // config being moved to, or current one if none
+	Needed   int // shards to fetch from other groups
+	Received int // shards fetched so far
+	Bytes    int // key/value bytes fetched so far
 }
 
-func (kv *ShardKV) recordOperation(cid string, seq int, reply *Rep) {
-	// we do not update the client state when ErrWrongGroup occurs
-	if reply.Err != ErrWrongGroup {
-		kv.xstate.MRRSMap[cid] = seq
-		kv.xstate.Replies[cid] = *reply
+// percentage of the needed shards fetched
+func (p ReconfigProgress) Percent() int {
+	if p.Needed == 0 {
+		return 100
 	}
+	return 100 * p.Received / p.Needed
 }
 
-func (kv *ShardKV) filterDuplicate(cid string, seq int) (*Rep, bool) {
-	last_seq := kv.xstate.MRRSMap[cid]
-	if seq < last_seq { 
-		return nil, true 
-	} else if seq == last_seq {
-		rep := kv.xstate.Replies[cid]
-		return &rep, true
-	} 
-	return nil, false
+func (kv *ShardKV) ReconfigProgress() ReconfigProgress {
+	kv.pmu.Lock()
+	defer kv.pmu.Unlock()
+	return kv.progress
 }
 
-func (kv *ShardKV) doGet(key string) (*Rep) {
-	var rep Rep
-	if kv.gid != kv.config.Shards[key2shard(key)] {
-		DPrintf("doGet       : ErrWrongGroup : server %d:%d : key %s\n", kv.gid, kv.me, key)
-		DPrintf("------------- config : %v\n", kv.config)
-		rep.Err = ErrWrongGroup
-	} else {
-		value, ok := kv.xstate.KVStore[key]
-		DPrintf("doGet : server %d:%d : key %s : value %s\n", 
-			kv.gid, kv.me, key, value)
-		if ok {
-			rep.Err, rep.Value = OK, value
-		} else {
-			rep.Err = ErrNoKey
-		}
+func (kv *ShardKV) startProgress(target int, needed []int) {
+	kv.pmu.Lock()
+	defer kv.pmu.Unlock()
+	// a retry of the same config keeps what was fetched
+	if kv.progress.Target != target {
+		kv.progress = ReconfigProgress{Target:target}
+		kv.fetched = map[int]int{}
 	}
-	return &rep
+	kv.progress.Needed = len(needed)
+	kv.needed = needed
 }
 
-func (kv *ShardKV) doPutAppend(op string, key string, value string) (*Rep) {
-	var rep Rep
-	if kv.gid != kv.config.Shards[key2shard(key)] {
-		DPrintf("doPutAppend : ErrWrongGroup : server %d:%d : key %s\n", kv.gid, kv.me, key)
-		DPrintf("------------- config : %v\n", kv.config)
-		rep.Err = ErrWrongGroup
-	} else {
-		value1 := kv.xstate.KVStore[key]
-		if op == Put {
-			kv.xstate.KVStore[key] = value
-		} else if op == Append {
-			kv.xstate.KVStore[key] += value
-		}
-		DPrintf("doPutAppend : server %d:%d : op %s : key %s : value %s->%s\n", 
-		kv.gid, kv.me, op, key, value1, kv.xstate.KVStore[key])
-		rep.Err = OK
+func (kv *ShardKV) shardFetched(shard int, xstate *XState) {
+	kv.pmu.Lock()
+	defer kv.pmu.Unlock()
+	if _, ok := kv.fetched[shard]; ok {
+		return
+	}
+	nbytes := 0
+	for key, value := range xstate.KVStore {
+		nbytes += len(key) + len(value)
 	}
-	return &rep
+	kv.fetched[shard] = nbytes
+	kv.progress.Received++
+	kv.progress.Bytes += nbytes
 }
-	
-func (kv *ShardKV) Get(args *GetArgs, reply *GetReply) error {
-	kv.mu.Lock()
-	defer kv.mu.Unlock()
 
-	DPrintf("RPC Get : server %d:%d : cleint %s : seq %d : key %s\n", 
-		kv.gid, kv.me, args.CID, args.Seq, args.Key)
-	
-	// we catch up to update the client states (filters actually)
-	kv.catchUp()
-
-	rp, yes := kv.filterDuplicate(args.CID, args.Seq)
-	if yes {
-		DPrintf("RPC Get : server %d:%d : dup-op detected : %v\n", kv.gid, kv.me, args)
-		if rp != nil {
-			reply.Err, reply.Value = rp.Err, rp.Value
+//
+// ErrNotReady in place of an ErrWrongGroup err for key if
+// its shard is one this server is fetching for the config it
+// is moving to: the key is about to be served here, and the
+// client should retry rather than look for another owner.
+// kv.mu or kv.smu must be held.
+//
+func (kv *ShardKV) arriving(key string, err Err) Err {
+	if err != ErrWrongGroup {
+		return err
+	}
+	kv.pmu.Lock()
+	defer kv.pmu.Unlock()
+	if kv.progress.Target <= kv.config.Num {
+		return err
+	}
+	shard := key2shard(key)
+	for _, s := range kv.needed {
+		if s == shard {
+			return ErrNotReady
 		}
-		return nil
 	}
-
-	xop := &Op{CID:args.CID, Seq:args.Seq, Op:Get, Key:args.Key}
-	kv.logOperation(xop)
-
-	rep := kv.catchUp()
-	reply.Err, reply.Value = rep.Err, rep.Value
-
-	return nil
+	return err
 }
 
+//
+// RPC handler telling operators which shards the group
+// serves, and how far a reconfiguration it started (and has
+// yet to finish) has got.
+//
+func (kv *ShardKV) Status(args *StatusArgs, reply *StatusReply) error {
+	defer kv.handling()()
 
-// RPC handler for client Put and Append requests
-func (kv *ShardKV) PutAppend(args *PutAppendArgs, reply *PutAppendReply) error {
-	kv.mu.Lock()
-	defer kv.mu.Unlock()
-	
-	DPrintf("RPC PutAppend : server %d:%d : cleint %s : seq %d : op %s : key %s :value %s\n", 
-		kv.gid, kv.me, args.CID, args.Seq, args.Op, args.Key, args.Value)
-
-	kv.catchUp()
+	// not kv.mu, which tick() holds while it asks the
+	// shardmaster for configs
+	kv.smu.RLock()
+	defer kv.smu.RUnlock()
+	kv.pmu.Lock()
+	defer kv.pmu.Unlock()
 
-	rp, yes := kv.filterDuplicate(args.CID, args.Seq) 
-	if yes {
-		DPrintf("RPC PutAppend : server %d:%d : dup-op detected %v\n", kv.gid, kv.me, args)
-		if rp != nil {
-			reply.Err = rp.Err
+	reply.ConfigNum = kv.config.Num
+	for shard, gid := range kv.config.Shards {
+		if gid == kv.gid {
+			reply.Shards = append(reply.Shards, shard)
 		}
-		return nil
 	}
-	
-	xop := &Op{CID:args.CID, Seq:args.Seq, Op:args.Op, Key:args.Key, Value:args.Value}
-	kv.logOperation(xop)
-	
-	rep := kv.catchUp()
-	reply.Err = rep.Err
-
+	reply.Reconfiguring, reply.Target, reply.Waiting = kv.reconfiguring()
+	reply.Err = OK
 	return nil
 }
 
-func (kv *ShardKV) reconfigure(config *shardmaster.Config) bool {
-	//DPrintf("----- server %d:%d : reconfigure %v\n", kv.gid, kv.me, config)
-	
-	// we catch up to ensure that kv.config.Num equals config.Num - 1
-	kv.catchUp()
-
-	xstate := MakeXState()
-	for shard := 0; shard < shardmaster.NShards; shard++ {
-		gid := kv.config.Shards[shard]
-		if config.Shards[shard] == kv.gid && gid != 0 && gid != kv.gid {
-		 	ret := kv.requestShard(gid, shard)
-			if ret == nil { 
-				return false
-			}
-			xstate.Update(ret)
+//
+// whether this server has started moving to a config and not
+// got there, which, and the shards it has yet to receive
+// for it. kv.smu and kv.pmu must be held.
+//
+func (kv *ShardKV) reconfiguring() (bool, int, []int) {
+	if kv.progress.Target <= kv.config.Num {
+		return false, 0, nil
+	}
+	var waiting []int
+	for _, shard := range kv.needed {
+		if _, ok := kv.fetched[shard]; !ok {
+			waiting = append(waiting, shard)
 		}
 	}
-	xop := &Op{Seq:config.Num, Op:Reconf, Extra:*xstate}
-	kv.logOperation(xop)
+	return true, kv.progress.Target, waiting
+}
 
-	return true
+//
+// a snapshot of a server's internal state, for operators
+// and tests
+//
+type Stats struct {
+	ConfigNum int
+	LastSeq   int                      // seq for next op to be applied
+	Applied   [shardmaster.NShards]int // shard -> seq of last op applied to it
+	MemoryBytes int                    // estimated bytes of state (see memory.go)
+	Mitigations int                    // times the server relieved memory pressure
+	Speculated  int                    // ReadSpeculative Gets answered
+	Behind      int                    // log slots known of but not yet applied
+	Filled      int                    // proposals into missed slots, to catch up
+	Installed   int                    // snapshots installed from peers
+	Sent        int                    // shard transfers served to other groups
+	Clients     int                    // clients remembered for duplicate detection
+	LeaseReads  int                    // Gets served under a read lease
+	RateLimited int                    // requests refused ErrRateLimited
 }
 
-func (kv *ShardKV) requestShard(gid int64, shard int) (*XState) {
-	DPrintf("----- server %d:%d : requestShard %d:%d\n", kv.gid, kv.me, gid, shard)
+func (kv *ShardKV) Stats() Stats {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
 
-	for _, server := range kv.config.Groups[gid] {
-		args := &TransferStateArgs{}
-		args.ConfigNum, args.Shard = kv.config.Num, shard
-		var reply TransferStateReply
-		ok := call(server, "ShardKV.TransferState", args, &reply)
-		if ok && reply.Err == OK {
-			return &reply.XState
-		}
-	}
-	DPrintf("----- server %d:%d : requestShard FAIL %v\n", kv.gid, kv.me, kv.config)
-	return nil
+	var stats Stats
+	stats.ConfigNum = kv.config.Num
+	stats.LastSeq = kv.last_seq
+	stats.Applied = kv.applied
+	stats.MemoryBytes = kv.memoryEstimate()
+	stats.Mitigations = kv.mitigations
+	stats.Speculated = int(atomic.LoadInt32(&kv.speculated))
+	stats.Behind = kv.px.Max() + 1 - kv.last_seq
+	stats.Filled = kv.filled
+	stats.Installed = kv.installed
+	stats.Sent = kv.sent
+	stats.Clients = len(kv.xstate.MRRSMap)
+	stats.LeaseReads = kv.leaseReads
+	stats.RateLimited = kv.limiter.count()
+	return stats
 }
 
-func (kv *ShardKV) TransferState(args *TransferStateArgs, reply *TransferStateReply) error {
-	DPrintf("RPC TransferState : Deadlock ? : server %d:%d ConfigNum %d vs args.ConfigNum %d\n", 
-		kv.gid, kv.me, kv.config.Num, args.ConfigNum)
-	
-	// we check if we have older config than the client-server's 
-	// it's ok to use kv.config.Num here :)
-	if kv.config.Num < args.ConfigNum {
-		reply.Err = ErrNotReady
-		return nil
-	} 
-	
+//
+// a hash of shard's contents as of the returned config, after
+// applying every op decided so far. replicas that agree on
+// the shard return the same digest for the same config.
+//
+func (kv *ShardKV) ShardDigest(shard int) (string, int) {
 	kv.mu.Lock()
 	defer kv.mu.Unlock()
 
-	DPrintf("RPC TransferState : server %d:%d : args %v\n", kv.gid, kv.me, args)
+	kv.learn()
+	return shardDigest(kv.xstate.KVStore, shard), kv.config.Num
+}
 
-	reply.XState.Init()
-	
-	for key := range kv.xstate.KVStore {
-		if key2shard(key) == args.Shard {
-			value := kv.xstate.KVStore[key]
-			reply.XState.KVStore[key] = value
-		}
-	}
-	for client := range kv.xstate.MRRSMap {
-		reply.XState.MRRSMap[client] = kv.xstate.MRRSMap[client] 
-		reply.XState.Replies[client] = kv.xstate.Replies[client]
+//
+// RPC handler reporting how paxos decided log slot args.Seq,
+// for debugging. only slots not yet forgotten are known.
+//
+func (kv *ShardKV) Decision(args *DecisionArgs, reply *DecisionReply) error {
+	d, ok := kv.px.Decision(args.Seq)
+	if !ok {
+		reply.Err = ErrNotReady
+		return nil
 	}
+	reply.Err, reply.Proposal, reply.Proposer = OK, d.Proposal, d.Proposer
+	return nil
+}
+
+//
+// RPC handler reporting how far this server has got through
+// its group's paxos log, for operators to spot a replica
+// falling behind.
+//
+func (kv *ShardKV) LogStatus(args *LogStatusArgs, reply *LogStatusReply) error {
+	defer kv.handling()()
+
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
 
 	reply.Err = OK
+	reply.Min, reply.Max = kv.px.Min(), kv.px.Max()
+	reply.Seq, reply.LastSeq = kv.seq, kv.last_seq
 	return nil
 }
 
 //
-// Ask the shardmaster if there's a new configuration;
-// if so, re-configure.
+// a hash of the whole state after applying every op decided
+// so far, and the seq of the next op to apply. replicas at
+// the same seq should return the same digest.
 //
-func (kv *ShardKV) tick() {
-	DPrintf("server %d:%d ---*--- tick ---*---\n", kv.gid, kv.me)
+func (kv *ShardKV) StateDigest() (string, int) {
 	kv.mu.Lock()
 	defer kv.mu.Unlock()
-	
-	// we catch up, in case we would log same ops as before
-	kv.catchUp()
 
-	latest_config := kv.sm.Query(-1)
-	for n := kv.config.Num + 1; n <= latest_config.Num; n++ {
-		config := kv.sm.Query(n)
-		if !kv.reconfigure(&config) {
-			break
-		}
-	}
+	kv.learn()
+	return kv.stateDigest(), kv.last_seq
 }
 
-// tell the server to shut itself down.
-// please don't change these two functions.
-func (kv *ShardKV) kill() {
-	atomic.StoreInt32(&kv.dead, 1)
-	kv.l.Close()
-	kv.px.Kill()
-}
+//
+// log xop, a server op, and wait until it is decided. gives
+// up with ErrTimeout after Options.ProposeTimeout, if set,
+// or with ErrShutdown once the server is killed; xop may
+// still be decided and applied later. kv.mu must be held.
+//
+func (kv *ShardKV) logOperation(xop *Op) Err {
+	seq := kv.seq
 
-// call this to find out if the server is dead.
-func (kv *ShardKV) isdead() bool {
-	return atomic.LoadInt32(&kv.dead) != 0
-}
+	wait_init := kv.backoff
+	var deadline time.Time
+	if kv.proposeTimeout > 0 {
+		deadline = time.Now().Add(kv.proposeTimeout)
+	}
 
-// please do not change these two functions.
-func (kv *ShardKV) Setunreliable(what bool) {
-	if what {
-		atomic.StoreInt32(&kv.unreliable, 1)
-	} else {
-		atomic.StoreInt32(&kv.unreliable, 0)
+	if xop.Time == 0 {
+		xop.Time = nowMillis()
 	}
-}
+	xop.Proposer = kv.me + 1
 
-func (kv *ShardKV) isunreliable() bool {
+	kv.logEvent(LevelDebug, "logging", Field{"seq", seq}, Field{"op", xop.Op},
+		Field{"client", xop.CID}, Field{"client_seq", xop.Seq})
+	wait := wait_init
+	started := -1 // the slot proposed into last
+	for {
+		fate, v := kv.px.Status(seq)
+		if fate == paxos.Forgotten {
+			// the peers forgot ops this server never applied
+			kv.catchUpFromPeer()
+			seq = kv.seq
+			wait = wait_init
+		} else if fate == paxos.Decided {
+			op := v.(Op)
+			kv.logEvent(LevelDebug, "slot decided", Field{"seq", seq}, Field{"op", op.Op},
+				Field{"client", op.CID}, Field{"client_seq", op.Seq})
+			if xop.IsSame(&op) {
+				break
+			}			
+			seq++
+			wait = wait_init
+		} else { // Pending
+			kv.logEvent(LevelDebug, "slot pending", Field{"seq", seq}, Field{"op", xop.Op})
+			if kv.halted() {
+				return ErrShutdown
+			}
+			if !deadline.IsZero() && time.Now().After(deadline) {
+				kv.logEvent(LevelWarn, "gave up logging", Field{"seq", seq}, Field{"op", xop.Op})
+				return ErrTimeout
+			}
+			if seq < kv.next || seq == started {
+				// claimed by propose(), which is getting it
+				// decided without kv.mu; or proposed already,
+				// and paxos keeps proposing until it's decided.
+				// (another proposer per poll would pile up
+				// rounds, each sending xop, which can be a
+				// whole shard.)
+			} else if seq < kv.px.Max() {
+				// a gap behind instances already known: filling
+				// it is what lets this replica catch up
+				kv.throttleFill()
+				if !kv.px.StartPriority(seq, *xop, paxos.PriorityHigh) {
+					return kv.refused(seq, xop)
+				}
+				started = seq
+			} else {
+				if !kv.px.Start(seq, *xop) {
+					return kv.refused(seq, xop)
+				}
+				started = seq
+			}
+			kv.awaitDecided(seq, wait)
+			wait = kv.backOff(wait)
+		}
+	}
+	kv.seq = seq + 1
+	return OK
+}
+
+//
+// paxos won't start slot seq, too far past the instances
+// it keeps. rather than move kv.seq there, logOperation()
+// gives up.
+//
+func (kv *ShardKV) refused(seq int, xop *Op) Err {
+	kv.logEvent(LevelWarn, "slot refused", Field{"seq", seq}, Field{"op", xop.Op})
+	return ErrNotReady
+}
+
+// the wait after wait for an op to be decided
+func (kv *ShardKV) backOff(wait time.Duration) time.Duration {
+	if wait *= 2; wait > kv.maxBackoff {
+		wait = kv.maxBackoff
+	}
+	return wait
+}
+
+//
+// wait until paxos decides (or forgets) slot seq, or for at
+// most wait, after which the caller looks again: this server
+// may not hear of a decision it took no part in.
+//
+func (kv *ShardKV) awaitDecided(seq int, wait time.Duration) {
+	t := time.NewTimer(wait)
+	defer t.Stop()
+	select {
+	case <-kv.px.Subscribe(seq):
+	case <-t.C:
+	}
+}
+
+//
+// wait for the next turn to propose into a gap in the log,
+// under Options.CatchUpRate. kv.mu must be held.
+//
+func (kv *ShardKV) throttleFill() {
+	kv.filled++
+	if kv.fillGap == 0 {
+		return
+	}
+	now := time.Now()
+	if kv.nextFill.After(now) {
+		time.Sleep(kv.nextFill.Sub(now))
+		now = kv.nextFill
+	}
+	kv.nextFill = now.Add(kv.fillGap)
+}
+
+// 
+// we let this func return the reply of the last Get/Put/Append op
+// for simplifying our implementation of RPC Get/PutAppend 
+//
+func (kv *ShardKV) catchUp() (rep *Rep) {
+	seq := kv.last_seq
+	for seq < kv.seq {
+		// take up to applyBatch decided ops, apply them all under
+		// one hold of kv.smu, then let paxos free them at once,
+		// since each Done() scans its log
+		end := seq + kv.applyBatch
+		if end > kv.seq {
+			end = kv.seq
+		}
+		first := seq
+		// the ops decided at first, first+1, ...: those of
+		// slot first+i end at ends[i]
+		ops, ends := kv.applying[:0], kv.applyEnds[:0]
+		forgotten, undecided := false, false
+		for ; seq < end; seq++ {
+			fate, v := kv.px.Status(seq)
+			if fate == paxos.Forgotten {
+				forgotten = true
+				break
+			}
+			if fate != paxos.Decided {
+				// kv.seq is only moved past decided slots
+				kv.logEvent(LevelWarn, "slot not decided", Field{"seq", seq})
+				undecided = true
+				break
+			}
+			decided := v.(Op)
+			start := len(ops)
+			ops = decided.appendUnbatched(ops)
+			for i := start; i < len(ops); i++ {
+				if kv.postDecode != nil {
+					kv.postDecode(&ops[i])
+				}
+				kv.countApplied(&ops[i])
+			}
+			ends = append(ends, len(ops))
+		}
+		if len(ends) > 0 {
+			kv.smu.Lock()
+			from := 0
+			for i, to := range ends {
+				for j := from; j < to; j++ {
+					op := &ops[j]
+					if r := kv.apply(first+i, op); r != nil {
+						rep = r
+						if w, ok := kv.results[opKey{op.CID, op.Seq}]; ok && w.rep == nil {
+							w.rep = r
+						}
+					} else if op.Op == FetchClaim {
+						kv.noteClaim(op)
+					}
+				}
+				from = to
+			}
+			kv.last_seq = first + len(ends)
+			kv.smu.Unlock()
+		}
+		// let go of the ops' values before keeping the array
+		for i := range ops {
+			ops[i] = Op{}
+		}
+		kv.applying, kv.applyEnds = ops[:0], ends[:0]
+		if undecided {
+			return
+		}
+		if forgotten {
+			// the peers forgot ops this server never applied
+			kv.catchUpFromPeer()
+			if kv.last_seq < kv.px.Min() {
+				// killed
+				return
+			}
+			seq = kv.last_seq
+		}
+		if kv.snapFile != "" && seq > kv.saved {
+			// peers must keep the ops after the last snapshot
+			kv.px.Done(kv.saved - 1)
+		} else {
+			kv.px.Done(seq - 1)
+		}
+	}
+	return
+}
+
+func (kv *ShardKV) Get(args *GetArgs, reply *GetReply) error {
+	defer kv.handling()()
+	kv.hot.touch(args.Key)
+
+	if pastDeadline(args.Deadline) {
+		reply.Err = ErrTimeout
+		return nil
+	}
+
+	// speculative reads, logging nothing, aren't limited
+	if args.Consistency != ReadSpeculative && !kv.limiter.allow(args.CID) {
+		reply.Err = ErrRateLimited
+		return nil
+	}
+
+	if args.MinSeq > 0 {
+		if err := kv.readAfter(args.MinSeq); err != OK {
+			reply.Err = err
+			kv.countReply(key2shard(args.Key), reply.Err)
+			return nil
+		}
+	}
+
+	if args.Consistency == ReadSpeculative {
+		kv.speculate(args, reply)
+		return nil
+	}
+
+	if args.Consistency == ReadConfirm {
+		err := kv.ConfirmLeadership()
+
+		kv.mu.Lock()
+		defer kv.mu.Unlock()
+		defer func() { reply.ConfigNum = kv.config.Num }()
+
+		if err != OK {
+			reply.Err = err
+			kv.countReply(key2shard(args.Key), reply.Err)
+			return nil
+		}
+
+		xop := &Op{CID:args.CID, Seq:args.Seq, Op:Get, Key:args.Key}
+		xop.HasDefault, xop.Default = kv.missingDefault(args)
+		if !kv.admit(xop) {
+			reply.Err = ErrRejected
+			return nil
+		}
+		rep := withDefault(kv.doGet(args.Key), xop)
+		reply.Err, reply.Value, reply.Version = kv.arriving(args.Key, rep.Err), rep.Value, rep.Version
+		kv.countReply(key2shard(args.Key), reply.Err)
+		return nil
+	}
+
+	// counted from arrival, as waiting for the shard is part
+	// of the wait
+	ctx, cancel := requestContext(args.Timeout)
+	defer cancel()
+
+	shard := key2shard(args.Key)
+	kv.shardMu[shard].Lock()
+	defer kv.shardMu[shard].Unlock()
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	defer func() { reply.ConfigNum = kv.config.Num }()
+
+	kv.logEvent(LevelDebug, "rpc", Field{"op", Get}, Field{"client", args.CID},
+		Field{"client_seq", args.Seq}, Field{"key", args.Key}, Field{"consistency", args.Consistency})
+	
+	// we catch up to update the client states (filters actually)
+	kv.catchUp()
+
+	xop := &Op{CID:args.CID, Seq:args.Seq, Op:Get, Key:args.Key}
+	xop.HasDefault, xop.Default = kv.missingDefault(args)
+	rp, yes := kv.filterDuplicate(xop)
+	if yes {
+		kv.logEvent(LevelDebug, "duplicate", Field{"op", Get}, Field{"client", args.CID},
+			Field{"client_seq", args.Seq})
+		if rp != nil {
+			reply.Err, reply.Value, reply.Version = rp.Err, rp.Value, rp.Version
+		}
+		return nil
+	}
+
+	if kv.leasedElsewhere() {
+		reply.Err = ErrNotLeader
+		return nil
+	}
+	if kv.leaseRead(args, reply) {
+		return nil
+	}
+	if !kv.admit(xop) {
+		reply.Err = ErrRejected
+		return nil
+	}
+	rep := kv.propose(ctx, xop)
+	reply.Err, reply.Value, reply.Version = kv.arriving(args.Key, rep.Err), rep.Value, rep.Version
+	kv.countReply(key2shard(args.Key), reply.Err)
+
+	return nil
+}
+
+//
+// answer a ReadSpeculative Get from the state applied so far,
+// without waiting for mu, so without waiting for a catchUp()
+// or the ops other clients are logging. answers ErrNotReady
+// unless the key is settled(). the answer may still miss ops
+// other replicas have applied, so it is only a guess until a
+// logged Get confirms it.
+//
+func (kv *ShardKV) speculate(args *GetArgs, reply *GetReply) {
+	kv.smu.RLock()
+	defer kv.smu.RUnlock()
+
+	reply.ConfigNum = kv.config.Num
+	xop := &Op{Op:Get, Key:args.Key}
+	xop.HasDefault, xop.Default = kv.missingDefault(args)
+	if !kv.settled(args.Key) {
+		reply.Err = ErrNotReady
+		return
+	}
+	if !kv.admit(xop) {
+		reply.Err = ErrRejected
+		return
+	}
+	rep := withDefault(kv.doGet(args.Key), xop)
+	reply.Err, reply.Value, reply.Version = kv.arriving(args.Key, rep.Err), rep.Value, rep.Version
+	atomic.AddInt32(&kv.speculated, 1)
+}
+
+//
+// is key's value as applied so far also its value after every
+// op this server knows to be decided? false if one of them may
+// change it, or if key has a TTL. kv.smu must be held.
+//
+func (kv *ShardKV) settled(key string) bool {
+	if _, ok := kv.xstate.Expires[key]; ok {
+		return false
+	}
+	if _, ok := kv.xstate.Deadlines[key]; ok {
+		return false
+	}
+	shard := key2shard(key)
+	for seq := kv.last_seq; seq <= kv.px.Max(); seq++ {
+		fate, v := kv.px.Status(seq)
+		if fate != paxos.Decided {
+			// undecided ops can be ordered after this read
+			continue
+		}
+		decided := v.(Op)
+		for _, op := range decided.unbatch() {
+			switch op.Op {
+			case Get, Noop, Lease, RebuildDedup, RepairSharding, ClientDone, Mirror, MirrorWrite:
+			case Put, PutIfAbsent, CAS, Append, AppendBounded, Incr, Apply:
+				if key2shard(op.Key) == shard {
+					return false
+				}
+			case PutBatch:
+				for _, kv := range op.Extra.(PutBatchArgs).KVs {
+					if key2shard(kv.Key) == shard {
+						return false
+					}
+				}
+			case CondTxn:
+				for _, kv := range op.Extra.(CondTxnArgs).Writes {
+					if key2shard(kv.Key) == shard {
+						return false
+					}
+				}
+			default:
+				// reconfigurations, transactions, sweeps &c
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// RPC handler for client Put and Append requests
+func (kv *ShardKV) PutAppend(args *PutAppendArgs, reply *PutAppendReply) error {
+	defer kv.handling()()
+	kv.hot.touch(args.Key)
+
+	if pastDeadline(args.Deadline) {
+		reply.Err = ErrTimeout
+		return nil
+	}
+	if !kv.limiter.allow(args.CID) {
+		reply.Err = ErrRateLimited
+		return nil
+	}
+	durability := args.Durability
+	if durability == DurabilityDefault {
+		durability = kv.durability
+	}
+	if durability == DurabilityFlushed && kv.snapFile == "" {
+		reply.Err = ErrNotDurable
+		return nil
+	}
+
+	ctx, cancel := requestContext(args.Timeout)
+	defer cancel()
+
+	// deferred before the locks are, so that the snapshot is
+	// written once they are released
+	defer func() {
+		if durability == DurabilityFlushed && reply.Err == OK && kv.flush() != nil {
+			reply.Err = ErrNotDurable
+		}
+	}()
+
+	shard := key2shard(args.Key)
+	kv.shardMu[shard].Lock()
+	defer kv.shardMu[shard].Unlock()
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	defer func() { reply.ConfigNum, reply.Seq = kv.config.Num, kv.last_seq }()
+	
+	kv.logEvent(LevelDebug, "rpc", Field{"op", args.Op}, Field{"client", args.CID},
+		Field{"client_seq", args.Seq}, Field{"key", args.Key})
+
+	kv.catchUp()
+
+	xop := &Op{CID:args.CID, Seq:args.Seq, Op:args.Op, Key:args.Key, Value:args.Value}
+	xop.TTL, xop.TTLMillis = args.TTL, args.TTLMillis
+	xop.CheckVersion, xop.Version = args.CheckVersion, args.Version
+	xop.Expected, xop.MaxLen = args.Expected, args.MaxLen
+	if args.Within > 0 {
+		xop.Deadline = kv.px.Max() + args.Within
+	}
+	rp, yes := kv.filterDuplicate(xop) 
+	if yes {
+		kv.logEvent(LevelDebug, "duplicate", Field{"op", args.Op}, Field{"client", args.CID},
+			Field{"client_seq", args.Seq})
+		if rp != nil {
+			reply.Err = rp.Err
+		}
+		return nil
+	}
+	
+	if kv.leasedElsewhere() {
+		reply.Err = ErrNotLeader
+		return nil
+	}
+	if kv.memoryPressure(xop) {
+		reply.Err = ErrMemoryPressure
+		return nil
+	}
+	if !kv.admit(xop) {
+		reply.Err = ErrRejected
+		return nil
+	}
+	kv.chargeMemory(xop)
+	rep := kv.propose(ctx, xop)
+	reply.Err = kv.arriving(args.Key, rep.Err)
+	kv.countReply(key2shard(args.Key), reply.Err)
+
+	return nil
+}
+
+// RPC handlers for the participants of a two-phase commit
+func (kv *ShardKV) Prepare(args *TxnArgs, reply *TxnReply) error {
+	return kv.txnOperation(Prepare, args, reply)
+}
+
+func (kv *ShardKV) Commit(args *TxnArgs, reply *TxnReply) error {
+	return kv.txnOperation(Commit, args, reply)
+}
+
+func (kv *ShardKV) Abort(args *TxnArgs, reply *TxnReply) error {
+	return kv.txnOperation(Abort, args, reply)
+}
+
+// RPC handler recording (or reporting) a transaction's outcome
+func (kv *ShardKV) Decide(args *TxnArgs, reply *TxnReply) error {
+	return kv.txnOperation(Decide, args, reply)
+}
+
+func (kv *ShardKV) txnOperation(op string, args *TxnArgs, reply *TxnReply) error {
+	defer kv.handling()()
+
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	kv.logEvent(LevelDebug, "rpc", Field{"op", op}, Field{"client", args.CID},
+		Field{"client_seq", args.Seq}, Field{"txn", args.TxnID})
+
+	rep := kv.execute(&Op{CID:args.CID, Seq:args.Seq, Op:op, Extra:*args})
+	reply.Err, reply.Commit = rep.Err, rep.Value == Commit
+
+	return nil
+}
+
+// RPC handler for applying a registered transform to a key
+func (kv *ShardKV) Apply(args *ApplyArgs, reply *ApplyReply) error {
+	defer kv.handling()()
+	kv.hot.touch(args.Key)
+
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	kv.logEvent(LevelDebug, "rpc", Field{"op", Apply}, Field{"client", args.CID},
+		Field{"client_seq", args.Seq}, Field{"key", args.Key}, Field{"func", args.Func})
+
+	xop := &Op{CID:args.CID, Seq:args.Seq, Op:Apply, Key:args.Key, Value:args.Arg, Extra:args.Func}
+	rep := kv.execute(xop)
+	reply.Err, reply.Value = rep.Err, rep.Value
+
+	return nil
+}
+
+// RPC handler for adding to a counter
+func (kv *ShardKV) Incr(args *IncrArgs, reply *IncrReply) error {
+	defer kv.handling()()
+	kv.hot.touch(args.Key)
+
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	kv.logEvent(LevelDebug, "rpc", Field{"op", Incr}, Field{"client", args.CID},
+		Field{"client_seq", args.Seq}, Field{"key", args.Key}, Field{"delta", args.Delta})
+
+	rep := kv.execute(&Op{CID:args.CID, Seq:args.Seq, Op:Incr, Key:args.Key, Extra:args.Delta})
+	reply.Err, reply.Value = rep.Err, rep.Value
+
+	return nil
+}
+
+// RPC handler for writing several keys in one op
+func (kv *ShardKV) PutBatch(args *PutBatchArgs, reply *PutBatchReply) error {
+	defer kv.handling()()
+
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	kv.logEvent(LevelDebug, "rpc", Field{"op", PutBatch}, Field{"client", args.CID},
+		Field{"client_seq", args.Seq}, Field{"keys", len(args.KVs)})
+
+	rep := kv.execute(&Op{CID:args.CID, Seq:args.Seq, Op:PutBatch, Extra:*args})
+	reply.Err = rep.Err
+
+	return nil
+}
+
+// RPC handler for a conditional write of keys of one shard
+func (kv *ShardKV) CondTxn(args *CondTxnArgs, reply *CondTxnReply) error {
+	defer kv.handling()()
+
+	keys := args.keys()
+	if len(keys) == 0 {
+		reply.Err = OK
+		return nil
+	}
+	if args.shard() < 0 {
+		reply.Err = ErrWrongGroup
+		return nil
+	}
+
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	kv.logEvent(LevelDebug, "rpc", Field{"op", CondTxn}, Field{"client", args.CID},
+		Field{"client_seq", args.Seq}, Field{"keys", len(keys)})
+
+	rep := kv.execute(&Op{CID:args.CID, Seq:args.Seq, Op:CondTxn, Extra:*args})
+	reply.Err = rep.Err
+
+	return nil
+}
+
+// RPC handler for removing a key
+func (kv *ShardKV) Delete(args *DeleteArgs, reply *DeleteReply) error {
+	defer kv.handling()()
+	kv.hot.touch(args.Key)
+
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	kv.logEvent(LevelDebug, "rpc", Field{"op", Delete}, Field{"client", args.CID},
+		Field{"client_seq", args.Seq}, Field{"key", args.Key})
+
+	rep := kv.execute(&Op{CID:args.CID, Seq:args.Seq, Op:Delete, Key:args.Key})
+	reply.Err = rep.Err
+
+	return nil
+}
+
+//
+// RPC handler reporting the args.N keys this server has
+// been asked about most in the last HotKeyHalfLife or so.
+// the rates are estimates, and only count requests made
+// to this server, not to the rest of its group.
+//
+func (kv *ShardKV) HotKeys(args *HotKeysArgs, reply *HotKeysReply) error {
+	reply.Keys = kv.hot.top(args.N)
+	reply.Err = OK
+	return nil
+}
+
+// longest a WaitChange or Watch RPC is held by the server
+const MaxWaitChange = 2 * time.Second
+
+//
+// RPC handler for long-polling a key. it only reads local
+// state, advanced over instances the replica has learned
+// were decided, so the value it returns may be stale.
+//
+func (kv *ShardKV) WaitChange(args *WaitChangeArgs, reply *WaitChangeReply) error {
+	defer kv.handling()()
+
+	rep := kv.awaitKey(args.Key, args.Timeout, func(rep *Rep) bool {
+		return rep.Value != args.Value
+	})
+	if rep.Err == ErrNoKey || rep.Err == ErrLocked {
+		rep.Err = OK
+	}
+	reply.Err, reply.Value = rep.Err, rep.Value
+	return nil
+}
+
+//
+// RPC handler for watching a key for a version after
+// args.Version. as stale as WaitChange().
+//
+func (kv *ShardKV) Watch(args *WatchArgs, reply *WatchReply) error {
+	defer kv.handling()()
+
+	rep := kv.awaitKey(args.Key, args.Timeout, func(rep *Rep) bool {
+		return rep.Err != ErrLocked && rep.Version != args.Version
+	})
+	if rep.Err == ErrLocked {
+		// changing; not yet changed
+		rep.Err, rep.Value, rep.Version = OK, "", args.Version
+	}
+	reply.Err, reply.Value, reply.Version = rep.Err, rep.Value, rep.Version
+	return nil
+}
+
+//
+// read key from local state until changed(), or the key's
+// shard isn't served here, or timeout (at most
+// MaxWaitChange) is up.
+//
+func (kv *ShardKV) awaitKey(key string, timeout time.Duration, changed func(rep *Rep) bool) *Rep {
+	if timeout > MaxWaitChange {
+		timeout = MaxWaitChange
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		kv.mu.Lock()
+		kv.learn()
+		rep := kv.doGet(key)
+		kv.mu.Unlock()
+
+		if rep.Err == ErrWrongGroup || changed(rep) ||
+			!time.Now().Before(deadline) || kv.halted() {
+			return rep
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+//
+// apply the ops other replicas got decided after ours,
+// without logging anything. kv.mu must be held.
+//
+func (kv *ShardKV) learn() {
+	for {
+		fate, _ := kv.px.Status(kv.seq)
+		if fate != paxos.Decided {
+			break
+		}
+		kv.seq++
+	}
+	kv.catchUp()
+}
+
+//
+// RPC handler for wiping one shard owned by this group.
+// the caller is not authenticated.
+//
+func (kv *ShardKV) ClearShard(args *ClearShardArgs, reply *ClearShardReply) error {
+	defer kv.handling()()
+
+	if args.Shard < 0 || args.Shard >= shardmaster.NShards {
+		reply.Err = ErrBadShard
+		return nil
+	}
+
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	kv.logEvent(LevelDebug, "rpc", Field{"op", ClearShard}, Field{"client", args.CID},
+		Field{"client_seq", args.Seq}, Field{"shard", args.Shard})
+
+	rep := kv.execute(&Op{CID:args.CID, Seq:args.Seq, Op:ClearShard, Extra:args.Shard})
+	reply.Err = rep.Err
+	if rep.Err == OK {
+		reply.Removed, _ = strconv.Atoi(rep.Value)
+	}
+
+	return nil
+}
+
+//
+// what a Get with args reads a missing key as: the one the
+// request asks for, else this server's, else none (ErrNoKey).
+// it is logged with the Get, so all replicas agree on it.
+//
+func (kv *ShardKV) missingDefault(args *GetArgs) (bool, string) {
+	if args.UseDefault {
+		return true, args.Default
+	}
+	if kv.missing != nil {
+		return true, *kv.missing
+	}
+	return false, ""
+}
+
+//
+// a no-op to be logged for the ConfirmLeadership() calls
+// waiting on it. done is closed once it has been applied.
+//
+type confirmRound struct {
+	done chan bool
+	err  Err // set before done is closed
+}
+
+//
+// apply the log up to seq (GetArgs.MinSeq) before a read.
+// ops this server has learned of are applied at once; if
+// that isn't enough, a no-op is logged as for
+// ConfirmLeadership(), which fills in the ops before it.
+//
+func (kv *ShardKV) readAfter(seq int) Err {
+	kv.mu.Lock()
+	kv.learn()
+	behind := kv.last_seq < seq
+	kv.mu.Unlock()
+	if behind {
+		return kv.ConfirmLeadership()
+	}
+	return OK
+}
+
+//
+// log a no-op and apply the log up to it, so that this
+// server's state includes every op that completed before
+// the call, and may serve reads linearizably from it.
+// calls arriving while a no-op is being logged share the
+// next one, so a burst of reads costs one or two log slots.
+// returns ErrTimeout if the no-op was not logged within
+// Options.ProposeTimeout.
+//
+func (kv *ShardKV) ConfirmLeadership() Err {
+	kv.cmu.Lock()
+	r := kv.round
+	leader := r == nil
+	if leader {
+		r = &confirmRound{done:make(chan bool)}
+		kv.round = r
+	}
+	kv.cmu.Unlock()
+
+	if !leader {
+		<-r.done
+		return r.err
+	}
+
+	kv.mu.Lock()
+	// calls from now on may come after our no-op is
+	// proposed, so they need another one
+	kv.cmu.Lock()
+	kv.round = nil
+	kv.cmu.Unlock()
+
+	kv.catchUp()
+	cid := "confirm-" + strconv.FormatInt(nrand(), 16)
+	r.err = kv.logOperation(&Op{CID:cid, Seq:1, Op:Noop})
+	kv.catchUp()
+	kv.mu.Unlock()
+
+	close(r.done)
+	return r.err
+}
+
+//
+// drop the group's cached replies to clients, e.g. after a
+// repair left them disagreeing with the data. each client's
+// most recent request seq is kept, so no op is ever applied
+// twice; see applier.droppedReply() for how retries of ops
+// whose replies were dropped are answered.
+//
+func (kv *ShardKV) RebuildDedup() {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	kv.catchUp()
+	cid := "rebuild-" + strconv.FormatInt(nrand(), 16)
+	kv.logOperation(&Op{CID:cid, Seq:1, Op:RebuildDedup})
+	kv.catchUp()
+}
+
+//
+// find the keys the group holds in shards it doesn't serve,
+// as after a change to key2shard() files keys under other
+// shards than they were written to, and return the group
+// serving each one's shard now (0 if none). the search is
+// logged, so every replica finds the same keys. nothing is
+// moved or deleted: what a group keeps of a shard it handed
+// over (see dropShard()) is found too, and there the new
+// owner's copy is the one to keep.
+//
+func (kv *ShardKV) RepairSharding() (map[string]int64, Err) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	kv.catchUp()
+	cid := "repair-" + strconv.FormatInt(nrand(), 16)
+	if err := kv.logOperation(&Op{CID:cid, Seq:1, Op:RepairSharding}); err != OK {
+		return nil, err
+	}
+	kv.catchUp()
+	return kv.orphans, OK
+}
+
+//
+// log a client op and return its reply, or the recorded
+// reply if the op is a duplicate. kv.mu must be held.
+//
+func (kv *ShardKV) execute(xop *Op) (*Rep) {
+	// we catch up to update the client states (filters actually)
+	kv.catchUp()
+
+	rp, yes := kv.filterDuplicate(xop)
+	if yes {
+		kv.logEvent(LevelDebug, "duplicate", Field{"op", xop.Op}, Field{"client", xop.CID},
+			Field{"client_seq", xop.Seq})
+		if rp == nil {
+			rp = &Rep{}
+		}
+		return rp
+	}
+
+	if kv.leasedElsewhere() {
+		return &Rep{Err:ErrNotLeader}
+	}
+	if !kv.admit(xop) {
+		return &Rep{Err:ErrRejected}
+	}
+	if err := kv.logOperation(xop); err != OK {
+		kv.countReply(opShard(xop), err)
+		return &Rep{Err:err}
+	}
+
+	rep := kv.catchUp()
+	kv.countReply(opShard(xop), rep.Err)
+	return rep
+}
+
+// run the PreLog hook on a client op about to be logged
+func (kv *ShardKV) admit(xop *Op) bool {
+	if kv.preLog == nil {
+		return true
+	}
+	if err := kv.preLog(xop); err != nil {
+		kv.logEvent(LevelInfo, "op rejected", Field{"op", xop.Op}, Field{"client", xop.CID},
+			Field{"client_seq", xop.Seq}, Field{"err", err})
+		return false
+	}
+	return true
+}
+
+//
+// recovery for transactions whose coordinator went away:
+// once a transaction has held locks here for TxnTimeout,
+// ask the group owning its Coord key for the outcome
+// (proposing abort), then log that outcome locally.
+//
+func (kv *ShardKV) resolveTxns() {
+	kv.mu.Lock()
+	kv.catchUp()
+	now := time.Now()
+	stale := map[string]string{} // txn -> coord
+	seen := map[string]bool{}
+	for key, lock := range kv.xstate.Locks {
+		if kv.config.Shards[key2shard(key)] != kv.gid {
+			continue
+		}
+		seen[lock.Txn] = true
+		first, ok := kv.txnSeen[lock.Txn]
+		if !ok {
+			kv.txnSeen[lock.Txn] = now
+		} else if now.Sub(first) > TxnTimeout {
+			stale[lock.Txn] = lock.Coord
+		}
+	}
+	for txn := range kv.txnSeen {
+		if !seen[txn] {
+			delete(kv.txnSeen, txn)
+		}
+	}
+	config := kv.config
+	kv.mu.Unlock()
+
+	for txn, coord := range stale {
+		commit, ok := kv.askOutcome(&config, txn, coord)
+		if !ok {
+			continue
+		}
+		kv.logEvent(LevelInfo, "txn resolved", Field{"txn", txn}, Field{"commit", commit})
+
+		kv.mu.Lock()
+		args := TxnArgs{TxnID:txn, Coord:coord, Writes:map[string]string{}}
+		for key, lock := range kv.xstate.Locks {
+			if lock.Txn == txn {
+				args.Writes[key] = ""
+			}
+		}
+		xop := &Op{Seq:int(nrand()), Op:Abort, Extra:args}
+		if commit {
+			xop.Op = Commit
+		}
+		kv.logOperation(xop)
+		kv.catchUp()
+		kv.mu.Unlock()
+	}
+}
+
+func (kv *ShardKV) askOutcome(config *shardmaster.Config, txn string, coord string) (bool, bool) {
+	gid := config.Shards[key2shard(coord)]
+	for _, server := range config.Groups[gid] {
+		args := &TxnArgs{TxnID:txn, Coord:coord, Commit:false, Seq:int(nrand())}
+		var reply TxnReply
+		ok := send(server, "ShardKV.Decide", args, &reply)
+		if ok && reply.Err == OK {
+			return reply.Commit, true
+		}
+	}
+	return false, false
+}
+
+//
+// log a SweepExpired op if this server holds keys with a
+// TTL. every replica applies it at the same seq, and so
+// drops the same keys.
+//
+func (kv *ShardKV) sweep() {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	kv.catchUp()
+	if len(kv.xstate.Expires) == 0 && len(kv.xstate.Deadlines) == 0 {
+		return
+	}
+	cid := "sweep-" + strconv.FormatInt(nrand(), 16)
+	kv.logOperation(&Op{CID:cid, Seq:1, Op:SweepExpired})
+	kv.catchUp()
+}
+
+//
+// move to config, which must follow the current one: freeze
+// the shards it takes from the group, fetch the shards it
+// brings, then log a Reconf.
+// kv.mu must be held; it is released while the shards are
+// fetched, all at once, so that clients are served and
+// other groups can fetch from this one in the meantime.
+// returns false if config was not reached.
+//
+// so that a group fetches each shard once rather than once
+// per replica, a replica first logs a claim to the fetch.
+// the one whose claim is decided first fetches; the others
+// wait ReconfHandoffTicks for its Reconf, and fetch only if
+// it doesn't come (as when that replica died).
+//
+func (kv *ShardKV) reconfigure(config *shardmaster.Config) bool {
+	// we catch up to ensure that kv.config.Num equals config.Num - 1
+	kv.catchUp()
+	if kv.config.Num >= config.Num {
+		// another replica logged it
+		return true
+	}
+
+	if err := kv.checkConfig(config); err != nil {
+		kv.logEvent(LevelWarn, "config refused", Field{"config", config.Num}, Field{"err", err})
+		return false
+	}
+	kv.freezeLeaving(config)
+	if kv.config.Num >= config.Num {
+		return true
+	}
+	if !kv.claimFetch(config.Num) {
+		return false
+	}
+	if kv.config.Num >= config.Num {
+		// the claimant logged it
+		return true
+	}
+
+	// a shard no group served (gid 0, or a gid missing from
+	// Groups) starts out empty: there is no one to fetch it from
+	needed := []int{}
+	for shard := 0; shard < shardmaster.NShards; shard++ {
+		gid := kv.config.Shards[shard]
+		_, served := kv.config.Groups[gid]
+		if config.Shards[shard] == kv.gid && served && gid != kv.gid {
+			needed = append(needed, shard)
+		}
+	}
+	kv.startProgress(config.Num, needed)
+
+	// a Reconf replaces kv.config rather than changing it
+	old := kv.config
+	fetched := make([]*XState, len(needed))
+	var wg sync.WaitGroup
+	kv.mu.Unlock()
+	for i, shard := range needed {
+		wg.Add(1)
+		go func(i int, shard int) {
+			defer wg.Done()
+			fetched[i] = kv.requestShard(&old, shard)
+			if fetched[i] != nil {
+				kv.shardFetched(shard, fetched[i])
+			}
+		}(i, shard)
+	}
+	wg.Wait()
+	kv.mu.Lock()
+
+	xstate := MakeXState()
+	for _, ret := range fetched {
+		if ret == nil { 
+			return false
+		}
+		xstate.Update(ret)
+	}
+
+	// another replica may have logged a Reconf meanwhile
+	kv.catchUp()
+	if kv.config.Num != old.Num {
+		return kv.config.Num >= config.Num
+	}
+	xop := &Op{Seq:config.Num, Op:Reconf, Extra:ReconfExtra{*config, *xstate}}
+	if kv.logOperation(xop) != OK {
+		return false
+	}
+
+	// not if it was fenced off by another's read lease
+	kv.catchUp()
+	return kv.config.Num >= config.Num
+}
+
+// a FetchClaim, as noted when applied
+type fetchClaim struct {
+	by int       // Op.Proposer of the claimant
+	at time.Time // when this server applied it
+}
+
+//
+// whether this server is to fetch the shards config num
+// brings: it claimed them first, or the replica that did
+// has taken too long. kv.mu must be held.
+//
+func (kv *ShardKV) claimFetch(num int) bool {
+	for n := range kv.claims {
+		if n <= kv.config.Num {
+			delete(kv.claims, n)
+		}
+	}
+	c, ok := kv.claims[num]
+	if !ok {
+		cid := "claim-" + strconv.FormatInt(nrand(), 16)
+		if kv.logOperation(&Op{CID:cid, Seq:1, Op:FetchClaim, Extra:num}) != OK {
+			return false
+		}
+		kv.catchUp()
+		if c, ok = kv.claims[num]; !ok {
+			// fenced off by another's read lease
+			return false
+		}
+	}
+	return c.by == kv.me + 1 || time.Since(c.at) >= ReconfHandoffTicks*kv.tickEvery
+}
+
+// note a FetchClaim applied. kv.mu must be held.
+func (kv *ShardKV) noteClaim(op *Op) {
+	num := op.Extra.(int)
+	if _, ok := kv.claims[num]; !ok && num > kv.config.Num {
+		kv.claims[num] = fetchClaim{op.Proposer, time.Now()}
+	}
+}
+
+//
+// refuse a config that doesn't follow the current one, or
+// that assigns a shard to a group it doesn't list.
+//
+func (kv *ShardKV) checkConfig(config *shardmaster.Config) error {
+	if config.Num != kv.config.Num + 1 {
+		return fmt.Errorf("does not follow config %d", kv.config.Num)
+	}
+	for shard, gid := range config.Shards {
+		if _, ok := config.Groups[gid]; gid != 0 && !ok {
+			return fmt.Errorf("shard %d assigned to unknown group %d", shard, gid)
+		}
+	}
+	return nil
+}
+
+//
+// fetch shard's state from the group serving it in config.
+// called without kv.mu. returns nil if no server of that
+// group gave it.
+//
+func (kv *ShardKV) requestShard(config *shardmaster.Config, shard int) (*XState) {
+	gid := config.Shards[shard]
+	kv.logEvent(LevelDebug, "fetching shard", Field{"shard", shard}, Field{"from", gid},
+		Field{"config", config.Num})
+
+	// back off while the source group is busy serving other
+	// transfers, since it will soon have a free slot
+	wait := 10 * time.Millisecond
+	for !kv.isdead() {
+		busy := false
+		for _, server := range config.Groups[gid] {
+			xs, err := kv.fetchChunks(server, config, shard)
+			if err == OK {
+				return xs
+			}
+			if err == ErrTransferBusy {
+				busy = true
+			}
+		}
+		if !busy {
+			break
+		}
+		time.Sleep(wait)
+		if wait < time.Second {
+			wait *= 2
+		}
+	}
+	kv.logEvent(LevelWarn, "shard fetch failed", Field{"shard", shard}, Field{"from", gid},
+		Field{"config", config.Num})
+	return nil
+}
+
+func (kv *ShardKV) TransferState(args *TransferStateArgs, reply *TransferStateReply) error {
+	defer kv.handling()()
+
+	release, ok := kv.transferSlot()
+	if !ok {
+		reply.Err = ErrTransferBusy
+		return nil
+	}
+	defer release()
+	
+	// no server holds kv.mu while it waits on another group
+	// (see reconfigure()), so two groups fetching shards from
+	// each other at once do not wedge
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	kv.logEvent(LevelDebug, "rpc", Field{"op", "TransferState"}, Field{"shard", args.Shard},
+		Field{"config", args.ConfigNum}, Field{"at", kv.config.Num})
+
+	if err := kv.transferReady(args.ConfigNum, args.Shard); err != OK {
+		reply.Err = err
+		return nil
+	}
+	reply.XState = *kv.shardState(args.Shard)
+	reply.Digest = shardDigest(reply.XState.KVStore, args.Shard)
+	reply.Checksum = transferChecksum(&reply.XState)
+	reply.Err = OK
+	kv.sent++
+	return nil
+}
+
+//
+// take one of the Options.MaxTransfers slots, returning the
+// function that frees it, or false if all are taken.
+//
+func (kv *ShardKV) transferSlot() (func(), bool) {
+	if kv.transfers == nil {
+		return func() {}, true
+	}
+	select {
+	case kv.transfers <- true:
+		return func() { <-kv.transfers }, true
+	default:
+		return nil, false
+	}
+}
+
+//
+// can shard's state be sent to a group moving to the config
+// after configNum? freezes the shard if this server is at
+// configNum. kv.mu must be held.
+//
+func (kv *ShardKV) transferReady(configNum int, shard int) Err {
+	// we check if we have older config than the client-server's 
+	if kv.config.Num < configNum {
+		return ErrNotReady
+	} 
+	if kv.leasedElsewhere() {
+		// the holder serves it; our Freeze would be fenced off
+		return ErrNotReady
+	}
+
+	// a replica other clients' ops did not go through may
+	// not have applied them yet; with transfers limited,
+	// requesters fall back to such replicas
+	kv.learn()
+
+	// the requester is moving to the config after ours, in
+	// which the shard is its. stop serving the shard first,
+	// or writes we took after replying would be lost.
+	if kv.config.Num == configNum {
+		kv.freeze(shard)
+		kv.catchUp()
+		if kv.config.Num == configNum && !kv.frozen[shard] {
+			return ErrNotReady
+		}
+	}
+	return OK
+}
+
+//
+// log a Freeze of shard in the current config. kv.mu must be
+// held.
+//
+func (kv *ShardKV) freeze(shard int) {
+	cid := "freeze-" + strconv.FormatInt(nrand(), 16)
+	extra := FreezeExtra{shard, kv.config.Num}
+	kv.logOperation(&Op{CID:cid, Seq:1, Op:Freeze, Extra:extra})
+}
+
+//
+// stop serving the shards config takes from this group as
+// soon as this server learns of it, rather than only when
+// their new owner comes to fetch them, so that clients move
+// on to the new owner and no write is taken that the fetch
+// could miss. kv.mu must be held.
+//
+func (kv *ShardKV) freezeLeaving(config *shardmaster.Config) {
+	froze := false
+	for shard, gid := range config.Shards {
+		if gid != kv.gid && kv.config.Shards[shard] == kv.gid && !kv.frozen[shard] {
+			kv.freeze(shard)
+			froze = true
+		}
+	}
+	if froze {
+		kv.catchUp()
+	}
+}
+
+//
+// a copy of shard's state, with the states of the clients that
+// used it, for another group to take the shard over. kv.mu
+// must be held.
+//
+func (kv *ShardKV) shardState(shard int) *XState {
+	xs := MakeXState()
+	
+	// keys whose TTL has run out are left behind
+	for key := range kv.xstate.KVStore {
+		if key2shard(key) == shard && !kv.expired(kv.last_seq, key) {
+			value := kv.xstate.KVStore[key]
+			xs.KVStore[key] = value
+		}
+	}
+	for key, seq := range kv.xstate.Expires {
+		if key2shard(key) == shard && !kv.expired(kv.last_seq, key) {
+			xs.Expires[key] = seq - kv.last_seq
+		}
+	}
+	for key, deadline := range kv.xstate.Deadlines {
+		if key2shard(key) == shard && !kv.expired(kv.last_seq, key) {
+			xs.Deadlines[key] = deadline
+		}
+	}
+	for key, version := range kv.xstate.Versions {
+		if key2shard(key) == shard {
+			xs.Versions[key] = version
+		}
+	}
+	for key, gid := range kv.xstate.Mirrors {
+		if key2shard(key) == shard {
+			xs.Mirrors[key] = gid
+		}
+	}
+	for key, gids := range kv.xstate.Unmirrored {
+		if key2shard(key) == shard {
+			xs.Unmirrored[key] = gids
+		}
+	}
+	for key, epoch := range kv.xstate.MirrorEpochs {
+		if key2shard(key) == shard {
+			xs.MirrorEpochs[key] = epoch
+		}
+	}
+	// the clients' states for other shards stay here
+	for client, last := range kv.xstate.LastShard {
+		if last != shard {
+			continue
+		}
+		xs.MRRSMap[client] = kv.xstate.MRRSMap[client] 
+		if rep, ok := kv.xstate.Replies[client]; ok {
+			xs.Replies[client] = rep
+		}
+		if recent, ok := kv.xstate.Recent[client]; ok {
+			xs.Recent[client] = recent
+		}
+		xs.LastShard[client] = last
+	}
+	for client, seq := range kv.xstate.ShardSeqs[shard] {
+		xs.noteShardSeq(shard, client, seq)
+	}
+	for key, lock := range kv.xstate.Locks {
+		if key2shard(key) == shard {
+			xs.Locks[key] = lock
+		}
+	}
+	for txn, outcome := range kv.xstate.Outcomes {
+		if key2shard(outcome.Coord) == shard {
+			xs.Outcomes[txn] = outcome
+		}
+	}
+	return xs
+}
+
+//
+// Ask the shardmaster if there's a new configuration;
+// if so, re-configure.
+//
+func (kv *ShardKV) tick() {
+	// not holding kv.mu, so that clients are still served
+	// from the current config if no shardmaster answers
+	latest_config, ok := kv.queryConfig(-1)
+	if !ok {
+		kv.logEvent(LevelWarn, "no shardmaster reachable")
+		return
+	}
+
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	
+	// we catch up, in case we would log same ops as before
+	kv.catchUp()
+	kv.catchUpFromPeer()
+	if latest_config.Num > kv.latest {
+		kv.latest = latest_config.Num
+	}
+
+	// reconfigure() may find another replica has moved on
+	for kv.config.Num < latest_config.Num {
+		config, ok := kv.queryConfig(kv.config.Num + 1)
+		if !ok || !kv.reconfigure(&config) {
+			break
+		}
+	}
+}
+
+//
+// have the server ask the shardmaster for a new config now,
+// rather than at its next tick, e.g. right after a Join,
+// Leave or Move. returns at once; the poll runs in the tick
+// loop, so it never overlaps a tick, and pokes that come
+// before it starts share it.
+//
+func (kv *ShardKV) PokeReconfigure() {
+	select {
+	case kv.poke <- true:
+	default:
+	}
+}
+
+//
+// ask the shardmaster for config num, falling back to the
+// secondary cluster (if any) when no primary server answers.
+// unlike shardmaster.Clerk.Query(), gives up after
+// ConfigQueryTimeout per cluster, so that a shardmaster that
+// is down or hung doesn't hold up tick() (and kv.mu) for
+// good.
+//
+func (kv *ShardKV) queryConfig(num int) (shardmaster.Config, bool) {
+	for _, sm := range kv.masters {
+		ctx, cancel := context.WithTimeout(context.Background(), ConfigQueryTimeout)
+		config, err := sm.QueryCtx(ctx, num)
+		cancel()
+		if err == nil {
+			return config, true
+		}
+	}
+	return shardmaster.Config{}, false
+}
+
+// note a client RPC handler running; call the returned
+// func when it is done.
+func (kv *ShardKV) handling() func() {
+	atomic.AddInt32(&kv.handlers, 1)
+	return func() { atomic.AddInt32(&kv.handlers, -1) }
+}
+
+//
+// shut the server down, for a restart: stop taking new
+// connections, give the RPCs already being handled until ctx
+// is done to finish, so their clients get replies rather
+// than hanging on a dead server, then save a last snapshot
+// (with Options.SnapshotInterval) and kill the server. ops
+// still waiting on paxos then give up with ErrShutdown.
+// returns ctx.Err() if some RPCs did not finish in time, or
+// the snapshot's error.
+//
+func (kv *ShardKV) Shutdown(ctx context.Context) error {
+	// stop taking connections as kill() does, but keep paxos
+	// going for the handlers
+	atomic.StoreInt32(&kv.draining, 1)
+	atomic.StoreInt32(&kv.dead, 1)
+	kv.l.Close()
+	// let connections just accepted reach their handlers
+	time.Sleep(10 * time.Millisecond)
+	var err error
+	for atomic.LoadInt32(&kv.handlers) > 0 {
+		if err = ctx.Err(); err != nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// stop the handlers still waiting, so that they let go of
+	// kv.mu for the snapshot
+	atomic.StoreInt32(&kv.draining, 0)
+	if kv.snapFile != "" {
+		if serr := kv.saveSnapshot(); serr != nil && err == nil {
+			err = serr
+		}
+	}
+	// the rest of kill(): dead is set and the listener closed
+	kv.px.Kill()
+	return err
+}
+
+// Shutdown() with a timeout. for tests.
+func (kv *ShardKV) drainAndKill(timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	kv.Shutdown(ctx)
+}
+
+//
+// should handlers give up on the ops they are waiting for?
+// once the server is dead, unless Shutdown() is still
+// letting them finish.
+//
+func (kv *ShardKV) halted() bool {
+	return kv.isdead() && atomic.LoadInt32(&kv.draining) == 0
+}
+
+// tell the server to shut itself down.
+// please don't change these two functions.
+func (kv *ShardKV) kill() {
+	atomic.StoreInt32(&kv.dead, 1)
+	kv.l.Close()
+	kv.px.Kill()
+}
+
+// call this to find out if the server is dead.
+func (kv *ShardKV) isdead() bool {
+	return atomic.LoadInt32(&kv.dead) != 0
+}
+
+// please do not change these two functions.
+func (kv *ShardKV) Setunreliable(what bool) {
+	if what {
+		atomic.StoreInt32(&kv.unreliable, 1)
+	} else {
+		atomic.StoreInt32(&kv.unreliable, 0)
+	}
+}
+
+func (kv *ShardKV) isunreliable() bool {
 	return atomic.LoadInt32(&kv.unreliable) != 0
 }
 
+//
+// a deterministic transform for Clerk.Apply(): it gets the
+// key's current value ("" if absent) and the client's arg,
+// and returns the new value.
+//
+type TransformFunc func(old string, arg string) string
+
+//
+// optional server settings, for StartServerWithOptions().
+// a nil *Options gives StartServer()'s behaviour.
+//
+type Options struct {
+	// transforms callable through Clerk.Apply(), by name.
+	// every server of a group must register the same ones.
+	Funcs map[string]TransformFunc
+
+	// a standby shardmaster cluster, only queried for
+	// configs when no primary shardmaster answers. the
+	// operator must give it the same Join/Leave/Move
+	// history as the primary; to promote it, restart
+	// servers and clerks with it as the primary.
+	SecondaryMasters []string
+
+	// called on each client op before it is proposed; may
+	// rewrite it (e.g. encrypt Value) or reject it with an
+	// error, which the client sees as ErrRejected.
+	PreLog func(op *Op) error
+	// called on each op decided in the log before it is
+	// applied (e.g. to decrypt Value). must be deterministic,
+	// and must not modify maps or slices held in op.Extra.
+	PostDecode func(op *Op)
+
+	// the most TransferState requests served at once; others
+	// get ErrTransferBusy and retry. 0 means no limit.
+	MaxTransfers int
+
+	// how long a server first waits for an op it proposed to
+	// be decided before looking again, doubling up to
+	// ProposeMaxBackoff. default to 10ms and 1s.
+	ProposeBackoff    time.Duration
+	ProposeMaxBackoff time.Duration
+
+	// how long a server waits for an op it proposed to be
+	// decided before giving up with ErrTimeout, as when its
+	// group has no majority. 0 means forever. the op may still
+	// be decided and applied later.
+	ProposeTimeout time.Duration
+
+	// how often a server asks the shardmaster for a new
+	// config. defaults to TickInterval. see also
+	// PokeReconfigure().
+	TickInterval time.Duration
+
+	// the most keys of a shard asked for per
+	// TransferStateChunk; see transfer.go. defaults to
+	// TransferChunkKeys.
+	TransferChunk int
+
+	// how many decided ops to apply at a time, under one
+	// hold of the lock on the state, before telling paxos
+	// they are done. defaults to 1.
+	ApplyBatch int
+
+	// how often each server logs a SweepExpired op, which
+	// drops keys whose TTL has run out. 0 means never;
+	// expired keys then only read as missing.
+	SweepInterval time.Duration
+
+	// if not nil, Gets of a missing key that do not ask for
+	// their own default read as OK with this value rather
+	// than ErrNoKey.
+	MissingDefault *string
+
+	// count one in this many client requests towards
+	// HotKeys(). defaults to 8.
+	HotKeySample int
+
+	// how often each server writes its state to disk, so
+	// that it can be restarted; see snapshot.go. 0 means
+	// never.
+	SnapshotInterval time.Duration
+
+	// the Durability of writes that don't ask for one.
+	// defaults to DurabilityMemory.
+	Durability string
+
+	// soft limit on the bytes of state a server holds, as
+	// estimated every MemoryCheckInterval. near it the server
+	// frees what it can; past it, writes that would grow the
+	// store get ErrMemoryPressure. 0 means no limit.
+	MemoryLimit int
+
+	// the most proposals a second a server makes into log
+	// slots it missed (e.g. while cut off from its group)
+	// when catching up, so that a replica rejoining far behind
+	// doesn't crowd out the others' client ops. 0 means no
+	// limit.
+	CatchUpRate int
+
+	// if > 0, one server of a group at a time holds a read
+	// lease this long, and serves Gets without logging them;
+	// see lease.go. every server of a group must use the
+	// same value.
+	LeaseDuration time.Duration
+
+	// the most clients a group remembers the last request
+	// of, to filter duplicates; past it, the ones idle
+	// longest are forgotten (see dedup.go). every server of
+	// a group must use the same value. 0 means no limit.
+	MaxClients int
+
+	// if > 0, a server logs the client ops it gets within
+	// this long of each other in one log slot, rather than
+	// each in its own; see batch.go. ops then wait up to this
+	// long before being proposed.
+	BatchWindow time.Duration
+
+	// the largest value, in bytes, a write may leave a key
+	// with; writes past it (including Appends, by the value
+	// they would make) get ErrValueTooLarge. every server of
+	// a group must use the same value. 0 means no limit.
+	MaxValueBytes int
+
+	// how long a server answers nothing but ErrWrongGroup for
+	// a shard before warning that it looks stuck; see
+	// metrics.go. defaults to StuckShardAfter.
+	StuckShardAfter time.Duration
+
+	// if > 0, the most Gets and PutAppends a second a server
+	// takes from one client, which may send up to ClientBurst
+	// (by default ClientRate) at once; past that, they get
+	// ErrRateLimited without being logged. see ratelimit.go.
+	ClientRate  int
+	ClientBurst int
+
+	// a peer of this group to copy the state of before
+	// serving, for a replica joining its group with nothing
+	// to go on; see snapshot.go. "" means none.
+	Bootstrap string
+
+	// receives the server's events, such as reconfigurations;
+	// see logger.go. nil drops them.
+	Logger Logger
+}
+
 //
 // Start a shardkv server.
 // gid is the ID of the server's replica group.
@@ -428,13 +2378,47 @@ func (kv *ShardKV) isunreliable() bool {
 //
 func StartServer(gid int64, shardmasters []string,
 	servers []string, me int) *ShardKV {
-	gob.Register(Op{})
-	gob.Register(XState{})
+	kv, err := StartServerE(gid, shardmasters, servers, me)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return kv
+}
 
-	kv := new(ShardKV)
-	kv.me = me
-	kv.gid = gid
-	kv.sm = shardmaster.MakeClerk(shardmasters)
+//
+// like StartServer(), but returns an error rather than
+// exiting if the server can't listen on servers[me], e.g.
+// because another live server is already serving there.
+//
+func StartServerE(gid int64, shardmasters []string,
+	servers []string, me int) (*ShardKV, error) {
+	return StartServerWithOptions(gid, shardmasters, servers, me, nil)
+}
+
+//
+// like StartServerE(), with optional settings.
+//
+func StartServerWithOptions(gid int64, shardmasters []string,
+	servers []string, me int, opts *Options) (*ShardKV, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+
+	// refuse to steal the socket of a live server, or of one
+	// being started alongside
+	if !reserveSocket(servers[me]) {
+		return nil, fmt.Errorf("listen error: %s is being started", servers[me])
+	}
+	defer releaseSocket(servers[me])
+	if c, err := net.Dial("unix", servers[me]); err == nil {
+		c.Close()
+		return nil, fmt.Errorf("listen error: %s is in use", servers[me])
+	}
+
+	kv, err := makeServer(gid, shardmasters, servers, me, opts)
+	if err != nil {
+		return nil, err
+	}
 
 	// Your initialization code here.
 	// Don't call Join().
@@ -444,12 +2428,11 @@ func StartServer(gid int64, shardmasters []string,
 
 	kv.px = paxos.Make(servers, me, rpcs)
 
-	kv.xstate.Init()
-
 	os.Remove(servers[me])
 	l, e := net.Listen("unix", servers[me])
 	if e != nil {
-		log.Fatal("listen error: ", e)
+		kv.px.Kill()
+		return nil, fmt.Errorf("listen error: %v", e)
 	}
 	kv.l = l
 
@@ -485,13 +2468,198 @@ func StartServer(gid int64, shardmasters []string,
 		}
 	}()
 
+	if opts.Bootstrap != "" {
+		if err := kv.bootstrap(opts.Bootstrap); err != nil {
+			kv.kill()
+			return nil, err
+		}
+	}
+
+	kv.startLoops(opts)
+
+	return kv, nil
+}
+
+// sockets servers of this process are starting to listen on
+var starting = struct {
+	sync.Mutex
+	socks map[string]bool
+}{socks: map[string]bool{}}
+
+//
+// claim sock for a server about to listen on it, until
+// releaseSocket(). false if another start holds it: between
+// the check that no server answers on a socket and the
+// listen, a second start would remove the first's socket.
+//
+func reserveSocket(sock string) bool {
+	starting.Lock()
+	defer starting.Unlock()
+	if starting.socks[sock] {
+		return false
+	}
+	starting.socks[sock] = true
+	return true
+}
+
+func releaseSocket(sock string) {
+	starting.Lock()
+	defer starting.Unlock()
+	delete(starting.socks, sock)
+}
+
+//
+// a ShardKV with its state set up, from its last snapshot
+// if it takes snapshots; not yet serving.
+//
+func makeServer(gid int64, shardmasters []string,
+	servers []string, me int, opts *Options) (*ShardKV, error) {
+	gob.Register(Op{})
+	gob.Register(XState{})
+	gob.Register(TxnArgs{})
+	gob.Register(ReconfExtra{})
+	gob.Register(FreezeExtra{})
+	gob.Register(MirrorCopy{})
+	gob.Register(PutBatchArgs{})
+	gob.Register(CondTxnArgs{})
+	gob.Register(BatchExtra{})
+
+	kv := new(ShardKV)
+	kv.applier.init(gid, me)
+	if opts.Logger != nil {
+		kv.log = opts.Logger
+	}
+	kv.funcs = opts.Funcs
+	kv.results = map[opKey]*opResult{}
+	kv.maxClients = opts.MaxClients
+	kv.maxValue = opts.MaxValueBytes
+	kv.leaseMillis = int64(opts.LeaseDuration / time.Millisecond)
+	kv.preLog = opts.PreLog
+	kv.postDecode = opts.PostDecode
+	kv.missing = opts.MissingDefault
+	kv.durability = opts.Durability
+	kv.memLimit = opts.MemoryLimit
+	if opts.CatchUpRate > 0 {
+		kv.fillGap = time.Second / time.Duration(opts.CatchUpRate)
+	}
+	if opts.HotKeySample > 0 {
+		kv.hot = makeHotKeys(opts.HotKeySample)
+	} else {
+		kv.hot = makeHotKeys(8)
+	}
+	kv.applyBatch = 1
+	if opts.ApplyBatch > 1 {
+		kv.applyBatch = opts.ApplyBatch
+	}
+	if opts.MaxTransfers > 0 {
+		kv.transfers = make(chan bool, opts.MaxTransfers)
+	}
+	kv.outgoing = map[int]*outgoing{}
+	kv.chunkKeys = TransferChunkKeys
+	if opts.TransferChunk > 0 {
+		kv.chunkKeys = opts.TransferChunk
+	}
+	kv.backoff, kv.maxBackoff = 10 * time.Millisecond, time.Second
+	if opts.ProposeBackoff > 0 {
+		kv.backoff = opts.ProposeBackoff
+	}
+	if opts.ProposeMaxBackoff > 0 {
+		kv.maxBackoff = opts.ProposeMaxBackoff
+	}
+	kv.proposeTimeout = opts.ProposeTimeout
+	kv.batchWindow = opts.BatchWindow
+	kv.batchCID = "batch-" + strconv.FormatInt(nrand(), 16)
+	kv.limiter = makeRateLimiter(opts.ClientRate, opts.ClientBurst)
+	kv.stuckAfter = StuckShardAfter
+	if opts.StuckShardAfter > 0 {
+		kv.stuckAfter = opts.StuckShardAfter
+	}
+	kv.tickEvery = TickInterval
+	if opts.TickInterval > 0 {
+		kv.tickEvery = opts.TickInterval
+	}
+	kv.poke = make(chan bool, 1)
+	kv.memPoke = make(chan bool, 1)
+	kv.charged = map[opKey]bool{}
+	kv.masters = []*shardmaster.Clerk{shardmaster.MakeClerk(shardmasters)}
+	if len(opts.SecondaryMasters) > 0 {
+		kv.masters = append(kv.masters, shardmaster.MakeClerk(opts.SecondaryMasters))
+	}
+	kv.txnSeen = map[string]time.Time{}
+	kv.claims = map[int]fetchClaim{}
+	kv.fetched = map[int]int{}
+	kv.pushed = map[mirrorTarget]mirrorPush{}
+	kv.servers = servers
+	if opts.SnapshotInterval > 0 {
+		kv.snapFile = snapshotFile(servers[me])
+		if err := kv.loadSnapshot(); err != nil {
+			return nil, fmt.Errorf("snapshot: %v", err)
+		}
+	}
+	return kv, nil
+}
+
+// start the background work of a server that is serving.
+func (kv *ShardKV) startLoops(opts *Options) {
 	go func() {
 		for kv.isdead() == false {
 			kv.tick()
-			time.Sleep(250 * time.Millisecond)
+			kv.resolveTxns()
+			select {
+			case <-kv.poke:
+			case <-time.After(kv.tickEvery):
+			}
 		}
 	}()
 
-	return kv
-}
+	go func() {
+		for kv.isdead() == false {
+			kv.pushMirrors()
+			time.Sleep(MirrorInterval)
+		}
+	}()
+
+	if opts.MemoryLimit > 0 {
+		go func() {
+			for kv.isdead() == false {
+				kv.checkMemory()
+				select {
+				case <-kv.memPoke:
+				case <-time.After(MemoryCheckInterval):
+				}
+			}
+		}()
+	}
+
+	if opts.SnapshotInterval > 0 {
+		go func() {
+			for {
+				time.Sleep(opts.SnapshotInterval)
+				if kv.isdead() {
+					break
+				}
+				if err := kv.saveSnapshot(); err != nil {
+					kv.logEvent(LevelError, "snapshot failed", Field{"err", err})
+				}
+			}
+		}()
+	}
+
+	if opts.SweepInterval > 0 {
+		go func() {
+			for kv.isdead() == false {
+				time.Sleep(opts.SweepInterval)
+				kv.sweep()
+			}
+		}()
+	}
 
+	if opts.LeaseDuration > 0 {
+		go func() {
+			for kv.isdead() == false {
+				kv.renewLease()
+				time.Sleep(opts.LeaseDuration / 4)
+			}
+		}()
+	}
+}
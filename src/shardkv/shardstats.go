@@ -0,0 +1,65 @@
+package shardkv
+
+import "shardmaster"
+
+//
+// per-shard key counts and sizes, for capacity planning.
+// each replica keeps them as it applies the log: setKey() and
+// deleteKey() adjust the count of the key's shard, and a
+// shard taken in or dropped whole is counted again. they are
+// not part of the replicated state (a snapshot leaves them
+// out, and a restored server counts them afresh), but come
+// out the same on every replica that applied the same log.
+//
+
+// the keys of a shard and their bytes (keys plus values)
+type shardSize struct {
+	Keys  int
+	Bytes int
+}
+
+// key, with value, joins its shard's count, or leaves it if n is -1
+func (ap *applier) countKey(key string, value string, n int) {
+	size := &ap.sizes[key2shard(key)]
+	size.Keys += n
+	size.Bytes += n * (len(key) + len(value))
+}
+
+// count shard's keys afresh
+func (ap *applier) recount(shard int) {
+	var size shardSize
+	for key, value := range ap.xstate.KVStore {
+		if key2shard(key) == shard {
+			size.Keys++
+			size.Bytes += len(key) + len(value)
+		}
+	}
+	ap.sizes[shard] = size
+}
+
+func (ap *applier) recountAll() {
+	for shard := 0; shard < shardmaster.NShards; shard++ {
+		ap.recount(shard)
+	}
+}
+
+//
+// RPC handler reporting the keys and bytes of each shard
+// this server's group serves, as of the ops it has applied.
+//
+func (kv *ShardKV) ShardStats(args *ShardStatsArgs, reply *ShardStatsReply) error {
+	defer kv.handling()()
+
+	kv.smu.RLock()
+	defer kv.smu.RUnlock()
+
+	reply.ConfigNum = kv.config.Num
+	for shard, gid := range kv.config.Shards {
+		if gid == kv.gid {
+			size := kv.sizes[shard]
+			reply.Shards = append(reply.Shards, ShardStat{shard, size.Keys, size.Bytes})
+		}
+	}
+	reply.Err = OK
+	return nil
+}
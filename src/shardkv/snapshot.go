@@ -0,0 +1,279 @@
+package shardkv
+
+import "bytes"
+import "fmt"
+import "io"
+import "time"
+import "encoding/gob"
+import "os"
+import "shardmaster"
+import "bufpool"
+
+//
+// snapshots, for servers started with a SnapshotInterval.
+//
+// every SnapshotInterval a server writes its applied state
+// (the store and everything else the log built, and the seq
+// of the next op to apply) to servers[me] + ".snapshot",
+// through a temp file renamed into place, so that a crash
+// leaves the last complete snapshot. a server started where
+// a snapshot exists loads it and resumes applying the log
+// from its seq. a DurabilityFlushed write is only answered
+// once a snapshot holding it is written, by the same path.
+//
+// to keep that possible, the server tells paxos it is done
+// only with ops before its last snapshot, so its peers keep
+// the rest of the log for it. a server down long enough to
+// be removed from its group's config is another matter.
+//
+// a replica restarted without a snapshot, or with one older
+// than the log its peers keep, instead installs a snapshot
+// from one of its peers (see catchUpFromPeer()). a server
+// started with Options.Bootstrap does so before it serves
+// anything, rather than replaying its group's whole log.
+//
+// paxos itself keeps no state on disk: a restarted server's
+// peer has forgotten what it promised and accepted. that is
+// safe as long as no instance a restarted peer took part in
+// is still undecided with a majority depending on it, which
+// holds when no more than one server of a group restarts at
+// a time and the others are up.
+//
+
+// how long a server started with Options.Bootstrap tries to
+// get a snapshot from its peer
+const BootstrapTimeout = 10 * time.Second
+
+type snapshot struct {
+	LastSeq int // seq of the next op to apply
+	Config  shardmaster.Config
+	XState  XState
+	Applied [shardmaster.NShards]int
+	Frozen  map[int]bool
+	Clock   int64
+	Lease   leaseState
+}
+
+func snapshotFile(server string) string {
+	return server + ".snapshot"
+}
+
+// append the applied state, gob-encoded, to buf, and return
+// its LastSeq. kv.mu must be held.
+func (kv *ShardKV) encodeSnapshot(buf *bytes.Buffer) (int, error) {
+	snap := snapshot{kv.last_seq, kv.config, kv.xstate, kv.applied, kv.frozen, kv.clock, kv.lease}
+	err := gob.NewEncoder(buf).Encode(&snap)
+	return snap.LastSeq, err
+}
+
+//
+// replace the applied state with an encoded snapshot, and
+// resume applying the log from its LastSeq. kv.mu must be
+// held.
+//
+func (kv *ShardKV) restore(r io.Reader) error {
+	// gob leaves out empty maps, so start from empty ones
+	var snap snapshot
+	snap.XState.Init()
+	snap.Frozen = map[int]bool{}
+	if err := gob.NewDecoder(r).Decode(&snap); err != nil {
+		return err
+	}
+	if snap.LastSeq < kv.last_seq {
+		return fmt.Errorf("snapshot at seq %d is behind seq %d", snap.LastSeq, kv.last_seq)
+	}
+
+	kv.smu.Lock()
+	defer kv.smu.Unlock()
+	kv.config, kv.xstate, kv.applied = snap.Config, snap.XState, snap.Applied
+	kv.frozen, kv.clock, kv.lease = snap.Frozen, snap.Clock, snap.Lease
+	kv.last_seq, kv.seq = snap.LastSeq, snap.LastSeq
+	kv.recountAll()
+	return nil
+}
+
+//
+// write the applied state to kv.snapFile, replacing the
+// last snapshot.
+//
+func (kv *ShardKV) saveSnapshot() error {
+	kv.snapMu.Lock()
+	defer kv.snapMu.Unlock()
+	return kv.writeSnapshot()
+}
+
+//
+// make sure a snapshot holding every op applied so far is on
+// disk, writing one unless a snapshot written meanwhile (for
+// another write, say) already holds them.
+//
+func (kv *ShardKV) flush() error {
+	kv.snapMu.Lock()
+	defer kv.snapMu.Unlock()
+
+	kv.mu.Lock()
+	saved := kv.saved >= kv.last_seq
+	kv.mu.Unlock()
+	if saved {
+		return nil
+	}
+	return kv.writeSnapshot()
+}
+
+// saveSnapshot(), with kv.snapMu held
+func (kv *ShardKV) writeSnapshot() error {
+	buf := bufpool.Get()
+	defer bufpool.Put(buf)
+
+	kv.mu.Lock()
+	seq, err := kv.encodeSnapshot(buf)
+	kv.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	tmp := kv.snapFile + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(buf.Bytes())
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, kv.snapFile)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	kv.mu.Lock()
+	if seq > kv.saved {
+		kv.saved = seq
+	}
+	kv.mu.Unlock()
+	return nil
+}
+
+//
+// load kv.snapFile, if there is one, into a server that has
+// not applied anything yet.
+//
+func (kv *ShardKV) loadSnapshot() error {
+	f, err := os.Open(kv.snapFile)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := kv.restore(f); err != nil {
+		return err
+	}
+	kv.saved = kv.last_seq
+	return nil
+}
+
+//
+// RPC handler giving a replica of this group that has fallen
+// behind the log its peers keep a snapshot of this server's
+// state to resume from.
+//
+func (kv *ShardKV) GetSnapshot(args *GetSnapshotArgs, reply *GetSnapshotReply) error {
+	defer kv.handling()()
+
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	kv.learn()
+	if kv.last_seq < kv.px.Min() {
+		// behind too
+		reply.Err = ErrNotReady
+		return nil
+	}
+	// not pooled: the reply keeps the bytes
+	var buf bytes.Buffer
+	if _, err := kv.encodeSnapshot(&buf); err != nil {
+		reply.Err = ErrNotReady
+		return nil
+	}
+	reply.Err, reply.Data = OK, buf.Bytes()
+	return nil
+}
+
+//
+// if the group's peers have forgotten ops this server has yet
+// to apply (as paxos finds out when this server proposes one
+// of them), replace its state with a peer's snapshot. kv.mu
+// must be held; it is released while asking each peer, since
+// two replicas left behind may be asking each other at once.
+//
+func (kv *ShardKV) catchUpFromPeer() {
+	for kv.last_seq < kv.px.Min() && !kv.halted() {
+		for i, srv := range kv.servers {
+			if i == kv.me {
+				continue
+			}
+			var reply GetSnapshotReply
+			kv.mu.Unlock()
+			ok := send(srv, "ShardKV.GetSnapshot", &GetSnapshotArgs{}, &reply)
+			kv.mu.Lock()
+			if kv.last_seq >= kv.px.Min() {
+				// installed by another handler meanwhile
+				break
+			}
+			if !ok || reply.Err != OK {
+				continue
+			}
+			last_seq := kv.last_seq
+			if err := kv.restore(bytes.NewReader(reply.Data)); err != nil {
+				continue
+			}
+			kv.logEvent(LevelInfo, "snapshot installed", Field{"from", last_seq}, Field{"seq", kv.last_seq})
+			kv.installed++
+			break
+		}
+		if kv.last_seq < kv.px.Min() {
+			kv.mu.Unlock()
+			time.Sleep(100 * time.Millisecond)
+			kv.mu.Lock()
+		}
+	}
+}
+
+//
+// install a snapshot from peer, a server of this group, in a
+// server about to start serving (see Options.Bootstrap).
+// retries for up to BootstrapTimeout, in case peer is itself
+// catching up.
+//
+func (kv *ShardKV) bootstrap(peer string) error {
+	var err error
+	for start := time.Now(); time.Since(start) < BootstrapTimeout && !kv.isdead(); {
+		var reply GetSnapshotReply
+		if !send(peer, "ShardKV.GetSnapshot", &GetSnapshotArgs{}, &reply) {
+			err = fmt.Errorf("bootstrap: no reply from %s", peer)
+		} else if reply.Err != OK {
+			err = fmt.Errorf("bootstrap: %s: %s", peer, reply.Err)
+		} else {
+			kv.mu.Lock()
+			err = kv.restore(bytes.NewReader(reply.Data))
+			if err == nil {
+				kv.logEvent(LevelInfo, "snapshot installed", Field{"from", peer}, Field{"seq", kv.last_seq})
+				kv.installed++
+			}
+			kv.mu.Unlock()
+			if err == nil {
+				return nil
+			}
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return err
+}
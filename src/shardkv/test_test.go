@@ -10,6 +10,16 @@ import "fmt"
 import "sync"
 import "sync/atomic"
 import "math/rand"
+import "reflect"
+import "sort"
+import "errors"
+import "strings"
+import "paxos"
+import "net"
+import "net/rpc"
+import "io"
+import "net/http/httptest"
+import "context"
 
 // information about the servers of one replica group.
 type tGroup struct {
@@ -20,11 +30,13 @@ type tGroup struct {
 
 // information about all the servers of a k/v cluster.
 type tCluster struct {
-	t           *testing.T
+	t           testing.TB
 	masters     []*shardmaster.ShardMaster
 	mck         *shardmaster.Clerk
 	masterports []string
 	groups      []*tGroup
+	opts        *Options
+	drain       time.Duration // if > 0, kill1() drains servers first
 }
 
 func port(tag string, host int) string {
@@ -42,17 +54,53 @@ func port(tag string, host int) string {
 // start a k/v replica server thread.
 //
 func (tc *tCluster) start1(gi int, si int, unreliable bool) {
-	s := StartServer(tc.groups[gi].gid, tc.masterports, tc.groups[gi].ports, si)
+	s, err := StartServerWithOptions(tc.groups[gi].gid, tc.masterports,
+		tc.groups[gi].ports, si, tc.opts)
+	if err != nil {
+		tc.t.Fatalf("StartServer: %v", err)
+	}
 	tc.groups[gi].servers[si] = s
 	s.Setunreliable(unreliable)
 }
 
+//
+// kill a k/v replica server, letting it finish the requests
+// it is handling if tc.drain is set.
+//
+func (tc *tCluster) kill1(gi int, si int) {
+	s := tc.groups[gi].servers[si]
+	if tc.drain > 0 {
+		s.drainAndKill(tc.drain)
+	} else {
+		s.kill()
+	}
+}
+
+//
+// have server si of g refuse connections, as a dead one
+// would, by moving its socket aside; or take them again.
+//
+func (g *tGroup) refuse1(si int, on bool) {
+	if on {
+		os.Rename(g.ports[si], g.ports[si]+"-refused")
+	} else {
+		os.Rename(g.ports[si]+"-refused", g.ports[si])
+	}
+}
+
+// refuse1() for all of g's servers.
+func (g *tGroup) refuse(on bool) {
+	for si := range g.ports {
+		g.refuse1(si, on)
+	}
+}
+
 func (tc *tCluster) cleanup() {
 	for gi := 0; gi < len(tc.groups); gi++ {
 		g := tc.groups[gi]
 		for si := 0; si < len(g.servers); si++ {
 			if g.servers[si] != nil {
-				g.servers[si].kill()
+				tc.kill1(gi, si)
 			}
 		}
 	}
@@ -64,6 +112,67 @@ func (tc *tCluster) cleanup() {
 	}
 }
 
+//
+// wait for the live servers of g to reach the same applied
+// seq with the same state. returns an error if they do not
+// within timeout.
+//
+func checkConverged(g *tGroup, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		digests := map[string]bool{}
+		seqs := map[int]bool{}
+		for _, srv := range g.servers {
+			if srv != nil && !srv.isdead() {
+				digest, seq := srv.StateDigest()
+				digests[digest] = true
+				seqs[seq] = true
+			}
+		}
+		if len(seqs) <= 1 && len(digests) <= 1 {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			if len(seqs) > 1 {
+				return fmt.Errorf("group %d replicas stuck at seqs %v", g.gid, seqs)
+			}
+			return fmt.Errorf("group %d replicas diverged: %v", g.gid, digests)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+//
+// for the end of a test, once load has stopped: fail
+// unless every live server of g converges on one state.
+//
+func AssertConverged(t testing.TB, g *tGroup) {
+	if err := checkConverged(g, 10*time.Second); err != nil {
+		t.Fatalf("%v", err)
+	}
+}
+
+//
+// wait for every server of group gi to have applied config
+// num or a later one.
+//
+func (tc *tCluster) awaitConfig(gi int, num int) {
+	for _, s := range tc.groups[gi].servers {
+		for i := 0; ; i++ {
+			s.mu.Lock()
+			xnum := s.config.Num
+			s.mu.Unlock()
+			if xnum >= num {
+				break
+			}
+			if i == 50 {
+				tc.t.Fatalf("server stuck at config %d", xnum)
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+}
+
 func (tc *tCluster) shardclerk() *shardmaster.Clerk {
 	return shardmaster.MakeClerk(tc.masterports)
 }
@@ -80,15 +189,24 @@ func (tc *tCluster) leave(gi int) {
 	tc.mck.Leave(tc.groups[gi].gid)
 }
 
-func setup(t *testing.T, tag string, unreliable bool) *tCluster {
+func setup(t testing.TB, tag string, unreliable bool) *tCluster {
+	return setupWithOptions(t, tag, unreliable, nil)
+}
+
+func setupWithOptions(t testing.TB, tag string, unreliable bool, opts *Options) *tCluster {
+	return setupGroups(t, tag, unreliable, 3, opts)
+}
+
+// like setupWithOptions(), with ngroups replica groups
+func setupGroups(t testing.TB, tag string, unreliable bool, ngroups int, opts *Options) *tCluster {
 	runtime.GOMAXPROCS(4)
 
 	const nmasters = 3
-	const ngroups = 3   // replica groups
 	const nreplicas = 3 // servers per group
 
 	tc := &tCluster{}
 	tc.t = t
+	tc.opts = opts
 	tc.masters = make([]*shardmaster.ShardMaster, nmasters)
 	tc.masterports = make([]string, nmasters)
 
@@ -201,6 +319,8 @@ func TestMove(t *testing.T) {
 			t.Fatalf("missing key/value")
 		}
 	}
+	AssertConverged(t, tc.groups[0])
+	AssertConverged(t, tc.groups[1])
 
 	// remove sockets from group 0.
 	for _, port := range tc.groups[0].ports {
@@ -358,3 +478,5328 @@ func TestConcurrentUnreliable(t *testing.T) {
 	doConcurrent(t, true)
 	fmt.Printf("  ... Passed\n")
 }
+
+// find two keys whose shards are served by different groups.
+func (tc *tCluster) splitKeys() (string, string) {
+	config := tc.mck.Query(-1)
+	keys := map[int64]string{}
+	for c := 'a'; c <= 'z'; c++ {
+		key := string(c)
+		gid := config.Shards[key2shard(key)]
+		if _, ok := keys[gid]; !ok {
+			keys[gid] = key
+		}
+		if len(keys) == 2 {
+			break
+		}
+	}
+	if len(keys) < 2 {
+		tc.t.Fatalf("all shards served by one group")
+	}
+	split := []string{}
+	for _, key := range keys {
+		split = append(split, key)
+	}
+	return split[0], split[1]
+}
+
+func TestTransaction(t *testing.T) {
+	tc := setup(t, "txn", false)
+	defer tc.cleanup()
+
+	tc.join(0)
+	tc.join(1)
+	time.Sleep(1 * time.Second)
+
+	k1, k2 := tc.splitKeys()
+	coord := k1
+	if k2 < k1 {
+		coord = k2
+	}
+
+	ck := tc.clerk()
+	ck.Put(k1, "1")
+	ck.Put(k2, "2")
+
+	fmt.Printf("Test: Cross-shard transaction commits ...\n")
+
+	if !ck.Transaction(map[string]string{k1: "x", k2: "y"}) {
+		t.Fatalf("transaction aborted")
+	}
+	if ck.Get(k1) != "x" || ck.Get(k2) != "y" {
+		t.Fatalf("transaction writes missing")
+	}
+
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: Conflicting transaction aborts ...\n")
+
+	// a coordinator that locks k2 and then dies.
+	ck1 := tc.clerk()
+	if ck1.txnSend("ShardKV.Prepare", "dead1", k2, map[string]string{k2: "z"}) != OK {
+		t.Fatalf("prepare failed")
+	}
+
+	if ck.Transaction(map[string]string{k1: "p", k2: "q"}) {
+		t.Fatalf("transaction committed over a lock")
+	}
+	if v := ck.Get(k1); v != "x" {
+		t.Fatalf("aborted write visible; got %v", v)
+	}
+
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: Transaction recovery after coordinator crash ...\n")
+
+	// the undecided transaction gets aborted.
+	if v := ck.Get(k2); v != "y" {
+		t.Fatalf("undecided transaction applied; got %v", v)
+	}
+
+	// a coordinator that dies after recording a commit.
+	ck2 := tc.clerk()
+	writes := map[string]string{k1: "m", k2: "n"}
+	if ck2.txnSend("ShardKV.Prepare", "dead2", coord, writes) != OK {
+		t.Fatalf("prepare failed")
+	}
+	if !ck2.txnDecide("dead2", coord, true) {
+		t.Fatalf("commit not recorded")
+	}
+	if ck.Get(k1) != "m" || ck.Get(k2) != "n" {
+		t.Fatalf("committed transaction not applied")
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestAppliedIndices(t *testing.T) {
+	tc := setup(t, "applied", false)
+	defer tc.cleanup()
+
+	fmt.Printf("Test: Per-shard applied indices ...\n")
+
+	tc.join(0)
+
+	ck := tc.clerk()
+	kv := tc.groups[0].servers[0]
+
+	// let the join's reconfiguration be applied
+	time.Sleep(1 * time.Second)
+	ck.Get("a")
+
+	keys := []string{"a", "b", "a", "c", "b", "a"}
+	for _, key := range keys {
+		before := kv.Stats()
+		ck.Put(key, "x")
+		after := kv.Stats()
+		for shard := 0; shard < shardmaster.NShards; shard++ {
+			if shard == key2shard(key) {
+				if after.Applied[shard] <= before.Applied[shard] {
+					t.Fatalf("shard %v index did not advance: %v -> %v",
+						shard, before.Applied[shard], after.Applied[shard])
+				}
+				if after.Applied[shard] >= after.LastSeq {
+					t.Fatalf("shard %v index %v beyond applied log %v",
+						shard, after.Applied[shard], after.LastSeq)
+				}
+			} else if after.Applied[shard] != before.Applied[shard] {
+				t.Fatalf("untouched shard %v index moved: %v -> %v",
+					shard, before.Applied[shard], after.Applied[shard])
+			}
+		}
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestDuplicateStart(t *testing.T) {
+	tc := setup(t, "dupstart", false)
+	defer tc.cleanup()
+
+	fmt.Printf("Test: Second server on a live socket refused ...\n")
+
+	tc.join(0)
+
+	ck := tc.clerk()
+	ck.Put("a", "x")
+
+	g := tc.groups[0]
+	kv, err := StartServerE(g.gid, tc.masterports, g.ports, 0)
+	if err == nil {
+		kv.kill()
+		t.Fatalf("second StartServerE on %v succeeded", g.ports[0])
+	}
+
+	// the first server still owns its socket.
+	ck.Put("a", "y")
+	if v := ck.Get("a"); v != "y" {
+		t.Fatalf("Get got %v, wanted y", v)
+	}
+	if _, err := os.Stat(g.ports[0]); err != nil {
+		t.Fatalf("socket of first server removed: %v", err)
+	}
+
+	// of servers started at once on a fresh socket, one gets
+	// it and the others an error
+	ports := []string{port("dupstart-fresh", 0)}
+	os.Remove(ports[0])
+	results := make(chan *ShardKV, 4)
+	for i := 0; i < 4; i++ {
+		go func() {
+			kv, _ := StartServerE(200, tc.masterports, ports, 0)
+			results <- kv
+		}()
+	}
+	started := []*ShardKV{}
+	for i := 0; i < 4; i++ {
+		if kv := <-results; kv != nil {
+			started = append(started, kv)
+		}
+	}
+	for _, kv := range started {
+		kv.kill()
+	}
+	nstarted := len(started)
+	if nstarted != 1 {
+		t.Fatalf("%d of 4 concurrent starts on one socket succeeded", nstarted)
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestApplyLog(t *testing.T) {
+	fmt.Printf("Test: Deterministic apply of a recorded log ...\n")
+
+	const gid = 100
+	var c1, c2 shardmaster.Config
+	c1.Num = 1
+	for shard := range c1.Shards {
+		c1.Shards[shard] = gid
+	}
+	c2.Num = 2
+	c2.Shards = c1.Shards
+	c2.Shards[key2shard("b")] = gid + 1
+	c2.Shards[key2shard("1")] = gid
+	moved := MakeXState()
+	moved.KVStore["1"] = "moved"
+	moved.MRRSMap["other"] = 7
+	moved.Replies["other"] = Rep{Err: OK}
+
+	recorded := []Op{
+		Op{CID: "c", Seq: 1, Op: Put, Key: "a", Value: "early"},
+		Op{Seq: 1, Op: Reconf, Extra: ReconfExtra{c1, *MakeXState()}},
+		Op{CID: "c", Seq: 2, Op: Put, Key: "a", Value: "x"},
+		Op{CID: "c", Seq: 3, Op: Append, Key: "a", Value: "y"},
+		Op{CID: "d", Seq: 1, Op: Put, Key: "b", Value: "z"},
+		Op{CID: "c", Seq: 4, Op: Get, Key: "a"},
+		Op{Seq: 2, Op: Reconf, Extra: ReconfExtra{c2, *moved}},
+		Op{CID: "d", Seq: 2, Op: Append, Key: "b", Value: "lost"},
+		Op{CID: "d", Seq: 3, Op: Append, Key: "1", Value: "+"},
+		Op{CID: "d", Seq: 4, Op: Apply, Key: "1", Value: "!", Extra: "suffix"},
+	}
+	funcs := map[string]TransformFunc{
+		"suffix": func(old string, arg string) string { return old + arg },
+	}
+
+	xs1 := ApplyLog(gid, recorded, funcs)
+	xs2 := ApplyLog(gid, recorded, funcs)
+	if !reflect.DeepEqual(xs1, xs2) {
+		t.Fatalf("two applies of one log differ:\n%v\n%v", xs1, xs2)
+	}
+
+	kvstore := map[string]string{"a": "xy", "b": "z", "1": "moved+!"}
+	if !reflect.DeepEqual(xs1.KVStore, kvstore) {
+		t.Fatalf("KVStore %v, wanted %v", xs1.KVStore, kvstore)
+	}
+	mrrs := map[string]int{"c": 4, "d": 4, "other": 7}
+	if !reflect.DeepEqual(xs1.MRRSMap, mrrs) {
+		t.Fatalf("MRRSMap %v, wanted %v", xs1.MRRSMap, mrrs)
+	}
+	if xs1.Replies["c"].Value != "xy" {
+		t.Fatalf("recorded Get reply %v, wanted xy", xs1.Replies["c"])
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestApplyFunc(t *testing.T) {
+	opts := &Options{}
+	opts.Funcs = map[string]TransformFunc{
+		"append-with-separator": func(old string, arg string) string {
+			if old == "" {
+				return arg
+			}
+			return old + "," + arg
+		},
+	}
+	tc := setupWithOptions(t, "applyfunc", false, opts)
+	defer tc.cleanup()
+
+	fmt.Printf("Test: Registered transform functions ...\n")
+
+	tc.join(0)
+
+	ck := tc.clerk()
+	for i, arg := range []string{"x", "y", "z"} {
+		v, err := ck.Apply("a", "append-with-separator", arg)
+		if err != OK {
+			t.Fatalf("Apply: %v", err)
+		}
+		wanted := []string{"x", "x,y", "x,y,z"}[i]
+		if v != wanted {
+			t.Fatalf("Apply returned %v, wanted %v", v, wanted)
+		}
+	}
+	if v := ck.Get("a"); v != "x,y,z" {
+		t.Fatalf("Get got %v, wanted x,y,z", v)
+	}
+
+	if _, err := ck.Apply("a", "no-such-func", "w"); err != ErrUnknownFunc {
+		t.Fatalf("unknown function gave %v", err)
+	}
+	if v := ck.Get("a"); v != "x,y,z" {
+		t.Fatalf("unknown function changed value to %v", v)
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestBadConfig(t *testing.T) {
+	tc := setup(t, "badconfig", false)
+	defer tc.cleanup()
+
+	fmt.Printf("Test: Malformed config refused ...\n")
+
+	tc.join(0)
+
+	ck := tc.clerk()
+	ck.Put("a", "x")
+
+	kv := tc.groups[0].servers[0]
+	kv.mu.Lock()
+	kv.catchUp()
+	num := kv.config.Num
+	bad := []shardmaster.Config{}
+
+	// a shard assigned to a group the config doesn't list
+	var c1 shardmaster.Config
+	c1.Num = num + 1
+	c1.Groups = map[int64][]string{tc.groups[0].gid: tc.groups[0].ports}
+	for shard := range c1.Shards {
+		c1.Shards[shard] = tc.groups[0].gid
+	}
+	c1.Shards[key2shard("a")] = 999
+	bad = append(bad, c1)
+
+	// a config that skips ahead
+	c2 := c1
+	c2.Num = num + 5
+	c2.Shards[key2shard("a")] = tc.groups[0].gid
+	bad = append(bad, c2)
+
+	for _, config := range bad {
+		if kv.reconfigure(&config) {
+			kv.mu.Unlock()
+			t.Fatalf("malformed config %v accepted", config)
+		}
+	}
+	if kv.config.Num != num {
+		kv.mu.Unlock()
+		t.Fatalf("config advanced to %v", kv.config.Num)
+	}
+	kv.mu.Unlock()
+
+	// the group keeps serving under its old config.
+	if v := ck.Get("a"); v != "x" {
+		t.Fatalf("Get got %v, wanted x", v)
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestReconfigProgress(t *testing.T) {
+	tc := setup(t, "progress", false)
+	defer tc.cleanup()
+
+	fmt.Printf("Test: Reconfiguration progress ...\n")
+
+	tc.join(0)
+
+	ck := tc.clerk()
+	for i := 0; i < 200; i++ {
+		ck.Put(strconv.Itoa(i), strconv.Itoa(rand.Int()))
+	}
+
+	// any replica of group 1 may be the one to fetch the
+	// shards, so watch them all
+	g := tc.groups[1]
+	done := make(chan bool)
+	samples := make(chan [][]ReconfigProgress)
+	go func() {
+		ps := make([][]ReconfigProgress, len(g.servers))
+		for {
+			select {
+			case <-done:
+				samples <- ps
+				return
+			default:
+			}
+			for si, kv := range g.servers {
+				ps[si] = append(ps[si], kv.ReconfigProgress())
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	tc.join(1)
+	for iters := 0; iters < 50; iters++ {
+		if g.servers[0].Stats().ConfigNum == 2 {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	done <- true
+	ps := <-samples
+
+	fetched := false
+	for si, kv := range g.servers {
+		for i := 1; i < len(ps[si]); i++ {
+			p0, p1 := ps[si][i-1], ps[si][i]
+			if p1.Target == p0.Target &&
+				(p1.Received < p0.Received || p1.Bytes < p0.Bytes) {
+				t.Fatalf("progress went backwards: %v -> %v", p0, p1)
+			}
+		}
+		last := kv.ReconfigProgress()
+		if last.Target == 2 && last.Needed > 0 && last.Percent() == 100 && last.Bytes > 0 {
+			fetched = true
+		}
+	}
+	if !fetched {
+		t.Fatalf("no server of group 1 shows a finished fetch")
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestWaitForValue(t *testing.T) {
+	tc := setup(t, "waitvalue", false)
+	defer tc.cleanup()
+
+	fmt.Printf("Test: WaitForValue ...\n")
+
+	tc.join(0)
+
+	ck1 := tc.clerk()
+	ck2 := tc.clerk()
+	ck1.Put("leader", "A")
+
+	if err := ck1.WaitForValue("leader", "B", 500*time.Millisecond); err != ErrTimeout {
+		t.Fatalf("WaitForValue without change gave %v", err)
+	}
+
+	ch := make(chan Err)
+	go func() {
+		ch <- ck1.WaitForValue("leader", "X", 10*time.Second)
+	}()
+
+	time.Sleep(500 * time.Millisecond)
+	ck2.Put("leader", "X")
+	t0 := time.Now()
+
+	select {
+	case err := <-ch:
+		if err != OK {
+			t.Fatalf("WaitForValue gave %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("WaitForValue did not unblock")
+	}
+	if d := time.Since(t0); d > 1500*time.Millisecond {
+		t.Fatalf("WaitForValue took %v to notice the Put", d)
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestShardmasterOutage(t *testing.T) {
+	const nsecondary = 3
+	secports := make([]string, nsecondary)
+	for i := 0; i < nsecondary; i++ {
+		secports[i] = port("smoutage-m2", i)
+	}
+	opts := &Options{SecondaryMasters: secports}
+	tc := setupWithOptions(t, "smoutage", false, opts)
+	defer tc.cleanup()
+
+	secondary := make([]*shardmaster.ShardMaster, nsecondary)
+	for i := 0; i < nsecondary; i++ {
+		secondary[i] = shardmaster.StartServer(secports, i)
+	}
+	defer func() {
+		for i := 0; i < nsecondary; i++ {
+			secondary[i].Kill()
+		}
+	}()
+	smck := shardmaster.MakeClerk(secports)
+
+	fmt.Printf("Test: Serving through a shardmaster outage ...\n")
+
+	// the operator mirrors the topology onto the secondary.
+	tc.join(0)
+	smck.Join(tc.groups[0].gid, tc.groups[0].ports)
+
+	ck := tc.clerk()
+	keys := make([]string, 10)
+	for i := 0; i < len(keys); i++ {
+		keys[i] = strconv.Itoa(i)
+		ck.Put(keys[i], "x")
+	}
+
+	for i := 0; i < len(tc.masters); i++ {
+		tc.masters[i].Kill()
+		tc.masters[i] = nil
+	}
+	time.Sleep(1 * time.Second)
+
+	for i := 0; i < len(keys); i++ {
+		ck.Append(keys[i], "y")
+		if v := ck.Get(keys[i]); v != "xy" {
+			t.Fatalf("Get(%v) got %v, wanted xy", keys[i], v)
+		}
+	}
+
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: Failing over to a secondary shardmaster ...\n")
+
+	smck.Join(tc.groups[1].gid, tc.groups[1].ports)
+	kv := tc.groups[1].servers[0]
+	for iters := 0; kv.Stats().ConfigNum != 2; iters++ {
+		if iters > 50 {
+			t.Fatalf("group 1 did not follow the secondary shardmaster")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	ck2 := MakeClerk(secports)
+	for i := 0; i < len(keys); i++ {
+		if v := ck2.Get(keys[i]); v != "xy" {
+			t.Fatalf("Get(%v) got %v, wanted xy", keys[i], v)
+		}
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestHungShardmaster(t *testing.T) {
+	cl := &captureLogger{}
+	tc := setupWithOptions(t, "smhung", false, &Options{Logger: cl})
+	defer tc.cleanup()
+
+	fmt.Printf("Test: Serving while the shardmaster hangs ...\n")
+
+	tc.join(0)
+	ck := tc.clerk()
+	keys := make([]string, 10)
+	for i := 0; i < len(keys); i++ {
+		keys[i] = strconv.Itoa(i)
+		ck.Put(keys[i], "x")
+	}
+
+	// shardmasters that take requests and never answer them
+	for i := 0; i < len(tc.masters); i++ {
+		tc.masters[i].Kill()
+		tc.masters[i] = nil
+		os.Remove(tc.masterports[i])
+		l, err := net.Listen("unix", tc.masterports[i])
+		if err != nil {
+			t.Fatalf("listen: %v", err)
+		}
+		defer l.Close()
+		go func() {
+			var conns []net.Conn
+			for {
+				c, err := l.Accept()
+				if err != nil {
+					break
+				}
+				conns = append(conns, c)
+			}
+			for _, c := range conns {
+				c.Close()
+			}
+		}()
+	}
+	warned := func() int {
+		return len(cl.find(LevelWarn, "no shardmaster reachable", tc.groups[0].gid))
+	}
+	before := warned()
+	time.Sleep(ConfigQueryTimeout)
+
+	for i := 0; i < len(keys); i++ {
+		ck.Append(keys[i], "y")
+		if v := ck.Get(keys[i]); v != "xy" {
+			t.Fatalf("Get(%v) got %v, wanted xy", keys[i], v)
+		}
+	}
+	// tick() gives up on the shardmaster and tries again
+	for iters := 0; warned() < before+6 && iters < 50; iters++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if n := warned(); n < before+6 {
+		t.Fatalf("%d failed shardmaster queries warned of while it hung", n-before)
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestClearShard(t *testing.T) {
+	tc := setup(t, "clearshard", false)
+	defer tc.cleanup()
+
+	fmt.Printf("Test: ClearShard removes exactly one shard ...\n")
+
+	tc.join(0)
+	tc.join(1)
+
+	ck := tc.clerk()
+	const nkeys = 30
+	for i := 0; i < nkeys; i++ {
+		ck.Put(strconv.Itoa(i), "v"+strconv.Itoa(i))
+	}
+
+	shard := key2shard("1")
+	if _, err := ck.ClearShard(shardmaster.NShards); err != ErrBadShard {
+		t.Fatalf("ClearShard of a bad shard gave %v", err)
+	}
+	if v := ck.Get("1"); v != "v1" {
+		t.Fatalf("rejected ClearShard removed a key")
+	}
+
+	wanted := 0
+	for i := 0; i < nkeys; i++ {
+		if key2shard(strconv.Itoa(i)) == shard {
+			wanted++
+		}
+	}
+	removed, err := ck.ClearShard(shard)
+	if err != OK || removed != wanted {
+		t.Fatalf("ClearShard gave %v, %v; wanted %v keys", removed, err, wanted)
+	}
+
+	for i := 0; i < nkeys; i++ {
+		key := strconv.Itoa(i)
+		v := ck.Get(key)
+		if key2shard(key) == shard && v != "" {
+			t.Fatalf("key %v of cleared shard has %v", key, v)
+		}
+		if key2shard(key) != shard && v != "v"+key {
+			t.Fatalf("key %v of another shard has %v", key, v)
+		}
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestClearShardRetry(t *testing.T) {
+	tc := setup(t, "clearretry", false)
+	defer tc.cleanup()
+
+	fmt.Printf("Test: Retries after ClearShard are answered ...\n")
+
+	tc.join(0)
+	tc.awaitConfig(0, 1)
+	srv := tc.groups[0].ports[0]
+
+	// a Put whose reply the client never saw.
+	put := &PutAppendArgs{Key: "a", Value: "x", Op: Put, CID: "lost", Seq: 1}
+	var reply PutAppendReply
+	if ok := call(srv, "ShardKV.PutAppend", put, &reply); !ok || reply.Err != OK {
+		t.Fatalf("Put got %v %v", ok, reply.Err)
+	}
+
+	ck := tc.clerk()
+	if _, err := ck.ClearShard(key2shard("a")); err != OK {
+		t.Fatalf("ClearShard gave %v", err)
+	}
+
+	reply = PutAppendReply{}
+	if ok := call(srv, "ShardKV.PutAppend", put, &reply); !ok || reply.Err != OK {
+		t.Fatalf("retried Put got %v %v", ok, reply.Err)
+	}
+	if v := ck.Get("a"); v != "" {
+		t.Fatalf("retried Put was applied again: Get(a) got %v", v)
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+// a reversible stand-in for encryption
+func tReverse(s string) string {
+	b := []byte(s)
+	for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
+		b[i], b[j] = b[j], b[i]
+	}
+	return string(b)
+}
+
+func TestOpHooks(t *testing.T) {
+	var mu sync.Mutex
+	decoded := map[string]bool{}
+
+	opts := &Options{}
+	opts.PreLog = func(op *Op) error {
+		if op.Key == "forbidden" {
+			return errors.New("forbidden key")
+		}
+		if op.Op == Put || op.Op == Append {
+			op.Value = "enc:" + tReverse(op.Value)
+		}
+		return nil
+	}
+	opts.PostDecode = func(op *Op) {
+		if op.Op == Put || op.Op == Append {
+			mu.Lock()
+			decoded[op.Value] = true
+			mu.Unlock()
+			op.Value = tReverse(op.Value[len("enc:"):])
+		}
+	}
+	tc := setupWithOptions(t, "ophooks", false, opts)
+	defer tc.cleanup()
+
+	fmt.Printf("Test: Pre-log and post-decode op hooks ...\n")
+
+	tc.join(0)
+
+	ck := tc.clerk()
+	ck.Put("a", "secret")
+	ck.Append("a", "-more")
+	if v := ck.Get("a"); v != "secret-more" {
+		t.Fatalf("Get got %v, wanted secret-more", v)
+	}
+
+	mu.Lock()
+	if !decoded["enc:terces"] || !decoded["enc:erom-"] {
+		t.Fatalf("log did not hold transformed values: %v", decoded)
+	}
+	if decoded["secret"] || decoded["-more"] {
+		t.Fatalf("log held plaintext values: %v", decoded)
+	}
+	mu.Unlock()
+
+	if err := ck.PutAppendE("forbidden", "x", "Put"); err != ErrRejected {
+		t.Fatalf("rejected Put gave %v", err)
+	}
+	if v, err := ck.GetE("forbidden"); err != ErrRejected || v != "" {
+		t.Fatalf("rejected Get gave %v %v", v, err)
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestTransferLimit(t *testing.T) {
+	opts := &Options{MaxTransfers: 1}
+	tc := setupWithOptions(t, "xferlimit", false, opts)
+	defer tc.cleanup()
+
+	fmt.Printf("Test: Limited concurrent TransferState ...\n")
+
+	tc.join(0)
+
+	ck := tc.clerk()
+	for i := 0; i < 200; i++ {
+		ck.Put(strconv.Itoa(i), strings.Repeat("x", 1000))
+	}
+
+	// flood the source group with transfer requests.
+	var done int32
+	var busy int32
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			srv := tc.groups[0].ports[i%len(tc.groups[0].ports)]
+			for atomic.LoadInt32(&done) == 0 {
+				args := &TransferStateArgs{Shard: i % shardmaster.NShards}
+				var reply TransferStateReply
+				ok := call(srv, "ShardKV.TransferState", args, &reply)
+				if ok && reply.Err == ErrTransferBusy {
+					atomic.AddInt32(&busy, 1)
+				}
+			}
+		}(i)
+	}
+
+	// clients are still served promptly.
+	for i := 0; i < 20; i++ {
+		t0 := time.Now()
+		ck.Append("a", "y")
+		if d := time.Since(t0); d > 2*time.Second {
+			t.Fatalf("Append took %v during the flood", d)
+		}
+	}
+
+	// and a real reconfiguration still gets its shards.
+	tc.join(1)
+	time.Sleep(2 * time.Second)
+	for i := 0; i < 200; i++ {
+		if v := ck.Get(strconv.Itoa(i)); len(v) != 1000 {
+			t.Fatalf("Get(%v) got %d bytes", i, len(v))
+		}
+	}
+
+	atomic.StoreInt32(&done, 1)
+	wg.Wait()
+
+	if atomic.LoadInt32(&busy) == 0 {
+		t.Fatalf("no transfer request was refused")
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestShardDigest(t *testing.T) {
+	tc := setup(t, "digest", false)
+	defer tc.cleanup()
+
+	fmt.Printf("Test: Shard digests after transfer ...\n")
+
+	tc.join(0)
+
+	ck := tc.clerk()
+	for i := 0; i < 100; i++ {
+		ck.Put(strconv.Itoa(i), strconv.Itoa(rand.Int()))
+	}
+
+	tc.join(1)
+	time.Sleep(2 * time.Second)
+	ck.Get("0")
+
+	config := tc.shardclerk().Query(-1)
+	moved := -1
+	for shard, gid := range config.Shards {
+		if gid != tc.groups[1].gid {
+			continue
+		}
+		moved = shard
+		// the source still holds the shard as it sent it.
+		want, _ := tc.groups[0].servers[0].ShardDigest(shard)
+		for _, srv := range tc.groups[1].servers {
+			got, num := srv.ShardDigest(shard)
+			if num != config.Num {
+				t.Fatalf("digest as of config %d, wanted %d", num, config.Num)
+			}
+			if got != want {
+				t.Fatalf("shard %d digest %v, source had %v", shard, got, want)
+			}
+		}
+	}
+	if moved < 0 {
+		t.Fatalf("no shard moved to group 1")
+	}
+
+	// a write the source never saw shows up as a mismatch.
+	key := ""
+	for i := 0; key2shard(key) != moved; i++ {
+		key = strconv.Itoa(i)
+	}
+	ck.Append(key, "z")
+	old, _ := tc.groups[0].servers[0].ShardDigest(moved)
+	for _, srv := range tc.groups[1].servers {
+		if got, _ := srv.ShardDigest(moved); got == old {
+			t.Fatalf("digest unchanged by a write")
+		}
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestDrainedKill(t *testing.T) {
+	opts := &Options{}
+	opts.PreLog = func(op *Op) error {
+		if op.Key == "slow" {
+			time.Sleep(1 * time.Second)
+		}
+		return nil
+	}
+	tc := setupWithOptions(t, "drain", false, opts)
+	defer tc.cleanup()
+	tc.drain = 5 * time.Second
+
+	fmt.Printf("Test: Draining requests before kill ...\n")
+
+	tc.join(0)
+
+	ck := tc.clerk()
+	ck.Put("a", "x")
+
+	// a request in flight when the kill starts gets its reply.
+	srv := tc.groups[0].ports[0]
+	ch := make(chan bool)
+	go func() {
+		args := &PutAppendArgs{Key: "slow", Value: "v", Op: "Put", CID: "drain", Seq: 1}
+		var reply PutAppendReply
+		ok := call(srv, "ShardKV.PutAppend", args, &reply)
+		ch <- ok && reply.Err == OK
+	}()
+	time.Sleep(200 * time.Millisecond)
+
+	killed := make(chan bool)
+	go func() {
+		tc.kill1(0, 0)
+		killed <- true
+	}()
+	time.Sleep(200 * time.Millisecond)
+
+	// a new request is refused at once, rather than left hanging.
+	ok := call(srv, "ShardKV.Get", &GetArgs{Key: "a", CID: "drain", Seq: 2}, &GetReply{})
+	if ok {
+		t.Fatalf("draining server took a new request")
+	}
+
+	if !<-ch {
+		t.Fatalf("in-flight request failed during drain")
+	}
+	<-killed
+	tc.groups[0].servers[0] = nil
+
+	if v := ck.Get("slow"); v != "v" {
+		t.Fatalf("Get got %v, wanted v", v)
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestApplyBatch(t *testing.T) {
+	tc := setupWithOptions(t, "applybatch", false, &Options{ApplyBatch: 16})
+	defer tc.cleanup()
+
+	fmt.Printf("Test: Batched apply ...\n")
+
+	tc.join(0)
+
+	const nclients = 5
+	var wg sync.WaitGroup
+	for i := 0; i < nclients; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ck := tc.clerk()
+			key := strconv.Itoa(i)
+			for j := 0; j < 20; j++ {
+				ck.Append(key, strconv.Itoa(j)+".")
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	wanted := ""
+	for j := 0; j < 20; j++ {
+		wanted += strconv.Itoa(j) + "."
+	}
+	ck := tc.clerk()
+	for i := 0; i < nclients; i++ {
+		if v := ck.Get(strconv.Itoa(i)); v != wanted {
+			t.Fatalf("Get(%v) got %v, wanted %v", i, v, wanted)
+		}
+	}
+
+	// every replica applies the same ops.
+	tc.join(1)
+	time.Sleep(2 * time.Second)
+	for i := 0; i < nclients; i++ {
+		if v := ck.Get(strconv.Itoa(i)); v != wanted {
+			t.Fatalf("Get(%v) after join got %v, wanted %v", i, v, wanted)
+		}
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+//
+// time catchUp() applying b.N decided Puts on a one-server
+// group, in batches of batch.
+//
+func benchmarkCatchUp(b *testing.B, batch int) {
+	pxport := port("bench-catchup-"+strconv.Itoa(batch), 0)
+	px := paxos.Make([]string{pxport}, 0, nil)
+	defer px.Kill()
+
+	const gid = 100
+	var config shardmaster.Config
+	config.Num = 1
+	config.Groups = map[int64][]string{gid: []string{pxport}}
+	for shard := range config.Shards {
+		config.Shards[shard] = gid
+	}
+	var xstate XState
+	xstate.Init()
+	ops := []Op{{Seq: 1, Op: Reconf, Extra: ReconfExtra{config, xstate}}}
+	for i := 0; i < b.N; i++ {
+		key := strconv.Itoa(i % 1000)
+		ops = append(ops, Op{CID: "bench", Seq: i + 1, Op: Put, Key: key, Value: key})
+	}
+	for seq := range ops {
+		px.Start(seq, ops[seq])
+		for {
+			if fate, _ := px.Status(seq); fate == paxos.Decided {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	kv := &ShardKV{px: px, applyBatch: batch}
+	kv.applier.init(gid, 0)
+	kv.seq = len(ops)
+
+	b.ResetTimer()
+	kv.catchUp()
+}
+
+func BenchmarkCatchUp1(b *testing.B)  { benchmarkCatchUp(b, 1) }
+func BenchmarkCatchUp16(b *testing.B) { benchmarkCatchUp(b, 16) }
+func BenchmarkCatchUp64(b *testing.B) { benchmarkCatchUp(b, 64) }
+
+func TestRebuildDedup(t *testing.T) {
+	tc := setup(t, "rebuilddedup", false)
+	defer tc.cleanup()
+
+	fmt.Printf("Test: Retries after RebuildDedup ...\n")
+
+	tc.join(0)
+
+	ck := tc.clerk()
+	ck.Put("a", "x")
+
+	// a client whose replies get lost, so that it retries.
+	g := tc.groups[0]
+	put := &PutAppendArgs{Key: "a", Value: "y", Op: "Append", CID: "retrier", Seq: 1}
+	if ok := call(g.ports[0], "ShardKV.PutAppend", put, &PutAppendReply{}); !ok {
+		t.Fatalf("Append failed")
+	}
+
+	g.servers[1].RebuildDedup()
+	for _, srv := range g.servers {
+		srv.ShardDigest(0) // catch up
+		srv.mu.Lock()
+		nreplies := len(srv.xstate.Replies)
+		srv.mu.Unlock()
+		if nreplies != 0 {
+			t.Fatalf("%d replies left after RebuildDedup", nreplies)
+		}
+	}
+
+	// the retried Append is not applied again.
+	for _, port := range g.ports {
+		var reply PutAppendReply
+		ok := call(port, "ShardKV.PutAppend", put, &reply)
+		if !ok || reply.Err != OK {
+			t.Fatalf("retried Append got %v %v", ok, reply.Err)
+		}
+	}
+	if v := ck.Get("a"); v != "xy" {
+		t.Fatalf("Get got %v, wanted xy", v)
+	}
+
+	// a retried Get is answered with the current value.
+	get := &GetArgs{Key: "a", CID: "retrier", Seq: 2}
+	call(g.ports[0], "ShardKV.Get", get, &GetReply{})
+	g.servers[0].RebuildDedup()
+	ck.Append("a", "z")
+	g.servers[2].ShardDigest(0) // catch up
+	var reply GetReply
+	if ok := call(g.ports[2], "ShardKV.Get", get, &reply); !ok || reply.Value != "xyz" {
+		t.Fatalf("retried Get got %v %v", ok, reply.Value)
+	}
+
+	// and new requests are served as usual.
+	put.Seq = 3
+	call(g.ports[1], "ShardKV.PutAppend", put, &PutAppendReply{})
+	if v := ck.Get("a"); v != "xyzy" {
+		t.Fatalf("Get got %v, wanted xyzy", v)
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestRepairSharding(t *testing.T) {
+	tc := setup(t, "repairsharding", false)
+	defer tc.cleanup()
+
+	fmt.Printf("Test: RepairSharding finds keys a new key2shard() moved ...\n")
+
+	tc.join(0)
+	tc.join(1)
+	config := tc.mck.Query(-1)
+	tc.awaitConfig(0, config.Num)
+	tc.awaitConfig(1, config.Num)
+
+	ck := tc.clerk()
+	for c := 'a'; c <= 'z'; c++ {
+		ck.Put(string(c), "x")
+	}
+
+	g := tc.groups[0]
+	// wait for every replica to apply the log as far as one
+	// of them has
+	catchUp := func() {
+		last := 0
+		for _, srv := range g.servers {
+			srv.ShardDigest(0)
+			if n := srv.Stats().LastSeq; n > last {
+				last = n
+			}
+		}
+		for si, srv := range g.servers {
+			for iters := 0; srv.Stats().LastSeq < last; iters++ {
+				if iters > 100 {
+					t.Fatalf("server %d stuck at seq %d", si, srv.Stats().LastSeq)
+				}
+				time.Sleep(10 * time.Millisecond)
+				srv.ShardDigest(0)
+			}
+		}
+	}
+	// the Puts are applied under the old key2shard()
+	catchUp()
+
+	// every key one shard on from where it was written
+	defer shardFunc.Store((func(string) int)(nil))
+	shardFunc.Store(func(key string) int {
+		return (int(key[0]) + 1) % shardmaster.NShards
+	})
+
+	wanted := map[string]int64{}
+	for c := 'a'; c <= 'z'; c++ {
+		key := string(c)
+		was, is := config.Shards[int(c) % shardmaster.NShards], config.Shards[key2shard(key)]
+		if was == g.gid && is != g.gid {
+			wanted[key] = is
+		}
+	}
+	if len(wanted) == 0 {
+		t.Fatalf("no keys moved off group 0 by config %v", config.Shards)
+	}
+
+	orphans, err := g.servers[1].RepairSharding()
+	if err != OK || !reflect.DeepEqual(orphans, wanted) {
+		t.Fatalf("RepairSharding got %v %v, wanted %v", orphans, err, wanted)
+	}
+	// the search is logged: every replica finds the same keys
+	catchUp()
+	for si, srv := range g.servers {
+		srv.mu.Lock()
+		found := srv.orphans
+		srv.mu.Unlock()
+		if !reflect.DeepEqual(found, wanted) {
+			t.Fatalf("server %d found %v, wanted %v", si, found, wanted)
+		}
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestWriteDeadline(t *testing.T) {
+	release := make(chan bool)
+	opts := &Options{}
+	opts.PreLog = func(op *Op) error {
+		if op.Key == "late" && op.CID == "late" {
+			<-release
+		}
+		return nil
+	}
+	tc := setupWithOptions(t, "deadline", false, opts)
+	defer tc.cleanup()
+
+	fmt.Printf("Test: Writes decided after their deadline ...\n")
+
+	tc.join(0)
+
+	ck := tc.clerk()
+	ck.Put("late", "old")
+	if err := ck.PutAppendWithin("a", "x", "Put", 5); err != OK {
+		t.Fatalf("prompt write got %v", err)
+	}
+
+	// server 2 holds the write up while the log moves on.
+	g := tc.groups[0]
+	ch := make(chan Err)
+	go func() {
+		args := &PutAppendArgs{Key: "late", Value: "new", Op: "Put",
+			CID: "late", Seq: 1, Within: 5}
+		var reply PutAppendReply
+		call(g.ports[2], "ShardKV.PutAppend", args, &reply)
+		ch <- reply.Err
+	}()
+	time.Sleep(100 * time.Millisecond)
+	for i := 0; i < 10; i++ {
+		ck.Append("a", strconv.Itoa(i))
+	}
+	close(release)
+
+	if err := <-ch; err != ErrExpired {
+		t.Fatalf("delayed write got %v, wanted ErrExpired", err)
+	}
+	if v := ck.Get("late"); v != "old" {
+		t.Fatalf("Get got %v, wanted old", v)
+	}
+	for _, srv := range g.servers {
+		srv.ShardDigest(0) // catch up
+		srv.mu.Lock()
+		v := srv.xstate.KVStore["late"]
+		srv.mu.Unlock()
+		if v != "old" {
+			t.Fatalf("a replica applied the expired write")
+		}
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestCurrentConfig(t *testing.T) {
+	tc := setup(t, "curconfig", false)
+	defer tc.cleanup()
+
+	fmt.Printf("Test: Clerk.CurrentConfig ...\n")
+
+	tc.join(0)
+
+	ck := tc.clerk()
+	ck.Put("a", "x")
+	config, _ := ck.CurrentConfig(time.Hour)
+	if _, ok := config.Groups[tc.groups[0].gid]; !ok || config.Num != 1 {
+		t.Fatalf("config %v does not show the first join", config)
+	}
+
+	tc.join(1)
+	time.Sleep(100 * time.Millisecond)
+
+	// a recent enough cached config is returned as is.
+	config, age := ck.CurrentConfig(time.Hour)
+	if config.Num != 1 || age <= 0 || age > time.Hour {
+		t.Fatalf("cached config %d, age %v", config.Num, age)
+	}
+
+	// a stale one is refreshed.
+	config, age = ck.CurrentConfig(50 * time.Millisecond)
+	if _, ok := config.Groups[tc.groups[1].gid]; !ok || config.Num != 2 {
+		t.Fatalf("refreshed config %v does not show the second join", config)
+	}
+	if age > 50*time.Millisecond {
+		t.Fatalf("refreshed config is %v old", age)
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestSweepExpired(t *testing.T) {
+	opts := &Options{SweepInterval: 200 * time.Millisecond}
+	tc := setupWithOptions(t, "sweep", false, opts)
+	defer tc.cleanup()
+
+	fmt.Printf("Test: Sweeping expired keys ...\n")
+
+	tc.join(0)
+
+	ck := tc.clerk()
+	ck.PutTTL("t", "v", 5)
+	ck.Put("keep", "v")
+	ck.PutTTL("r", "v", 5)
+
+	// "r" keeps having its TTL refreshed; "t" is never touched.
+	for i := 0; i < 10; i++ {
+		time.Sleep(100 * time.Millisecond)
+		ck.PutTTL("r", "v", 50)
+	}
+	time.Sleep(2 * opts.SweepInterval)
+
+	for _, srv := range tc.groups[0].servers {
+		srv.ShardDigest(0) // catch up
+		srv.mu.Lock()
+		_, t1 := srv.xstate.KVStore["t"]
+		_, t2 := srv.xstate.Expires["t"]
+		_, keep := srv.xstate.KVStore["keep"]
+		_, r := srv.xstate.KVStore["r"]
+		srv.mu.Unlock()
+		if t1 || t2 {
+			t.Fatalf("expired key not reclaimed")
+		}
+		if !keep || !r {
+			t.Fatalf("live key reclaimed")
+		}
+	}
+	if v := ck.Get("t"); v != "" {
+		t.Fatalf("Get of expired key got %v", v)
+	}
+	if v := ck.Get("r"); v != "v" {
+		t.Fatalf("Get of refreshed key got %v", v)
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestTTLMove(t *testing.T) {
+	tc := setup(t, "ttlmove", false)
+	defer tc.cleanup()
+
+	fmt.Printf("Test: TTLs survive a move between groups ...\n")
+
+	tc.join(0)
+
+	// group 0's log gets well ahead of group 1's.
+	ck := tc.clerk()
+	for i := 0; i < 60; i++ {
+		ck.Put("k", strconv.Itoa(i))
+	}
+	const ttl = 40
+	ck.PutTTL("t", "v", ttl)
+
+	tc.join(1)
+	tc.leave(0)
+	tc.awaitConfig(1, tc.mck.Query(-1).Num)
+
+	if v := ck.Get("t"); v != "v" {
+		t.Fatalf("Get of moved key got %v", v)
+	}
+	for _, srv := range tc.groups[1].servers {
+		srv.ShardDigest(0) // catch up
+		srv.mu.Lock()
+		last, ok := srv.xstate.Expires["t"]
+		left := last - srv.last_seq
+		srv.mu.Unlock()
+		if !ok || left < 0 || left > ttl {
+			t.Fatalf("moved key has %v seqs left (%v)", left, ok)
+		}
+	}
+
+	for i := 0; i < ttl; i++ {
+		ck.Put("k", strconv.Itoa(i))
+	}
+	if v := ck.Get("t"); v != "" {
+		t.Fatalf("Get of moved key after its TTL got %v", v)
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestConfirmedReads(t *testing.T) {
+	tc := setup(t, "confirm", false)
+	defer tc.cleanup()
+
+	fmt.Printf("Test: Reads after a confirming no-op ...\n")
+
+	tc.join(0)
+
+	// a write done through one server is seen by a confirmed
+	// read from any other, even one no client op went through.
+	ck := tc.clerk()
+	g := tc.groups[0]
+	for i := 0; i < 20; i++ {
+		v := strconv.Itoa(i)
+		ck.Put("a", v)
+		args := &GetArgs{Key: "a", Consistency: ReadConfirm}
+		var reply GetReply
+		ok := call(g.ports[1+i%2], "ShardKV.Get", args, &reply)
+		if !ok || reply.Err != OK || reply.Value != v {
+			t.Fatalf("confirmed Get got %v %v %v, wanted %v", ok, reply.Err, reply.Value, v)
+		}
+	}
+
+	// concurrent confirmed reads share no-ops.
+	const nreaders = 20
+	cks := make([]*Clerk, nreaders)
+	for i := 0; i < nreaders; i++ {
+		cks[i] = tc.clerk()
+		cks[i].GetConfirm("a") // fetch a config
+	}
+	g.servers[0].ShardDigest(0) // catch up
+	before := g.servers[0].Stats().LastSeq
+
+	var wg sync.WaitGroup
+	for i := 0; i < nreaders; i++ {
+		wg.Add(1)
+		go func(myck *Clerk) {
+			defer wg.Done()
+			if v := myck.GetConfirm("a"); v != "19" {
+				t.Errorf("GetConfirm got %v, wanted 19", v)
+			}
+		}(cks[i])
+	}
+	wg.Wait()
+	g.servers[0].ShardDigest(0) // catch up
+	if n := g.servers[0].Stats().LastSeq - before; n >= nreaders/2 {
+		t.Fatalf("%d confirmed reads took %d log slots", nreaders, n)
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func benchmarkGet(b *testing.B, consistency string) {
+	tc := setup(b, "benchget", false)
+	defer tc.cleanup()
+
+	tc.join(0)
+	tc.clerk().Put("a", "x")
+
+	b.SetParallelism(8)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		ck := tc.clerk()
+		for pb.Next() {
+			ck.get(context.Background(), &GetArgs{Key: "a", Consistency: consistency})
+		}
+	})
+}
+
+func BenchmarkGetLogged(b *testing.B)  { benchmarkGet(b, ReadLogged) }
+func BenchmarkGetConfirm(b *testing.B) { benchmarkGet(b, ReadConfirm) }
+
+//
+// Puts from many clients at once, each to one of nshards
+// shards. ops on different shards are decided concurrently,
+// so more shards should mean more Puts a second.
+//
+func benchmarkPutShards(b *testing.B, nshards int) {
+	tc := setup(b, "benchput"+strconv.Itoa(nshards), false)
+	defer tc.cleanup()
+
+	tc.join(0)
+	tc.clerk().Put("0", "x")
+
+	var nclients int32
+	b.SetParallelism(8)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		ck := tc.clerk()
+		// key2shard() maps "0".."9" onto all 10 shards
+		key := strconv.Itoa(int(atomic.AddInt32(&nclients, 1)) % nshards)
+		for pb.Next() {
+			ck.Put(key, "x")
+		}
+	})
+}
+
+func BenchmarkPutOneShard(b *testing.B)  { benchmarkPutShards(b, 1) }
+func BenchmarkPutTenShards(b *testing.B) { benchmarkPutShards(b, 10) }
+
+//
+// Puts from many clients at once to all shards, by servers
+// that batch the ops they get within window of each other.
+// reports the log slots used per Put.
+//
+func benchmarkPutBatched(b *testing.B, window time.Duration) {
+	tc := setupWithOptions(b, "benchbatch", false, &Options{BatchWindow: window})
+	defer tc.cleanup()
+
+	tc.join(0)
+	tc.clerk().Put("0", "x")
+	px := tc.groups[0].servers[0].px
+	before := px.Max()
+
+	var nclients int32
+	b.SetParallelism(8)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		ck := tc.clerk()
+		key := strconv.Itoa(int(atomic.AddInt32(&nclients, 1)) % 10)
+		for pb.Next() {
+			ck.Put(key, "x")
+		}
+	})
+	b.StopTimer()
+	b.ReportMetric(float64(px.Max() - before) / float64(b.N), "slots/op")
+}
+
+func BenchmarkPutUnbatched(b *testing.B) { benchmarkPutBatched(b, 0) }
+func BenchmarkPutBatched(b *testing.B)   { benchmarkPutBatched(b, 5*time.Millisecond) }
+
+//
+// the memory a stream of Puts costs the process: clerk,
+// servers, and paxos together. run with -benchmem, or read
+// the allocs/op it reports.
+//
+func BenchmarkPutAllocs(b *testing.B) {
+	tc := setup(b, "benchallocs", false)
+	defer tc.cleanup()
+
+	tc.join(0)
+	ck := tc.clerk()
+	ck.Put("0", "x")
+
+	value := strings.Repeat("x", 100)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ck.Put(strconv.Itoa(i % 10), value)
+	}
+}
+
+func TestMissingKeyDefault(t *testing.T) {
+	fmt.Printf("Test: Defaults for missing keys ...\n")
+
+	// by default a missing key is ErrNoKey.
+	tc := setup(t, "nokey", false)
+	tc.join(0)
+	ck := tc.clerk()
+	if v, err := ck.GetE("b"); err != ErrNoKey || v != "" {
+		t.Fatalf("Get without default got %v %v", v, err)
+	}
+	if v := ck.GetOr("b", "zero"); v != "zero" {
+		t.Fatalf("Get with request default got %v", v)
+	}
+	tc.cleanup()
+
+	none := "none"
+	tc = setupWithOptions(t, "missingkey", false, &Options{MissingDefault: &none})
+	defer tc.cleanup()
+
+	tc.join(0)
+
+	ck = tc.clerk()
+	ck.Put("a", "x")
+	if v, err := ck.GetE("a"); err != OK || v != "x" {
+		t.Fatalf("Get of present key got %v %v", v, err)
+	}
+	if v, err := ck.GetE("b"); err != OK || v != "none" {
+		t.Fatalf("Get with server default got %v %v", v, err)
+	}
+	if v := ck.GetOr("b", "zero"); v != "zero" {
+		t.Fatalf("Get with request default got %v", v)
+	}
+	if v := ck.GetConfirm("b"); v != "none" {
+		t.Fatalf("confirmed Get with server default got %v", v)
+	}
+
+	// a retry gets the recorded reply.
+	args := &GetArgs{Key: "c", CID: "retrier", Seq: 1, UseDefault: true, Default: "mine"}
+	srv := tc.groups[0].ports[0]
+	for i := 0; i < 2; i++ {
+		var reply GetReply
+		if ok := call(srv, "ShardKV.Get", args, &reply); !ok || reply.Err != OK || reply.Value != "mine" {
+			t.Fatalf("Get %d got %v %v %v", i, ok, reply.Err, reply.Value)
+		}
+	}
+
+	// an empty default is a default too.
+	args = &GetArgs{Key: "c", CID: "retrier", Seq: 2, UseDefault: true, Default: ""}
+	var reply GetReply
+	if ok := call(srv, "ShardKV.Get", args, &reply); !ok || reply.Err != OK || reply.Value != "" {
+		t.Fatalf("Get with empty default got %v %v %v", ok, reply.Err, reply.Value)
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestConvergence(t *testing.T) {
+	tc := setup(t, "converge", false)
+	defer tc.cleanup()
+
+	fmt.Printf("Test: Replicas converge after reconfiguration ...\n")
+
+	tc.join(0)
+	ck := tc.clerk()
+	for i := 0; i < 20; i++ {
+		ck.Put(strconv.Itoa(i), strconv.Itoa(rand.Int()))
+	}
+	tc.join(1)
+	time.Sleep(2 * time.Second)
+	for i := 0; i < 20; i++ {
+		ck.Append(strconv.Itoa(i), "x")
+	}
+
+	AssertConverged(t, tc.groups[0])
+	AssertConverged(t, tc.groups[1])
+
+	// a replica that wrongly applied something is caught.
+	srv := tc.groups[1].servers[2]
+	srv.mu.Lock()
+	srv.xstate.KVStore["bogus"] = "x"
+	srv.mu.Unlock()
+	if err := checkConverged(tc.groups[1], 1*time.Second); err == nil {
+		t.Fatalf("divergence not detected")
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestHotKeys(t *testing.T) {
+	tc := setup(t, "hotkeys", false)
+	defer tc.cleanup()
+
+	fmt.Printf("Test: Hot key statistics ...\n")
+
+	tc.join(0)
+
+	ck := tc.clerk()
+	ck.Put("hot", "x")
+	for i := 0; i < 20; i++ {
+		ck.Put("cold"+strconv.Itoa(i), "x")
+	}
+	for i := 0; i < 300; i++ {
+		ck.Get("hot")
+	}
+
+	keys := ck.HotKeys(tc.groups[0].gid, 5)
+	if len(keys) == 0 || keys[0].Key != "hot" {
+		t.Fatalf("hammered key is not the hottest: %v", keys)
+	}
+	for _, kr := range keys[1:] {
+		if kr.Rate > keys[0].Rate/5 {
+			t.Fatalf("cold key %v at %v, hot one at %v", kr.Key, kr.Rate, keys[0].Rate)
+		}
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestUpdate(t *testing.T) {
+	tc := setup(t, "update", false)
+	defer tc.cleanup()
+
+	fmt.Printf("Test: Concurrent Clerk.Update ...\n")
+
+	tc.join(0)
+
+	incr := func(old string) (string, bool) {
+		n, _ := strconv.Atoi(old)
+		return strconv.Itoa(n + 1), true
+	}
+
+	const nclients = 8
+	const nincr = 10
+	var wg sync.WaitGroup
+	for i := 0; i < nclients; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ck := tc.clerk()
+			for j := 0; j < nincr; j++ {
+				for {
+					if _, ok := ck.Update("n", incr); ok {
+						break
+					}
+				}
+			}
+		}()
+	}
+
+	// the key changes owner while the updates run.
+	time.Sleep(500 * time.Millisecond)
+	tc.join(1)
+	tc.join(2)
+	wg.Wait()
+
+	ck := tc.clerk()
+	if v := ck.Get("n"); v != strconv.Itoa(nclients*nincr) {
+		t.Fatalf("Get got %v, wanted %v", v, nclients*nincr)
+	}
+	if v, ok := ck.Update("n", func(old string) (string, bool) { return "", false }); ok || v != strconv.Itoa(nclients*nincr) {
+		t.Fatalf("declined Update gave %v %v", v, ok)
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestMirror(t *testing.T) {
+	tc := setup(t, "mirror", false)
+	defer tc.cleanup()
+
+	fmt.Printf("Test: Reading a mirrored key after its group dies ...\n")
+
+	tc.join(0)
+	tc.join(1)
+
+	// a key group 0 serves
+	config := tc.mck.Query(-1)
+	key := ""
+	for i := 0; key == ""; i++ {
+		k := strconv.Itoa(i)
+		if config.Shards[key2shard(k)] == tc.groups[0].gid {
+			key = k
+		}
+	}
+
+	ck := tc.clerk()
+	ck.Put(key, "x")
+	if err := ck.Mirror(key, tc.groups[1].gid); err != OK {
+		t.Fatalf("Mirror got %v", err)
+	}
+	ck.Put(key, "y")
+	if v, err := ck.GetMirrored(key); err != OK || v != "y" {
+		t.Fatalf("GetMirrored with group up got %v %v", v, err)
+	}
+
+	// wait for the push to group 1
+	mirrored := false
+	for i := 0; i < 50 && !mirrored; i++ {
+		args := &GetMirrorArgs{Key: key}
+		var reply GetMirrorReply
+		ok := call(tc.groups[1].ports[0], "ShardKV.GetMirror", args, &reply)
+		mirrored = ok && reply.Err == OK && reply.Copy.Value == "y"
+		time.Sleep(100 * time.Millisecond)
+	}
+	if !mirrored {
+		t.Fatalf("write never reached the mirror")
+	}
+
+	for si := 0; si < len(tc.groups[0].servers); si++ {
+		tc.kill1(0, si)
+	}
+
+	done := make(chan bool)
+	go func() {
+		if v, err := ck.GetMirrored(key); err != OK || v != "y" {
+			t.Errorf("GetMirrored with group down got %v %v", v, err)
+		}
+		done <- true
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("GetMirrored did not fall back to the mirror")
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestUnmirror(t *testing.T) {
+	tc := setup(t, "unmirror", false)
+	defer tc.cleanup()
+
+	fmt.Printf("Test: Groups a key is no longer mirrored onto drop it ...\n")
+
+	tc.join(0)
+	tc.join(1)
+	tc.join(2)
+
+	// a key group 0 serves
+	config := tc.mck.Query(-1)
+	key := ""
+	for i := 0; key == ""; i++ {
+		k := strconv.Itoa(i)
+		if config.Shards[key2shard(k)] == tc.groups[0].gid {
+			key = k
+		}
+	}
+
+	// wait for group gi's copy of key to read as want ("" if
+	// it should have none)
+	check := func(gi int, want string) {
+		var reply GetMirrorReply
+		for i := 0; i < 50; i++ {
+			reply = GetMirrorReply{}
+			ok := call(tc.groups[gi].ports[0], "ShardKV.GetMirror", &GetMirrorArgs{Key: key}, &reply)
+			if ok && want == "" && reply.Err == ErrNoKey {
+				return
+			}
+			if ok && want != "" && reply.Err == OK && reply.Copy.Value == want {
+				return
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		t.Fatalf("group %d's copy is %v %v; wanted %q", gi, reply.Err, reply.Copy.Value, want)
+	}
+
+	ck := tc.clerk()
+	ck.Put(key, "x")
+	ck.Mirror(key, tc.groups[1].gid)
+	check(1, "x")
+
+	// moving the mirror drops the old copy
+	ck.Mirror(key, tc.groups[2].gid)
+	check(2, "x")
+	check(1, "")
+
+	// so does stopping it, and later writes don't reach it
+	ck.Mirror(key, 0)
+	check(2, "")
+	ck.Put(key, "y")
+	check(2, "")
+
+	// mirroring onto a group again brings its copy back
+	ck.Mirror(key, tc.groups[1].gid)
+	check(1, "y")
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestMemoryLimit(t *testing.T) {
+	const limit = 64 * 1024
+	tc := setupWithOptions(t, "memlimit", false, &Options{MemoryLimit: limit})
+	defer tc.cleanup()
+
+	fmt.Printf("Test: Writes refused under memory pressure ...\n")
+
+	tc.join(0)
+
+	ck := tc.clerk()
+	value := strings.Repeat("x", 1024)
+	n := 0
+	for ; n < 1000; n++ {
+		err := ck.PutAppendE(strconv.Itoa(n), value, "Put")
+		if err == ErrMemoryPressure {
+			break
+		}
+		if err != OK {
+			t.Fatalf("Put %d got %v", n, err)
+		}
+	}
+	if n == 1000 {
+		t.Fatalf("no ErrMemoryPressure after %d KB of writes", n)
+	}
+
+	mitigated := false
+	for _, srv := range tc.groups[0].servers {
+		stats := srv.Stats()
+		if stats.MemoryBytes > 2*limit {
+			t.Fatalf("memory estimate %d far past the limit", stats.MemoryBytes)
+		}
+		mitigated = mitigated || stats.Mitigations > 0
+	}
+	if !mitigated {
+		t.Fatalf("no server relieved memory")
+	}
+
+	// writes that don't grow the store still go through.
+	if err := ck.PutAppendE("0", "y", "Put"); err != OK {
+		t.Fatalf("shrinking Put got %v", err)
+	}
+	if v := ck.Get("0"); v != "y" {
+		t.Fatalf("Get got %v", v)
+	}
+	if v := ck.Get(strconv.Itoa(n - 1)); v != value {
+		t.Fatalf("last accepted write lost")
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestMemoryCharge(t *testing.T) {
+	tc := setupWithOptions(t, "memcharge", false, &Options{MemoryLimit: 1 << 20})
+	defer tc.cleanup()
+
+	fmt.Printf("Test: Writes count towards the memory estimate once ...\n")
+
+	tc.join(0)
+
+	srv := tc.groups[0].servers[0]
+	xop := &Op{CID: "c", Seq: 1, Op: Put, Key: "k", Value: strings.Repeat("x", 1024)}
+
+	// holding mu keeps checkMemory() from starting over
+	srv.mu.Lock()
+	before := srv.memBytes
+	srv.chargeMemory(xop)
+	srv.chargeMemory(xop) // a retry
+	after := srv.memBytes
+	srv.mu.Unlock()
+
+	if after - before != opBytes(xop) {
+		t.Fatalf("Put counted as %d bytes; wanted %d", after - before, opBytes(xop))
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+// a Put or a Get of one key, for checkLinearizable()
+type regOp struct {
+	put        bool
+	value      string // written, or read ("" if missing)
+	start, end int64
+}
+
+//
+// can ops, on one key initially missing, be put in an order
+// that respects real time and in which every Get reads the
+// latest Put? a search in the style of Wing & Gong; ops must
+// number at most 64.
+//
+func checkLinearizable(ops []regOp) bool {
+	full := uint64(1)<<uint(len(ops)) - 1
+	type state struct {
+		done  uint64
+		value string
+	}
+	failed := map[state]bool{}
+	var search func(s state) bool
+	search = func(s state) bool {
+		if s.done == full {
+			return true
+		}
+		if failed[s] {
+			return false
+		}
+		// an op may go next if no other op ended before it began
+		minEnd := int64(1<<63 - 1)
+		for i, op := range ops {
+			if s.done&(1<<uint(i)) == 0 && op.end < minEnd {
+				minEnd = op.end
+			}
+		}
+		for i, op := range ops {
+			if s.done&(1<<uint(i)) != 0 || op.start > minEnd {
+				continue
+			}
+			next := state{s.done | 1<<uint(i), s.value}
+			if op.put {
+				next.value = op.value
+			} else if op.value != s.value {
+				continue
+			}
+			if search(next) {
+				return true
+			}
+		}
+		failed[s] = true
+		return false
+	}
+	return search(state{0, ""})
+}
+
+func TestSpeculativeReads(t *testing.T) {
+	tc := setup(t, "speculative", false)
+	defer tc.cleanup()
+
+	fmt.Printf("Test: Speculative reads are confirmed linearizably ...\n")
+
+	// the checker itself: a read that misses a finished write
+	stale := []regOp{{true, "a", 0, 1}, {false, "", 2, 3}}
+	if checkLinearizable(stale) {
+		t.Fatalf("stale read passes checkLinearizable()")
+	}
+
+	tc.join(0)
+
+	// load on other keys, so that replicas the clerks don't
+	// send it to are often catching up
+	stop := int32(0)
+	var lwg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		lwg.Add(1)
+		go func(i int) {
+			defer lwg.Done()
+			ck := tc.clerk()
+			for atomic.LoadInt32(&stop) == 0 {
+				ck.Append("load"+strconv.Itoa(i), "x")
+			}
+		}(i)
+	}
+
+	const nclients = 4
+	const nops = 12
+	var mu sync.Mutex
+	history := []regOp{}
+	retracted := 0
+	var wg sync.WaitGroup
+	for i := 0; i < nclients; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ck := tc.clerk()
+			for j := 0; j < nops; j++ {
+				op := regOp{start: time.Now().UnixNano()}
+				if rand.Intn(3) == 0 {
+					op.put, op.value = true, strconv.Itoa(i)+"-"+strconv.Itoa(j)
+					ck.Put("k", op.value)
+				} else {
+					spec, confirmed := ck.GetSpeculative("k")
+					op.value = <-confirmed
+					if spec != op.value {
+						mu.Lock()
+						retracted++
+						mu.Unlock()
+					}
+				}
+				op.end = time.Now().UnixNano()
+				mu.Lock()
+				history = append(history, op)
+				mu.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+	atomic.StoreInt32(&stop, 1)
+	lwg.Wait()
+
+	if !checkLinearizable(history) {
+		t.Fatalf("confirmed reads not linearizable: %v", history)
+	}
+	speculated := 0
+	for _, srv := range tc.groups[0].servers {
+		speculated += srv.Stats().Speculated
+	}
+	if speculated == 0 {
+		t.Fatalf("no read was answered speculatively")
+	}
+	fmt.Printf("  ... %d speculative answers, %d retracted\n", speculated, retracted)
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestScanStream(t *testing.T) {
+	tc := setup(t, "scan", false)
+	defer tc.cleanup()
+
+	fmt.Printf("Test: Streaming a large scan to a slow consumer ...\n")
+
+	tc.join(0)
+	tc.join(1)
+
+	const nkeys = 100000
+	const txnKeys = 1000
+	ck := tc.clerk()
+	for i := 0; i < nkeys; i += txnKeys {
+		writes := map[string]string{}
+		for j := i; j < i+txnKeys; j++ {
+			writes[fmt.Sprintf("s%06d", j)] = strconv.Itoa(j)
+		}
+		if !ck.Transaction(writes) {
+			t.Fatalf("loading transaction aborted")
+		}
+	}
+	ck.Put("t", "other prefix")
+
+	sc := ck.ScanStream("s")
+	n := 0
+	for {
+		key, value, ok := sc.Next()
+		if !ok {
+			break
+		}
+		if key != fmt.Sprintf("s%06d", n) || value != strconv.Itoa(n) {
+			t.Fatalf("key %d is %v=%v", n, key, value)
+		}
+		if len(sc.batch) >= ScanBatchKeys {
+			t.Fatalf("a batch of %d keys", len(sc.batch)+1)
+		}
+		n++
+		if n%5000 == 0 {
+			// a slow consumer
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+	if n != nkeys {
+		t.Fatalf("scanned %d keys, wanted %d", n, nkeys)
+	}
+	if sc.batches < nkeys/ScanBatchKeys {
+		t.Fatalf("%d keys in only %d batches", n, sc.batches)
+	}
+
+	// an empty prefix scans every shard
+	sc = ck.ScanStream("")
+	n = 0
+	for _, _, ok := sc.Next(); ok; _, _, ok = sc.Next() {
+		n++
+	}
+	if n != nkeys+1 {
+		t.Fatalf("full scan saw %d keys, wanted %d", n, nkeys+1)
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestCatchUpRate(t *testing.T) {
+	const rate = 20
+	tc := setupWithOptions(t, "catchup", false, &Options{CatchUpRate: rate})
+	defer tc.cleanup()
+
+	fmt.Printf("Test: A rejoining replica catches up at a limited rate ...\n")
+
+	tc.join(0)
+	ck := tc.clerk()
+	ck.Put("a", "x")
+
+	// cut server 2 off while the others log ops
+	lagger := tc.groups[0].servers[2]
+	tc.groups[0].refuse1(2, true)
+	const missed = 40
+	for i := 0; i < missed; i++ {
+		ck.Append("a", "x")
+	}
+	tc.groups[0].refuse1(2, false)
+
+	// the group keeps serving while server 2 catches up
+	stop := int32(0)
+	served := int32(0)
+	go func() {
+		ck := tc.clerk()
+		for atomic.LoadInt32(&stop) == 0 {
+			ck.Put("b", "y")
+			atomic.AddInt32(&served, 1)
+		}
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	start := time.Now()
+	args := &GetArgs{Key: "a", CID: "rejoin", Seq: 1}
+	var reply GetReply
+	ok := call(tc.groups[0].ports[2], "ShardKV.Get", args, &reply)
+	elapsed := time.Since(start)
+	atomic.StoreInt32(&stop, 1)
+	if !ok || reply.Err != OK || reply.Value != strings.Repeat("x", missed+1) {
+		t.Fatalf("Get from the rejoined server got %v %v %v", ok, reply.Err, reply.Value)
+	}
+
+	stats := lagger.Stats()
+	if stats.Filled < missed/2 {
+		t.Fatalf("only %d missed slots filled", stats.Filled)
+	}
+	if limit := elapsed.Seconds()*rate + 2; float64(stats.Filled) > limit {
+		t.Fatalf("%d fills in %v, over the rate of %d/s", stats.Filled, elapsed, rate)
+	}
+	if atomic.LoadInt32(&served) == 0 {
+		t.Fatalf("no client op done during the catch-up")
+	}
+	fmt.Printf("  ... %d slots filled in %v\n", stats.Filled, elapsed)
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestDecisionProposer(t *testing.T) {
+	// no snapshot is taken before the end, so the servers
+	// never tell paxos they are done and no slot is forgotten
+	opts := &Options{SnapshotInterval: time.Hour}
+	tc := setupWithOptions(t, "decision", false, opts)
+	defer tc.cleanup()
+
+	fmt.Printf("Test: Decisions report their proposer ...\n")
+
+	// every server logs the config before the clerk starts,
+	// so none is still proposing its Reconf into later slots
+	tc.join(0)
+	tc.awaitConfig(0, 1)
+	ck := tc.clerk()
+	ck.Put("a", "x")
+
+	// the clerk sends every op to server 0, which is then
+	// the only proposer of its Appends. the servers' own ops
+	// may be proposed by any of them.
+	g := tc.groups[0]
+	start := g.servers[0].Stats().LastSeq
+	for i := 0; i < 10; i++ {
+		ck.Append("a", "x")
+	}
+	end := g.servers[0].Stats().LastSeq
+
+	appends := 0
+	for seq := start; seq < end; seq++ {
+		fate, v := g.servers[0].px.Status(seq)
+		if fate != paxos.Decided {
+			t.Fatalf("slot %d: %v", seq, fate)
+		}
+		decided := v.(Op)
+		proposer := -1
+		for _, op := range decided.unbatch() {
+			if op.Op == Append && op.CID == ck.me {
+				proposer = op.Proposer - 1
+			}
+		}
+		if proposer < 0 {
+			continue
+		}
+		appends++
+		for si := range g.servers {
+			var reply DecisionReply
+			for iters := 0; iters < 50; iters++ {
+				ok := call(g.ports[si], "ShardKV.Decision", &DecisionArgs{seq}, &reply)
+				if ok && reply.Err == OK {
+					break
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			if reply.Err != OK || reply.Proposer != proposer ||
+				reply.Proposer != 0 || reply.Proposal < 1 {
+				t.Fatalf("server %d slot %d: %v proposal %d by %d",
+					si, seq, reply.Err, reply.Proposal, reply.Proposer)
+			}
+		}
+	}
+	if appends != 10 {
+		t.Fatalf("found %d of the clerk's Appends in the log", appends)
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestPutIfAbsent(t *testing.T) {
+	tc := setup(t, "putifabsent", false)
+	defer tc.cleanup()
+
+	fmt.Printf("Test: Concurrent PutIfAbsent ...\n")
+
+	tc.join(0)
+
+	const nclients = 10
+	var wg sync.WaitGroup
+	won := make(chan string, nclients)
+	for i := 0; i < nclients; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ck := tc.clerk()
+			if ck.PutIfAbsent("lock", strconv.Itoa(i)) {
+				won <- strconv.Itoa(i)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(won)
+	winners := []string{}
+	for w := range won {
+		winners = append(winners, w)
+	}
+	if len(winners) != 1 {
+		t.Fatalf("%d PutIfAbsents succeeded", len(winners))
+	}
+	ck := tc.clerk()
+	if v := ck.Get("lock"); v != winners[0] {
+		t.Fatalf("key holds %v, winner wrote %v", v, winners[0])
+	}
+
+	// retries get the recorded outcome.
+	srv := tc.groups[0].ports[0]
+	for key, want := range map[string]Err{"new": OK, "lock": ErrKeyExists} {
+		args := &PutAppendArgs{Key: key, Value: "r", Op: PutIfAbsent, CID: "retrier-" + key, Seq: 1}
+		for i := 0; i < 2; i++ {
+			var reply PutAppendReply
+			if ok := call(srv, "ShardKV.PutAppend", args, &reply); !ok || reply.Err != want {
+				t.Fatalf("PutIfAbsent %d of %v got %v %v", i, key, ok, reply.Err)
+			}
+		}
+	}
+	if v := ck.Get("new"); v != "r" {
+		t.Fatalf("PutIfAbsent of a missing key left %v", v)
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestSharedTransport(t *testing.T) {
+	tc := setup(t, "shared", false)
+	defer tc.cleanup()
+
+	fmt.Printf("Test: Five groups on one transport ...\n")
+
+	// replace the default groups with five sharing a socket.
+	for gi := range tc.groups {
+		for si := range tc.groups[gi].servers {
+			tc.kill1(gi, si)
+		}
+	}
+	tr, err := MakeTransport(port("shared", 99))
+	if err != nil {
+		t.Fatalf("MakeTransport: %v", err)
+	}
+	defer tr.Close()
+
+	const ngroups = 5
+	const nreplicas = 3
+	tc.groups = make([]*tGroup, ngroups)
+	for i := 0; i < ngroups; i++ {
+		g := &tGroup{gid: int64(i + 200)}
+		g.servers = make([]*ShardKV, nreplicas)
+		g.ports = make([]string, nreplicas)
+		for j := 0; j < nreplicas; j++ {
+			g.ports[j] = tr.Addr(strconv.Itoa(i*nreplicas + j))
+		}
+		for j := 0; j < nreplicas; j++ {
+			g.servers[j], err = StartServerOnTransport(g.gid, tc.masterports, g.ports, j, nil, tr)
+			if err != nil {
+				t.Fatalf("StartServerOnTransport: %v", err)
+			}
+		}
+		tc.groups[i] = g
+	}
+	if _, err := StartServerOnTransport(200, tc.masterports, tc.groups[0].ports, 0, nil, tr); err == nil {
+		t.Fatalf("two servers started at %v", tc.groups[0].ports[0])
+	}
+
+	tc.join(0)
+	ck := tc.clerk()
+	keys := make([]string, 20)
+	vals := make([]string, len(keys))
+	for i := 0; i < len(keys); i++ {
+		keys[i] = strconv.Itoa(rand.Int())
+		vals[i] = strconv.Itoa(rand.Int())
+		ck.Put(keys[i], vals[i])
+	}
+
+	check := func() {
+		for i := 0; i < len(keys); i++ {
+			if v := ck.Get(keys[i]); v != vals[i] {
+				t.Fatalf("Get(%v) got %v, wanted %v", keys[i], v, vals[i])
+			}
+		}
+	}
+
+	for gi := 1; gi < ngroups; gi++ {
+		tc.join(gi)
+		check()
+	}
+	for gi := 0; gi < ngroups-1; gi++ {
+		tc.leave(gi)
+		check()
+	}
+	for i := 0; i < len(keys); i++ {
+		ck.Append(keys[i], "x")
+		vals[i] += "x"
+	}
+	check()
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestDelete(t *testing.T) {
+	tc := setup(t, "delete", false)
+	defer tc.cleanup()
+
+	fmt.Printf("Test: Delete across reconfigurations ...\n")
+
+	tc.join(0)
+	ck := tc.clerk()
+
+	// the first half, to be deleted, has a key in every shard
+	keys := make([]string, 2*shardmaster.NShards)
+	for i := 0; i < len(keys); i++ {
+		keys[i] = strconv.Itoa(i % shardmaster.NShards) + strconv.Itoa(i)
+		ck.Put(keys[i], "v")
+	}
+
+	check := func() {
+		for i := 0; i < len(keys); i++ {
+			v := ck.Get(keys[i])
+			if i < len(keys)/2 && v != "" {
+				t.Fatalf("deleted key %v came back as %v", keys[i], v)
+			}
+			if i >= len(keys)/2 && v != "v" {
+				t.Fatalf("Get(%v) got %v", keys[i], v)
+			}
+		}
+	}
+
+	// delete the keys at another group than the one that
+	// held them first, then move them back there.
+	tc.join(1)
+	tc.leave(0)
+
+	// a retried Delete gets the reply of the first.
+	args := &DeleteArgs{Key: keys[0], CID: "retrier", Seq: 1}
+	for i := 0; i < 2; i++ {
+		var reply DeleteReply
+		for j := 0; j < 50; j++ {
+			// wait for the server to take on the shard
+			reply.Err = ""
+			ok := call(tc.groups[1].ports[i], "ShardKV.Delete", args, &reply)
+			if ok && reply.Err != ErrWrongGroup {
+				break
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		if reply.Err != OK {
+			t.Fatalf("Delete %d got %v", i, reply.Err)
+		}
+	}
+	for i := 1; i < len(keys)/2; i++ {
+		if !ck.Delete(keys[i]) {
+			t.Fatalf("Delete(%v) found no key", keys[i])
+		}
+	}
+	if ck.Delete(keys[1]) {
+		t.Fatalf("second Delete found the key")
+	}
+	check()
+
+	tc.join(0)
+	check()
+	tc.leave(1)
+	check()
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestCAS(t *testing.T) {
+	tc := setup(t, "cas", false)
+	defer tc.cleanup()
+
+	fmt.Printf("Test: Concurrent CAS ...\n")
+
+	tc.join(0)
+	ck := tc.clerk()
+	ck.Put("lock", "free")
+
+	const nclients = 2
+	for round := 0; round < 10; round++ {
+		var wg sync.WaitGroup
+		won := make(chan string, nclients)
+		for i := 0; i < nclients; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				holder := strconv.Itoa(round) + "-" + strconv.Itoa(i)
+				if tc.clerk().CAS("lock", "free", holder) {
+					won <- holder
+				}
+			}(i)
+		}
+		wg.Wait()
+		close(won)
+		winners := []string{}
+		for w := range won {
+			winners = append(winners, w)
+		}
+		if len(winners) != 1 {
+			t.Fatalf("%d CASes succeeded", len(winners))
+		}
+		if v := ck.Get("lock"); v != winners[0] {
+			t.Fatalf("lock holds %v, winner wrote %v", v, winners[0])
+		}
+		if !ck.CAS("lock", winners[0], "free") {
+			t.Fatalf("winner could not release the lock")
+		}
+	}
+
+	// retries get the recorded outcome.
+	srv := tc.groups[0].ports[0]
+	for _, want := range []Err{OK, ErrMismatch} {
+		args := &PutAppendArgs{Key: "lock", Value: "r", Op: CAS, Expected: "free", CID: "retrier-" + string(want), Seq: 1}
+		for i := 0; i < 2; i++ {
+			var reply PutAppendReply
+			if ok := call(srv, "ShardKV.PutAppend", args, &reply); !ok || reply.Err != want {
+				t.Fatalf("CAS %d got %v %v, wanted %v", i, ok, reply.Err, want)
+			}
+		}
+	}
+	if v := ck.Get("lock"); v != "r" {
+		t.Fatalf("lock holds %v after CAS", v)
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestIncr(t *testing.T) {
+	tc := setup(t, "incr", false)
+	defer tc.cleanup()
+
+	fmt.Printf("Test: Concurrent Incr ...\n")
+
+	tc.join(0)
+
+	const nclients = 5
+	const nincr = 20
+	var wg sync.WaitGroup
+	for i := 0; i < nclients; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ck := tc.clerk()
+			for j := 0; j < nincr; j++ {
+				if _, err := ck.Incr("counter", 2); err != OK {
+					t.Errorf("Incr got %v", err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	ck := tc.clerk()
+	if n, err := ck.Incr("counter", -1); err != OK || n != 2*nclients*nincr-1 {
+		t.Fatalf("counter at %v %v, wanted %v", n, err, 2*nclients*nincr-1)
+	}
+
+	// a retried Incr is not applied twice.
+	args := &IncrArgs{Key: "counter", Delta: 10, CID: "retrier", Seq: 1}
+	for i := 0; i < 2; i++ {
+		var reply IncrReply
+		ok := call(tc.groups[0].ports[i], "ShardKV.Incr", args, &reply)
+		if !ok || reply.Err != OK || reply.Value != strconv.Itoa(2*nclients*nincr+9) {
+			t.Fatalf("Incr %d got %v %v %v", i, ok, reply.Err, reply.Value)
+		}
+	}
+
+	ck.Put("word", "x")
+	if _, err := ck.Incr("word", 1); err != ErrNotNumber {
+		t.Fatalf("Incr of a non-number got %v", err)
+	}
+	if ck.Get("word") != "x" {
+		t.Fatalf("failed Incr changed the value")
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+//
+// Incr starts a missing key from zero, takes negative deltas,
+// and counts on from a number stored by Put.
+//
+func TestIncrValues(t *testing.T) {
+	tc := setup(t, "incrvalues", false)
+	defer tc.cleanup()
+
+	fmt.Printf("Test: Incr of missing, negative and Put values ...\n")
+
+	tc.join(0)
+	ck := tc.clerk()
+
+	if n, err := ck.Incr("missing", -3); err != OK || n != -3 {
+		t.Fatalf("Incr of a missing key got %v %v, wanted -3", n, err)
+	}
+	if v := ck.Get("missing"); v != "-3" {
+		t.Fatalf("Get after Incr got %q, wanted -3", v)
+	}
+
+	ck.Put("n", "40")
+	if n, err := ck.Incr("n", 2); err != OK || n != 42 {
+		t.Fatalf("Incr of a Put number got %v %v, wanted 42", n, err)
+	}
+	if n, err := ck.Incr("n", -50); err != OK || n != -8 {
+		t.Fatalf("decrement got %v %v, wanted -8", n, err)
+	}
+	if v := ck.Get("n"); v != "-8" {
+		t.Fatalf("Get after the decrement got %q, wanted -8", v)
+	}
+
+	// the counter moves with its shard
+	tc.join(1)
+	tc.awaitConfig(1, tc.mck.Query(-1).Num)
+	if n, err := ck.Incr("n", 1); err != OK || n != -7 {
+		t.Fatalf("Incr after a Join got %v %v, wanted -7", n, err)
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestPutBatch(t *testing.T) {
+	tc := setup(t, "putbatch", false)
+	defer tc.cleanup()
+
+	fmt.Printf("Test: PutBatch uses fewer paxos instances ...\n")
+
+	tc.join(0)
+	ck := tc.clerk()
+
+	const nkeys = 1000
+	const batch = 100
+	instances := func() int {
+		max := 0
+		for _, s := range tc.groups[0].servers {
+			if m := s.px.Max(); m > max {
+				max = m
+			}
+		}
+		return max
+	}
+
+	start := instances()
+	for i := 0; i < nkeys; i++ {
+		ck.Put("single-"+strconv.Itoa(i), strconv.Itoa(i))
+	}
+	single := instances() - start
+
+	start = instances()
+	for i := 0; i < nkeys; i += batch {
+		kvs := []KeyValue{}
+		for j := i; j < i+batch; j++ {
+			kvs = append(kvs, KeyValue{"batch-" + strconv.Itoa(j), strconv.Itoa(j)})
+		}
+		if err := ck.PutBatch(kvs); err != OK {
+			t.Fatalf("PutBatch got %v", err)
+		}
+	}
+	batched := instances() - start
+	fmt.Printf("  ... %d instances for single Puts, %d for batches\n", single, batched)
+	if batched > single/batch*2 {
+		t.Fatalf("%d batches took %d instances", nkeys/batch, batched)
+	}
+	for i := 0; i < nkeys; i += 37 {
+		if v := ck.Get("batch-" + strconv.Itoa(i)); v != strconv.Itoa(i) {
+			t.Fatalf("Get(batch-%d) got %v", i, v)
+		}
+	}
+
+	// a batch spanning groups writes nothing.
+	tc.join(1)
+	tc.awaitConfig(0, tc.mck.Query(-1).Num)
+	kvs := []KeyValue{}
+	for shard := 0; shard < shardmaster.NShards; shard++ {
+		kvs = append(kvs, KeyValue{strconv.Itoa(shard) + "-span", "x"})
+	}
+	if err := ck.PutBatch(kvs); err != ErrWrongGroup {
+		t.Fatalf("PutBatch across groups got %v", err)
+	}
+	args := &PutBatchArgs{KVs: kvs, CID: "spanner", Seq: 1}
+	var reply PutBatchReply
+	if ok := call(tc.groups[0].ports[0], "ShardKV.PutBatch", args, &reply); !ok || reply.Err != ErrWrongGroup {
+		t.Fatalf("PutBatch across groups got %v %v", ok, reply.Err)
+	}
+	for _, kv := range kvs {
+		if v := ck.Get(kv.Key); v != "" {
+			t.Fatalf("failed batch wrote %v", kv.Key)
+		}
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestScanGroup(t *testing.T) {
+	tc := setup(t, "scangroup", false)
+	defer tc.cleanup()
+
+	fmt.Printf("Test: Scan of a group's shards ...\n")
+
+	tc.join(0)
+	ck := tc.clerk()
+	keys := []string{}
+	for shard := 0; shard < shardmaster.NShards; shard++ {
+		for i := 0; i < 3; i++ {
+			key := strconv.Itoa(shard) + "-" + strconv.Itoa(i)
+			keys = append(keys, key)
+			ck.Put(key, "v")
+		}
+	}
+
+	// group 0 keeps its copies of the shards that move.
+	tc.join(1)
+	config := tc.mck.Query(-1)
+
+	for gi := 0; gi < 2; gi++ {
+		gid := tc.groups[gi].gid
+		shards := []int{}
+		want := []string{}
+		for shard := 0; shard < shardmaster.NShards; shard++ {
+			if config.Shards[shard] == gid {
+				shards = append(shards, shard)
+			}
+		}
+		for _, key := range keys {
+			if config.Shards[key2shard(key)] == gid {
+				want = append(want, key)
+			}
+		}
+		sort.Strings(want)
+
+		var reply ScanReply
+		args := &ScanArgs{Shard: AllShards, Max: ScanBatchKeys}
+		for i := 0; ; i++ {
+			reply = ScanReply{}
+			ok := call(tc.groups[gi].ports[0], "ShardKV.Scan", args, &reply)
+			if ok && reply.Err == OK && reflect.DeepEqual(reply.Shards, shards) {
+				break
+			}
+			if i == 50 {
+				t.Fatalf("group %d did not reach config %d", gid, config.Num)
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+
+		got := []string{}
+		for _, kv := range reply.KVs {
+			got = append(got, kv.Key)
+		}
+		if reply.More || !reflect.DeepEqual(got, want) {
+			t.Fatalf("group %d scanned %v, wanted %v", gid, got, want)
+		}
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestTTLMillis(t *testing.T) {
+	tc := setup(t, "ttlmillis", false)
+	defer tc.cleanup()
+
+	fmt.Printf("Test: TTL in milliseconds ...\n")
+
+	tc.join(0)
+	ck := tc.clerk()
+
+	// a key in every shard, so some move when group 1 joins
+	keys := []string{}
+	for shard := 0; shard < shardmaster.NShards; shard++ {
+		key := strconv.Itoa(shard) + "-ttl"
+		keys = append(keys, key)
+		ck.PutTTLMillis(key, "v", 500)
+	}
+	ck.Put("stays", "v")
+	if v := ck.Get(keys[0]); v != "v" {
+		t.Fatalf("Get before the TTL got %v", v)
+	}
+
+	time.Sleep(time.Second)
+	if v := ck.Get(keys[0]); v != "" {
+		t.Fatalf("Get after the TTL got %v", v)
+	}
+	for si, s := range tc.groups[0].servers {
+		s.mu.Lock()
+		s.learn()
+		_, ok := s.xstate.KVStore[keys[0]]
+		s.mu.Unlock()
+		if ok {
+			t.Fatalf("server %d still holds the expired key", si)
+		}
+	}
+
+	// the other expired keys don't move.
+	tc.join(1)
+	config := tc.mck.Query(-1)
+	tc.awaitConfig(1, config.Num)
+	moved := 0
+	for _, key := range keys {
+		if config.Shards[key2shard(key)] != tc.groups[1].gid {
+			continue
+		}
+		moved++
+		for _, s := range tc.groups[1].servers {
+			s.mu.Lock()
+			s.learn()
+			_, ok := s.xstate.KVStore[key]
+			s.mu.Unlock()
+			if ok {
+				t.Fatalf("expired key %v moved to group 1", key)
+			}
+		}
+		if v := ck.Get(key); v != "" {
+			t.Fatalf("Get(%v) after the TTL got %v", key, v)
+		}
+	}
+	if moved == 0 {
+		t.Fatalf("no keys moved")
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestSnapshotRestart(t *testing.T) {
+	tc := setupWithOptions(t, "snapshot", false, &Options{SnapshotInterval: 50 * time.Millisecond})
+	defer func() {
+		tc.cleanup()
+		// let snapshots being written finish
+		time.Sleep(100 * time.Millisecond)
+		for _, g := range tc.groups {
+			for _, port := range g.ports {
+				os.Remove(snapshotFile(port))
+			}
+		}
+	}()
+
+	fmt.Printf("Test: Restart from a snapshot ...\n")
+
+	tc.join(0)
+	ck := tc.clerk()
+	keys := make([]string, 20)
+	for i := 0; i < len(keys); i++ {
+		keys[i] = strconv.Itoa(rand.Int())
+		ck.Put(keys[i], strconv.Itoa(i))
+	}
+
+	// let every server apply the Puts and snapshot them
+	for _, s := range tc.groups[0].servers {
+		s.mu.Lock()
+		s.learn()
+		s.mu.Unlock()
+	}
+	time.Sleep(200 * time.Millisecond)
+
+	tc.kill1(0, 2)
+	tc.start1(0, 2, false)
+	s := tc.groups[0].servers[2]
+	s.mu.Lock()
+	for i, key := range keys {
+		if v := s.xstate.KVStore[key]; v != strconv.Itoa(i) {
+			s.mu.Unlock()
+			t.Fatalf("restarted server has %v=%v, wanted %v", key, v, i)
+		}
+	}
+	s.mu.Unlock()
+
+	// it catches up from its snapshot and serves on.
+	tc.kill1(0, 0)
+	for i := 0; i < len(keys); i++ {
+		ck.Append(keys[i], "x")
+	}
+	for i := 0; i < len(keys); i++ {
+		if v := ck.Get(keys[i]); v != strconv.Itoa(i)+"x" {
+			t.Fatalf("Get(%v) got %v", keys[i], v)
+		}
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestSnapshotFromPeer(t *testing.T) {
+	tc := setup(t, "frompeer", false)
+	defer tc.cleanup()
+
+	fmt.Printf("Test: Lagging replica installs a peer's snapshot ...\n")
+
+	tc.join(0)
+	ck := tc.clerk()
+	keys := make([]string, 10)
+	for i := 0; i < len(keys); i++ {
+		keys[i] = strconv.Itoa(rand.Int())
+		ck.Put(keys[i], strconv.Itoa(i))
+	}
+
+	// writes through server 2 tell the others how far it
+	// got, so they can forget the log before that.
+	for i := 0; i < 3; i++ {
+		args := &PutAppendArgs{Key: keys[i], Value: "x", Op: Append, CID: "via2", Seq: i + 1}
+		var reply PutAppendReply
+		if ok := call(tc.groups[0].ports[2], "ShardKV.PutAppend", args, &reply); !ok || reply.Err != OK {
+			t.Fatalf("Append got %v %v", ok, reply.Err)
+		}
+	}
+
+	// restart it without its state.
+	tc.kill1(0, 2)
+	for i := 0; i < len(keys); i++ {
+		ck.Append(keys[i], "y")
+	}
+	tc.start1(0, 2, false)
+	s := tc.groups[0].servers[2]
+
+	for i := 0; i < len(keys); i++ {
+		want := strconv.Itoa(i) + "y"
+		if i < 3 {
+			want = strconv.Itoa(i) + "xy"
+		}
+		args := &GetArgs{Key: keys[i], CID: "reader", Seq: i + 1}
+		var reply GetReply
+		if ok := call(tc.groups[0].ports[2], "ShardKV.Get", args, &reply); !ok || reply.Value != want {
+			t.Fatalf("restarted server read %v=%v %v, wanted %v", keys[i], reply.Value, ok, want)
+		}
+	}
+	if n := s.Stats().Installed; n != 1 {
+		t.Fatalf("restarted server installed %d snapshots", n)
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestBootstrapReplica(t *testing.T) {
+	tc := setup(t, "bootstrap", false)
+	defer tc.cleanup()
+
+	fmt.Printf("Test: New replica bootstraps from a peer's snapshot ...\n")
+
+	tc.join(0)
+	tc.kill1(0, 2)
+
+	// the other two keep taking writes while it joins.
+	keys := []string{"a", "b", "c"}
+	done := int32(0)
+	counts := make([]int, len(keys))
+	ch := make(chan bool)
+	go func() {
+		ck := tc.clerk()
+		for i := 0; atomic.LoadInt32(&done) == 0; i++ {
+			ck.Append(keys[i%len(keys)], "x")
+			counts[i%len(keys)]++
+		}
+		ch <- true
+	}()
+	time.Sleep(500 * time.Millisecond)
+
+	tc.opts = &Options{Bootstrap: tc.groups[0].ports[0]}
+	tc.start1(0, 2, false)
+	s := tc.groups[0].servers[2]
+	if n := s.Stats().Installed; n != 1 {
+		t.Fatalf("new server installed %d snapshots", n)
+	}
+	time.Sleep(500 * time.Millisecond)
+	atomic.StoreInt32(&done, 1)
+	<-ch
+
+	for i := 0; i < len(keys); i++ {
+		want := strings.Repeat("x", counts[i])
+		args := &GetArgs{Key: keys[i], CID: "reader", Seq: i + 1}
+		var reply GetReply
+		if ok := call(tc.groups[0].ports[2], "ShardKV.Get", args, &reply); !ok || reply.Value != want {
+			t.Fatalf("new server read %v=%v %v %v, wanted %v", keys[i], reply.Value, ok, reply.Err, want)
+		}
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestForgottenBelowCursor(t *testing.T) {
+	tc := setup(t, "forgotten", false)
+	defer tc.cleanup()
+
+	fmt.Printf("Test: Replica whose unapplied ops are forgotten recovers ...\n")
+
+	tc.join(0)
+	ck := tc.clerk()
+	ck.Put("a", "1")
+	for _, s := range tc.groups[0].servers {
+		s.ShardDigest(0) // catch up
+	}
+
+	// server 2 stops applying, then hears of decisions it
+	// hasn't applied, which its paxos peer lets go of.
+	s := tc.groups[0].servers[2]
+	s.mu.Lock()
+	for i := 0; i < 10; i++ {
+		args := &PutAppendArgs{Key: "a", Value: "x", Op: Append, CID: "writer", Seq: i + 1}
+		var reply PutAppendReply
+		if ok := call(tc.groups[0].ports[i%2], "ShardKV.PutAppend", args, &reply); !ok || reply.Err != OK {
+			s.mu.Unlock()
+			t.Fatalf("Append got %v %v", ok, reply.Err)
+		}
+	}
+	s.px.Done(s.px.Max())
+	for iters := 0; s.px.Min() <= s.last_seq && iters < 50; iters++ {
+		ck.Append("b", "y") // the Decideds tell of the others' Done()
+	}
+	if s.px.Min() <= s.last_seq {
+		s.mu.Unlock()
+		t.Fatalf("nothing forgotten past server 2's applied ops")
+	}
+	s.seq = s.px.Min()
+	s.mu.Unlock()
+
+	args := &GetArgs{Key: "a", CID: "reader", Seq: 1}
+	var reply GetReply
+	if ok := call(tc.groups[0].ports[2], "ShardKV.Get", args, &reply); !ok || reply.Value != "1xxxxxxxxxx" {
+		t.Fatalf("lagging server read a=%v %v %v", reply.Value, ok, reply.Err)
+	}
+	if n := s.Stats().Installed; n != 1 {
+		t.Fatalf("lagging server installed %d snapshots", n)
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestForgetClients(t *testing.T) {
+	const max = 100
+	tc := setupWithOptions(t, "forget", false, &Options{MaxClients: max})
+	defer tc.cleanup()
+
+	fmt.Printf("Test: Groups forget idle clients ...\n")
+
+	tc.join(0)
+	ck := tc.clerk()
+	ck.Put("a", "")
+
+	// 2000 clients make one request each, while one client
+	// keeps retrying each of its appends.
+	const rounds = 40
+	for r := 1; r <= rounds; r++ {
+		var wg sync.WaitGroup
+		for i := 0; i < 50; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				args := &PutAppendArgs{Key: "b", Value: "x", Op: Put, CID: fmt.Sprintf("c%d-%d", r, i), Seq: 1}
+				var reply PutAppendReply
+				call(tc.groups[0].ports[i % 3], "ShardKV.PutAppend", args, &reply)
+			}(i)
+		}
+		wg.Wait()
+
+		for try := 0; try < 2; try++ {
+			args := &PutAppendArgs{Key: "a", Value: "x", Op: Append, CID: "active", Seq: r}
+			var reply PutAppendReply
+			if ok := call(tc.groups[0].ports[try], "ShardKV.PutAppend", args, &reply); !ok || reply.Err != OK {
+				t.Fatalf("Append got %v %v", ok, reply.Err)
+			}
+		}
+	}
+
+	if v := ck.Get("a"); v != strings.Repeat("x", rounds) {
+		t.Fatalf("retried appends applied again: got %v", v)
+	}
+	for _, s := range tc.groups[0].servers {
+		if n := s.Stats().Clients; n > max {
+			t.Fatalf("server remembers %d clients, more than %d", n, max)
+		}
+	}
+
+	// a clerk that is done is forgotten by every replica.
+	ck.Done()
+	for si, s := range tc.groups[0].servers {
+		args := &GetArgs{Key: "a", CID: "reader", Seq: si + 1}
+		var reply GetReply
+		call(tc.groups[0].ports[si], "ShardKV.Get", args, &reply)
+		s.mu.Lock()
+		_, ok := s.xstate.MRRSMap[ck.me]
+		s.mu.Unlock()
+		if ok {
+			t.Fatalf("server %d still remembers a clerk that is done", si)
+		}
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+//
+// listen on from, and pass each connection on to the server
+// listening on to after delay.
+//
+func slowProxy(t *testing.T, from string, to string, delay time.Duration) net.Listener {
+	os.Remove(from)
+	l, err := net.Listen("unix", from)
+	if err != nil {
+		t.Fatalf("listen %v: %v", from, err)
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				time.Sleep(delay)
+				d, err := net.Dial("unix", to)
+				if err != nil {
+					return
+				}
+				go func() {
+					io.Copy(d, c)
+					d.Close()
+				}()
+				io.Copy(c, d)
+			}()
+		}
+	}()
+	return l
+}
+
+func TestParallelFetch(t *testing.T) {
+	const ngroups = 10
+	tc := setupGroups(t, "parfetch", false, ngroups, nil)
+	defer tc.cleanup()
+
+	fmt.Printf("Test: Shards are fetched in parallel ...\n")
+
+	// every connection to group 0 takes delay to set up.
+	const delay = 400 * time.Millisecond
+	proxies := make([]string, len(tc.groups[0].ports))
+	for i, p := range tc.groups[0].ports {
+		proxies[i] = port("parfetchp", i)
+		l := slowProxy(t, proxies[i], p, delay)
+		defer os.Remove(proxies[i])
+		defer l.Close()
+	}
+	tc.mck.Join(tc.groups[0].gid, proxies)
+
+	ck := tc.clerk()
+	for i := 0; i < shardmaster.NShards; i++ {
+		ck.Put(strconv.Itoa(i), strconv.Itoa(i))
+	}
+
+	// group 1 takes half the shards from group 0; one at a
+	// time, that would take 5 * delay.
+	start := time.Now()
+	tc.join(1)
+	for {
+		num := 0
+		for _, s := range tc.groups[1].servers {
+			s.mu.Lock()
+			if s.config.Num > num {
+				num = s.config.Num
+			}
+			s.mu.Unlock()
+		}
+		if num >= 2 {
+			break
+		}
+		if time.Since(start) > 10 * time.Second {
+			t.Fatalf("group 1 never moved to config 2")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if d := time.Since(start); d > 3 * delay {
+		t.Fatalf("moving to config 2 took %v", d)
+	}
+
+	for gi := 2; gi < ngroups; gi++ {
+		tc.join(gi)
+	}
+	for i := 0; i < shardmaster.NShards; i++ {
+		if v := ck.Get(strconv.Itoa(i)); v != strconv.Itoa(i) {
+			t.Fatalf("Get(%v) got %v", i, v)
+		}
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestSwapShards(t *testing.T) {
+	tc := setup(t, "swap", true)
+	defer tc.cleanup()
+
+	fmt.Printf("Test: Groups swapping shards don't wedge (unreliable) ...\n")
+
+	tc.join(0)
+	tc.join(1)
+	config := tc.mck.Query(-1)
+	a, b := -1, -1
+	for shard, gid := range config.Shards {
+		if gid == tc.groups[0].gid && a < 0 {
+			a = shard
+		}
+		if gid == tc.groups[1].gid && b < 0 {
+			b = shard
+		}
+	}
+	// key2shard("0") is 8
+	ka, kb := strconv.Itoa((a + 2) % 10), strconv.Itoa((b + 2) % 10)
+
+	ck := tc.clerk()
+	ck.Put(ka, "")
+	ck.Put(kb, "")
+
+	var done int32
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ck := tc.clerk()
+		for atomic.LoadInt32(&done) == 0 {
+			ck.Append(ka, "x")
+			ck.Append(kb, "y")
+		}
+	}()
+
+	// each round, both groups move to the config that gives
+	// away their shard, then straight on to the one that gives
+	// them the other's.
+	for round := 0; round < 5; round++ {
+		ga, gb := tc.groups[round % 2].gid, tc.groups[(round + 1) % 2].gid
+		tc.mck.Move(a, gb)
+		tc.mck.Move(b, ga)
+		num := tc.mck.Query(-1).Num
+		for gi := 0; gi < 2; gi++ {
+			for _, s := range tc.groups[gi].servers {
+				for i := 0; ; i++ {
+					s.mu.Lock()
+					xnum := s.config.Num
+					s.mu.Unlock()
+					if xnum >= num {
+						break
+					}
+					if i == 200 {
+						t.Fatalf("server of group %d stuck at config %d", gi, xnum)
+					}
+					time.Sleep(100 * time.Millisecond)
+				}
+			}
+		}
+	}
+
+	atomic.StoreInt32(&done, 1)
+	wg.Wait()
+	va, vb := ck.Get(ka), ck.Get(kb)
+	if len(va) == 0 || va != strings.Repeat("x", len(va)) || len(vb) != len(va) ||
+		vb != strings.Repeat("y", len(vb)) {
+		t.Fatalf("got %v=%v %v=%v", ka, va, kb, vb)
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestLeaseReads(t *testing.T) {
+	fmt.Printf("Test: Gets under a read lease ...\n")
+
+	// average Get latency over 50 Gets
+	latency := func(tc *tCluster) time.Duration {
+		ck := tc.clerk()
+		ck.Put("a", "x")
+		start := time.Now()
+		for i := 0; i < 50; i++ {
+			if v := ck.Get("a"); v != "x" {
+				t.Fatalf("Get got %v, wanted x", v)
+			}
+		}
+		return time.Since(start) / 50
+	}
+
+	tc := setup(t, "nolease", false)
+	tc.join(0)
+	logged := latency(tc)
+	tc.cleanup()
+
+	tc = setupWithOptions(t, "lease", false, &Options{LeaseDuration: time.Second})
+	defer tc.cleanup()
+	tc.join(0)
+	time.Sleep(500 * time.Millisecond) // for the lease to be taken
+	leased := latency(tc)
+	reads := 0
+	for _, s := range tc.groups[0].servers {
+		reads += s.Stats().LeaseReads
+	}
+	if reads < 50 || leased > logged / 2 {
+		t.Fatalf("%d lease reads; Get took %v with a lease, %v without", reads, leased, logged)
+	}
+
+	// reads see every write before them, while shards move.
+	var done int32
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; atomic.LoadInt32(&done) == 0; i++ {
+			tc.join(1 + i % 2)
+			time.Sleep(time.Second)
+			tc.leave(1 + i % 2)
+			time.Sleep(time.Second)
+		}
+	}()
+	writer, reader := tc.clerk(), tc.clerk()
+	start := time.Now()
+	for i := 0; time.Since(start) < 5 * time.Second; i++ {
+		key := strconv.Itoa(i % 10)
+		writer.Put(key, strconv.Itoa(i))
+		if v := reader.Get(key); v != strconv.Itoa(i) {
+			t.Fatalf("Get(%v) got %v, wanted %v", key, v, i)
+		}
+	}
+	atomic.StoreInt32(&done, 1)
+	wg.Wait()
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestMetrics(t *testing.T) {
+	tc := setup(t, "metrics", false)
+	defer tc.cleanup()
+
+	fmt.Printf("Test: Metrics count ops ...\n")
+
+	tc.join(0)
+	tc.awaitConfig(0, 1)
+	ck := tc.clerk()
+	ck.Put("a", "x")
+	ck.Put("b", "y")
+	ck.Append("a", "1")
+	ck.Append("a", "2")
+	ck.Append("b", "3")
+	for i := 0; i < 4; i++ {
+		ck.Get("a")
+	}
+
+	// a group not in the config serves no shards.
+	args := &GetArgs{Key: "a", CID: "stray", Seq: 1}
+	var reply GetReply
+	if ok := call(tc.groups[1].ports[0], "ShardKV.Get", args, &reply); !ok || reply.Err != ErrWrongGroup {
+		t.Fatalf("Get from group 1 got %v %v", ok, reply.Err)
+	}
+	if n := tc.groups[1].servers[0].Metrics().WrongGroup; n != 1 {
+		t.Fatalf("group 1 counted %d ErrWrongGroup replies", n)
+	}
+
+	want := Metrics{Gets: 4, Puts: 2, Appends: 3, Reconfigs: 1, ConfigNum: 1,
+		OwnedShards: shardmaster.NShards}
+	for si, s := range tc.groups[0].servers {
+		s.ShardDigest(0) // catch up
+		if m := s.Metrics(); m != want {
+			t.Fatalf("server %d metrics %+v, wanted %+v", si, m, want)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	tc.groups[0].servers[0].MetricsHandler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if line := "shardkv_appends_total{gid=\"100\",server=\"0\"} 3\n"; !strings.Contains(w.Body.String(), line) {
+		t.Fatalf("scraped metrics lack %q:\n%s", line, w.Body.String())
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+// a Logger keeping the events it gets
+type captureLogger struct {
+	mu     sync.Mutex
+	events []captured
+}
+
+type captured struct {
+	level  Level
+	msg    string
+	fields map[string]interface{}
+}
+
+func (cl *captureLogger) Log(level Level, msg string, fields []Field) {
+	ev := captured{level, msg, map[string]interface{}{}}
+	for _, f := range fields {
+		ev.fields[f.Key] = f.Value
+	}
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	cl.events = append(cl.events, ev)
+}
+
+// the events logged at level with msg by group gid
+func (cl *captureLogger) find(level Level, msg string, gid int64) []captured {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	found := []captured{}
+	for _, ev := range cl.events {
+		if ev.level == level && ev.msg == msg && ev.fields["gid"] == gid {
+			found = append(found, ev)
+		}
+	}
+	return found
+}
+
+func TestLogger(t *testing.T) {
+	cl := &captureLogger{}
+	tc := setupWithOptions(t, "logger", false, &Options{Logger: cl})
+	defer tc.cleanup()
+
+	fmt.Printf("Test: Logger gets reconfigurations ...\n")
+
+	tc.join(0)
+	tc.awaitConfig(0, 1)
+	ck := tc.clerk()
+	ck.Put("a", "x")
+
+	evs := cl.find(LevelInfo, "reconfigured", tc.groups[0].gid)
+	if len(evs) == 0 {
+		t.Fatalf("no reconfiguration logged")
+	}
+	for _, ev := range evs {
+		if ev.fields["config"] != 1 {
+			t.Fatalf("reconfiguration logged with config %v, wanted 1", ev.fields["config"])
+		}
+		if gained := ev.fields["gained"].([]int); len(gained) != shardmaster.NShards {
+			t.Fatalf("reconfiguration logged gaining shards %v", gained)
+		}
+	}
+
+	// a group not in the config serves no shards.
+	args := &GetArgs{Key: "a", CID: "stray", Seq: 1}
+	var reply GetReply
+	if ok := call(tc.groups[1].ports[0], "ShardKV.Get", args, &reply); !ok || reply.Err != ErrWrongGroup {
+		t.Fatalf("Get from group 1 got %v %v", ok, reply.Err)
+	}
+	evs = cl.find(LevelInfo, "wrong group", tc.groups[1].gid)
+	if len(evs) == 0 {
+		t.Fatalf("no ErrWrongGroup logged")
+	}
+	for _, ev := range evs {
+		if ev.fields["key"] != "a" || ev.fields["shard"] != key2shard("a") || ev.fields["owner"] != tc.groups[0].gid {
+			t.Fatalf("ErrWrongGroup logged as %v", ev)
+		}
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestContextTimeout(t *testing.T) {
+	tc := setup(t, "ctxtimeout", false)
+	defer tc.cleanup()
+
+	fmt.Printf("Test: Get and Put give up once their context is done ...\n")
+
+	tc.join(0)
+	tc.awaitConfig(0, 1)
+	ck := tc.clerk()
+	ck.Put("a", "x")
+
+	// server 0 can no longer reach a majority of its group.
+	tc.kill1(0, 1)
+	tc.kill1(0, 2)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500 * time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := ck.GetCtx(ctx, "a"); err != ErrTimeout {
+		t.Fatalf("Get past its deadline got %v", err)
+	}
+	if d := time.Since(start); d > 2 * time.Second {
+		t.Fatalf("Get past its deadline took %v", d)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 500 * time.Millisecond)
+	defer cancel()
+	start = time.Now()
+	if err := ck.PutAppendCtx(ctx, "b", "y", "Put"); err != ErrTimeout {
+		t.Fatalf("Put past its deadline got %v", err)
+	}
+	if d := time.Since(start); d > 2 * time.Second {
+		t.Fatalf("Put past its deadline took %v", d)
+	}
+
+	// the server gives up by itself, too.
+	args := &GetArgs{Key: "a", CID: "direct", Seq: 1, Timeout: 300 * time.Millisecond}
+	var reply GetReply
+	if ok := call(tc.groups[0].ports[0], "ShardKV.Get", args, &reply); !ok || reply.Err != ErrTimeout {
+		t.Fatalf("Get with a Timeout got %v %v", ok, reply.Err)
+	}
+
+	// no deadline: the server keeps waiting, but the clerk
+	// gives up when told to.
+	ctx, cancel = context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(300 * time.Millisecond)
+		cancel()
+	}()
+	start = time.Now()
+	if _, err := ck.GetCtx(ctx, "a"); err != ErrTimeout {
+		t.Fatalf("canceled Get got %v", err)
+	}
+	if d := time.Since(start); d > 2 * time.Second {
+		t.Fatalf("canceled Get took %v", d)
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestLeaveLastOwner(t *testing.T) {
+	tc := setup(t, "lastowner", false)
+	defer tc.cleanup()
+
+	fmt.Printf("Test: Keys of a group that leaves stay served ...\n")
+
+	tc.join(0)
+	tc.join(1)
+	mck := tc.shardclerk()
+	for shard := 0; shard < shardmaster.NShards; shard++ {
+		mck.Move(shard, tc.groups[0].gid)
+	}
+	// group 1 alone serves key "a"
+	mck.Move(key2shard("a"), tc.groups[1].gid)
+	num := mck.Query(-1).Num
+	tc.awaitConfig(1, num)
+
+	ck := tc.clerk()
+	ck.Put("a", "x")
+	ck.Put("b", "y")
+
+	tc.leave(1)
+	c := mck.Query(-1)
+	for shard, gid := range c.Shards {
+		if gid != tc.groups[0].gid {
+			t.Fatalf("shard %d assigned to %d after group 1 left", shard, gid)
+		}
+	}
+	tc.awaitConfig(0, c.Num)
+
+	// group 1 handed its shard over, so it can go.
+	for si := range tc.groups[1].servers {
+		tc.kill1(1, si)
+	}
+	for key, want := range map[string]string{"a": "x", "b": "y"} {
+		ctx, cancel := context.WithTimeout(context.Background(), 10 * time.Second)
+		v, err := ck.GetCtx(ctx, key)
+		cancel()
+		if err != OK || v != want {
+			t.Fatalf("Get(%s) got %v %v, wanted %v", key, v, err, want)
+		}
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestChunkedTransfer(t *testing.T) {
+	tc := setupWithOptions(t, "chunked", false, &Options{TransferChunk: 5000})
+	defer tc.cleanup()
+
+	fmt.Printf("Test: A large shard moves in chunks ...\n")
+
+	tc.join(0)
+	tc.awaitConfig(0, 1)
+	ck := tc.clerk()
+
+	const nkeys = 100000
+	shard := key2shard("a")
+	for i := 0; i < nkeys; i += 1000 {
+		kvs := []KeyValue{}
+		for j := i; j < i + 1000; j++ {
+			kvs = append(kvs, KeyValue{"a" + strconv.Itoa(j), strconv.Itoa(j)})
+		}
+		if err := ck.PutBatch(kvs); err != OK {
+			t.Fatalf("PutBatch got %v", err)
+		}
+	}
+	want, _ := tc.groups[0].servers[0].ShardDigest(shard)
+
+	tc.join(1)
+	mck := tc.shardclerk()
+	mck.Move(shard, tc.groups[1].gid)
+	num := mck.Query(-1).Num
+	for _, s := range tc.groups[1].servers {
+		for i := 0; ; i++ {
+			if digest, xnum := s.ShardDigest(shard); xnum >= num {
+				if digest != want {
+					t.Fatalf("shard arrived with digest %v, wanted %v", digest, want)
+				}
+				break
+			}
+			if i == 300 {
+				t.Fatalf("shard never arrived")
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+	for _, i := range []int{0, nkeys / 2, nkeys - 1} {
+		if v := ck.Get("a" + strconv.Itoa(i)); v != strconv.Itoa(i) {
+			t.Fatalf("Get(a%d) got %v", i, v)
+		}
+	}
+
+	// a chunk holds at most Max keys.
+	args := &TransferChunkArgs{ConfigNum: num - 1, Shard: shard, Max: 1000}
+	var reply TransferChunkReply
+	if ok := call(tc.groups[1].ports[0], "ShardKV.TransferStateChunk", args, &reply); !ok || reply.Err != OK {
+		t.Fatalf("TransferStateChunk got %v %v", ok, reply.Err)
+	}
+	if len(reply.XState.KVStore) != 1000 || reply.Done || reply.Next != 1000 {
+		t.Fatalf("first chunk has %d keys, done %v, next %d", len(reply.XState.KVStore), reply.Done, reply.Next)
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestShardScopedDedup(t *testing.T) {
+	tc := setup(t, "scopeddedup", false)
+	defer tc.cleanup()
+
+	fmt.Printf("Test: Client states move with the shards they used ...\n")
+
+	tc.join(0)
+	tc.join(1)
+	mck := tc.shardclerk()
+	for shard := 0; shard < shardmaster.NShards; shard++ {
+		mck.Move(shard, tc.groups[0].gid)
+	}
+	tc.awaitConfig(0, mck.Query(-1).Num)
+
+	g0 := tc.groups[0]
+	send1 := func(port string, args *PutAppendArgs) {
+		var reply PutAppendReply
+		if ok := call(port, "ShardKV.PutAppend", args, &reply); !ok || reply.Err != OK {
+			t.Fatalf("%v %v got %v %v", args.Op, args.Key, ok, reply.Err)
+		}
+	}
+	// "hopper" appends to "a", then moves on to "b"'s shard;
+	// "other" only ever writes "b".
+	first := &PutAppendArgs{Key: "a", Value: "x", Op: Append, CID: "hopper", Seq: 1}
+	send1(g0.ports[0], first)
+	send1(g0.ports[0], &PutAppendArgs{Key: "b", Value: "y", Op: Put, CID: "hopper", Seq: 2})
+	send1(g0.ports[0], &PutAppendArgs{Key: "b", Value: "z", Op: Put, CID: "other", Seq: 1})
+
+	hop := func(gi int) {
+		mck.Move(key2shard("a"), tc.groups[gi].gid)
+		num := mck.Query(-1).Num
+		tc.awaitConfig(0, num)
+		tc.awaitConfig(1, num)
+	}
+	check := func(want string) {
+		ck := tc.clerk()
+		if v := ck.Get("a"); v != want {
+			t.Fatalf("Get(a) got %v, wanted %v", v, want)
+		}
+	}
+
+	hop(1)
+	g1 := tc.groups[1]
+	for si, s := range g1.servers {
+		s.mu.Lock()
+		_, other := s.xstate.MRRSMap["other"]
+		seq := s.xstate.MRRSMap["hopper"]
+		s.mu.Unlock()
+		if other {
+			t.Fatalf("server %d took the state of a client of another shard", si)
+		}
+		if seq != 1 {
+			t.Fatalf("server %d has hopper at seq %d, wanted 1", si, seq)
+		}
+	}
+
+	// a stale copy of hopper's first Append is filtered by the
+	// group now serving "a", and by the old one once it's back.
+	call(g1.ports[1], "ShardKV.PutAppend", first, &PutAppendReply{})
+	check("x")
+	hop(0)
+	call(g0.ports[2], "ShardKV.PutAppend", first, &PutAppendReply{})
+	check("x")
+
+	// a retry of the most recent op carries its reply along.
+	last := &PutAppendArgs{Key: "a", Value: "w", Op: Append, CID: "hopper", Seq: 3}
+	send1(g0.ports[0], last)
+	hop(1)
+	send1(g1.ports[0], last)
+	check("xw")
+
+	fmt.Printf("  ... Passed\n")
+}
+
+// a stand-in for a server, garbling the shard states it passes on
+type tGarbler struct {
+	to   string
+	sent int32
+}
+
+func (g *tGarbler) TransferStateChunk(args *TransferChunkArgs, reply *TransferChunkReply) error {
+	if !call(g.to, "ShardKV.TransferStateChunk", args, reply) {
+		return errors.New("unreachable")
+	}
+	for key, version := range reply.XState.Versions {
+		reply.XState.Versions[key] = version + 1
+	}
+	atomic.AddInt32(&g.sent, 1)
+	return nil
+}
+
+func TestTransferChecksum(t *testing.T) {
+	cl := &captureLogger{}
+	tc := setupWithOptions(t, "checksum", false, &Options{Logger: cl})
+	defer tc.cleanup()
+
+	fmt.Printf("Test: A garbled shard transfer is refused ...\n")
+
+	// group 0 is listed with the garbler ahead of its servers.
+	g0, g1 := tc.groups[0], tc.groups[1]
+	garbler := &tGarbler{to: g0.ports[0]}
+	rs := rpc.NewServer()
+	rs.RegisterName("ShardKV", garbler)
+	gport := port("checksum-garbler", 0)
+	os.Remove(gport)
+	l, err := net.Listen("unix", gport)
+	if err != nil {
+		t.Fatalf("listen %v: %v", gport, err)
+	}
+	defer l.Close()
+	go rs.Accept(l)
+
+	tc.mck.Join(g0.gid, append([]string{gport}, g0.ports...))
+	tc.awaitConfig(0, 1)
+	ck := tc.clerk()
+	ck.Put("a", "x")
+	ck.Put("a", "y")
+
+	tc.join(1)
+	mck := tc.shardclerk()
+	mck.Move(key2shard("a"), g1.gid)
+	num := mck.Query(-1).Num
+	tc.awaitConfig(1, num)
+
+	if atomic.LoadInt32(&garbler.sent) == 0 {
+		t.Fatalf("the garbler was never asked for the shard")
+	}
+	if len(cl.find(LevelError, "transfer checksum mismatch", g1.gid)) == 0 {
+		t.Fatalf("no checksum mismatch reported")
+	}
+	for si, s := range g1.servers {
+		s.mu.Lock()
+		version := s.xstate.Versions["a"]
+		s.mu.Unlock()
+		if version != 2 {
+			t.Fatalf("server %d took version %d of a, wanted 2", si, version)
+		}
+	}
+	if v := ck.Get("a"); v != "y" {
+		t.Fatalf("Get(a) got %v, wanted y", v)
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestTransferChecksumBuffers(t *testing.T) {
+	fmt.Printf("Test: Transfer checksums don't see earlier states ...\n")
+
+	// a checksum taken after a bigger state's, in a buffer
+	// reused from it, must be what it was the first time
+	var small, big XState
+	small.Init()
+	small.KVStore["a"] = "x"
+	big.Init()
+	for i := 0; i < 1000; i++ {
+		big.KVStore[strconv.Itoa(i)] = strings.Repeat("y", 100)
+	}
+	sum := transferChecksum(&small)
+	for i := 0; i < 10; i++ {
+		if transferChecksum(&big) == sum {
+			t.Fatalf("different states with one checksum")
+		}
+		if s := transferChecksum(&small); s != sum {
+			t.Fatalf("checksum %x after a bigger state, wanted %x", s, sum)
+		}
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestProposeTimeout(t *testing.T) {
+	opts := &Options{ProposeBackoff: 5 * time.Millisecond,
+		ProposeMaxBackoff: 50 * time.Millisecond, ProposeTimeout: 300 * time.Millisecond}
+	tc := setupWithOptions(t, "proposetimeout", false, opts)
+	defer tc.cleanup()
+
+	fmt.Printf("Test: Servers give up on ops paxos doesn't decide ...\n")
+
+	tc.join(0)
+	tc.awaitConfig(0, 1)
+	ck := tc.clerk()
+	ck.Put("a", "x")
+
+	// server 0 can no longer reach a majority of its group.
+	tc.kill1(0, 1)
+	tc.kill1(0, 2)
+	srv := tc.groups[0].ports[0]
+
+	timed := func(what string, rpcname string, args interface{}, reply interface{}, err func() Err) {
+		start := time.Now()
+		if ok := call(srv, rpcname, args, reply); !ok || err() != ErrTimeout {
+			t.Fatalf("%s got %v %v", what, ok, err())
+		}
+		if d := time.Since(start); d > 2 * time.Second {
+			t.Fatalf("%s took %v", what, d)
+		}
+	}
+	var get GetReply
+	timed("Get", "ShardKV.Get", &GetArgs{Key: "a", CID: "direct", Seq: 1},
+		&get, func() Err { return get.Err })
+	var put PutAppendReply
+	timed("Put", "ShardKV.PutAppend", &PutAppendArgs{Key: "a", Value: "y", Op: Put, CID: "direct", Seq: 2},
+		&put, func() Err { return put.Err })
+	var confirmed GetReply
+	timed("confirmed Get", "ShardKV.Get", &GetArgs{Key: "a", CID: "direct", Seq: 3, Consistency: ReadConfirm},
+		&confirmed, func() Err { return confirmed.Err })
+	shard := key2shard("a")
+	var clear ClearShardReply
+	timed("ClearShard", "ShardKV.ClearShard",
+		&ClearShardArgs{Shard: shard, CID: "direct", Seq: 4},
+		&clear, func() Err { return clear.Err })
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestPokeReconfigure(t *testing.T) {
+	tc := setupWithOptions(t, "poke", false, &Options{TickInterval: 20 * time.Second})
+	defer tc.cleanup()
+
+	fmt.Printf("Test: A poked server moves to a new config at once ...\n")
+
+	poke := func() {
+		num := tc.mck.Query(-1).Num
+		for _, g := range tc.groups {
+			for _, s := range g.servers {
+				s.PokeReconfigure()
+				s.PokeReconfigure() // coalesced with the first
+			}
+		}
+		for gi := range tc.groups {
+			tc.awaitConfig(gi, num)
+		}
+	}
+
+	tc.join(0)
+	poke()
+	ck := tc.clerk()
+	ck.Put("a", "x")
+
+	tc.join(1)
+	poke()
+	shard := key2shard("a")
+	to := tc.groups[0].gid
+	if tc.mck.Query(-1).Shards[shard] == to {
+		to = tc.groups[1].gid
+	}
+	tc.mck.Move(shard, to)
+	start := time.Now()
+	poke()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5 * time.Second)
+	defer cancel()
+	if v, err := ck.GetCtx(ctx, "a"); err != OK || v != "x" {
+		t.Fatalf("Get(a) got %v %v, wanted x", v, err)
+	}
+	if d := time.Since(start); d > 5 * time.Second {
+		t.Fatalf("moving a shard took %v", d)
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestReplyConfigNum(t *testing.T) {
+	tc := setup(t, "replyconfig", false)
+	defer tc.cleanup()
+
+	fmt.Printf("Test: Replies carry the server's config ...\n")
+
+	tc.join(0)
+	tc.awaitConfig(0, 1)
+	ck := tc.clerk()
+	ck.Put("a", "x")
+
+	g0, g1 := tc.groups[0], tc.groups[1]
+	var get GetReply
+	if ok := call(g0.ports[0], "ShardKV.Get", &GetArgs{Key: "a", CID: "direct", Seq: 1}, &get); !ok || get.ConfigNum != 1 {
+		t.Fatalf("Get got %v from config %d, wanted 1", get.Err, get.ConfigNum)
+	}
+
+	tc.join(1)
+	mck := tc.shardclerk()
+	mck.Move(key2shard("a"), g1.gid)
+	num := mck.Query(-1).Num
+	tc.awaitConfig(0, num)
+	tc.awaitConfig(1, num)
+
+	// the old owner says it moved on, the new one serves.
+	get = GetReply{}
+	if ok := call(g0.ports[1], "ShardKV.Get", &GetArgs{Key: "a", CID: "direct", Seq: 2}, &get); !ok ||
+		get.Err != ErrWrongGroup || get.ConfigNum != num {
+		t.Fatalf("old owner's Get got %v from config %d, wanted %v from %d", get.Err, get.ConfigNum, ErrWrongGroup, num)
+	}
+	var put PutAppendReply
+	args := &PutAppendArgs{Key: "a", Value: "y", Op: Put, CID: "direct", Seq: 3}
+	if ok := call(g1.ports[0], "ShardKV.PutAppend", args, &put); !ok || put.Err != OK || put.ConfigNum != num {
+		t.Fatalf("new owner's Put got %v from config %d, wanted config %d", put.Err, put.ConfigNum, num)
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestBinaryValues(t *testing.T) {
+	tc := setup(t, "binary", false)
+	defer tc.cleanup()
+
+	fmt.Printf("Test: Binary values survive a reconfiguration ...\n")
+
+	tc.join(0)
+	ck := tc.clerk()
+
+	nul := []byte{'a', 0, 'b', 0, 0}
+	bad := []byte{0xff, 0xfe, 0xc3, 0x28, 0x80}
+	ck.PutBytes("a", nul)
+	ck.PutBytes("b", bad)
+	ck.AppendBytes("b", nul)
+	if v := ck.GetBytes("missing"); v != nil {
+		t.Fatalf("GetBytes of a missing key got %v", v)
+	}
+
+	tc.join(1)
+	mck := tc.shardclerk()
+	mck.Move(key2shard("a"), tc.groups[1].gid)
+	mck.Move(key2shard("b"), tc.groups[1].gid)
+	num := mck.Query(-1).Num
+	tc.awaitConfig(1, num)
+
+	want := map[string][]byte{"a": nul, "b": append(append([]byte{}, bad...), nul...)}
+	for key, value := range want {
+		if v := ck.GetBytes(key); !reflect.DeepEqual(v, value) {
+			t.Fatalf("GetBytes(%s) got %v, wanted %v", key, v, value)
+		}
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestMaxValueBytes(t *testing.T) {
+	const max = 100
+	tc := setupWithOptions(t, "maxvalue", false, &Options{MaxValueBytes: max})
+	defer tc.cleanup()
+
+	fmt.Printf("Test: Values past MaxValueBytes are refused ...\n")
+
+	tc.join(0)
+	ck := tc.clerk()
+
+	if err := ck.PutAppendE("a", strings.Repeat("x", max), Put); err != OK {
+		t.Fatalf("Put of %d bytes got %v", max, err)
+	}
+	if err := ck.PutAppendE("b", strings.Repeat("x", max + 1), Put); err != ErrValueTooLarge {
+		t.Fatalf("Put of %d bytes got %v", max + 1, err)
+	}
+	if err := ck.PutAppendE("a", "y", Append); err != ErrValueTooLarge {
+		t.Fatalf("Append past the limit got %v", err)
+	}
+	if err := ck.PutBatch([]KeyValue{{"c", "z"}, {"d", strings.Repeat("x", max + 1)}}); err != ErrValueTooLarge {
+		t.Fatalf("PutBatch past the limit got %v", err)
+	}
+
+	// every replica refused the same writes.
+	for si, s := range tc.groups[0].servers {
+		s.ShardDigest(0) // catch up
+		s.mu.Lock()
+		a, b, c := s.xstate.KVStore["a"], s.xstate.KVStore["b"], s.xstate.KVStore["c"]
+		s.mu.Unlock()
+		if len(a) != max || b != "" || c != "" {
+			t.Fatalf("server %d has a=%d bytes, b=%q, c=%q", si, len(a), b, c)
+		}
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestDuplicateReconf(t *testing.T) {
+	fmt.Printf("Test: A Reconf logged twice is applied once ...\n")
+
+	const gid = 100
+	var c1, c2 shardmaster.Config
+	c1.Num = 1
+	for shard := range c1.Shards {
+		c1.Shards[shard] = gid
+	}
+	c2.Num = 2
+	c2.Shards = c1.Shards
+	c2.Shards[key2shard("b")] = gid + 1
+	stale := MakeXState()
+	stale.KVStore["a"] = "stale"
+	stale.MRRSMap["c"] = 1
+	stale.Replies["c"] = Rep{Err: OK}
+
+	recorded := []Op{
+		Op{Seq: 1, Op: Reconf, Extra: ReconfExtra{c1, *MakeXState()}},
+		Op{CID: "c", Seq: 1, Op: Put, Key: "a", Value: "x"},
+		Op{CID: "c", Seq: 2, Op: Append, Key: "a", Value: "y"},
+		Op{Seq: 2, Op: Reconf, Extra: ReconfExtra{c2, *MakeXState()}},
+		Op{CID: "c", Seq: 3, Op: Append, Key: "a", Value: "z"},
+	}
+	replayed := append([]Op{}, recorded...)
+	replayed = append(replayed,
+		Op{Seq: 1, Op: Reconf, Extra: ReconfExtra{c1, *stale}},
+		Op{Seq: 2, Op: Reconf, Extra: ReconfExtra{c2, *stale}})
+
+	xs := ApplyLog(gid, replayed, nil)
+	if v := xs.KVStore["a"]; v != "xyz" {
+		t.Fatalf("a is %q after a duplicate Reconf, wanted xyz", v)
+	}
+	if !reflect.DeepEqual(xs, ApplyLog(gid, recorded, nil)) {
+		t.Fatalf("duplicate Reconfs changed the state")
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestShutdown(t *testing.T) {
+	tc := setupWithOptions(t, "shutdown", false, &Options{SnapshotInterval: time.Hour})
+	defer func() {
+		tc.cleanup()
+		for _, g := range tc.groups {
+			for _, port := range g.ports {
+				os.Remove(snapshotFile(port))
+			}
+		}
+	}()
+
+	fmt.Printf("Test: Shutdown drains, snapshots and stops ...\n")
+
+	tc.join(0)
+	tc.awaitConfig(0, 1)
+	ck := tc.clerk()
+	ck.Put("a", "x")
+
+	// server 0 can no longer reach a majority, so an Append
+	// it takes is stuck until Shutdown gives up on it.
+	tc.kill1(0, 1)
+	tc.kill1(0, 2)
+	srv := tc.groups[0].ports[0]
+	done := make(chan PutAppendReply, 1)
+	go func() {
+		args := &PutAppendArgs{Key: "a", Value: "y", Op: Append, CID: "stuck", Seq: 1}
+		var reply PutAppendReply
+		if !call(srv, "ShardKV.PutAppend", args, &reply) {
+			reply.Err = "call failed"
+		}
+		done <- reply
+	}()
+	time.Sleep(200 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300 * time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := tc.groups[0].servers[0].Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Shutdown with an Append stuck got %v", err)
+	}
+	if d := time.Since(start); d > 3 * time.Second {
+		t.Fatalf("Shutdown took %v", d)
+	}
+	select {
+	case reply := <-done:
+		if reply.Err != ErrShutdown {
+			t.Fatalf("stuck Append got %v, wanted %v", reply.Err, ErrShutdown)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("stuck Append never answered")
+	}
+	if _, err := os.Stat(snapshotFile(srv)); err != nil {
+		t.Fatalf("no snapshot after Shutdown: %v", err)
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestDurability(t *testing.T) {
+	tc := setupWithOptions(t, "durability", false, &Options{SnapshotInterval: time.Hour})
+	defer func() {
+		tc.cleanup()
+		for _, g := range tc.groups {
+			for _, port := range g.ports {
+				os.Remove(snapshotFile(port))
+			}
+		}
+	}()
+
+	fmt.Printf("Test: Flushed writes survive a crash ...\n")
+
+	tc.join(0)
+	tc.awaitConfig(0, 1)
+
+	// a server not taking snapshots can't flush
+	nodisk := setup(t, "nodisk", false)
+	defer nodisk.cleanup()
+	nodisk.join(0)
+	if err := nodisk.clerk().PutAppendDurable("a", "x", Put, DurabilityFlushed); err != ErrNotDurable {
+		t.Fatalf("Flushed write without snapshots got %v", err)
+	}
+
+	// the clerk sends every op to server 0. the Memory write
+	// comes after the last flush, so no snapshot holds it.
+	ck := tc.clerk()
+	if err := ck.PutAppendDurable("f", "x", Put, DurabilityFlushed); err != OK {
+		t.Fatalf("Flushed write got %v", err)
+	}
+	if err := ck.PutAppendDurable("m", "x", Put, DurabilityMemory); err != OK {
+		t.Fatalf("Memory write got %v", err)
+	}
+
+	// the whole group crashes, without writing snapshots
+	for si := range tc.groups[0].servers {
+		tc.kill1(0, si)
+	}
+	tc.start1(0, 0, false)
+
+	srv := tc.groups[0].servers[0]
+	srv.mu.Lock()
+	f, fok := srv.xstate.KVStore["f"]
+	_, mok := srv.xstate.KVStore["m"]
+	srv.mu.Unlock()
+	if !fok || f != "x" {
+		t.Fatalf("Flushed write lost in the crash")
+	}
+	if mok {
+		t.Fatalf("Memory write found in the snapshot")
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestReadAfterWrite(t *testing.T) {
+	tc := setup(t, "readafter", false)
+	defer tc.cleanup()
+
+	fmt.Printf("Test: A Get with MinSeq sees the write it names ...\n")
+
+	tc.join(0)
+	tc.awaitConfig(0, 1)
+	g := tc.groups[0]
+
+	for i := 0; i < 20; i++ {
+		// write through server 0, with server 1 cut off for
+		// every other write, so it has yet to apply it
+		value := strconv.Itoa(i)
+		if i%2 == 0 {
+			g.refuse1(1, true)
+		}
+		var put PutAppendReply
+		args := &PutAppendArgs{Key: "a", Value: value, Op: Put, CID: "writer", Seq: i + 1}
+		if ok := call(g.ports[0], "ShardKV.PutAppend", args, &put); !ok || put.Err != OK {
+			t.Fatalf("Put got %v", put.Err)
+		}
+		g.refuse1(1, false)
+		if put.Seq <= 0 {
+			t.Fatalf("Put answered at seq %d", put.Seq)
+		}
+
+		for _, c := range []string{ReadSpeculative, ReadConfirm, ReadLogged} {
+			var get GetReply
+			gargs := &GetArgs{Key: "a", CID: "reader" + c, Seq: i + 1, Consistency: c, MinSeq: put.Seq}
+			if ok := call(g.ports[1], "ShardKV.Get", gargs, &get); !ok || get.Err != OK || get.Value != value {
+				t.Fatalf("%q Get after the Put got %v %q, wanted %q", c, get.Err, get.Value, value)
+			}
+		}
+	}
+
+	// the clerk sends its own writes' seqs
+	ck := tc.clerk()
+	for i := 0; i < 10; i++ {
+		value := "c" + strconv.Itoa(i)
+		ck.Put("b", value)
+		if v, _ := ck.GetSpeculative("b"); v != value {
+			t.Fatalf("speculative Get after Put got %q, wanted %q", v, value)
+		}
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestStatus(t *testing.T) {
+	tc := setup(t, "status", false)
+	defer tc.cleanup()
+
+	fmt.Printf("Test: Status reports a stalled reconfiguration ...\n")
+
+	tc.join(0)
+	tc.awaitConfig(0, 1)
+	ck := tc.clerk()
+	for i := 0; i < 20; i++ {
+		ck.Put(strconv.Itoa(i), "x")
+	}
+
+	// group 0 stops answering, so group 1 can't fetch the
+	// shards the Join gives it
+	g0, g1 := tc.groups[0], tc.groups[1]
+	g0.refuse(true)
+	tc.join(1)
+	config := tc.shardclerk().Query(-1)
+	want := []int{}
+	for shard, gid := range config.Shards {
+		if gid == g1.gid {
+			want = append(want, shard)
+		}
+	}
+
+	var st StatusReply
+	for iters := 0; ; iters++ {
+		st = StatusReply{}
+		if ok := call(g1.ports[0], "ShardKV.Status", &StatusArgs{}, &st); ok && st.Reconfiguring {
+			break
+		}
+		if iters > 100 {
+			t.Fatalf("Status never reported the reconfiguration: %+v", st)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if st.ConfigNum != config.Num-1 || st.Target != config.Num || len(st.Shards) != 0 ||
+		!reflect.DeepEqual(st.Waiting, want) {
+		t.Fatalf("stalled Status %+v, wanted config %d waiting on %v", st, config.Num-1, want)
+	}
+
+	g0.refuse(false)
+	tc.awaitConfig(1, config.Num)
+	st = StatusReply{}
+	if ok := call(g1.ports[0], "ShardKV.Status", &StatusArgs{}, &st); !ok || st.Err != OK {
+		t.Fatalf("Status failed: %v", st.Err)
+	}
+	if st.ConfigNum != config.Num || st.Reconfiguring || len(st.Waiting) != 0 ||
+		!reflect.DeepEqual(st.Shards, want) {
+		t.Fatalf("Status %+v after the reconfiguration, wanted shards %v", st, want)
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestArrivingShard(t *testing.T) {
+	tc := setup(t, "arriving", false)
+	defer tc.cleanup()
+
+	fmt.Printf("Test: A shard still being fetched is not ready, not elsewhere ...\n")
+
+	tc.join(0)
+	tc.awaitConfig(0, 1)
+	ck := tc.clerk()
+	for i := 0; i < 20; i++ {
+		ck.Put(strconv.Itoa(i), "x"+strconv.Itoa(i))
+	}
+
+	// stall the transfer of the shards the Join gives group 1
+	g0, g1 := tc.groups[0], tc.groups[1]
+	g0.refuse(true)
+	tc.join(1)
+	var st StatusReply
+	for iters := 0; !st.Reconfiguring || len(st.Waiting) == 0; iters++ {
+		if iters > 100 {
+			t.Fatalf("group 1 never started fetching: %+v", st)
+		}
+		time.Sleep(50 * time.Millisecond)
+		st = StatusReply{}
+		call(g1.ports[0], "ShardKV.Status", &StatusArgs{}, &st)
+	}
+	key := ""
+	for i := 0; i < 20 && key == ""; i++ {
+		if key2shard(strconv.Itoa(i)) == st.Waiting[0] {
+			key = strconv.Itoa(i)
+		}
+	}
+	if key == "" {
+		t.Fatalf("no key in shard %d", st.Waiting[0])
+	}
+
+	for _, c := range []string{ReadLogged, ReadConfirm, ReadSpeculative} {
+		var get GetReply
+		args := &GetArgs{Key: key, CID: "direct" + c, Seq: 1, Consistency: c}
+		if ok := call(g1.ports[0], "ShardKV.Get", args, &get); !ok || get.Err != ErrNotReady {
+			t.Fatalf("%q Get of an arriving key got %v, wanted %v", c, get.Err, ErrNotReady)
+		}
+	}
+	var put PutAppendReply
+	pargs := &PutAppendArgs{Key: key, Value: "y", Op: Put, CID: "direct", Seq: 1}
+	if ok := call(g1.ports[0], "ShardKV.PutAppend", pargs, &put); !ok || put.Err != ErrNotReady {
+		t.Fatalf("Put of an arriving key got %v, wanted %v", put.Err, ErrNotReady)
+	}
+
+	// a clerk reading the key through the move gets its value
+	got := make(chan string)
+	go func() {
+		got <- tc.clerk().Get(key)
+	}()
+	time.Sleep(300 * time.Millisecond)
+	g0.refuse(false)
+	if v := <-got; v != "x"+key {
+		t.Fatalf("Get during the move got %q, wanted %q", v, "x"+key)
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestClerkConfigCache(t *testing.T) {
+	tc := setup(t, "configcache", true)
+	defer tc.cleanup()
+
+	fmt.Printf("Test: The clerk rarely asks the shardmaster ...\n")
+
+	tc.join(0)
+	tc.join(1)
+	ck := tc.clerk()
+
+	const nops = 100
+	for i := 0; i < nops; i++ {
+		key := strconv.Itoa(i % 10)
+		ck.Put(key, strconv.Itoa(i))
+		if v := ck.Get(key); v != strconv.Itoa(i) {
+			t.Fatalf("Get(%s) got %q, wanted %q", key, v, strconv.Itoa(i))
+		}
+	}
+
+	ck.mu.Lock()
+	queries := ck.queries
+	ck.mu.Unlock()
+	if queries > 2*nops/10 {
+		t.Fatalf("%d shardmaster queries for %d ops", queries, 2*nops)
+	}
+
+	// a moved shard still reaches its new group
+	tc.join(2)
+	tc.shardclerk().Move(key2shard("0"), tc.groups[2].gid)
+	ck.Put("0", "moved")
+	if v := ck.Get("0"); v != "moved" {
+		t.Fatalf("Get after the move got %q", v)
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestClerkBackoff(t *testing.T) {
+	tc := setup(t, "backoff", false)
+	defer tc.cleanup()
+
+	fmt.Printf("Test: The clerk backs off from a group that doesn't answer ...\n")
+
+	tc.join(0)
+	ck := tc.clerk()
+	ck.Put("a", "x")
+	ck.SetBackoff(10*time.Millisecond, 500*time.Millisecond)
+
+	// the group refuses connections, as a dead one would
+	tc.groups[0].refuse(true)
+
+	// waits of 5-10, 10-20, ... 250-500ms, then 250-500ms: 7
+	// to 9 passes over the group's 3 servers in 1.5s, where
+	// retrying every 10ms would make over 100.
+	count := func() int {
+		ck.mu.Lock()
+		defer ck.mu.Unlock()
+		return ck.sent
+	}
+	before := count()
+	ctx, cancel := context.WithTimeout(context.Background(), 1500*time.Millisecond)
+	defer cancel()
+	if _, err := ck.GetCtx(ctx, "a"); err != ErrTimeout {
+		t.Fatalf("Get from a dead group got %v", err)
+	}
+	nservers := len(tc.groups[0].servers)
+	if n := count() - before; n < 6*nservers || n > 11*nservers {
+		t.Fatalf("%d RPCs to a dead group in 1.5s, wanted %d to %d", n, 6*nservers, 11*nservers)
+	}
+
+	tc.groups[0].refuse(false)
+	if v := ck.Get("a"); v != "x" {
+		t.Fatalf("Get after the group came back got %q", v)
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestClerkIDs(t *testing.T) {
+	tc := setup(t, "clerkids", false)
+	defer tc.cleanup()
+
+	fmt.Printf("Test: Clerks get distinct client identifiers ...\n")
+
+	const n = 1000
+	seen := map[string]bool{}
+	for i := 0; i < n; i++ {
+		ck := tc.clerk()
+		if len(ck.me) != 32 {
+			t.Fatalf("client identifier %q is not 128 bits of hex", ck.me)
+		}
+		if seen[ck.me] {
+			t.Fatalf("client identifier %q made twice", ck.me)
+		}
+		seen[ck.me] = true
+	}
+
+	tc.join(0)
+	ck := MakeClerkWithID(tc.masterports, "named")
+	if ck.me != "named" {
+		t.Fatalf("MakeClerkWithID made %q", ck.me)
+	}
+	ck.Put("a", "x")
+	if v := tc.clerk().Get("a"); v != "x" {
+		t.Fatalf("Get got %q", v)
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestBatchedOps(t *testing.T) {
+	tc := setupWithOptions(t, "batched", true, &Options{BatchWindow: 10 * time.Millisecond})
+	defer tc.cleanup()
+
+	fmt.Printf("Test: Batched ops apply once each, in order ...\n")
+
+	tc.join(0)
+	tc.clerk().Put("0", "")
+
+	const nclients = 20
+	const nops = 10
+	var wg sync.WaitGroup
+	for i := 0; i < nclients; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ck := tc.clerk()
+			for j := 0; j < nops; j++ {
+				ck.Append(strconv.Itoa(i%10), fmt.Sprintf("%d.%d;", i, j))
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	ck := tc.clerk()
+	for k := 0; k < 10; k++ {
+		v := ck.Get(strconv.Itoa(k))
+		next := map[int]int{}
+		for _, token := range strings.Split(strings.TrimSuffix(v, ";"), ";") {
+			var i, j int
+			fmt.Sscanf(token, "%d.%d", &i, &j)
+			if j != next[i] {
+				t.Fatalf("key %d has %q from client %d after %d of its ops: %q", k, token, i, next[i], v)
+			}
+			next[i]++
+		}
+		for i := k; i < nclients; i += 10 {
+			if next[i] != nops {
+				t.Fatalf("key %d has %d of client %d's ops: %q", k, next[i], i, v)
+			}
+		}
+	}
+
+	// far fewer log slots than ops
+	s := tc.groups[0].servers[0]
+	s.ShardDigest(0) // catch up
+	if slots, ops := s.px.Max() + 1, nclients*nops; slots > ops*3/4 {
+		t.Fatalf("%d log slots for %d ops", slots, ops)
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestStuckShard(t *testing.T) {
+	cl := &captureLogger{}
+	tc := setupWithOptions(t, "stuck", false, &Options{Logger: cl, StuckShardAfter: 300 * time.Millisecond})
+	defer tc.cleanup()
+
+	fmt.Printf("Test: Server warns of a shard answered only ErrWrongGroup ...\n")
+
+	tc.join(0)
+	tc.join(1)
+	config := tc.shardclerk().Query(-1)
+	tc.awaitConfig(0, config.Num)
+	tc.awaitConfig(1, config.Num)
+
+	// a key of a shard group 1 owns, then group 1 dies
+	g0, g1 := tc.groups[0], tc.groups[1]
+	key := ""
+	for i := 0; key == ""; i++ {
+		if k := strconv.Itoa(i); config.Shards[key2shard(k)] == g1.gid {
+			key = k
+		}
+	}
+	for si := range g1.servers {
+		tc.kill1(1, si)
+	}
+
+	// clients still asking group 0 for it
+	start := time.Now()
+	for time.Since(start) < 500*time.Millisecond {
+		args := &GetArgs{Key: key, CID: "lost", Seq: 1}
+		var reply GetReply
+		if ok := call(g0.ports[0], "ShardKV.Get", args, &reply); !ok || reply.Err != ErrWrongGroup {
+			t.Fatalf("Get from group 0 got %v %v", ok, reply.Err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	evs := cl.find(LevelWarn, "shard stuck", g0.gid)
+	if len(evs) != 1 {
+		t.Fatalf("%d stuck shard warnings", len(evs))
+	}
+	if ev := evs[0]; ev.fields["shard"] != key2shard(key) || ev.fields["owner"] != g1.gid {
+		t.Fatalf("stuck shard logged as %v", ev)
+	}
+	if n := g0.servers[0].Metrics().StuckShards; n != 1 {
+		t.Fatalf("%d stuck shards counted", n)
+	}
+
+	// a run that stops is over
+	time.Sleep(400 * time.Millisecond)
+	if n := g0.servers[0].Metrics().StuckShards; n != 0 {
+		t.Fatalf("%d stuck shards counted once the replies stopped", n)
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestMoveOneShard(t *testing.T) {
+	tc := setup(t, "moveone", false)
+	defer tc.cleanup()
+
+	fmt.Printf("Test: Move transfers just the one shard ...\n")
+
+	tc.join(0)
+	tc.join(1)
+	config := tc.shardclerk().Query(-1)
+	tc.awaitConfig(0, config.Num)
+	tc.awaitConfig(1, config.Num)
+
+	// a key in every shard
+	ck := tc.clerk()
+	keys := make([]string, shardmaster.NShards)
+	for i := 0; i < 100; i++ {
+		if k := strconv.Itoa(i); keys[key2shard(k)] == "" {
+			keys[key2shard(k)] = k
+			ck.Put(k, "v"+k)
+		}
+	}
+
+	const shard = 3
+	ga, gb := tc.groups[0], tc.groups[1]
+	if config.Shards[shard] != ga.gid {
+		ga, gb = gb, ga
+	}
+	tc.mck.Move(shard, gb.gid)
+	tc.awaitConfig(0, config.Num+1)
+	tc.awaitConfig(1, config.Num+1)
+
+	args := &GetArgs{Key: keys[shard], CID: "mover", Seq: 1}
+	var reply GetReply
+	if ok := call(gb.ports[0], "ShardKV.Get", args, &reply); !ok || reply.Err != OK || reply.Value != "v"+keys[shard] {
+		t.Fatalf("new owner read %v %v %v", ok, reply.Err, reply.Value)
+	}
+	args.Seq++
+	reply = GetReply{}
+	if ok := call(ga.ports[0], "ShardKV.Get", args, &reply); !ok || reply.Err != ErrWrongGroup {
+		t.Fatalf("old owner read %v %v %v", ok, reply.Err, reply.Value)
+	}
+
+	// only shard 3's one key moved, and only to B. (progress
+	// is kept by the replicas that fetched for the Move.)
+	want := len(keys[shard]) + len("v"+keys[shard])
+	fetchers := 0
+	for _, s := range gb.servers {
+		if p := s.ReconfigProgress(); p.Target == config.Num+1 {
+			if p.Needed != 1 || p.Bytes != want {
+				t.Fatalf("new owner fetched %+v, wanted 1 shard of %d bytes", p, want)
+			}
+			fetchers++
+		}
+	}
+	if fetchers == 0 {
+		t.Fatalf("no replica of the new owner fetched for the Move")
+	}
+	for _, s := range ga.servers {
+		if p := s.ReconfigProgress(); p.Target == config.Num+1 && p.Needed != 0 {
+			t.Fatalf("old owner fetched %+v", p)
+		}
+	}
+	for i, k := range keys {
+		if v := ck.Get(k); v != "v"+k {
+			t.Fatalf("shard %d's %v read %v after the Move", i, k, v)
+		}
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestRateLimit(t *testing.T) {
+	tc := setupWithOptions(t, "ratelimit", false, &Options{ClientRate: 10, ClientBurst: 5})
+	defer tc.cleanup()
+
+	fmt.Printf("Test: A client past its rate is throttled, others aren't ...\n")
+
+	tc.join(0)
+	tc.awaitConfig(0, 1)
+	g0 := tc.groups[0]
+	s := g0.servers[0]
+	s.ShardDigest(0) // catch up
+	before := s.px.Max()
+
+	// one client blasting a server
+	start := time.Now()
+	accepted, limited := 0, 0
+	for i := 0; i < 50; i++ {
+		args := &PutAppendArgs{Key: "a", Value: "x", Op: Append, CID: "noisy", Seq: i + 1}
+		var reply PutAppendReply
+		if ok := call(g0.ports[0], "ShardKV.PutAppend", args, &reply); !ok {
+			t.Fatalf("PutAppend failed")
+		}
+		switch reply.Err {
+		case OK:
+			accepted++
+		case ErrRateLimited:
+			limited++
+		default:
+			t.Fatalf("PutAppend got %v", reply.Err)
+		}
+	}
+	allowed := 5 + int(time.Since(start).Seconds()*10) + 1
+	if limited == 0 || accepted > allowed {
+		t.Fatalf("%d accepted and %d limited, wanted at most %d accepted", accepted, limited, allowed)
+	}
+	if n := s.Stats().RateLimited; n != limited {
+		t.Fatalf("Stats counted %d limited, wanted %d", n, limited)
+	}
+	if logged := s.px.Max() - before; logged >= accepted + limited {
+		t.Fatalf("%d slots logged for %d accepted ops", logged, accepted)
+	}
+
+	// another client still gets through at once
+	args := &PutAppendArgs{Key: "b", Value: "y", Op: Put, CID: "quiet", Seq: 1}
+	var reply PutAppendReply
+	if ok := call(g0.ports[0], "ShardKV.PutAppend", args, &reply); !ok || reply.Err != OK {
+		t.Fatalf("other client's Put got %v %v", ok, reply.Err)
+	}
+
+	// a Clerk past its rate backs off and gets through
+	ck := tc.clerk()
+	for i := 0; i < 15; i++ {
+		ck.Append("c", "z")
+	}
+	if v := ck.Get("c"); v != strings.Repeat("z", 15) {
+		t.Fatalf("Clerk read %v", v)
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestPing(t *testing.T) {
+	tc := setup(t, "ping", false)
+	defer tc.cleanup()
+
+	fmt.Printf("Test: Ping reports readiness during a stuck transfer ...\n")
+
+	tc.join(0)
+	tc.awaitConfig(0, 1)
+	ck := tc.clerk()
+	ck.Put("a", "x")
+
+	ping := func(port string) PingReply {
+		var reply PingReply
+		if ok := call(port, "ShardKV.Ping", &PingArgs{}, &reply); !ok || reply.Err != OK {
+			t.Fatalf("Ping failed: %v %v", ok, reply.Err)
+		}
+		return reply
+	}
+
+	g0, g1 := tc.groups[0], tc.groups[1]
+	if r := ping(g0.ports[0]); !r.Alive || !r.Quorum || !r.Ready || r.ConfigNum != 1 {
+		t.Fatalf("serving group pinged %+v", r)
+	}
+
+	// group 0 stops answering, so group 1 can't fetch the
+	// shards the Join gives it
+	g0.refuse(true)
+	tc.join(1)
+	var r PingReply
+	for iters := 0; ; iters++ {
+		if r = ping(g1.ports[0]); !r.Ready {
+			break
+		}
+		if iters > 100 {
+			t.Fatalf("Ping never reported the stuck transfer: %+v", r)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if !r.Alive || !r.Quorum {
+		t.Fatalf("stuck group pinged %+v", r)
+	}
+
+	g0.refuse(false)
+	config := tc.shardclerk().Query(-1)
+	tc.awaitConfig(1, config.Num)
+	if r := ping(g1.ports[0]); !r.Ready || r.ConfigNum != config.Num {
+		t.Fatalf("group pinged %+v after the transfer", r)
+	}
+
+	// no quorum without two of the three
+	tc.kill1(1, 1)
+	tc.kill1(1, 2)
+	if r := ping(g1.ports[0]); !r.Alive || r.Quorum || r.Ready {
+		t.Fatalf("group without a majority pinged %+v", r)
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestRecentReplies(t *testing.T) {
+	tc := setup(t, "recent", false)
+	defer tc.cleanup()
+
+	fmt.Printf("Test: Retries of a client's recent ops get their replies ...\n")
+
+	tc.join(0)
+	tc.awaitConfig(0, 1)
+	port := tc.groups[0].ports[0]
+
+	incr := func(seq int) string {
+		args := &IncrArgs{Key: "n", Delta: 1, CID: "pipeliner", Seq: seq}
+		var reply IncrReply
+		if ok := call(port, "ShardKV.Incr", args, &reply); !ok || reply.Err != OK {
+			t.Fatalf("Incr %d got %v %v", seq, ok, reply.Err)
+		}
+		return reply.Value
+	}
+	for seq := 1; seq <= 5; seq++ {
+		if v := incr(seq); v != strconv.Itoa(seq) {
+			t.Fatalf("Incr %d got %v", seq, v)
+		}
+	}
+
+	// a retry of seq 2 gets the reply seq 2 got, and isn't applied
+	if v := incr(2); v != "2" {
+		t.Fatalf("retried Incr 2 got %v", v)
+	}
+	if v := tc.clerk().Get("n"); v != "5" {
+		t.Fatalf("n is %v after the retry", v)
+	}
+
+	// older than ReplyHistory ops: still not applied again
+	var reply IncrReply
+	call(port, "ShardKV.Incr", &IncrArgs{Key: "n", Delta: 1, CID: "pipeliner", Seq: 1}, &reply)
+	if v := tc.clerk().Get("n"); v != "5" {
+		t.Fatalf("n is %v after retrying Incr 1", v)
+	}
+
+	// the replies go with the client's state to another group
+	tc.join(1)
+	config := tc.shardclerk().Query(-1)
+	tc.awaitConfig(0, config.Num)
+	tc.awaitConfig(1, config.Num)
+	if gid := config.Shards[key2shard("n")]; gid != tc.groups[0].gid {
+		port = tc.groups[1].ports[0]
+	}
+	if v := incr(3); v != "3" {
+		t.Fatalf("retried Incr 3 got %v at the shard's new group", v)
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+
+func TestOutOfOrderOps(t *testing.T) {
+	tc := setup(t, "outoforder", false)
+	defer tc.cleanup()
+
+	fmt.Printf("Test: Pipelined ops decided out of order are applied ...\n")
+
+	tc.join(0)
+	tc.awaitConfig(0, 1)
+	port := tc.groups[0].ports[0]
+
+	incr := func(seq int) string {
+		args := &IncrArgs{Key: "n", Delta: 1, CID: "pipeliner", Seq: seq}
+		var reply IncrReply
+		if ok := call(port, "ShardKV.Incr", args, &reply); !ok || reply.Err != OK {
+			t.Fatalf("Incr %d got %v %v", seq, ok, reply.Err)
+		}
+		return reply.Value
+	}
+
+	// seq 3 is decided before seqs 1 and 2, sent before it
+	if v := incr(3); v != "1" {
+		t.Fatalf("Incr 3 got %v", v)
+	}
+	if v := incr(1); v != "2" {
+		t.Fatalf("Incr 1, after 3, got %v", v)
+	}
+	if v := incr(2); v != "3" {
+		t.Fatalf("Incr 2, after 3, got %v", v)
+	}
+
+	// retries of each get the reply it got
+	for seq, want := range map[int]string{1: "2", 2: "3", 3: "1"} {
+		if v := incr(seq); v != want {
+			t.Fatalf("retried Incr %d got %v; wanted %v", seq, v, want)
+		}
+	}
+
+	// with the replies dropped, retries are still not applied
+	tc.groups[0].servers[0].RebuildDedup()
+	for seq := 1; seq <= 3; seq++ {
+		incr(seq)
+	}
+	if v := tc.clerk().Get("n"); v != "3" {
+		t.Fatalf("n is %v after the retries", v)
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+func TestCondTxn(t *testing.T) {
+	tc := setup(t, "condtxn", false)
+	defer tc.cleanup()
+
+	fmt.Printf("Test: Conditional transactions within a shard ...\n")
+
+	tc.join(0)
+	ck := tc.clerk()
+	ck.Put("a1", "x")
+	ck.Put("a2", "y")
+
+	// a conditional swap
+	err := ck.CondTxn([]KeyValue{{"a1", "x"}, {"a2", "y"}}, []KeyValue{{"a1", "y"}, {"a2", "x"}})
+	if err != OK {
+		t.Fatalf("swap got %v", err)
+	}
+	if v1, v2 := ck.Get("a1"), ck.Get("a2"); v1 != "y" || v2 != "x" {
+		t.Fatalf("after the swap a1=%v a2=%v", v1, v2)
+	}
+
+	// a failed condition writes nothing
+	err = ck.CondTxn([]KeyValue{{"a1", "x"}}, []KeyValue{{"a2", "z"}, {"a3", "z"}})
+	if err != ErrMismatch {
+		t.Fatalf("stale txn got %v", err)
+	}
+	if v2, v3 := ck.Get("a2"), ck.Get("a3"); v2 != "x" || v3 != "" {
+		t.Fatalf("failed txn wrote a2=%v a3=%v", v2, v3)
+	}
+
+	// conflicting transactions: exactly one commits
+	errs := make([]Err, 2)
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			mine := strconv.Itoa(i)
+			errs[i] = tc.clerk().CondTxn([]KeyValue{{"a1", "y"}, {"a2", "x"}},
+				[]KeyValue{{"a1", mine}, {"a2", mine}})
+		}(i)
+	}
+	wg.Wait()
+	winner := -1
+	for i, err := range errs {
+		if err == OK {
+			if winner >= 0 {
+				t.Fatalf("both conflicting txns committed")
+			}
+			winner = i
+		} else if err != ErrMismatch {
+			t.Fatalf("txn %d got %v", i, err)
+		}
+	}
+	if winner < 0 {
+		t.Fatalf("neither conflicting txn committed")
+	}
+	if v1, v2 := ck.Get("a1"), ck.Get("a2"); v1 != strconv.Itoa(winner) || v2 != v1 {
+		t.Fatalf("after txn %d committed a1=%v a2=%v", winner, v1, v2)
+	}
+
+	// keys of two shards
+	if err := ck.CondTxn(nil, []KeyValue{{"a1", "w"}, {"b1", "w"}}); err != ErrWrongGroup {
+		t.Fatalf("cross-shard txn got %v", err)
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestWatch(t *testing.T) {
+	tc := setup(t, "watch", false)
+	defer tc.cleanup()
+
+	fmt.Printf("Test: Watch wakes on a key's change ...\n")
+
+	tc.join(0)
+	ck := tc.clerk()
+	ck.Put("w", "1")
+	_, version := ck.GetVersion("w")
+
+	type watched struct {
+		value   string
+		version int
+		err     Err
+	}
+	done := make(chan watched, 1)
+	go func() {
+		v, ver, err := tc.clerk().Watch("w", version, 5*time.Second)
+		done <- watched{v, ver, err}
+	}()
+	time.Sleep(200 * time.Millisecond)
+	select {
+	case w := <-done:
+		t.Fatalf("Watch returned %+v before any change", w)
+	default:
+	}
+
+	ck.Put("w", "2")
+	select {
+	case w := <-done:
+		if w.err != OK || w.value != "2" || w.version != version+1 {
+			t.Fatalf("Watch woke with %+v", w)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Watch not woken by the Put")
+	}
+
+	// unchanged: the same version after the timeout
+	start := time.Now()
+	if v, ver, err := ck.Watch("w", version+1, 300*time.Millisecond); err != OK || v != "2" || ver != version+1 {
+		t.Fatalf("unchanged Watch got %v %v %v", v, ver, err)
+	}
+	if d := time.Since(start); d < 300*time.Millisecond {
+		t.Fatalf("unchanged Watch returned after %v", d)
+	}
+
+	// the key's shard moving away ends the watch
+	g0, g1 := tc.groups[0], tc.groups[1]
+	tc.join(1)
+	config := tc.shardclerk().Query(-1)
+	tc.awaitConfig(0, config.Num)
+	tc.awaitConfig(1, config.Num)
+	if config.Shards[key2shard("w")] != g0.gid {
+		tc.mck.Move(key2shard("w"), g0.gid)
+		config.Num++
+		tc.awaitConfig(0, config.Num)
+		tc.awaitConfig(1, config.Num)
+	}
+	moved := make(chan WatchReply, 1)
+	go func() {
+		args := &WatchArgs{Key: "w", Version: version + 1, Timeout: MaxWaitChange}
+		var reply WatchReply
+		call(g0.ports[0], "ShardKV.Watch", args, &reply)
+		moved <- reply
+	}()
+	time.Sleep(100 * time.Millisecond)
+	tc.mck.Move(key2shard("w"), g1.gid)
+	select {
+	case reply := <-moved:
+		if reply.Err != ErrWrongGroup {
+			t.Fatalf("Watch of a moved key got %+v", reply)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("Watch of a moved key not answered")
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestLogStatus(t *testing.T) {
+	tc := setup(t, "logstatus", false)
+	defer tc.cleanup()
+
+	fmt.Printf("Test: LogStatus follows the paxos log ...\n")
+
+	tc.join(0)
+	ck := tc.clerk()
+	ck.Put("a", "")
+	port := tc.groups[0].ports[0]
+	logStatus := func() LogStatusReply {
+		var reply LogStatusReply
+		if ok := call(port, "ShardKV.LogStatus", &LogStatusArgs{}, &reply); !ok || reply.Err != OK {
+			t.Fatalf("LogStatus got %v %v", ok, reply.Err)
+		}
+		if !(reply.Min <= reply.LastSeq && reply.LastSeq <= reply.Seq && reply.Seq <= reply.Max+1) {
+			t.Fatalf("LogStatus out of order: %+v", reply)
+		}
+		return reply
+	}
+
+	last := logStatus()
+	for i := 0; i < 5; i++ {
+		for j := 0; j < 10; j++ {
+			args := &PutAppendArgs{Key: "a", Value: "x", Op: Append, CID: "writer", Seq: i*10 + j + 1}
+			var reply PutAppendReply
+			if ok := call(port, "ShardKV.PutAppend", args, &reply); !ok || reply.Err != OK {
+				t.Fatalf("Append got %v %v", ok, reply.Err)
+			}
+		}
+		st := logStatus()
+		if st.LastSeq < last.LastSeq+10 || st.Max < last.Max+10 {
+			t.Fatalf("10 appends moved LogStatus from %+v to %+v", last, st)
+		}
+		if st.Min < last.Min || st.Seq < last.Seq {
+			t.Fatalf("LogStatus went back from %+v to %+v", last, st)
+		}
+		last = st
+	}
+	// the others' Done()s reach server 0 with their decisions
+	for iters := 0; last.Min == 0 && iters < 50; iters++ {
+		args := &PutAppendArgs{Key: "b", Value: "y", Op: Append, CID: "writer2", Seq: iters + 1}
+		var reply PutAppendReply
+		call(tc.groups[0].ports[iters%3], "ShardKV.PutAppend", args, &reply)
+		last = logStatus()
+	}
+	if last.Min == 0 {
+		t.Fatalf("Min stayed 0 through %+v", last)
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestFetchOncePerGroup(t *testing.T) {
+	tc := setup(t, "fetchonce", false)
+	defer tc.cleanup()
+
+	fmt.Printf("Test: A group fetches each shard once per config ...\n")
+
+	tc.join(0)
+	ck := tc.clerk()
+	keys := make([]string, shardmaster.NShards)
+	for i := 0; i < 100; i++ {
+		if k := strconv.Itoa(i); keys[key2shard(k)] == "" {
+			keys[key2shard(k)] = k
+			ck.Put(k, "v"+k)
+		}
+	}
+
+	tc.join(1)
+	config := tc.shardclerk().Query(-1)
+	tc.awaitConfig(0, config.Num)
+	tc.awaitConfig(1, config.Num)
+
+	moved := 0
+	for _, gid := range config.Shards {
+		if gid == tc.groups[1].gid {
+			moved++
+		}
+	}
+	sent := 0
+	for _, s := range tc.groups[0].servers {
+		sent += s.Stats().Sent
+	}
+	// once per replica of group 1 would be 3 * moved
+	if moved == 0 || sent >= 2*moved {
+		t.Fatalf("%d shard transfers for %d shards moved", sent, moved)
+	}
+
+	for _, k := range keys {
+		if v := ck.Get(k); v != "v"+k {
+			t.Fatalf("Get(%v) = %v, wanted %v", k, v, "v"+k)
+		}
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestShardStats(t *testing.T) {
+	tc := setup(t, "shardstats", false)
+	defer tc.cleanup()
+
+	fmt.Printf("Test: ShardStats counts each shard's keys ...\n")
+
+	tc.join(0)
+	ck := tc.clerk()
+	kvs := map[string]string{}
+	for i := 0; i < 50; i++ {
+		k := "k" + strconv.Itoa(i)
+		kvs[k] = strings.Repeat("v", i%5+1)
+		ck.Put(k, kvs[k])
+	}
+	for i := 0; i < 50; i += 7 {
+		k := "k" + strconv.Itoa(i)
+		ck.Delete(k)
+		delete(kvs, k)
+	}
+	for i := 1; i < 50; i += 7 {
+		k := "k" + strconv.Itoa(i)
+		ck.Append(k, "xyz")
+		kvs[k] += "xyz"
+	}
+	want := map[int]ShardStat{}
+	for k, v := range kvs {
+		st := want[key2shard(k)]
+		st.Shard = key2shard(k)
+		st.Keys++
+		st.Bytes += len(k) + len(v)
+		want[st.Shard] = st
+	}
+
+	check := func() {
+		total := 0
+		for _, g := range tc.groups[:2] {
+			for si, s := range g.servers {
+				s.ShardDigest(0) // catch up
+				var reply ShardStatsReply
+				if ok := call(g.ports[si], "ShardKV.ShardStats", &ShardStatsArgs{}, &reply); !ok || reply.Err != OK {
+					t.Fatalf("ShardStats got %v %v", ok, reply.Err)
+				}
+				for _, st := range reply.Shards {
+					if w := want[st.Shard]; st.Keys != w.Keys || st.Bytes != w.Bytes {
+						t.Fatalf("group %d server %d reported %+v, wanted %+v", g.gid, si, st, w)
+					}
+					if si == 0 {
+						total += st.Keys
+					}
+				}
+			}
+		}
+		if total != len(kvs) {
+			t.Fatalf("groups reported %d keys, wanted %d", total, len(kvs))
+		}
+	}
+	check()
+
+	// the counts move with the shards
+	tc.join(1)
+	config := tc.shardclerk().Query(-1)
+	tc.awaitConfig(0, config.Num)
+	tc.awaitConfig(1, config.Num)
+	check()
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestHandoffWrites(t *testing.T) {
+	tc := setup(t, "handoff", false)
+	defer tc.cleanup()
+
+	fmt.Printf("Test: No write is lost while its shard is handed off ...\n")
+
+	tc.join(0)
+	tc.join(1)
+	config := tc.shardclerk().Query(-1)
+	tc.awaitConfig(0, config.Num)
+	tc.awaitConfig(1, config.Num)
+
+	const key = "handoff"
+	shard := key2shard(key)
+	gids := []int64{tc.groups[0].gid, tc.groups[1].gid}
+
+	// appenders keep writing to the shard as it moves back
+	// and forth between the groups
+	const nclients = 4
+	var done int32
+	counts := make([]int, nclients)
+	var wg sync.WaitGroup
+	for ci := 0; ci < nclients; ci++ {
+		wg.Add(1)
+		go func(ci int) {
+			defer wg.Done()
+			ck := tc.clerk()
+			for atomic.LoadInt32(&done) == 0 {
+				ck.Append(key, "x "+strconv.Itoa(ci)+" "+strconv.Itoa(counts[ci])+" y")
+				counts[ci]++
+			}
+		}(ci)
+	}
+	for i := 0; i < 6; i++ {
+		tc.mck.Move(shard, gids[(i+1)%2])
+		time.Sleep(500 * time.Millisecond)
+	}
+	atomic.StoreInt32(&done, 1)
+	wg.Wait()
+
+	v := tc.clerk().Get(key)
+	for ci := 0; ci < nclients; ci++ {
+		last := -1
+		for _, elem := range strings.Split(v, "x ")[1:] {
+			var c, n int
+			fmt.Sscanf(elem, "%d %d y", &c, &n)
+			if c != ci {
+				continue
+			}
+			if n != last+1 {
+				t.Fatalf("client %d's append %d followed %d", ci, n, last)
+			}
+			last = n
+		}
+		if last+1 != counts[ci] {
+			t.Fatalf("client %d made %d appends, %d were kept", ci, counts[ci], last+1)
+		}
+	}
+	for _, g := range tc.groups[:2] {
+		AssertConverged(t, g)
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestAppendBounded(t *testing.T) {
+	tc := setup(t, "appendbounded", false)
+	defer tc.cleanup()
+
+	fmt.Printf("Test: AppendBounded keeps the last N bytes ...\n")
+
+	tc.join(0)
+	ck := tc.clerk()
+
+	const key = "rolling"
+	const max = 50
+	all := ""
+	for i := 0; i < 40; i++ {
+		chunk := "<" + strconv.Itoa(i) + ">"
+		ck.AppendBounded(key, chunk, max)
+		all += chunk
+		v := ck.Get(key)
+		if len(v) > max {
+			t.Fatalf("value grew to %d bytes, past %d", len(v), max)
+		}
+		want := all
+		if len(want) > max {
+			want = want[len(want)-max:]
+		}
+		if v != want {
+			t.Fatalf("after %d appends got %q, wanted %q", i+1, v, want)
+		}
+	}
+
+	AssertConverged(t, tc.groups[0])
+	want := ck.Get(key)
+	for si, s := range tc.groups[0].servers {
+		s.ShardDigest(0) // catch up
+		s.mu.Lock()
+		v := s.xstate.KVStore[key]
+		s.mu.Unlock()
+		if v != want {
+			t.Fatalf("server %d holds %q, wanted %q", si, v, want)
+		}
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestExportImport(t *testing.T) {
+	src := setupGroups(t, "export", false, 1, nil)
+	defer src.cleanup()
+	dst := setupGroups(t, "import", false, 1, nil)
+	defer dst.cleanup()
+
+	fmt.Printf("Test: Export from one group and Import into another ...\n")
+
+	src.join(0)
+	dst.join(0)
+	ck := src.clerk()
+	kvs := map[string]string{}
+	for i := 0; i < 30; i++ {
+		k := "k" + strconv.Itoa(i)
+		kvs[k] = "v" + strconv.Itoa(i)
+		ck.Put(k, kvs[k])
+	}
+	ck.Append("k0", "+")
+	kvs["k0"] += "+"
+
+	xs := src.groups[0].servers[0].Export()
+	if len(xs.KVStore) != len(kvs) {
+		t.Fatalf("exported %d keys, wanted %d", len(xs.KVStore), len(kvs))
+	}
+
+	dst.awaitConfig(0, 1)
+	if err := dst.groups[0].servers[1].Import(xs); err != OK {
+		t.Fatalf("Import got %v", err)
+	}
+	dck := dst.clerk()
+	for k, v := range kvs {
+		if got := dck.Get(k); got != v {
+			t.Fatalf("Get(%v) = %v after Import, wanted %v", k, got, v)
+		}
+	}
+
+	// importing again doesn't undo later writes
+	dck.Put("k1", "later")
+	if err := dst.groups[0].servers[2].Import(xs); err != OK {
+		t.Fatalf("second Import got %v", err)
+	}
+	if got := dck.Get("k1"); got != "later" {
+		t.Fatalf("second Import undid a Put: Get(k1) = %v", got)
+	}
+	AssertConverged(t, dst.groups[0])
+
+	fmt.Printf("  ... Passed\n")
+}
+
+// a stand-in for a server still taking in its shards
+type tNotReady struct {
+	left  int32 // ErrNotReady replies still to give
+	calls int32
+}
+
+func (g *tNotReady) Get(args *GetArgs, reply *GetReply) error {
+	atomic.AddInt32(&g.calls, 1)
+	if atomic.AddInt32(&g.left, -1) >= 0 {
+		reply.Err = ErrNotReady
+	} else {
+		reply.Err, reply.Value = OK, "ready"
+	}
+	return nil
+}
+
+func TestClerkNotReady(t *testing.T) {
+	tc := setupGroups(t, "notready", false, 0, nil)
+	defer tc.cleanup()
+
+	fmt.Printf("Test: The clerk waits out ErrNotReady at the same server ...\n")
+
+	fakes := []*tNotReady{{left: 4}, {left: 4}}
+	ports := []string{}
+	for i, g := range fakes {
+		rs := rpc.NewServer()
+		rs.RegisterName("ShardKV", g)
+		gport := port("notready-group", i)
+		os.Remove(gport)
+		l, err := net.Listen("unix", gport)
+		if err != nil {
+			t.Fatalf("listen %v: %v", gport, err)
+		}
+		defer l.Close()
+		go rs.Accept(l)
+		ports = append(ports, gport)
+	}
+	tc.mck.Join(100, ports)
+
+	ck := tc.clerk()
+	ck.SetBackoff(10*time.Millisecond, 50*time.Millisecond)
+	if v := ck.Get("a"); v != "ready" {
+		t.Fatalf("Get got %q", v)
+	}
+	ck.mu.Lock()
+	queries := ck.queries
+	ck.mu.Unlock()
+	// the one query is for the clerk's first config
+	if queries != 1 {
+		t.Fatalf("%d shardmaster queries for a group that was only not ready", queries)
+	}
+	if a, b := atomic.LoadInt32(&fakes[0].calls), atomic.LoadInt32(&fakes[1].calls); a != 5 || b != 0 {
+		t.Fatalf("servers got %d and %d requests, wanted 5 and 0", a, b)
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestMultiGet(t *testing.T) {
+	tc := setup(t, "multiget", false)
+	defer tc.cleanup()
+
+	fmt.Printf("Test: MultiGet reads many keys at once ...\n")
+
+	tc.join(0)
+	tc.join(1)
+	config := tc.shardclerk().Query(-1)
+	tc.awaitConfig(0, config.Num)
+	tc.awaitConfig(1, config.Num)
+
+	ck := tc.clerk()
+	keys := make([]string, 50)
+	for i := range keys {
+		keys[i] = strconv.Itoa(i)
+		if i%10 != 0 {
+			ck.Put(keys[i], "v"+keys[i])
+		}
+	}
+
+	g0 := tc.groups[0]
+	var reply MultiGetReply
+	args := &MultiGetArgs{Keys: keys, CID: "multi"}
+	if ok := call(g0.ports[1], "ShardKV.MultiGet", args, &reply); !ok || reply.Err != OK {
+		t.Fatalf("MultiGet got %v %v", ok, reply.Err)
+	}
+	if len(reply.Results) != len(keys) {
+		t.Fatalf("%d results for %d keys", len(reply.Results), len(keys))
+	}
+	nowned := 0
+	for i, res := range reply.Results {
+		owned := config.Shards[key2shard(keys[i])] == g0.gid
+		if owned {
+			nowned++
+		}
+		switch {
+		case !owned && res.Err != ErrWrongGroup:
+			t.Fatalf("key %v of another group got %v", keys[i], res.Err)
+		case owned && i%10 == 0 && res.Err != ErrNoKey:
+			t.Fatalf("missing key %v got %v", keys[i], res.Err)
+		case owned && i%10 != 0 && (res.Err != OK || res.Value != "v"+keys[i]):
+			t.Fatalf("key %v got %v %q", keys[i], res.Err, res.Value)
+		}
+	}
+	if nowned == 0 || nowned == len(keys) {
+		t.Fatalf("group %d owns %d of the %d keys", g0.gid, nowned, len(keys))
+	}
+
+	values := ck.MultiGet(keys)
+	for i, v := range values {
+		want := "v" + keys[i]
+		if i%10 == 0 {
+			want = ""
+		}
+		if v != want {
+			t.Fatalf("Clerk.MultiGet read %v as %q, wanted %q", keys[i], v, want)
+		}
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestPastDeadline(t *testing.T) {
+	tc := setup(t, "pastdeadline", false)
+	defer tc.cleanup()
+
+	fmt.Printf("Test: A request past its deadline is refused unlogged ...\n")
+
+	tc.join(0)
+	ck := tc.clerk()
+	ck.Put("a", "x")
+
+	g := tc.groups[0]
+	maxes := func() []int {
+		m := []int{}
+		for _, s := range g.servers {
+			m = append(m, s.px.Max())
+		}
+		return m
+	}
+	before := maxes()
+
+	past := time.Now().Add(-time.Second)
+	put := &PutAppendArgs{Key: "a", Value: "late", Op: "Put", CID: "late", Seq: 1, Deadline: past}
+	var preply PutAppendReply
+	if ok := call(g.ports[0], "ShardKV.PutAppend", put, &preply); !ok || preply.Err != ErrTimeout {
+		t.Fatalf("late Put got %v %v", ok, preply.Err)
+	}
+	get := &GetArgs{Key: "a", CID: "late", Seq: 2, Deadline: past}
+	var greply GetReply
+	if ok := call(g.ports[1], "ShardKV.Get", get, &greply); !ok || greply.Err != ErrTimeout {
+		t.Fatalf("late Get got %v %v", ok, greply.Err)
+	}
+	if after := maxes(); !reflect.DeepEqual(before, after) {
+		t.Fatalf("late requests took paxos slots: Max() %v before, %v after", before, after)
+	}
+
+	// with time left, the request goes through
+	put.Seq, put.Deadline = 3, time.Now().Add(10*time.Second)
+	preply = PutAppendReply{}
+	if ok := call(g.ports[0], "ShardKV.PutAppend", put, &preply); !ok || preply.Err != OK {
+		t.Fatalf("timely Put got %v %v", ok, preply.Err)
+	}
+	if v := ck.Get("a"); v != "late" {
+		t.Fatalf("Get(a) = %v, wanted late", v)
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
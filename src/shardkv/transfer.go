@@ -0,0 +1,312 @@
+package shardkv
+
+import "bytes"
+import "fmt"
+import "hash/crc32"
+import "sort"
+import "time"
+import "shardmaster"
+import "bufpool"
+
+//
+// chunked shard transfer.
+//
+// a group taking a shard over fetches it with
+// TransferStateChunk, a few keys at a time, rather than in one
+// TransferState reply that holds the whole shard. the first
+// request (Snapshot 0) is checked and freezes the shard as
+// TransferState does, then the server copies the shard's
+// state aside, so that later chunks come from the same view
+// whatever it applies meanwhile. the copy's keys are sorted,
+// and a chunk is a range of them, by offset. the last chunk
+// also carries the client states, and the digest of the
+// whole shard, which the requester checks. each chunk carries
+// a checksum of its state too, so that one garbled on the way
+// is refused before any of it is taken in.
+//
+// a server keeps one copy per shard, which other requesters
+// for the same config share, and drops it once no chunk of it
+// was asked for in TransferCopyIdle. (not by config: a group
+// may be configs ahead of the one fetching from it.) a
+// request for a copy the server no longer has gets
+// ErrNotReady, and the requester starts over.
+//
+
+// keys per TransferStateChunk, unless Options.TransferChunk
+const TransferChunkKeys = 1000
+
+// how long a shard's copy is kept after its last chunk is sent
+const TransferCopyIdle = 10 * time.Second
+
+// a shard's state as copied for a transfer
+type outgoing struct {
+	id        int64
+	configNum int
+	xstate    *XState
+	keys      []string // the keys of xstate's per-key maps, sorted
+	digest    string
+	used      time.Time // when a chunk was last asked for
+}
+
+func makeOutgoing(configNum int, shard int, xs *XState) *outgoing {
+	og := &outgoing{id:nrand(), configNum:configNum, xstate:xs}
+	seen := map[string]bool{}
+	add := func(key string) {
+		if !seen[key] {
+			seen[key] = true
+			og.keys = append(og.keys, key)
+		}
+	}
+	for key := range xs.KVStore {
+		add(key)
+	}
+	for key := range xs.Versions {
+		add(key)
+	}
+	for key := range xs.Expires {
+		add(key)
+	}
+	for key := range xs.Deadlines {
+		add(key)
+	}
+	for key := range xs.Mirrors {
+		add(key)
+	}
+	for key := range xs.Unmirrored {
+		add(key)
+	}
+	for key := range xs.MirrorEpochs {
+		add(key)
+	}
+	for key := range xs.Locks {
+		add(key)
+	}
+	sort.Strings(og.keys)
+	og.digest = shardDigest(xs.KVStore, shard)
+	return og
+}
+
+// the state of keys [from, to) of og, plus the client states if last
+func (og *outgoing) chunk(from int, to int, last bool) XState {
+	var xs XState
+	xs.Init()
+	for _, key := range og.keys[from:to] {
+		if value, ok := og.xstate.KVStore[key]; ok {
+			xs.KVStore[key] = value
+		}
+		if version, ok := og.xstate.Versions[key]; ok {
+			xs.Versions[key] = version
+		}
+		if seq, ok := og.xstate.Expires[key]; ok {
+			xs.Expires[key] = seq
+		}
+		if deadline, ok := og.xstate.Deadlines[key]; ok {
+			xs.Deadlines[key] = deadline
+		}
+		if gid, ok := og.xstate.Mirrors[key]; ok {
+			xs.Mirrors[key] = gid
+		}
+		if gids, ok := og.xstate.Unmirrored[key]; ok {
+			xs.Unmirrored[key] = gids
+		}
+		if epoch, ok := og.xstate.MirrorEpochs[key]; ok {
+			xs.MirrorEpochs[key] = epoch
+		}
+		if lock, ok := og.xstate.Locks[key]; ok {
+			xs.Locks[key] = lock
+		}
+	}
+	if last {
+		xs.MRRSMap = og.xstate.MRRSMap
+		xs.Replies = og.xstate.Replies
+		xs.Recent = og.xstate.Recent
+		xs.LastShard = og.xstate.LastShard
+		xs.ShardSeqs = og.xstate.ShardSeqs
+		xs.Outcomes = og.xstate.Outcomes
+	}
+	return xs
+}
+
+func (kv *ShardKV) TransferStateChunk(args *TransferChunkArgs, reply *TransferChunkReply) error {
+	defer kv.handling()()
+
+	release, ok := kv.transferSlot()
+	if !ok {
+		reply.Err = ErrTransferBusy
+		return nil
+	}
+	defer release()
+
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	kv.logEvent(LevelDebug, "rpc", Field{"op", "TransferStateChunk"}, Field{"shard", args.Shard},
+		Field{"config", args.ConfigNum}, Field{"offset", args.Offset}, Field{"at", kv.config.Num})
+
+	now := time.Now()
+	for shard, og := range kv.outgoing {
+		if now.Sub(og.used) > TransferCopyIdle {
+			delete(kv.outgoing, shard)
+		}
+	}
+
+	og := kv.outgoing[args.Shard]
+	if args.Snapshot == 0 {
+		if err := kv.transferReady(args.ConfigNum, args.Shard); err != OK {
+			reply.Err = err
+			return nil
+		}
+		if og == nil || og.configNum != args.ConfigNum {
+			og = makeOutgoing(args.ConfigNum, args.Shard, kv.shardState(args.Shard))
+			kv.outgoing[args.Shard] = og
+			kv.logEvent(LevelDebug, "shard copied for transfer", Field{"shard", args.Shard},
+				Field{"config", args.ConfigNum}, Field{"keys", len(og.keys)})
+		}
+		kv.sent++
+	} else if og == nil || og.id != args.Snapshot || args.Offset < 0 || args.Offset > len(og.keys) {
+		reply.Err = ErrNotReady
+		return nil
+	}
+
+	og.used = now
+	max := args.Max
+	if max <= 0 {
+		max = TransferChunkKeys
+	}
+	end := args.Offset + max
+	if end >= len(og.keys) {
+		end = len(og.keys)
+		reply.Done = true
+		reply.Digest = og.digest
+	}
+	reply.XState = og.chunk(args.Offset, end, reply.Done)
+	reply.Checksum = transferChecksum(&reply.XState)
+	reply.Snapshot, reply.Next = og.id, end
+	reply.Err = OK
+	return nil
+}
+
+//
+// fetch shard's state from server, chunk by chunk. returns
+// the error of the chunk that failed, or ErrNotReady if the
+// server was unreachable or sent a state failing its checksum
+// or digest.
+// a busy server is waited for once it has started.
+//
+func (kv *ShardKV) fetchChunks(server string, config *shardmaster.Config, shard int) (*XState, Err) {
+	xs := MakeXState()
+	args := &TransferChunkArgs{ConfigNum:config.Num, Shard:shard, Max:kv.chunkKeys}
+	wait := 10 * time.Millisecond
+	for !kv.isdead() {
+		var reply TransferChunkReply
+		ok := send(server, "ShardKV.TransferStateChunk", args, &reply)
+		if !ok {
+			return nil, ErrNotReady
+		}
+		if reply.Err == ErrTransferBusy && args.Snapshot != 0 {
+			// keep our place in this server's copy
+			time.Sleep(wait)
+			if wait < time.Second {
+				wait *= 2
+			}
+			continue
+		}
+		if reply.Err != OK {
+			return nil, reply.Err
+		}
+		wait = 10 * time.Millisecond
+		if transferChecksum(&reply.XState) != reply.Checksum {
+			kv.logEvent(LevelError, "transfer checksum mismatch", Field{"shard", shard},
+				Field{"from", server}, Field{"offset", args.Offset})
+			return nil, ErrNotReady
+		}
+		xs.Update(&reply.XState)
+		if reply.Done {
+			if shardDigest(xs.KVStore, shard) != reply.Digest {
+				kv.logEvent(LevelError, "shard digest mismatch", Field{"shard", shard}, Field{"from", server})
+				return nil, ErrNotReady
+			}
+			return xs, OK
+		}
+		args.Snapshot, args.Offset = reply.Snapshot, reply.Next
+	}
+	return nil, ErrNotReady
+}
+
+//
+// a CRC-32 of the state a transfer sends: every entry of
+// xs's maps, in order. Copies and Seen stay with the group
+// and are left out. the entries are formatted one after
+// another into a pooled buffer, rather than each into a
+// string of its own, and sorted as slices of it.
+//
+func transferChecksum(xs *XState) uint32 {
+	buf := bufpool.Get()
+	defer bufpool.Put(buf)
+	ends := []int{}
+	add := func(m string, key string, value interface{}) {
+		fmt.Fprintf(buf, "%s %q %#v\n", m, key, value)
+		ends = append(ends, buf.Len())
+	}
+	for key, value := range xs.KVStore {
+		add("kv", key, value)
+	}
+	for key, version := range xs.Versions {
+		add("version", key, version)
+	}
+	for key, seq := range xs.Expires {
+		add("expires", key, seq)
+	}
+	for key, deadline := range xs.Deadlines {
+		add("deadline", key, deadline)
+	}
+	for key, gid := range xs.Mirrors {
+		add("mirror", key, gid)
+	}
+	for key, gids := range xs.Unmirrored {
+		add("unmirrored", key, gids)
+	}
+	for key, epoch := range xs.MirrorEpochs {
+		add("mirror epoch", key, epoch)
+	}
+	for key, lock := range xs.Locks {
+		add("lock", key, lock)
+	}
+	for txn, outcome := range xs.Outcomes {
+		add("outcome", txn, outcome)
+	}
+	for cid, seq := range xs.MRRSMap {
+		add("mrrs", cid, seq)
+	}
+	for cid, rep := range xs.Replies {
+		add("reply", cid, rep)
+	}
+	for cid, recent := range xs.Recent {
+		add("recent", cid, recent)
+	}
+	for cid, shard := range xs.LastShard {
+		add("lastshard", cid, shard)
+	}
+	for shard, seqs := range xs.ShardSeqs {
+		for cid, seq := range seqs {
+			add(fmt.Sprintf("shardseq %d", shard), cid, seq)
+		}
+	}
+	// the buffer is done growing, so slices of it stay put
+	data := buf.Bytes()
+	entries := make([][]byte, len(ends))
+	from := 0
+	for i, to := range ends {
+		entries[i] = data[from:to]
+		from = to
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return bytes.Compare(entries[i], entries[j]) < 0
+	})
+
+	h := crc32.NewIEEE()
+	for _, entry := range entries {
+		h.Write(entry)
+	}
+	return h.Sum32()
+}
@@ -0,0 +1,127 @@
+package shardkv
+
+import "fmt"
+import "net"
+import "net/rpc"
+import "os"
+import "sync"
+import "paxos"
+
+//
+// several groups in one process. by default each server
+// listens on its own socket with its own rpc.Server; a
+// Transport instead lets any number of servers, of any
+// groups, share one socket and one rpc.Server. each server
+// on a Transport is known by an address of the form
+// socket@tag, and registers its ShardKV and Paxos services
+// as ShardKV@tag and Paxos@tag; clerks and peers given such
+// an address call those names on the shared socket.
+//
+// a server on a Transport has no listener of its own, so
+// Setunreliable() has no effect on it, and after kill() its
+// handlers still answer RPCs (as a dead server whose paxos
+// peer has stopped) until the Transport is closed.
+//
+
+type Transport struct {
+	mu   sync.Mutex
+	sock string
+	l    net.Listener
+	rpcs *rpc.Server
+	tags map[string]bool
+	dead bool
+}
+
+//
+// start listening on sock for the servers that will be
+// started on the Transport.
+//
+func MakeTransport(sock string) (*Transport, error) {
+	tr := &Transport{sock:sock, rpcs:rpc.NewServer(), tags:map[string]bool{}}
+
+	os.Remove(sock)
+	l, e := net.Listen("unix", sock)
+	if e != nil {
+		return nil, fmt.Errorf("listen error: %v", e)
+	}
+	tr.l = l
+
+	go func() {
+		for {
+			conn, err := tr.l.Accept()
+			if err != nil {
+				return
+			}
+			go tr.rpcs.ServeConn(conn)
+		}
+	}()
+
+	return tr, nil
+}
+
+// the address of the server with tag on the Transport
+func (tr *Transport) Addr(tag string) string {
+	return tr.sock + "@" + tag
+}
+
+// stop serving every server on the Transport.
+func (tr *Transport) Close() {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	if !tr.dead {
+		tr.dead = true
+		tr.l.Close()
+	}
+}
+
+//
+// like StartServerWithOptions(), but serves on tr rather than
+// on a socket of its own. servers[me] must be an address of
+// tr (see Addr()) not yet used by another server; the other
+// servers may be on tr, on other Transports, or on sockets
+// of their own.
+//
+func StartServerOnTransport(gid int64, shardmasters []string,
+	servers []string, me int, opts *Options, tr *Transport) (*ShardKV, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+
+	sock, service := rpcTarget(servers[me], "ShardKV")
+	if sock != tr.sock || service == "ShardKV" {
+		return nil, fmt.Errorf("%s is not an address on %s", servers[me], tr.sock)
+	}
+
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	if tr.dead {
+		return nil, fmt.Errorf("transport %s is closed", tr.sock)
+	}
+	if tr.tags[servers[me]] {
+		return nil, fmt.Errorf("listen error: %s is in use", servers[me])
+	}
+	tr.tags[servers[me]] = true
+
+	kv, err := makeServer(gid, shardmasters, servers, me, opts)
+	if err != nil {
+		delete(tr.tags, servers[me])
+		return nil, err
+	}
+	tr.rpcs.RegisterName(service, kv)
+	kv.px = paxos.Make(servers, me, tr.rpcs)
+	kv.l = sharedListener{}
+
+	kv.startLoops(opts)
+
+	return kv, nil
+}
+
+//
+// the listener of a server on a Transport, which accepts
+// nothing itself; closing it leaves the Transport serving.
+//
+type sharedListener struct{}
+
+func (sharedListener) Accept() (net.Conn, error) { return nil, fmt.Errorf("shared listener") }
+func (sharedListener) Close() error              { return nil }
+func (sharedListener) Addr() net.Addr            { return nil }
@@ -5,6 +5,7 @@ package shardmaster
 // Please don't change this file.
 //
 
+import "context"
 import "net/rpc"
 import "time"
 import "fmt"
@@ -69,13 +70,75 @@ func (ck *Clerk) Query(num int) Config {
 	}
 }
 
+//
+// like Query(), but gives up once ctx is done, e.g. when no
+// server answers in time, returning ctx.Err(). a server that
+// takes the request but never replies is left behind.
+//
+func (ck *Clerk) QueryCtx(ctx context.Context, num int) (Config, error) {
+	for {
+		// try each known server.
+		for _, srv := range ck.servers {
+			args := &QueryArgs{}
+			args.Num = num
+			var reply QueryReply
+			done := make(chan bool, 1)
+			go func(srv string) {
+				done <- call(srv, "ShardMaster.Query", args, &reply)
+			}(srv)
+			select {
+			case ok := <-done:
+				if ok {
+					return reply.Config, nil
+				}
+			case <-ctx.Done():
+				return Config{}, ctx.Err()
+			}
+		}
+		select {
+		case <-time.After(100 * time.Millisecond):
+		case <-ctx.Done():
+			return Config{}, ctx.Err()
+		}
+	}
+}
+
+//
+// like Query(), but returns the config by group: each one's
+// servers and the shards it serves.
+//
+func (ck *Clerk) Describe(num int) Description {
+	for {
+		// try each known server.
+		for _, srv := range ck.servers {
+			args := &QueryArgs{}
+			args.Num = num
+			var reply DescribeReply
+			ok := call(srv, "ShardMaster.Describe", args, &reply)
+			if ok {
+				return reply.Description
+			}
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
 func (ck *Clerk) Join(gid int64, servers []string) {
+	ck.join(&JoinArgs{GID:gid, Servers:servers})
+}
+
+//
+// like Join(), but the group gets shards in proportion to
+// weight (see JoinArgs).
+//
+func (ck *Clerk) JoinWeighted(gid int64, servers []string, weight int) {
+	ck.join(&JoinArgs{GID:gid, Servers:servers, Weighted:true, Weight:weight})
+}
+
+func (ck *Clerk) join(args *JoinArgs) {
 	for {
 		// try each known server.
 		for _, srv := range ck.servers {
-			args := &JoinArgs{}
-			args.GID = gid
-			args.Servers = servers
 			var reply JoinReply
 			ok := call(srv, "ShardMaster.Join", args, &reply)
 			if ok {
@@ -118,3 +181,21 @@ func (ck *Clerk) Move(shard int, gid int64) {
 		time.Sleep(100 * time.Millisecond)
 	}
 }
+
+//
+// make server peer, an index into the servers the clerk was
+// made with, the shardmaster's paxos leader. the request goes
+// to that server alone, which takes over as it returns.
+//
+func (ck *Clerk) TransferLeadership(peer int) {
+	for {
+		args := &TransferLeadershipArgs{}
+		args.Peer = peer
+		var reply TransferLeadershipReply
+		ok := call(ck.servers[peer], "ShardMaster.TransferLeadership", args, &reply)
+		if ok {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
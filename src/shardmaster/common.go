@@ -8,6 +8,8 @@ package shardmaster
 // Leave(gid) -- replica group gid is retiring, hand off all its shards.
 // Move(shard, gid) -- hand off one shard from current owner to gid.
 // Query(num) -> fetch Config # num, or latest config if num==-1.
+// Describe(num) -> like Query, but by group: each one's servers and shards.
+// TransferLeadership(peer) -- make server peer the paxos leader.
 //
 // A Config (configuration) describes a set of replica groups, and the
 // replica group responsible for each shard. Configs are numbered. Config
@@ -43,6 +45,12 @@ type Config struct {
 type JoinArgs struct {
 	GID     int64    // unique replica group ID
 	Servers []string // group server ports
+	// if Weighted, the group gets shards in proportion to
+	// Weight, relative to the other groups' (0: none, but it
+	// stays in Groups); else its weight is 1. (not a *int:
+	// gob would drop a pointer to 0.)
+	Weighted bool
+	Weight   int
 }
 
 type JoinReply struct {
@@ -63,6 +71,13 @@ type MoveArgs struct {
 type MoveReply struct {
 }
 
+type TransferLeadershipArgs struct {
+	Peer int // index of the server to lead
+}
+
+type TransferLeadershipReply struct {
+}
+
 type QueryArgs struct {
 	Num int // desired config number
 }
@@ -70,3 +85,24 @@ type QueryArgs struct {
 type QueryReply struct {
 	Config Config
 }
+
+// one group of a Description
+type GroupInfo struct {
+	GID     int64
+	Servers []string
+	Shards  []int // the shards it serves, in order
+}
+
+//
+// a Config, by group: what Describe() returns. Groups are in
+// gid order; Unassigned lists the shards of no group (gid 0).
+//
+type Description struct {
+	Num        int
+	Groups     []GroupInfo
+	Unassigned []int
+}
+
+type DescribeReply struct {
+	Description Description
+}
@@ -12,6 +12,7 @@ import "os"
 import "syscall"
 import "encoding/gob"
 import "math/rand"
+import "sort"
 
 import "time"
 
@@ -32,6 +33,7 @@ type ShardMaster struct {
 	seq        int 
 
 	configs []Config // indexed by config num
+	weights map[int64]int // gid -> weight, of the groups joined
 }
 
 
@@ -40,6 +42,7 @@ const (
 	Leave = "Leave"
 	Move  = "Move"
 	Query = "Query"
+	TransferLeadership = "TransferLeadership"
 )
 
 type Op struct {
@@ -48,6 +51,8 @@ type Op struct {
 	Shard   int
 	GID     int64
 	Servers []string
+	Weight  int // for Join
+	Peer    int // for TransferLeadership
 }
 
 
@@ -55,10 +60,17 @@ func (sm *ShardMaster) Join(args *JoinArgs, reply *JoinReply) error {
 	sm.mu.Lock()
 	defer sm.mu.Unlock()
 
-	xop := &Op{OpID:nrand(), Op:Join, GID:args.GID, Servers:args.Servers}
+	weight := 1
+	if args.Weighted {
+		weight = args.Weight
+	}
+	if weight < 0 {
+		weight = 0
+	}
+	xop := &Op{OpID:nrand(), Op:Join, GID:args.GID, Servers:args.Servers, Weight:weight}
 	sm.sync(xop)
 
-	sm.doJoin(args.GID, args.Servers)
+	sm.doJoin(args.GID, args.Servers, weight)
 
 	return nil
 }
@@ -79,7 +91,7 @@ func (sm *ShardMaster) Move(args *MoveArgs, reply *MoveReply) error {
 	sm.mu.Lock()
 	defer sm.mu.Unlock()
 
-	xop := &Op{OpID:nrand(), Op:Leave, Shard:args.Shard, GID:args.GID}
+	xop := &Op{OpID:nrand(), Op:Move, Shard:args.Shard, GID:args.GID}
 	sm.sync(xop)
 
 	sm.doMove(args.Shard, args.GID)
@@ -105,6 +117,58 @@ func (sm *ShardMaster) Query(args *QueryArgs, reply *QueryReply) error {
 	return nil
 }
 
+//
+// RPC handler making this server's paxos peer the leader
+// (see paxos's leader.go), say before the leader is taken
+// down for maintenance. the transfer is logged: the other
+// servers resign as they apply it, so that none takes the
+// leadership back, and this one takes it at once rather
+// than after the next op it gets decided.
+//
+func (sm *ShardMaster) TransferLeadership(args *TransferLeadershipArgs, reply *TransferLeadershipReply) error {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	xop := &Op{OpID:nrand(), Op:TransferLeadership, Peer:args.Peer}
+	sm.sync(xop)
+
+	sm.doTransfer(args.Peer)
+
+	return nil
+}
+
+//
+// RPC handler answering a Query with the config described
+// by group; read-only, like Query.
+//
+func (sm *ShardMaster) Describe(args *QueryArgs, reply *DescribeReply) error {
+	var qr QueryReply
+	sm.Query(args, &qr)
+	reply.Description = describe(&qr.Config)
+	return nil
+}
+
+func describe(config *Config) Description {
+	d := Description{Num:config.Num}
+	shard_map := map[int64][]int{}
+	for shard, gid := range config.Shards {
+		shard_map[gid] = append(shard_map[gid], shard)
+	}
+	for gid, servers := range config.Groups {
+		d.Groups = append(d.Groups, GroupInfo{GID:gid, Servers:servers, Shards:shard_map[gid]})
+	}
+	sort.Slice(d.Groups, func(i, j int) bool {
+		return d.Groups[i].GID < d.Groups[j].GID
+	})
+	for gid, shards := range shard_map {
+		if _, ok := config.Groups[gid]; !ok {
+			d.Unassigned = append(d.Unassigned, shards...)
+		}
+	}
+	sort.Ints(d.Unassigned)
+	return d
+}
+
 func (sm *ShardMaster) sync(xop *Op) {
 	seq := sm.seq
 	
@@ -141,23 +205,26 @@ func (sm *ShardMaster) sync(xop *Op) {
 func (sm *ShardMaster) applyOp(xop *Op) {
 	switch xop.Op {
 	case Join:
-		sm.doJoin(xop.GID, xop.Servers)
+		sm.doJoin(xop.GID, xop.Servers, xop.Weight)
 	case Leave:
 		sm.doLeave(xop.GID)
 	case Move:
 		sm.doMove(xop.Shard, xop.GID)
+	case TransferLeadership:
+		sm.doTransfer(xop.Peer)
 	default:
 	}
 }
 
-func (sm *ShardMaster) doJoin(gid int64, servers []string) {
-	DPrintf("--- server %d : doJoin(gid %d, servers %v)\n", sm.me, gid, servers)
+func (sm *ShardMaster) doJoin(gid int64, servers []string, weight int) {
+	DPrintf("--- server %d : doJoin(gid %d, servers %v, weight %d)\n", sm.me, gid, servers, weight)
 	var config Config
 	sm.prepareNextConfig(&config)
 	_, exists := config.Groups[gid]
 	if !exists {
 		config.Groups[gid] = servers
-		sm.rebalance(&config, Join, gid)
+		sm.weights[gid] = weight
+		sm.rebalance(&config)
 	}
 	sm.configs = append(sm.configs, config)
 }
@@ -169,7 +236,8 @@ func (sm *ShardMaster) doLeave(gid int64) {
 	_, exists := config.Groups[gid]
 	if exists {
 		delete(config.Groups, gid)
-		sm.rebalance(&config, Leave, gid)
+		delete(sm.weights, gid)
+		sm.rebalance(&config)
 	}
 	sm.configs = append(sm.configs, config)
 }
@@ -178,10 +246,23 @@ func (sm *ShardMaster) doMove(shard int, gid int64) {
 	DPrintf("--- server %d : doMove(shard %d, gid %d)\n", sm.me, shard, gid)
 	var config Config
 	sm.prepareNextConfig(&config)
-	config.Shards[shard] = gid
+	// a shard is only ever assigned to a group in Groups,
+	// which its servers can fetch it from
+	if _, ok := config.Groups[gid]; ok && shard >= 0 && shard < NShards {
+		config.Shards[shard] = gid
+	}
 	sm.configs = append(sm.configs, config)
 }
 
+func (sm *ShardMaster) doTransfer(peer int) {
+	DPrintf("--- server %d : doTransfer(peer %d)\n", sm.me, peer)
+	if peer == sm.me {
+		sm.px.Lead()
+	} else {
+		sm.px.Resign()
+	}
+}
+
 func (sm *ShardMaster) prepareNextConfig(config *Config) {
 	last_config := sm.configs[len(sm.configs)-1]
 	config.Num = len(sm.configs)
@@ -192,35 +273,86 @@ func (sm *ShardMaster) prepareNextConfig(config *Config) {
 	}
 }
 
-func (sm *ShardMaster) rebalance(config *Config, op string, gid int64) {
-	count_map := map[int64]int{}
-	shard_map := map[int64][]int{}
-	for shard, xgid := range config.Shards {
-		count_map[xgid] += 1
-		shard_map[xgid] = append(shard_map[xgid], shard)
+//
+// reassign config's shards to its groups in proportion to
+// their weights, while moving as few as possible: a group
+// keeps its shards up to its target, and only shards of
+// groups that left or that are over their target move.
+// NShards * weight / total weight, rounded down, is a
+// group's target; the shards left over go one each to the
+// groups with the largest remainders, then to those already
+// serving the most shards, so fewer move. ties go by gid, so
+// that every server computes the same config. if every
+// group has weight 0, all count as 1.
+//
+func (sm *ShardMaster) rebalance(config *Config) {
+	if len(config.Groups) == 0 {
+		for shard := range config.Shards {
+			config.Shards[shard] = 0
+		}
+		return
 	}
-	max_nshards, max_gid := 0, int64(0)
-	min_nshards, min_gid := NShards + 1, int64(0)
-	for xgid := range config.Groups {
-		nshards := count_map[xgid]
 
-		if max_nshards < nshards {
-			max_nshards, max_gid = nshards, xgid
+	shard_map := map[int64][]int{}
+	for shard, gid := range config.Shards {
+		shard_map[gid] = append(shard_map[gid], shard)
+	}
+	weights := map[int64]int{}
+	total := 0
+	gids := []int64{}
+	for gid := range config.Groups {
+		weights[gid] = sm.weights[gid]
+		total += weights[gid]
+		gids = append(gids, gid)
+	}
+	if total == 0 {
+		for gid := range weights {
+			weights[gid] = 1
+		}
+		total = len(weights)
+	}
+	sort.Slice(gids, func(i, j int) bool {
+		ri, rj := NShards * weights[gids[i]] % total, NShards * weights[gids[j]] % total
+		if ri != rj {
+			return ri > rj
 		}
-		if min_nshards > nshards {
-			min_nshards, min_gid = nshards, xgid
+		ni, nj := len(shard_map[gids[i]]), len(shard_map[gids[j]])
+		if ni != nj {
+			return ni > nj
 		}
+		return gids[i] < gids[j]
+	})
+
+	target := map[int64]int{}
+	left := NShards
+	for _, gid := range gids {
+		target[gid] = NShards * weights[gid] / total
+		left -= target[gid]
+	}
+	// fewer than the groups with a remainder, so none of
+	// weight 0 gets one
+	for _, gid := range gids[:left] {
+		target[gid]++
 	}
 
-	if op == Join {
-		spg := NShards / len(config.Groups)
-		for i := 0; i < spg; i++ {
-			shard := shard_map[max_gid][i]
-			config.Shards[shard] = gid
+	// shards without a group, or beyond their group's target
+	free := []int{}
+	for shard, gid := range config.Shards {
+		if _, ok := config.Groups[gid]; !ok {
+			free = append(free, shard)
+		}
+	}
+	for _, gid := range gids {
+		if n := len(shard_map[gid]); n > target[gid] {
+			free = append(free, shard_map[gid][target[gid]:]...)
 		}
-	} else if op == Leave {
-		for _, shard := range shard_map[gid] {
-			config.Shards[shard] = min_gid
+	}
+	sort.Ints(free)
+
+	for _, gid := range gids {
+		for n := len(shard_map[gid]); n < target[gid]; n++ {
+			config.Shards[free[0]] = gid
+			free = free[1:]
 		}
 	}
 }
@@ -262,6 +394,7 @@ func StartServer(servers []string, me int) *ShardMaster {
 
 	sm.configs = make([]Config, 1)
 	sm.configs[0].Groups = map[int64][]string{}
+	sm.weights = map[int64]int{}
 
 	rpcs := rpc.NewServer()
 
@@ -5,9 +5,10 @@ import "runtime"
 import "strconv"
 import "os"
 
-// import "time"
+import "time"
 import "fmt"
 import "math/rand"
+import "sync"
 
 func port(tag string, host int) string {
 	s := "/var/tmp/824-"
@@ -370,3 +371,343 @@ func TestFreshQuery(t *testing.T) {
 	fmt.Printf("  ... Passed\n")
 	os.Remove(portx)
 }
+
+// the shards whose owner differs between c1 and c2
+func moved(c1 Config, c2 Config) []int {
+	shards := []int{}
+	for shard := range c1.Shards {
+		if c1.Shards[shard] != c2.Shards[shard] {
+			shards = append(shards, shard)
+		}
+	}
+	return shards
+}
+
+func TestMinimalMoves(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	const nservers = 3
+	var sma []*ShardMaster = make([]*ShardMaster, nservers)
+	var kvh []string = make([]string, nservers)
+	defer cleanup(sma)
+
+	for i := 0; i < nservers; i++ {
+		kvh[i] = port("moves", i)
+	}
+	for i := 0; i < nservers; i++ {
+		sma[i] = StartServer(kvh, i)
+	}
+
+	ck := MakeClerk(kvh)
+
+	fmt.Printf("Test: Join and Leave move as few shards as possible ...\n")
+
+	gids := []int64{1, 2, 3}
+	for _, gid := range gids {
+		ck.Join(gid, []string{"x", "y", "z"})
+	}
+	check(t, gids, ck)
+
+	// 4, 3 and 3 shards become 3, 3, 2 and 2: the new group
+	// takes NShards/4 of them and nothing else moves.
+	c1 := ck.Query(-1)
+	ck.Join(4, []string{"x", "y", "z"})
+	gids = append(gids, 4)
+	check(t, gids, ck)
+	c2 := ck.Query(-1)
+	if m := moved(c1, c2); len(m) != NShards / 4 {
+		t.Fatalf("Join moved shards %v, wanted %d", m, NShards / 4)
+	}
+	for _, shard := range moved(c1, c2) {
+		if c2.Shards[shard] != 4 {
+			t.Fatalf("Join moved shard %d to %d", shard, c2.Shards[shard])
+		}
+	}
+
+	// only the shards of the group leaving move.
+	ck.Leave(2)
+	gids = []int64{1, 3, 4}
+	check(t, gids, ck)
+	c3 := ck.Query(-1)
+	left := 0
+	for _, gid := range c2.Shards {
+		if gid == 2 {
+			left++
+		}
+	}
+	if m := moved(c2, c3); len(m) != left {
+		t.Fatalf("Leave moved shards %v, wanted %d", m, left)
+	}
+
+	// a Join after a Move still balances.
+	ck.Move(0, 1)
+	ck.Join(5, []string{"x", "y", "z"})
+	check(t, []int64{1, 3, 4, 5}, ck)
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestWeights(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	const nservers = 3
+	var sma []*ShardMaster = make([]*ShardMaster, nservers)
+	var kvh []string = make([]string, nservers)
+	defer cleanup(sma)
+
+	for i := 0; i < nservers; i++ {
+		kvh[i] = port("weights", i)
+	}
+	for i := 0; i < nservers; i++ {
+		sma[i] = StartServer(kvh, i)
+	}
+
+	ck := MakeClerk(kvh)
+
+	fmt.Printf("Test: Join with weights ...\n")
+
+	ck.JoinWeighted(1, []string{"x", "y", "z"}, 1)
+	ck.JoinWeighted(2, []string{"x", "y", "z"}, 2)
+	ck.JoinWeighted(3, []string{"x", "y", "z"}, 1)
+
+	// 2.5, 5 and 2.5 shards: group 1 already serves the
+	// most of the two halves left over.
+	counts := func(c Config) map[int64]int {
+		n := map[int64]int{}
+		for _, gid := range c.Shards {
+			n[gid]++
+		}
+		return n
+	}
+	c := ck.Query(-1)
+	if n := counts(c); n[1] != 3 || n[2] != 5 || n[3] != 2 {
+		t.Fatalf("weights 1:2:1 got shards %v", n)
+	}
+
+	// a group of weight 0 is tracked, but serves nothing.
+	ck.JoinWeighted(4, []string{"x", "y", "z"}, 0)
+	c1 := ck.Query(-1)
+	if _, ok := c1.Groups[4]; !ok {
+		t.Fatalf("group of weight 0 missing")
+	}
+	if m := moved(c, c1); len(m) != 0 {
+		t.Fatalf("joining a group of weight 0 moved shards %v", m)
+	}
+
+	// every server computes the same configs.
+	for i := 0; i < nservers; i++ {
+		cki := MakeClerk([]string{kvh[i]})
+		for num := 1; num <= c1.Num; num++ {
+			if ci, c := cki.Query(num), ck.Query(num); ci.Shards != c.Shards {
+				t.Fatalf("server %d config %d is %v, wanted %v", i, num, ci.Shards, c.Shards)
+			}
+		}
+	}
+
+	// with only weight 0 left, shards are shared equally.
+	ck.Leave(1)
+	ck.Leave(2)
+	ck.Leave(3)
+	if n := counts(ck.Query(-1)); n[4] != NShards {
+		t.Fatalf("group of weight 0 left alone got shards %v", n)
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestDescribe(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	const nservers = 3
+	var sma []*ShardMaster = make([]*ShardMaster, nservers)
+	var kvh []string = make([]string, nservers)
+	defer cleanup(sma)
+
+	for i := 0; i < nservers; i++ {
+		kvh[i] = port("describe", i)
+	}
+	for i := 0; i < nservers; i++ {
+		sma[i] = StartServer(kvh, i)
+	}
+
+	ck := MakeClerk(kvh)
+
+	fmt.Printf("Test: Describe() ...\n")
+
+	if d := ck.Describe(0); d.Num != 0 || len(d.Groups) != 0 || len(d.Unassigned) != NShards {
+		t.Fatalf("config 0 described as %+v", d)
+	}
+
+	ck.Join(2, []string{"b1", "b2"})
+	ck.Join(1, []string{"a1"})
+	for shard := 0; shard < NShards; shard++ {
+		ck.Move(shard, 1)
+	}
+	ck.Move(3, 2)
+	ck.Move(7, 2)
+
+	d := ck.Describe(-1)
+	c := ck.Query(-1)
+	if d.Num != c.Num || len(d.Unassigned) != 0 || len(d.Groups) != 2 {
+		t.Fatalf("latest config %d described as %+v", c.Num, d)
+	}
+	want := []GroupInfo{
+		{GID: 1, Servers: []string{"a1"}, Shards: []int{0, 1, 2, 4, 5, 6, 8, 9}},
+		{GID: 2, Servers: []string{"b1", "b2"}, Shards: []int{3, 7}},
+	}
+	for i, g := range want {
+		if fmt.Sprint(d.Groups[i]) != fmt.Sprint(g) {
+			t.Fatalf("group %d described as %+v, wanted %+v", g.GID, d.Groups[i], g)
+		}
+	}
+
+	// an older config, as Query(num) has it
+	d = ck.Describe(1)
+	if d.Num != 1 || len(d.Groups) != 1 || d.Groups[0].GID != 2 || len(d.Groups[0].Shards) != NShards {
+		t.Fatalf("config 1 described as %+v", d)
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestNoOrphanShards(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	const nservers = 3
+	var sma []*ShardMaster = make([]*ShardMaster, nservers)
+	var kvh []string = make([]string, nservers)
+	defer cleanup(sma)
+
+	for i := 0; i < nservers; i++ {
+		kvh[i] = port("orphan", i)
+	}
+	for i := 0; i < nservers; i++ {
+		sma[i] = StartServer(kvh, i)
+	}
+
+	ck := MakeClerk(kvh)
+
+	fmt.Printf("Test: Every shard is served by a group in the config ...\n")
+
+	ck.Join(1, []string{"a"})
+	ck.Join(2, []string{"b"})
+	for shard := 0; shard < NShards; shard++ {
+		ck.Move(shard, 1)
+	}
+	ck.Move(0, 2)
+	ck.Move(1, 3) // no such group
+	if c := ck.Query(-1); c.Shards[1] != 1 {
+		t.Fatalf("shard 1 moved to unknown group %v", c.Shards[1])
+	}
+
+	// group 2 alone serves shard 0.
+	ck.Leave(2)
+	d := ck.Describe(-1)
+	if len(d.Unassigned) != 0 || len(d.Groups) != 1 || len(d.Groups[0].Shards) != NShards {
+		t.Fatalf("after Leave, config described as %+v", d)
+	}
+
+	// every server logged the Moves as Moves.
+	c := ck.Query(-1)
+	for i := 0; i < nservers; i++ {
+		cki := MakeClerk([]string{kvh[i]})
+		for num := 1; num <= c.Num; num++ {
+			if ci, c := cki.Query(num), ck.Query(num); ci.Shards != c.Shards || len(ci.Groups) != len(c.Groups) {
+				t.Fatalf("server %d config %d is %v, wanted %v", i, num, ci, c)
+			}
+		}
+	}
+
+	ck.Leave(1)
+	d = ck.Describe(-1)
+	if len(d.Groups) != 0 || len(d.Unassigned) != NShards {
+		t.Fatalf("with no groups, config described as %+v", d)
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestTransferLeadership(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	const nservers = 3
+	var sma []*ShardMaster = make([]*ShardMaster, nservers)
+	var kvh []string = make([]string, nservers)
+	defer cleanup(sma)
+
+	for i := 0; i < nservers; i++ {
+		kvh[i] = port("transfer", i)
+	}
+	for i := 0; i < nservers; i++ {
+		sma[i] = StartServer(kvh, i)
+	}
+
+	ck := MakeClerk(kvh)
+
+	fmt.Printf("Test: Leadership moves to the named server ...\n")
+
+	// the clerk tries server 0 first, whose decided Join
+	// makes it leader
+	ck.Join(1, []string{"a", "b", "c"})
+	for iters := 0; iters < 30 && !sma[0].px.IsLeader(); iters++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !sma[0].px.IsLeader() {
+		t.Fatalf("server 0 not leader after its Join")
+	}
+
+	// Queries to server 0 all through the transfer
+	var mu sync.Mutex
+	var slowest time.Duration
+	nqueries := 0
+	done := make(chan bool)
+	stopped := make(chan bool)
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			start := time.Now()
+			ck.Query(-1)
+			mu.Lock()
+			if d := time.Since(start); d > slowest {
+				slowest = d
+			}
+			nqueries++
+			mu.Unlock()
+		}
+	}()
+
+	time.Sleep(200 * time.Millisecond)
+	ck.TransferLeadership(2)
+	if !sma[2].px.IsLeader() {
+		t.Fatalf("server 2 not leader once TransferLeadership returned")
+	}
+	time.Sleep(500 * time.Millisecond)
+	close(done)
+	<-stopped
+
+	// server 0 resigned as it applied the transfer, and its
+	// Queries since haven't made it leader again
+	if sma[0].px.IsLeader() {
+		t.Fatalf("server 0 still leader after the transfer")
+	}
+	if !sma[2].px.IsLeader() {
+		t.Fatalf("server 2 lost the leadership")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if nqueries < 10 {
+		t.Fatalf("only %d Queries during the transfer", nqueries)
+	}
+	if slowest > 200 * time.Millisecond {
+		t.Fatalf("a Query took %v during the transfer", slowest)
+	}
+
+	check(t, []int64{1}, ck)
+
+	fmt.Printf("  ... Passed\n")
+}